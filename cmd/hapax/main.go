@@ -78,6 +78,19 @@ func main() {
 		cancel()
 	}()
 
+	// Reload configuration on SIGHUP. An invalid configuration is logged
+	// and the server keeps the current one.
+	go func() {
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		for range hupCh {
+			logger.Info("Received SIGHUP, reloading configuration")
+			if err := srv.Reload(); err != nil {
+				logger.Error("Configuration reload failed", zap.Error(err))
+			}
+		}
+	}()
+
 	// Start server
 	logger.Info("Starting hapax",
 		zap.String("version", Version),
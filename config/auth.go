@@ -0,0 +1,125 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// apiKeyHashPrefix marks the hashing scheme of stored API keys
+const apiKeyHashPrefix = "sha256:"
+
+// AuthConfig controls API key authentication of client requests.
+// Keys can be listed inline, kept in a separate keys file, or both.
+// Only hashes of the keys are stored; use HashAPIKey to compute them.
+type AuthConfig struct {
+	// Enabled requires a valid API key on the completion routes that list
+	// no middleware (default: false). Routes listing the auth middleware
+	// require one regardless.
+	Enabled bool `yaml:"enabled"`
+
+	// KeysFile is an optional YAML file with a top-level "keys" list in the
+	// same format as Keys. The config watcher reloads it when it changes.
+	// Relative paths are resolved against the working directory.
+	KeysFile string `yaml:"keys_file,omitempty"`
+
+	// Keys lists the accepted API keys
+	Keys []APIKeyConfig `yaml:"keys,omitempty"`
+}
+
+// APIKeyConfig describes one client API key.
+type APIKeyConfig struct {
+	// ID identifies the key in logs, metrics and rate limits. Must be unique.
+	ID string `yaml:"id"`
+
+	// Label is a human-readable description (e.g., "billing service")
+	Label string `yaml:"label,omitempty"`
+
+	// Tenant groups keys belonging to the same customer or team (optional)
+	Tenant string `yaml:"tenant,omitempty"`
+
+	// Hash is the SHA-256 digest of the key, hex encoded, optionally
+	// prefixed with "sha256:"
+	Hash string `yaml:"hash"`
+
+	// ExpiresAt is the time after which the key is rejected (optional)
+	ExpiresAt time.Time `yaml:"expires_at,omitempty"`
+
+	// Disabled rejects the key without removing it from the configuration
+	Disabled bool `yaml:"disabled,omitempty"`
+
+	// Admin grants access to the /admin endpoints
+	Admin bool `yaml:"admin,omitempty"`
+}
+
+// HashAPIKey returns the digest of an API key in the form stored in
+// APIKeyConfig.Hash.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return apiKeyHashPrefix + hex.EncodeToString(sum[:])
+}
+
+// LoadKeys returns the inline keys followed by those of the keys file.
+// Hashes are normalized to the form returned by HashAPIKey, and the keys
+// are checked for missing fields and duplicates.
+func (a *AuthConfig) LoadKeys() ([]APIKeyConfig, error) {
+	keys := make([]APIKeyConfig, 0, len(a.Keys))
+	keys = append(keys, a.Keys...)
+
+	if a.KeysFile != "" {
+		data, err := os.ReadFile(a.KeysFile)
+		if err != nil {
+			return nil, fmt.Errorf("read keys file: %w", err)
+		}
+		var file struct {
+			Keys []APIKeyConfig `yaml:"keys"`
+		}
+		if err := yaml.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("decode keys file %s: %w", a.KeysFile, err)
+		}
+		keys = append(keys, file.Keys...)
+	}
+
+	ids := make(map[string]bool, len(keys))
+	hashes := make(map[string]bool, len(keys))
+	for i := range keys {
+		key := &keys[i]
+		if key.ID == "" {
+			return nil, fmt.Errorf("empty id for API key %d", i)
+		}
+		if ids[key.ID] {
+			return nil, fmt.Errorf("duplicate API key id: %s", key.ID)
+		}
+		ids[key.ID] = true
+
+		hash, err := normalizeKeyHash(key.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("API key %s: %w", key.ID, err)
+		}
+		if hashes[hash] {
+			return nil, fmt.Errorf("API key %s: hash already used by another key", key.ID)
+		}
+		hashes[hash] = true
+		key.Hash = hash
+	}
+
+	return keys, nil
+}
+
+// normalizeKeyHash validates a SHA-256 hex digest and returns it lowercased
+// with the hash prefix.
+func normalizeKeyHash(hash string) (string, error) {
+	digest := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(hash), apiKeyHashPrefix))
+	if len(digest) != hex.EncodedLen(sha256.Size) {
+		return "", fmt.Errorf("hash must be a hex encoded SHA-256 digest")
+	}
+	if _, err := hex.DecodeString(digest); err != nil {
+		return "", fmt.Errorf("hash must be a hex encoded SHA-256 digest")
+	}
+	return apiKeyHashPrefix + digest, nil
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// Budget periods. Periods follow the calendar in UTC.
+const (
+	// BudgetPeriodDaily resets budgets at midnight UTC
+	BudgetPeriodDaily = "daily"
+
+	// BudgetPeriodMonthly resets budgets on the first day of each month
+	BudgetPeriodMonthly = "monthly"
+)
+
+// BudgetConfig defines token and spend budgets for the completion
+// endpoints. Unlike rate limits, which smooth traffic, budgets cap the
+// total consumption of a key or tenant over a day or a month.
+type BudgetConfig struct {
+	// Enabled turns on budget enforcement (default: false)
+	Enabled bool `yaml:"enabled"`
+
+	// StatePath is the file where consumption is persisted across
+	// restarts. If empty, persistence is disabled.
+	StatePath string `yaml:"state_path,omitempty"`
+
+	// SaveInterval is how often consumption is saved (default: 30s)
+	SaveInterval time.Duration `yaml:"save_interval"`
+
+	// Limits lists the budgets to enforce. A request must be within
+	// every budget that applies to it.
+	Limits []BudgetLimit `yaml:"limits,omitempty"`
+}
+
+// BudgetLimit caps the tokens and spend of each key or tenant per period.
+type BudgetLimit struct {
+	// Name identifies the budget in errors and usage reports (default:
+	// the scope and period, plus the match value if any)
+	Name string `yaml:"name,omitempty"`
+
+	// Scope is "key" or "tenant". Unauthenticated requests are counted
+	// per client address in the key scope.
+	Scope string `yaml:"scope"`
+
+	// Match restricts the budget to one key ID or tenant. Within a scope,
+	// matching budgets replace those without Match.
+	Match string `yaml:"match,omitempty"`
+
+	// Period is "daily" or "monthly"
+	Period string `yaml:"period"`
+
+	// Tokens caps prompt and completion tokens per period (0: unlimited).
+	// Requests whose estimated prompt would exceed the budget are rejected.
+	Tokens int64 `yaml:"tokens,omitempty"`
+
+	// Spend caps the estimated cost in USD per period (0: unlimited),
+	// based on the pricing table
+	Spend float64 `yaml:"spend,omitempty"`
+}
+
+// LimitName returns the configured name of the budget, or one derived
+// from its scope, period and match value.
+func (b *BudgetLimit) LimitName() string {
+	switch {
+	case b.Name != "":
+		return b.Name
+	case b.Match != "":
+		return b.Scope + ":" + b.Match + ":" + b.Period
+	default:
+		return b.Scope + ":" + b.Period
+	}
+}
+
+// validate checks the budget settings.
+func (c *BudgetConfig) validate() error {
+	if c.SaveInterval < 0 {
+		return fmt.Errorf("negative budget save interval: %v", c.SaveInterval)
+	}
+
+	names := make(map[string]bool, len(c.Limits))
+	for i, b := range c.Limits {
+		switch b.Scope {
+		case RateLimitScopeKey, RateLimitScopeTenant:
+		default:
+			return fmt.Errorf("invalid scope %q for budget %d", b.Scope, i)
+		}
+		switch b.Period {
+		case BudgetPeriodDaily, BudgetPeriodMonthly:
+		default:
+			return fmt.Errorf("invalid period %q for budget %d", b.Period, i)
+		}
+
+		name := b.LimitName()
+		if names[name] {
+			return fmt.Errorf("duplicate budget: %s", name)
+		}
+		names[name] = true
+
+		if b.Tokens < 0 || b.Spend < 0 {
+			return fmt.Errorf("budget %s: negative limit", name)
+		}
+		if b.Tokens == 0 && b.Spend == 0 {
+			return fmt.Errorf("budget %s: tokens or spend must be set", name)
+		}
+	}
+	return nil
+}
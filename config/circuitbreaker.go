@@ -0,0 +1,49 @@
+package config
+
+import "fmt"
+
+// validate checks the error rate.
+func (cb *CircuitBreakerConfig) validate() error {
+	if cb == nil {
+		return nil
+	}
+	if cb.ErrorRate < 0 || cb.ErrorRate > 100 {
+		return fmt.Errorf("circuit breaker error rate must be between 0 and 100")
+	}
+	if cb.Interval < 0 || cb.Timeout < 0 {
+		return fmt.Errorf("negative circuit breaker interval or timeout")
+	}
+	return nil
+}
+
+// CircuitBreakerFor returns the circuit breaker settings of the named
+// chain entry: the circuit_breaker block, with the fields set in the
+// entry's own circuit_breaker in the providers map taking precedence.
+func (c *Config) CircuitBreakerFor(name string) CircuitBreakerConfig {
+	settings := c.CircuitBreaker
+	p, ok := c.Providers[name]
+	if !ok || p.CircuitBreaker == nil {
+		return settings
+	}
+
+	override := p.CircuitBreaker
+	if override.MaxRequests > 0 {
+		settings.MaxRequests = override.MaxRequests
+	}
+	if override.Interval > 0 {
+		settings.Interval = override.Interval
+	}
+	if override.Timeout > 0 {
+		settings.Timeout = override.Timeout
+	}
+	if override.FailureThreshold > 0 {
+		settings.FailureThreshold = override.FailureThreshold
+	}
+	if override.ErrorRate > 0 {
+		settings.ErrorRate = override.ErrorRate
+	}
+	if override.MinRequests > 0 {
+		settings.MinRequests = override.MinRequests
+	}
+	return settings
+}
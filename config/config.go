@@ -24,9 +24,17 @@ type Config struct {
 	Routes             []RouteConfig             `yaml:"routes"`
 	Providers          map[string]ProviderConfig `yaml:"providers"`
 	ProviderPreference []string                  `yaml:"provider_preference"` // Order of provider preference
+	Selection          string                    `yaml:"selection,omitempty"` // Default provider selection strategy
+	Models             ModelRegistry             `yaml:"models,omitempty"`    // Model names clients may request
+	Routing            RoutingConfig             `yaml:"routing,omitempty"`   // Content-based routing to models
 	CircuitBreaker     CircuitBreakerConfig      `yaml:"circuit_breaker"`
 	Queue              QueueConfig               `yaml:"queue"`
-	TestMode           bool                      `yaml:"-"` // Skip provider initialization in tests
+	Auth               AuthConfig                `yaml:"auth"`
+	CORS               CORSConfig                `yaml:"cors"`
+	RateLimit          RateLimitConfig           `yaml:"rate_limit"`
+	Budgets            BudgetConfig              `yaml:"budgets"`
+	Pricing            PricingTable              `yaml:"pricing,omitempty"` // Model prices for cost estimates
+	TestMode           bool                      `yaml:"-"`                 // Skip provider initialization in tests
 }
 
 // ServerConfig holds server-specific configuration for the HTTP server.
@@ -135,6 +143,12 @@ type LLMConfig struct {
 	// Retry configuration (optional)
 	Retry *RetryConfig `yaml:"retry,omitempty"`
 
+	// Hedging configuration (optional)
+	Hedging *HedgingConfig `yaml:"hedging,omitempty"`
+
+	// OutlierDetection ejects providers deviating from the others (optional)
+	OutlierDetection *OutlierDetectionConfig `yaml:"outlier_detection,omitempty"`
+
 	// Options contains provider-specific generation parameters
 	Options map[string]interface{} `yaml:"options"`
 
@@ -155,9 +169,10 @@ type BackupProvider struct {
 // ProviderHealthCheck defines health check settings
 type ProviderHealthCheck struct {
 	Enabled          bool          `yaml:"enabled"`
-	Interval         time.Duration `yaml:"interval"`
-	Timeout          time.Duration `yaml:"timeout"`
-	FailureThreshold int           `yaml:"failure_threshold"`
+	Interval         time.Duration `yaml:"interval"`          // Time between checks (default: 1m)
+	Timeout          time.Duration `yaml:"timeout"`           // Time limit of a check (default: 5s)
+	FailureThreshold int           `yaml:"failure_threshold"` // Failed checks before a provider is unhealthy (default: 1)
+	Mode             string        `yaml:"mode,omitempty"`    // Default mode of every provider (default: generate)
 }
 
 // CacheConfig defines caching behavior for LLM responses.
@@ -226,6 +241,17 @@ type ProviderConfig struct {
 	Type   string `yaml:"type"`    // Provider type (e.g., openai, anthropic)
 	Model  string `yaml:"model"`   // Model name
 	APIKey string `yaml:"api_key"` // API key for authentication
+	Weight int    `yaml:"weight"`  // Share of traffic under weighted round-robin (default: 1)
+
+	// Endpoint is the base URL of the provider's API, such as
+	// "http://localhost:11434" for Ollama (default: the provider's public API)
+	Endpoint string `yaml:"endpoint,omitempty"`
+
+	// HealthCheck overrides the health check mode of llm.health_check (optional)
+	HealthCheck *HealthProbe `yaml:"health_check,omitempty"`
+
+	// CircuitBreaker overrides fields of the circuit_breaker block for this provider (optional)
+	CircuitBreaker *CircuitBreakerConfig `yaml:"circuit_breaker,omitempty"`
 }
 
 // LoggingConfig holds logging-specific configuration.
@@ -254,11 +280,22 @@ type RouteConfig struct {
 	// Headers specifies the required headers for this route
 	Headers map[string]string `yaml:"headers,omitempty"`
 
-	// Middleware specifies the route-specific middleware
-	Middleware []string `yaml:"middleware,omitempty"`
+	// Middleware specifies the route-specific middleware, in the order
+	// it runs, each with its settings
+	Middleware []MiddlewareConfig `yaml:"middleware,omitempty"`
 
 	// HealthCheck specifies the health check configuration for this route
 	HealthCheck *HealthCheck `yaml:"health_check,omitempty"`
+
+	// Selection overrides the provider selection strategy for this route
+	Selection string `yaml:"selection,omitempty"`
+
+	// Split sends a share of the route's traffic to a candidate provider
+	Split *TrafficSplit `yaml:"split,omitempty"`
+
+	// Dedup coalesces concurrent identical requests of an API key into a
+	// single provider call (default: true)
+	Dedup *bool `yaml:"dedup,omitempty"`
 }
 
 // HealthCheck defines health check configuration for a route
@@ -289,9 +326,17 @@ type CircuitBreakerConfig struct {
 	// Timeout is the period of the open state until it becomes half-open
 	Timeout time.Duration `yaml:"timeout"`
 
-	// FailureThreshold is the number of failures needed to trip the circuit
+	// FailureThreshold is the number of consecutive failures needed to trip the circuit
 	FailureThreshold uint32 `yaml:"failure_threshold"`
 
+	// ErrorRate is the percentage of failed requests within the Interval
+	// that trips the circuit; 0 disables it
+	ErrorRate float64 `yaml:"error_rate,omitempty"`
+
+	// MinRequests is the number of requests within the Interval needed
+	// before the error rate applies (default: 10)
+	MinRequests uint32 `yaml:"min_requests,omitempty"`
+
 	// TestMode indicates whether to skip Prometheus metric registration (for testing)
 	TestMode bool `yaml:"test_mode"`
 }
@@ -406,6 +451,9 @@ func DefaultConfig() *Config {
 			"openai",
 		},
 
+		// Serve from the first available provider of the preference order
+		Selection: SelectionPriority,
+
 		Logging: LoggingConfig{
 			Level:  "info",
 			Format: "json",
@@ -413,26 +461,25 @@ func DefaultConfig() *Config {
 
 		Routes: []RouteConfig{
 			{
-				Path:    "/v1/completions",
-				Handler: "completion",
-				Version: "v1",
-				Methods: []string{"POST", "OPTIONS"},
-				Middleware: []string{
-					"auth",
-					"rate-limit",
-					"cors",
-					"logging",
-				},
-				HealthCheck: &HealthCheck{
-					Enabled:   true,
-					Interval:  30 * time.Second,
-					Timeout:   5 * time.Second,
-					Threshold: 3,
-					Checks: map[string]string{
-						"api":     "http",
-						"latency": "threshold",
-					},
-				},
+				Path:       "/v1/completions",
+				Handler:    "completion",
+				Version:    "v1",
+				Methods:    []string{"POST"},
+				Middleware: Middleware("auth", "ratelimit", "budget", "logging"),
+			},
+			{
+				Path:       "/v1/chat/completions",
+				Handler:    "chat_completions",
+				Version:    "v1",
+				Methods:    []string{"POST"},
+				Middleware: Middleware("auth", "ratelimit", "budget", "logging"),
+			},
+			{
+				Path:       "/v1/messages",
+				Handler:    "messages",
+				Version:    "v1",
+				Methods:    []string{"POST"},
+				Middleware: Middleware("auth", "ratelimit", "budget", "logging"),
 			},
 			{
 				Path:    "/health",
@@ -445,7 +492,7 @@ func DefaultConfig() *Config {
 				Handler:    "metrics",
 				Version:    "v1",
 				Methods:    []string{"GET"},
-				Middleware: []string{"auth"},
+				Middleware: Middleware("auth"),
 			},
 		},
 
@@ -455,6 +502,21 @@ func DefaultConfig() *Config {
 			StatePath:    "",               // No persistence by default
 			SaveInterval: 30 * time.Second, // Save every 30s when enabled
 		},
+
+		CORS: CORSConfig{
+			Origins: []string{"*"}, // Any origin, without credentials
+		},
+
+		RateLimit: RateLimitConfig{
+			Enabled:     false,            // Disabled by default
+			IdleTimeout: 10 * time.Minute, // Forget clients idle for 10 minutes
+		},
+
+		Budgets: BudgetConfig{
+			Enabled:      false,            // Disabled by default
+			StatePath:    "",               // No persistence by default
+			SaveInterval: 30 * time.Second, // Save every 30s when enabled
+		},
 	}
 }
 
@@ -647,6 +709,75 @@ func (c *Config) Validate() error {
 	if c.LLM.MaxContextTokens < 0 {
 		return fmt.Errorf("negative max context tokens: %d", c.LLM.MaxContextTokens)
 	}
+	for i, bp := range c.LLM.BackupProviders {
+		if bp.Provider == "" {
+			return fmt.Errorf("empty provider for backup provider %d", i)
+		}
+	}
+	for name, p := range c.Providers {
+		if p.Type == "" {
+			return fmt.Errorf("empty type for provider %s", name)
+		}
+		if p.Weight < 0 {
+			return fmt.Errorf("negative weight for provider %s", name)
+		}
+	}
+	if err := validSelection(c.Selection); err != nil {
+		return err
+	}
+	if err := c.Models.validate(c.ProviderChain()); err != nil {
+		return err
+	}
+	if err := c.Routing.validate(c.Models); err != nil {
+		return err
+	}
+
+	// Cache validation
+	if c.LLM.Cache != nil && c.LLM.Cache.Enable {
+		switch c.LLM.Cache.Type {
+		case "memory":
+			// No extra settings required
+		case "file":
+			if c.LLM.Cache.Dir == "" {
+				return fmt.Errorf("cache type 'file' requires dir")
+			}
+		case "redis":
+			if c.LLM.Cache.Redis == nil || c.LLM.Cache.Redis.Address == "" {
+				return fmt.Errorf("cache type 'redis' requires redis.address")
+			}
+		default:
+			return fmt.Errorf("invalid cache type: %s", c.LLM.Cache.Type)
+		}
+		if c.LLM.Cache.TTL < 0 {
+			return fmt.Errorf("negative cache TTL: %v", c.LLM.Cache.TTL)
+		}
+		if c.LLM.Cache.MaxSize < 0 {
+			return fmt.Errorf("negative cache max size: %d", c.LLM.Cache.MaxSize)
+		}
+	}
+
+	if err := c.LLM.Hedging.validate(); err != nil {
+		return err
+	}
+	if err := c.LLM.OutlierDetection.validate(); err != nil {
+		return err
+	}
+	if err := c.LLM.HealthCheck.validate(); err != nil {
+		return err
+	}
+	if err := c.CircuitBreaker.validate(); err != nil {
+		return err
+	}
+	for name, p := range c.Providers {
+		if p.HealthCheck != nil {
+			if err := p.HealthCheck.validate(p.Type); err != nil {
+				return fmt.Errorf("provider %s: %w", name, err)
+			}
+		}
+		if err := p.CircuitBreaker.validate(); err != nil {
+			return fmt.Errorf("provider %s: %w", name, err)
+		}
+	}
 
 	// Logging validation
 	switch c.Logging.Level {
@@ -674,6 +805,50 @@ func (c *Config) Validate() error {
 		if route.Version == "" {
 			return fmt.Errorf("empty version in route %d", i)
 		}
+		if err := validSelection(route.Selection); err != nil {
+			return fmt.Errorf("route %s: %w", route.Path, err)
+		}
+		for _, mw := range route.Middleware {
+			settings, err := mw.Settings()
+			if err != nil {
+				return fmt.Errorf("route %s: %w", route.Path, err)
+			}
+			// CORS settings of routes must also be valid with those they inherit
+			if cors, ok := settings.(*CORSSettings); ok {
+				merged := c.CORS.Override(cors)
+				if err := merged.validate(); err != nil {
+					return fmt.Errorf("route %s: %w", route.Path, err)
+				}
+			}
+		}
+		if route.Split != nil {
+			if err := route.Split.validate(c.ProviderChain()); err != nil {
+				return fmt.Errorf("route %s: %w", route.Path, err)
+			}
+		}
+	}
+
+	// Auth validation, including the keys file
+	if _, err := c.Auth.LoadKeys(); err != nil {
+		return fmt.Errorf("invalid auth configuration: %w", err)
+	}
+
+	// CORS validation
+	if err := c.CORS.validate(); err != nil {
+		return err
+	}
+
+	// Rate limit validation
+	if err := c.RateLimit.validate(); err != nil {
+		return err
+	}
+
+	// Budget and pricing validation
+	if err := c.Budgets.validate(); err != nil {
+		return err
+	}
+	if err := c.Pricing.validate(); err != nil {
+		return err
 	}
 
 	return nil
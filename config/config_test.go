@@ -1,9 +1,15 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
+
+	"go.uber.org/zap"
 )
 
 func TestLoadValidConfig(t *testing.T) {
@@ -32,6 +38,12 @@ routes:
   - path: /v1/completions
     handler: completion
     version: v1
+    middleware:
+      - auth
+      - timeout: {duration: 30s}
+      - ratelimit:
+          rpm: 60
+      - body_limit: {bytes: 1MB}
   - path: /health
     handler: health
     version: v1
@@ -70,6 +82,36 @@ routes:
 	if len(config.Routes) != 2 {
 		t.Errorf("unexpected number of routes: got %d, want %d", len(config.Routes), 2)
 	}
+
+	// Check route middleware
+	mws := config.Routes[0].Middleware
+	if len(mws) != 4 {
+		t.Fatalf("unexpected number of middleware: got %d, want %d", len(mws), 4)
+	}
+	if mws[0].Name != "auth" || mws[0].Params != nil {
+		t.Errorf("unexpected middleware: got %+v, want auth", mws[0])
+	}
+	settings, err := mws[1].Settings()
+	if err != nil {
+		t.Fatalf("Failed to decode timeout settings: %v", err)
+	}
+	if d := settings.(*TimeoutSettings).Duration; d != 30*time.Second {
+		t.Errorf("unexpected timeout: got %v, want %v", d, 30*time.Second)
+	}
+	settings, err = mws[2].Settings()
+	if err != nil {
+		t.Fatalf("Failed to decode rate limit settings: %v", err)
+	}
+	if rpm := settings.(*RateLimitSettings).RPM; rpm != 60 {
+		t.Errorf("unexpected rpm: got %d, want %d", rpm, 60)
+	}
+	settings, err = mws[3].Settings()
+	if err != nil {
+		t.Fatalf("Failed to decode body limit settings: %v", err)
+	}
+	if b := settings.(*BodyLimitSettings).Bytes; b != 1<<20 {
+		t.Errorf("unexpected body limit: got %d, want %d", b, 1<<20)
+	}
 }
 
 func TestLoadInvalidConfig(t *testing.T) {
@@ -111,6 +153,375 @@ routes:
 `,
 			want: "empty path",
 		},
+		{
+			name: "file cache without dir",
+			config: `
+llm:
+  cache:
+    enable: true
+    type: file
+`,
+			want: "cache type 'file' requires dir",
+		},
+		{
+			name: "unknown cache type",
+			config: `
+llm:
+  cache:
+    enable: true
+    type: memcached
+`,
+			want: "invalid cache type",
+		},
+		{
+			name: "unknown rate limit scope",
+			config: `
+rate_limit:
+  policies:
+    - scope: ip
+      requests: 10
+      window: 1m
+`,
+			want: "invalid scope",
+		},
+		{
+			name: "rate limit without window",
+			config: `
+rate_limit:
+  policies:
+    - scope: key
+      requests: 10
+`,
+			want: "window must be positive",
+		},
+		{
+			name: "rate limit without limits",
+			config: `
+rate_limit:
+  policies:
+    - scope: global
+      window: 1m
+`,
+			want: "requests or tokens must be set",
+		},
+		{
+			name: "duplicate rate limit policy",
+			config: `
+rate_limit:
+  policies:
+    - scope: key
+      requests: 10
+      window: 1m
+    - scope: key
+      tokens: 1000
+      window: 1m
+`,
+			want: "duplicate rate limit policy: key",
+		},
+		{
+			name: "unknown budget period",
+			config: `
+budgets:
+  limits:
+    - scope: key
+      period: weekly
+      tokens: 1000
+`,
+			want: "invalid period",
+		},
+		{
+			name: "route scoped budget",
+			config: `
+budgets:
+  limits:
+    - scope: route
+      period: daily
+      tokens: 1000
+`,
+			want: "invalid scope",
+		},
+		{
+			name: "budget without limits",
+			config: `
+budgets:
+  limits:
+    - scope: tenant
+      period: monthly
+`,
+			want: "tokens or spend must be set",
+		},
+		{
+			name: "negative price",
+			config: `
+pricing:
+  gpt-4o:
+    input: -1
+`,
+			want: "negative price for model gpt-4o",
+		},
+		{
+			name: "unknown selection strategy",
+			config: `
+selection: random
+`,
+			want: "invalid selection strategy: random",
+		},
+		{
+			name: "unknown route selection strategy",
+			config: `
+routes:
+  - path: /completions
+    handler: completion
+    version: v1
+    selection: fastest
+`,
+			want: "route /completions: invalid selection strategy: fastest",
+		},
+		{
+			name: "negative provider weight",
+			config: `
+providers:
+  ollama:
+    type: ollama
+    model: llama2
+    weight: -1
+`,
+			want: "negative weight for provider ollama",
+		},
+		{
+			name: "model alias without providers",
+			config: `
+models:
+  fast: []
+`,
+			want: "no providers for model fast",
+		},
+		{
+			name: "model alias of an unknown provider",
+			config: `
+models:
+  smart:
+    - provider: anthropic
+      model: claude-3-opus
+`,
+			want: "model smart: no provider matches anthropic/claude-3-opus",
+		},
+		{
+			name: "routing rule to an unknown model",
+			config: `
+models:
+  fast:
+    - provider: ollama
+routing:
+  rules:
+    - name: long-context
+      min_prompt_tokens: 8000
+      model: big
+`,
+			want: `routing rule long-context: unknown model "big"`,
+		},
+		{
+			name: "routing rule with inverted token bounds",
+			config: `
+models:
+  fast:
+    - provider: ollama
+routing:
+  rules:
+    - name: medium
+      min_prompt_tokens: 800
+      max_prompt_tokens: 100
+      model: fast
+`,
+			want: "routing rule medium: min_prompt_tokens exceeds max_prompt_tokens",
+		},
+		{
+			name: "unknown default routing model",
+			config: `
+routing:
+  default: fast
+`,
+			want: "unknown default routing model: fast",
+		},
+		{
+			name: "hedging percentile out of range",
+			config: `
+llm:
+  provider: ollama
+  model: llama2
+  hedging:
+    enabled: true
+    percentile: 20
+`,
+			want: "hedging percentile must be between 50 and 100",
+		},
+		{
+			name: "outlier detection factor too low",
+			config: `
+llm:
+  provider: ollama
+  model: llama2
+  outlier_detection:
+    enabled: true
+    error_rate_factor: 0.5
+`,
+			want: "outlier detection factors must be greater than 1",
+		},
+		{
+			name: "invalid health check mode",
+			config: `
+llm:
+  provider: ollama
+  model: llama2
+  health_check:
+    enabled: true
+    mode: tcp
+`,
+			want: "invalid health check mode: tcp",
+		},
+		{
+			name: "ping health check without url",
+			config: `
+providers:
+  local:
+    type: ollama
+    model: llama2
+    health_check:
+      mode: ping
+`,
+			want: "provider local: ping health check requires url",
+		},
+		{
+			name: "circuit breaker error rate out of range",
+			config: `
+providers:
+  local:
+    type: ollama
+    model: llama2
+    circuit_breaker:
+      error_rate: 150
+`,
+			want: "provider local: circuit breaker error rate must be between 0 and 100",
+		},
+		{
+			name: "invalid split mode",
+			config: `
+routes:
+  - path: /completions
+    handler: completion
+    version: v1
+    split:
+      mode: canary
+      percent: 10
+      candidate:
+        provider: ollama
+`,
+			want: "route /completions: invalid split mode: canary",
+		},
+		{
+			name: "split percent out of range",
+			config: `
+routes:
+  - path: /completions
+    handler: completion
+    version: v1
+    split:
+      percent: 150
+      candidate:
+        provider: ollama
+`,
+			want: "route /completions: split percent must be between 0 and 100",
+		},
+		{
+			name: "split candidate of an unknown provider",
+			config: `
+routes:
+  - path: /completions
+    handler: completion
+    version: v1
+    split:
+      mode: shadow
+      percent: 5
+      candidate:
+        provider: mistral
+`,
+			want: "route /completions: no provider matches split candidate mistral",
+		},
+		{
+			name: "unknown middleware",
+			config: `
+routes:
+  - path: /completions
+    handler: completion
+    version: v1
+    middleware: [auth, compress]
+`,
+			want: "route /completions: unknown middleware: compress",
+		},
+		{
+			name: "unknown middleware setting",
+			config: `
+routes:
+  - path: /completions
+    handler: completion
+    version: v1
+    middleware:
+      - timeout: {seconds: 30}
+`,
+			want: "route /completions: middleware timeout: invalid settings",
+		},
+		{
+			name: "invalid middleware setting",
+			config: `
+routes:
+  - path: /completions
+    handler: completion
+    version: v1
+    middleware:
+      - body_limit: {bytes: 1XB}
+`,
+			want: "invalid byte size",
+		},
+		{
+			name: "settings of middleware taking none",
+			config: `
+routes:
+  - path: /completions
+    handler: completion
+    version: v1
+    middleware:
+      - auth: {required: true}
+`,
+			want: "route /completions: middleware auth: invalid settings",
+		},
+		{
+			name: "CORS origin with a path",
+			config: `
+cors:
+  origins: ["https://app.example.com/"]
+`,
+			want: "invalid CORS origin",
+		},
+		{
+			name: "CORS credentials for any origin",
+			config: `
+cors:
+  allow_credentials: true
+`,
+			want: "CORS credentials cannot be allowed for any origin",
+		},
+		{
+			name: "route CORS credentials for any origin",
+			config: `
+routes:
+  - path: /completions
+    handler: completion
+    version: v1
+    middleware:
+      - cors: {allow_credentials: true}
+`,
+			want: "route /completions: CORS credentials cannot be allowed for any origin",
+		},
 	}
 
 	for _, tt := range tests {
@@ -153,8 +564,335 @@ func TestDefaultConfig(t *testing.T) {
 	}
 
 	// Check default routes
-	if len(config.Routes) != 3 {
+	if len(config.Routes) != 5 {
 		t.Errorf("unexpected number of default routes: got %d, want %d",
-			len(config.Routes), 3)
+			len(config.Routes), 5)
+	}
+}
+
+func TestProviderChain(t *testing.T) {
+	t.Setenv("HAPAX_TEST_BACKUP_KEY", "sk-backup")
+
+	cfg := DefaultConfig()
+	cfg.LLM.BackupProviders = []BackupProvider{
+		{Provider: "anthropic", Model: "claude-3-haiku"},
+		{Provider: "openai", Model: "gpt-3.5-turbo", APIKey: "${HAPAX_TEST_BACKUP_KEY}"},
+		{Provider: "openai", Model: "gpt-4"},
+	}
+	cfg.Providers = map[string]ProviderConfig{
+		"anthropic": {Type: "anthropic", Model: "claude-3-5-sonnet"},
+		"groq":      {Type: "groq", Model: "llama3"},
+		"azure-1":   {Type: "openai", Model: "gpt-4"},
+	}
+	cfg.ProviderPreference = []string{"groq", "unknown", "ollama"}
+
+	chain := cfg.ProviderChain()
+
+	var names []string
+	for _, p := range chain {
+		names = append(names, p.Name)
+	}
+	want := []string{"groq", "ollama", "anthropic", "openai", "openai-gpt-4", "azure-1"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Fatalf("unexpected chain: got %v, want %v", names, want)
+	}
+
+	byName := make(map[string]NamedProvider)
+	for _, p := range chain {
+		byName[p.Name] = p
+	}
+	if got := byName["ollama"]; got.Type != "ollama" || got.Model != "llama2" {
+		t.Errorf("primary not taken from llm block: %+v", got)
+	}
+	if got := byName["openai"].APIKey; got != "sk-backup" {
+		t.Errorf("backup API key not expanded: got %q", got)
+	}
+	if got := byName["anthropic"].Model; got != "claude-3-5-sonnet" {
+		t.Errorf("providers entry should shadow legacy backup: got model %q", got)
+	}
+}
+
+func TestAuthConfigLoadKeys(t *testing.T) {
+	hash := HashAPIKey("sk-test")
+	if !strings.HasPrefix(hash, "sha256:") || len(hash) != len("sha256:")+64 {
+		t.Fatalf("unexpected hash format: %s", hash)
+	}
+
+	keysFile := filepath.Join(t.TempDir(), "keys.yaml")
+	if err := os.WriteFile(keysFile, []byte(`
+keys:
+  - id: from-file
+    hash: `+strings.ToUpper(strings.TrimPrefix(HashAPIKey("sk-file"), "sha256:"))+`
+    expires_at: 2030-01-01T00:00:00Z
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(strings.NewReader(`
+auth:
+  enabled: true
+  keys_file: ` + keysFile + `
+  keys:
+    - id: inline
+      label: Inline key
+      tenant: acme
+      hash: ` + hash + `
+      disabled: true
+`))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	keys, err := cfg.Auth.LoadKeys()
+	if err != nil {
+		t.Fatalf("LoadKeys() error = %v", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("got %d keys, want 2", len(keys))
+	}
+	if keys[0].ID != "inline" || keys[0].Tenant != "acme" || !keys[0].Disabled {
+		t.Errorf("unexpected inline key: %+v", keys[0])
+	}
+	if keys[1].Hash != HashAPIKey("sk-file") {
+		t.Errorf("file key hash not normalized: %s", keys[1].Hash)
+	}
+	if want := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC); !keys[1].ExpiresAt.Equal(want) {
+		t.Errorf("unexpected expiry: %v", keys[1].ExpiresAt)
+	}
+
+	invalid := []struct {
+		name string
+		auth AuthConfig
+		want string
+	}{
+		{"missing id", AuthConfig{Keys: []APIKeyConfig{{Hash: hash}}}, "empty id"},
+		{"bad hash", AuthConfig{Keys: []APIKeyConfig{{ID: "a", Hash: "sk-plaintext"}}}, "SHA-256"},
+		{"duplicate id", AuthConfig{Keys: []APIKeyConfig{{ID: "a", Hash: hash}, {ID: "a", Hash: HashAPIKey("other")}}}, "duplicate API key id"},
+		{"duplicate hash", AuthConfig{Keys: []APIKeyConfig{{ID: "a", Hash: hash}, {ID: "b", Hash: hash}}}, "already used"},
+		{"missing file", AuthConfig{KeysFile: filepath.Join(t.TempDir(), "missing.yaml")}, "read keys file"},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.auth.LoadKeys()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("LoadKeys() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigWatcherKeysFile(t *testing.T) {
+	dir := t.TempDir()
+	keysFile := filepath.Join(dir, "keys.yaml")
+	configFile := filepath.Join(dir, "config.yaml")
+
+	writeKeys := func(id string) {
+		t.Helper()
+		if err := os.WriteFile(keysFile, []byte("keys:\n  - id: "+id+"\n    hash: "+HashAPIKey(id)+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeKeys("first")
+	if err := os.WriteFile(configFile, []byte("auth:\n  enabled: true\n  keys_file: "+keysFile+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	watcher, err := NewConfigWatcher(configFile, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewConfigWatcher() error = %v", err)
+	}
+	defer watcher.Close()
+	updates := watcher.Subscribe()
+
+	// Editing only the keys file publishes a new configuration
+	writeKeys("second")
+
+	select {
+	case cfg := <-updates:
+		keys, err := cfg.Auth.LoadKeys()
+		if err != nil {
+			t.Fatalf("LoadKeys() error = %v", err)
+		}
+		if len(keys) != 1 || keys[0].ID != "second" {
+			t.Errorf("unexpected keys after reload: %+v", keys)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for keys reload")
+	}
+}
+
+func TestConfigWatcherRename(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(configFile, []byte("server:\n  port: 8081\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	watcher, err := NewConfigWatcher(configFile, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewConfigWatcher() error = %v", err)
+	}
+	defer watcher.Close()
+	updates := watcher.Subscribe()
+
+	// Editors and Kubernetes replace the file by renaming another over it,
+	// repeatedly
+	for _, port := range []int{8082, 8083} {
+		tmp := filepath.Join(dir, ".config.yaml.tmp")
+		if err := os.WriteFile(tmp, []byte(fmt.Sprintf("server:\n  port: %d\n", port)), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, configFile); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case cfg := <-updates:
+			if cfg.Server.Port != port {
+				t.Errorf("got port %d after rename, want %d", cfg.Server.Port, port)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for reload to port %d", port)
+		}
+	}
+}
+
+func TestConfigWatcherReload(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(configFile, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("server:\n  port: 8081\n")
+
+	watcher, err := NewConfigWatcher(configFile, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewConfigWatcher() error = %v", err)
+	}
+	defer watcher.Close()
+	updates := watcher.Subscribe()
+	initial := watcher.Status()
+	if initial.Version == "" || initial.LoadedAt.IsZero() {
+		t.Fatalf("unexpected initial status: %+v", initial)
+	}
+
+	// An invalid configuration is rejected, keeping the last valid one
+	write("server:\n  port: 70000\n")
+	if version, err := watcher.Check(); err == nil {
+		t.Errorf("Check() = %s, want error", version)
+	}
+	if err := watcher.Reload(); err == nil {
+		t.Fatal("Reload() of invalid config succeeded")
+	}
+	if got := watcher.GetCurrentConfig().Server.Port; got != 8081 {
+		t.Errorf("got port %d after invalid reload, want 8081", got)
+	}
+	status := watcher.Status()
+	if status.Version != initial.Version || status.LastError == "" || status.Failures == 0 {
+		t.Errorf("unexpected status after invalid reload: %+v", status)
+	}
+
+	// A subscriber that falls behind gets the latest configuration
+	write("server:\n  port: 8082\n")
+	if err := watcher.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	write("server:\n  port: 8083\n")
+	if err := watcher.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if cfg := <-updates; cfg.Server.Port != 8083 {
+		t.Errorf("got port %d, want the latest 8083", cfg.Server.Port)
+	}
+	status = watcher.Status()
+	if status.LastError != "" || status.Reloads < 2 || status.Version == initial.Version {
+		t.Errorf("unexpected status after reloads: %+v", status)
+	}
+
+	// Close ends subscriptions
+	watcher.Close()
+	if _, ok := <-updates; ok {
+		t.Error("subscription not closed by Close")
+	}
+}
+
+func TestConfigWatcherApplier(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	write := func(port int, keysFile string) {
+		t.Helper()
+		content := fmt.Sprintf("server:\n  port: %d\nauth:\n  keys_file: %s\n", port, keysFile)
+		if err := os.WriteFile(configFile, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keysFiles := []string{filepath.Join(dir, "keys.yaml"), filepath.Join(dir, "other-keys.yaml")}
+	for _, path := range keysFiles {
+		if err := os.WriteFile(path, []byte("keys: []\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(8081, keysFiles[0])
+
+	watcher, err := NewConfigWatcher(configFile, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewConfigWatcher() error = %v", err)
+	}
+	defer watcher.Close()
+	updates := watcher.Subscribe()
+	initial := watcher.Status()
+
+	errApply := errors.New("provider unavailable")
+	var applied []int
+	watcher.SetApplier(func(cfg *Config) error {
+		if cfg.Server.Port == 8082 {
+			return errApply
+		}
+		applied = append(applied, cfg.Server.Port)
+		return nil
+	})
+
+	// A configuration that fails to apply is rejected like an invalid one,
+	// and the keys file of the configuration served stays watched
+	write(8082, keysFiles[1])
+	if err := watcher.Reload(); !errors.Is(err, errApply) {
+		t.Fatalf("Reload() error = %v, want %v", err, errApply)
+	}
+	if got := watcher.GetCurrentConfig().Server.Port; got != 8081 {
+		t.Errorf("got port %d after failed apply, want 8081", got)
+	}
+	status := watcher.Status()
+	if status.Version != initial.Version || !strings.Contains(status.LastError, "provider unavailable") ||
+		status.Failures != 1 || status.Reloads != 0 {
+		t.Errorf("unexpected status after failed apply: %+v", status)
+	}
+	select {
+	case cfg := <-updates:
+		t.Errorf("published port %d that failed to apply", cfg.Server.Port)
+	default:
+	}
+	if watcher.keysFile != keysFiles[0] {
+		t.Errorf("watching keys file %s after failed apply, want %s", watcher.keysFile, keysFiles[0])
+	}
+
+	// A configuration that applies is served and published
+	write(8083, keysFiles[1])
+	if err := watcher.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if len(applied) != 1 || applied[0] != 8083 {
+		t.Errorf("applied %v, want [8083]", applied)
+	}
+	if cfg := <-updates; cfg.Server.Port != 8083 {
+		t.Errorf("got port %d, want 8083", cfg.Server.Port)
+	}
+	status = watcher.Status()
+	if status.LastError != "" || status.Reloads != 1 || status.Version == initial.Version {
+		t.Errorf("unexpected status after reload: %+v", status)
+	}
+	if watcher.keysFile != keysFiles[1] {
+		t.Errorf("watching keys file %s, want %s", watcher.keysFile, keysFiles[1])
 	}
 }
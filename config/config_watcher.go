@@ -2,8 +2,16 @@
 package config
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"go.uber.org/zap"
@@ -12,19 +20,51 @@ import (
 // Verify at compile time that ConfigWatcher implements Watcher
 var _ Watcher = (*ConfigWatcher)(nil)
 
-// ConfigWatcher manages configuration hot reloading
+// reloadDebounce is how long file events must settle before a reload, so
+// that a file written in several steps is reloaded once, complete.
+const reloadDebounce = 100 * time.Millisecond
+
+// ReloadStatus describes the configuration a watcher serves and the
+// outcome of its last reload.
+type ReloadStatus struct {
+	Version     string    `json:"version"`              // SHA-256 of the config and keys files served
+	LoadedAt    time.Time `json:"loaded_at"`            // When the served configuration was loaded
+	LastAttempt time.Time `json:"last_attempt"`         // When a reload was last attempted, zero before the first
+	LastError   string    `json:"last_error,omitempty"` // Why the last reload failed, empty when it succeeded
+	Reloads     uint64    `json:"reloads"`              // Reloads that changed the configuration
+	Failures    uint64    `json:"failures"`             // Reloads that failed
+}
+
+// ConfigWatcher manages configuration hot reloading. It serves the last
+// valid configuration: a configuration that fails to load or validate is
+// rejected, and the previous one stays in place.
 type ConfigWatcher struct {
 	// Using atomic.Value for thread-safe config access
 	currentConfig atomic.Value
 	configPath    string
+	keysFile      string // API keys file watched alongside the config, if any
 	watcher       *fsnotify.Watcher
 	logger        *zap.Logger
-	// Channel to notify subscribers of config changes
-	subscribers []chan<- *Config
+	// mu serializes reloads and protects the fields below and keysFile
+	mu     sync.Mutex
+	status ReloadStatus
+	closed bool
+	// apply takes new configurations before they are served, if set
+	apply func(*Config) error
+	// Channels to notify subscribers of config changes
+	subscribers []chan *Config
 }
 
 // NewConfigWatcher creates a new configuration watcher
 func NewConfigWatcher(configPath string, logger *zap.Logger) (*ConfigWatcher, error) {
+	configPath = filepath.Clean(configPath)
+
+	// Load initial configuration
+	initialConfig, version, err := load(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load initial config: %w", err)
+	}
+
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create watcher: %w", err)
@@ -34,46 +74,204 @@ func NewConfigWatcher(configPath string, logger *zap.Logger) (*ConfigWatcher, er
 		configPath: configPath,
 		watcher:    watcher,
 		logger:     logger,
-	}
-
-	// Load initial configuration
-	initialConfig, err := LoadFile(configPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load initial config: %w", err)
+		status:     ReloadStatus{Version: version, LoadedAt: time.Now()},
 	}
 	cw.currentConfig.Store(initialConfig)
 
-	// Start watching the config file
-	if err := watcher.Add(configPath); err != nil {
+	// Watch the directory of the config file rather than the file itself:
+	// editors and Kubernetes replace files by renaming others over them,
+	// which ends watches of the replaced file.
+	if err := watcher.Add(filepath.Dir(configPath)); err != nil {
+		watcher.Close()
 		return nil, fmt.Errorf("failed to watch config file: %w", err)
 	}
+	if err := cw.watchKeysFile(initialConfig.Auth.KeysFile); err != nil {
+		watcher.Close()
+		return nil, err
+	}
 
 	go cw.watchConfig()
 	return cw, nil
 }
 
-// Subscribe allows components to receive config updates
+// load reads and validates the configuration at path, along with its API
+// keys, without applying it. It returns the configuration and its version,
+// the SHA-256 of the config and keys files.
+func load(path string) (*Config, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("read config file: %w", err)
+	}
+	cfg, err := Load(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	hash := sha256.New()
+	hash.Write(data)
+	if cfg.Auth.KeysFile != "" {
+		keys, err := os.ReadFile(cfg.Auth.KeysFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("read keys file: %w", err)
+		}
+		hash.Write(keys)
+	}
+	if _, err := cfg.Auth.LoadKeys(); err != nil {
+		return nil, "", fmt.Errorf("load API keys: %w", err)
+	}
+
+	return cfg, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Subscribe allows components to receive config updates. A subscriber
+// that falls behind receives the latest configuration in place of those
+// it has not received yet. The channel is closed by Close.
 func (cw *ConfigWatcher) Subscribe() <-chan *Config {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
 	ch := make(chan *Config, 1)
+	if cw.closed {
+		close(ch)
+		return ch
+	}
 	cw.subscribers = append(cw.subscribers, ch)
 	return ch
 }
 
+// SetApplier has apply take each configuration a reload loads before it
+// is served, published and reported in the status. When apply fails, the
+// reload fails: the current configuration stays in place and the error is
+// recorded in the status. apply is called with cw.mu held, so it must not
+// call the watcher back.
+func (cw *ConfigWatcher) SetApplier(apply func(*Config) error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.apply = apply
+}
+
 // GetCurrentConfig returns the current configuration thread-safely
 func (cw *ConfigWatcher) GetCurrentConfig() *Config {
 	return cw.currentConfig.Load().(*Config)
 }
 
+// Status returns the version of the current configuration and the outcome
+// of the last reload.
+func (cw *ConfigWatcher) Status() ReloadStatus {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	return cw.status
+}
+
+// Check loads and validates the config file as Reload would, without
+// applying it, and returns the version it would serve.
+func (cw *ConfigWatcher) Check() (string, error) {
+	_, version, err := load(cw.configPath)
+	return version, err
+}
+
+// Reload loads the config file and, if it changed, has the applier take
+// it, then publishes it to subscribers. When it fails to load, validate or
+// apply, the current configuration stays in place and the error is
+// recorded in the status.
+func (cw *ConfigWatcher) Reload() error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	if cw.closed {
+		return fmt.Errorf("config watcher is closed")
+	}
+
+	cw.status.LastAttempt = time.Now()
+	newConfig, version, err := load(cw.configPath)
+	if err != nil {
+		cw.status.LastError = err.Error()
+		cw.status.Failures++
+		cw.logger.Error("Failed to reload config, keeping the current one",
+			zap.String("version", cw.status.Version),
+			zap.Error(err))
+		return err
+	}
+	cw.status.LastError = ""
+
+	if version == cw.status.Version {
+		cw.logger.Debug("Config unchanged", zap.String("version", version))
+		return nil
+	}
+
+	if cw.apply != nil {
+		if err := cw.apply(newConfig); err != nil {
+			err = fmt.Errorf("apply config: %w", err)
+			cw.status.LastError = err.Error()
+			cw.status.Failures++
+			cw.logger.Error("Failed to apply config, keeping the current one",
+				zap.String("version", cw.status.Version),
+				zap.Error(err))
+			return err
+		}
+	}
+
+	// Follow the keys file of the configuration served, if its location
+	// changed
+	if err := cw.watchKeysFile(newConfig.Auth.KeysFile); err != nil {
+		cw.logger.Error("Failed to watch API keys file", zap.Error(err))
+	}
+
+	// Store the new configuration
+	cw.currentConfig.Store(newConfig)
+	cw.status.Version = version
+	cw.status.LoadedAt = cw.status.LastAttempt
+	cw.status.Reloads++
+	cw.publish(newConfig)
+
+	cw.logger.Info("Configuration reloaded successfully", zap.String("version", version))
+	return nil
+}
+
+// publish hands cfg to every subscriber without waiting for them. Callers
+// hold cw.mu, so that only publish sends to subscribers.
+func (cw *ConfigWatcher) publish(cfg *Config) {
+	for _, sub := range cw.subscribers {
+		select {
+		case sub <- cfg:
+		default:
+			// Replace the configuration the subscriber has not received
+			// yet, which leaves room for cfg
+			select {
+			case <-sub:
+			default:
+			}
+			sub <- cfg
+		}
+	}
+}
+
 func (cw *ConfigWatcher) watchConfig() {
+	// Reloads wait for events to settle
+	timer := time.NewTimer(reloadDebounce)
+	timer.Stop()
+	defer timer.Stop()
+
 	for {
 		select {
 		case event, ok := <-cw.watcher.Events:
 			if !ok {
 				return
 			}
-			if event.Op&fsnotify.Write == fsnotify.Write {
-				cw.handleConfigChange()
+			if !cw.affects(event) {
+				continue
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
 			}
+			timer.Reset(reloadDebounce)
+		case <-timer.C:
+			cw.logger.Info("Detected config file change, reloading...")
+			// Errors are logged and recorded in the status
+			_ = cw.Reload()
 		case err, ok := <-cw.watcher.Errors:
 			if !ok {
 				return
@@ -83,36 +281,62 @@ func (cw *ConfigWatcher) watchConfig() {
 	}
 }
 
-func (cw *ConfigWatcher) handleConfigChange() {
-	cw.logger.Info("Detected config file change, reloading...")
+// affects reports whether a file event may change the configuration: it
+// concerns the config or keys file, or the "..data" link through which
+// Kubernetes swaps the files of mounted ConfigMaps and Secrets.
+func (cw *ConfigWatcher) affects(event fsnotify.Event) bool {
+	name := filepath.Clean(event.Name)
 
-	newConfig, err := LoadFile(cw.configPath)
-	if err != nil {
-		cw.logger.Error("Failed to load new config", zap.Error(err))
-		return
-	}
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	return name == cw.configPath || name == cw.keysFile ||
+		strings.HasPrefix(filepath.Base(name), "..")
+}
 
-	// Validate the new configuration
-	if err := newConfig.Validate(); err != nil {
-		cw.logger.Error("Invalid new configuration", zap.Error(err))
-		return
+// watchKeysFile switches the watched API keys file to path, so that edits
+// to the keys reload the configuration like edits to the config file do.
+// Like the config file, it is watched through its directory. Callers hold
+// cw.mu, except NewConfigWatcher.
+func (cw *ConfigWatcher) watchKeysFile(path string) error {
+	if path != "" {
+		path = filepath.Clean(path)
+	}
+	if path == cw.keysFile {
+		return nil
 	}
 
-	// Store the new configuration
-	cw.currentConfig.Store(newConfig)
-
-	// Notify all subscribers
-	for _, sub := range cw.subscribers {
-		select {
-		case sub <- newConfig:
-		default:
-			// Skip if subscriber is not ready
+	configDir := filepath.Dir(cw.configPath)
+	if cw.keysFile != "" {
+		if dir := filepath.Dir(cw.keysFile); dir != configDir {
+			// The previous directory may already be gone
+			_ = cw.watcher.Remove(dir)
 		}
+		cw.keysFile = ""
 	}
-
-	cw.logger.Info("Configuration reloaded successfully")
+	if path != "" {
+		if dir := filepath.Dir(path); dir != configDir {
+			if err := cw.watcher.Add(dir); err != nil {
+				return fmt.Errorf("failed to watch keys file: %w", err)
+			}
+		}
+		cw.keysFile = path
+	}
+	return nil
 }
 
+// Close stops watching the config file and closes the channels of
+// subscribers.
 func (cw *ConfigWatcher) Close() error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	if cw.closed {
+		return nil
+	}
+	cw.closed = true
+	for _, sub := range cw.subscribers {
+		close(sub)
+	}
+	cw.subscribers = nil
 	return cw.watcher.Close()
 }
@@ -0,0 +1,123 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// CORSConfig defines which browser origins may call the API, through
+// Cross-Origin Resource Sharing.
+type CORSConfig struct {
+	// Origins lists the allowed origins: exact ones such as
+	// https://app.example.com, subdomain wildcards such as
+	// https://*.example.com, or "*" for any origin. When empty, responses
+	// carry no CORS headers.
+	Origins []string `yaml:"origins"`
+
+	// Methods lists the methods of allowed requests
+	// (default: GET, POST, PUT, DELETE, OPTIONS)
+	Methods []string `yaml:"methods,omitempty"`
+
+	// Headers lists the request headers clients may send
+	// (default: Accept, Authorization, Content-Type, X-API-Key, X-Request-ID)
+	Headers []string `yaml:"headers,omitempty"`
+
+	// ExposedHeaders lists the response headers clients may read, beyond
+	// the safelisted ones
+	ExposedHeaders []string `yaml:"exposed_headers,omitempty"`
+
+	// AllowCredentials lets browsers send cookies and HTTP authentication.
+	// It cannot be combined with the "*" origin.
+	AllowCredentials bool `yaml:"allow_credentials"`
+
+	// MaxAge is how long browsers may cache the answer to a preflight
+	// request (default: not sent)
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+// CORSSettings configures the cors middleware of a route. The settings
+// that are set replace those of the cors section on the route.
+type CORSSettings struct {
+	Origins          []string       `yaml:"origins"`
+	Methods          []string       `yaml:"methods"`
+	Headers          []string       `yaml:"headers"`
+	ExposedHeaders   []string       `yaml:"exposed_headers"`
+	AllowCredentials *bool          `yaml:"allow_credentials"`
+	MaxAge           *time.Duration `yaml:"max_age"`
+}
+
+// Validate checks the origins and methods of the settings.
+func (s *CORSSettings) Validate() error {
+	cfg := CORSConfig{Origins: s.Origins, Methods: s.Methods}
+	if s.AllowCredentials != nil {
+		cfg.AllowCredentials = *s.AllowCredentials
+	}
+	if s.MaxAge != nil {
+		cfg.MaxAge = *s.MaxAge
+	}
+	return cfg.validate()
+}
+
+// Override returns the configuration with the settings of a route
+// replacing its own.
+func (c CORSConfig) Override(s *CORSSettings) CORSConfig {
+	if s == nil {
+		return c
+	}
+	if len(s.Origins) > 0 {
+		c.Origins = s.Origins
+	}
+	if len(s.Methods) > 0 {
+		c.Methods = s.Methods
+	}
+	if len(s.Headers) > 0 {
+		c.Headers = s.Headers
+	}
+	if len(s.ExposedHeaders) > 0 {
+		c.ExposedHeaders = s.ExposedHeaders
+	}
+	if s.AllowCredentials != nil {
+		c.AllowCredentials = *s.AllowCredentials
+	}
+	if s.MaxAge != nil {
+		c.MaxAge = *s.MaxAge
+	}
+	return c
+}
+
+// validate checks the origins, methods and max age.
+func (c *CORSConfig) validate() error {
+	for _, origin := range c.Origins {
+		if !validOrigin(origin) {
+			return fmt.Errorf("invalid CORS origin %q: want scheme://host[:port], scheme://*.domain or *", origin)
+		}
+	}
+	if c.AllowCredentials && slices.Contains(c.Origins, "*") {
+		return fmt.Errorf("CORS credentials cannot be allowed for any origin (*)")
+	}
+	for _, method := range c.Methods {
+		if method == "" || method != strings.ToUpper(method) || strings.ContainsAny(method, " ,") {
+			return fmt.Errorf("invalid CORS method %q", method)
+		}
+	}
+	if c.MaxAge < 0 {
+		return fmt.Errorf("negative CORS max age: %v", c.MaxAge)
+	}
+	return nil
+}
+
+// validOrigin reports whether an origin is "*", or a scheme and a host,
+// optionally with a port and a subdomain wildcard.
+func validOrigin(origin string) bool {
+	if origin == "*" {
+		return true
+	}
+	scheme, host, ok := strings.Cut(origin, "://")
+	if !ok || scheme == "" || host == "" || strings.ContainsAny(host, "/?#") {
+		return false
+	}
+	host = strings.TrimPrefix(host, "*.")
+	return host != "" && !strings.Contains(host, "*")
+}
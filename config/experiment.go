@@ -0,0 +1,72 @@
+package config
+
+import "fmt"
+
+// Traffic split modes
+const (
+	// SplitModeSplit serves the sampled requests with the candidate (A/B test)
+	SplitModeSplit = "split"
+
+	// SplitModeShadow serves every request as usual and sends a copy of
+	// the sampled ones to the candidate, whose response is only logged
+	SplitModeShadow = "shadow"
+)
+
+// TrafficSplit sends a share of a route's traffic to a candidate provider,
+// to compare it against production before rolling it out.
+type TrafficSplit struct {
+	// Name labels the experiment in metrics and logs (default: the route path)
+	Name string `yaml:"name,omitempty"`
+
+	// Mode is "split" (default) or "shadow"
+	Mode string `yaml:"mode,omitempty"`
+
+	// Percent is the share of requests sampled, from 0 to 100
+	Percent float64 `yaml:"percent"`
+
+	// Candidate selects the providers under evaluation
+	Candidate ModelTarget `yaml:"candidate"`
+
+	// LogResponses logs the content of shadow responses at debug level.
+	// Responses may carry user data, so only their length and hash are
+	// logged otherwise.
+	LogResponses bool `yaml:"log_responses,omitempty"`
+}
+
+// Shadow reports whether the candidate only receives copies of requests.
+func (s *TrafficSplit) Shadow() bool {
+	return s.Mode == SplitModeShadow
+}
+
+// validate checks the mode and percentage, and that the candidate matches
+// an entry of the failover chain.
+func (s *TrafficSplit) validate(chain []NamedProvider) error {
+	switch s.Mode {
+	case "", SplitModeSplit, SplitModeShadow:
+	default:
+		return fmt.Errorf("invalid split mode: %s", s.Mode)
+	}
+	if s.Percent < 0 || s.Percent > 100 {
+		return fmt.Errorf("split percent must be between 0 and 100")
+	}
+	if s.Candidate.Provider == "" {
+		return fmt.Errorf("empty split candidate provider")
+	}
+	if !s.Candidate.matchesChain(chain) {
+		return fmt.Errorf("no provider matches split candidate %s", s.Candidate)
+	}
+	return nil
+}
+
+// Experiment returns the traffic split of the route, named after the
+// route's path unless it has a name, or nil when the route has none.
+func (r *RouteConfig) Experiment() *TrafficSplit {
+	if r.Split == nil {
+		return nil
+	}
+	split := *r.Split
+	if split.Name == "" {
+		split.Name = r.Path
+	}
+	return &split
+}
@@ -0,0 +1,117 @@
+package config
+
+import "fmt"
+
+// Provider health check modes
+const (
+	// HealthModeGenerate sends a one-token completion, the default of the
+	// provider types whose models endpoint is unknown
+	HealthModeGenerate = "generate"
+
+	// HealthModeModels lists the provider's models, which costs no tokens,
+	// the default of the provider types whose models endpoint is known
+	HealthModeModels = "models"
+
+	// HealthModePing sends a GET request to a URL
+	HealthModePing = "ping"
+
+	// HealthModePassive sends nothing and judges providers by the error
+	// rate of live traffic
+	HealthModePassive = "passive"
+)
+
+// modelsProviders lists the provider types whose models endpoint is known.
+var modelsProviders = map[string]bool{
+	"openai":    true,
+	"anthropic": true,
+	"ollama":    true,
+	"groq":      true,
+	"mistral":   true,
+}
+
+// HealthProbe overrides how the health of a provider is checked.
+type HealthProbe struct {
+	// Mode is "generate", "models", "ping" or "passive"
+	Mode string `yaml:"mode"`
+
+	// URL is the target of ping checks, or replaces the provider's models
+	// endpoint in models mode (e.g. "http://ollama:11434/api/tags"), which
+	// is otherwise derived from the provider's endpoint
+	URL string `yaml:"url,omitempty"`
+}
+
+// validate checks the mode, and that the URL is set when the mode needs it.
+func (p *HealthProbe) validate(providerType string) error {
+	switch p.Mode {
+	case "", HealthModeGenerate, HealthModePassive:
+	case HealthModePing:
+		if p.URL == "" {
+			return fmt.Errorf("ping health check requires url")
+		}
+	case HealthModeModels:
+		if p.URL == "" && !modelsProviders[providerType] {
+			return fmt.Errorf("models health check requires url for provider type %s", providerType)
+		}
+	default:
+		return fmt.Errorf("invalid health check mode: %s", p.Mode)
+	}
+	return nil
+}
+
+// validate checks the settings of llm.health_check. Its mode applies to
+// every provider, so a ping needs a per-provider url and is not accepted.
+func (hc *ProviderHealthCheck) validate() error {
+	if hc == nil {
+		return nil
+	}
+	if hc.Interval < 0 || hc.Timeout < 0 {
+		return fmt.Errorf("negative health check interval or timeout")
+	}
+	if hc.FailureThreshold < 0 {
+		return fmt.Errorf("negative health check failure threshold")
+	}
+	switch hc.Mode {
+	case "", HealthModeGenerate, HealthModeModels, HealthModePassive:
+		return nil
+	case HealthModePing:
+		return fmt.Errorf("ping health check requires url, set it per provider")
+	default:
+		return fmt.Errorf("invalid health check mode: %s", hc.Mode)
+	}
+}
+
+// HealthProbe returns how the health of the named chain entry is checked:
+// its own health_check in the providers map, which takes the mode of
+// llm.health_check when it sets none. Without either, providers whose
+// models endpoint is known list their models, which costs no tokens, and
+// the others generate.
+func (c *Config) HealthProbe(name string) HealthProbe {
+	var probe HealthProbe
+	if p, ok := c.Providers[name]; ok && p.HealthCheck != nil {
+		probe = *p.HealthCheck
+	}
+	if probe.Mode == "" && c.LLM.HealthCheck != nil {
+		probe.Mode = c.LLM.HealthCheck.Mode
+	}
+	if probe.Mode == "" {
+		probe.Mode = HealthModeGenerate
+		if modelsProviders[c.providerType(name)] {
+			probe.Mode = HealthModeModels
+		}
+	}
+	return probe
+}
+
+// providerType returns the type of the named chain entry, or an empty
+// string when there is none.
+func (c *Config) providerType(name string) string {
+	if p, ok := c.Providers[name]; ok {
+		return p.Type
+	}
+	for _, entry := range c.ProviderChain() {
+		if entry.Name == name {
+			return entry.Type
+		}
+	}
+	return ""
+}
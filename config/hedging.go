@@ -0,0 +1,47 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// HedgingConfig enables hedged requests: when the provider serving a
+// completion has not answered after a delay derived from its recent
+// latencies, the same prompt is sent to the next provider of the chain
+// and the first answer wins. Hedging trades extra spend for a shorter
+// tail latency, so the share of hedged requests is capped by a budget.
+type HedgingConfig struct {
+	// Enabled turns hedging on (default: false)
+	Enabled bool `yaml:"enabled"`
+
+	// Percentile of the provider's recent latencies after which a hedge
+	// is sent, between 50 and 100 (default: 95)
+	Percentile float64 `yaml:"percentile"`
+
+	// Delay is the hedging delay used until enough latencies have been
+	// observed (default: 2s)
+	Delay time.Duration `yaml:"delay"`
+
+	// MinDelay is the shortest hedging delay, whatever the latencies (default: 50ms)
+	MinDelay time.Duration `yaml:"min_delay"`
+
+	// Budget is the maximum percentage of requests that may be hedged (default: 10)
+	Budget float64 `yaml:"budget"`
+}
+
+// validate checks the percentile, delays and budget.
+func (h *HedgingConfig) validate() error {
+	if h == nil || !h.Enabled {
+		return nil
+	}
+	if h.Percentile != 0 && (h.Percentile < 50 || h.Percentile > 100) {
+		return fmt.Errorf("hedging percentile must be between 50 and 100")
+	}
+	if h.Delay < 0 || h.MinDelay < 0 {
+		return fmt.Errorf("negative hedging delay")
+	}
+	if h.Budget < 0 || h.Budget > 100 {
+		return fmt.Errorf("hedging budget must be between 0 and 100")
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// MiddlewareConfig names a route middleware along with its settings. In
+// YAML it is either a name or a mapping of a name to its settings:
+//
+//	middleware:
+//	  - auth
+//	  - timeout: {duration: 30s}
+type MiddlewareConfig struct {
+	// Name identifies the middleware
+	Name string
+
+	// Params are the settings of the middleware, decoded into the
+	// settings registered with its name
+	Params map[string]interface{}
+}
+
+// UnmarshalYAML reads a middleware from a name, or from a mapping of a
+// name to its settings.
+func (m *MiddlewareConfig) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		m.Name = value.Value
+		m.Params = nil
+		return nil
+	case yaml.MappingNode:
+		if len(value.Content) != 2 {
+			return fmt.Errorf("line %d: middleware must map a single name to its settings", value.Line)
+		}
+		m.Name = value.Content[0].Value
+		m.Params = nil
+		return value.Content[1].Decode(&m.Params)
+	default:
+		return fmt.Errorf("line %d: middleware must be a name or a mapping of a name to its settings", value.Line)
+	}
+}
+
+// MarshalYAML writes a middleware without settings as its name.
+func (m MiddlewareConfig) MarshalYAML() (interface{}, error) {
+	if len(m.Params) == 0 {
+		return m.Name, nil
+	}
+	return map[string]interface{}{m.Name: m.Params}, nil
+}
+
+// Settings decodes the settings of the middleware into those registered
+// with its name, and validates them. It fails for unknown names.
+func (m MiddlewareConfig) Settings() (interface{}, error) {
+	middlewareMu.RLock()
+	entry, ok := middlewareRegistry[m.Name]
+	middlewareMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown middleware: %s", m.Name)
+	}
+
+	settings := entry.newSettings()
+	if len(m.Params) > 0 {
+		// Settings go through YAML, so that they decode as in a file
+		data, err := yaml.Marshal(m.Params)
+		if err != nil {
+			return nil, fmt.Errorf("middleware %s: %w", m.Name, err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(settings); err != nil {
+			return nil, fmt.Errorf("middleware %s: invalid settings: %w", m.Name, err)
+		}
+	}
+	if v, ok := settings.(interface{ Validate() error }); ok {
+		if err := v.Validate(); err != nil {
+			return nil, fmt.Errorf("middleware %s: %w", m.Name, err)
+		}
+	}
+	return settings, nil
+}
+
+// Middleware returns middleware without settings for the given names.
+func Middleware(names ...string) []MiddlewareConfig {
+	mws := make([]MiddlewareConfig, len(names))
+	for i, name := range names {
+		mws[i] = MiddlewareConfig{Name: name}
+	}
+	return mws
+}
+
+// middlewareEntry is a route middleware known to configurations.
+type middlewareEntry struct {
+	newSettings func() interface{} // Returns the settings it takes
+	constructor interface{}        // Builds it, nil until the router registers it
+}
+
+var (
+	middlewareMu sync.RWMutex
+
+	// middlewareRegistry holds the route middleware by name. The router
+	// registers the constructors of the built-in names.
+	middlewareRegistry = map[string]middlewareEntry{
+		"auth":       {newSettings: noSettings},
+		"ratelimit":  {newSettings: func() interface{} { return new(RateLimitSettings) }},
+		"rate-limit": {newSettings: func() interface{} { return new(RateLimitSettings) }},
+		"budget":     {newSettings: noSettings},
+		"cors":       {newSettings: func() interface{} { return new(CORSSettings) }},
+		"logging":    {newSettings: noSettings},
+		"timeout":    {newSettings: func() interface{} { return new(TimeoutSettings) }},
+		"body_limit": {newSettings: func() interface{} { return new(BodyLimitSettings) }},
+	}
+)
+
+// noSettings returns the settings of middleware that take none.
+func noSettings() interface{} {
+	return new(struct{})
+}
+
+// RegisterMiddleware makes a route middleware name valid in
+// configurations. newSettings returns a pointer to the struct its
+// settings decode into; settings implementing Validate() error are
+// validated along with the configuration. constructor builds the
+// middleware, and is opaque to this package: it is set and read by the
+// router. Registering a name again replaces its settings and constructor.
+func RegisterMiddleware(name string, newSettings func() interface{}, constructor interface{}) {
+	if newSettings == nil {
+		newSettings = noSettings
+	}
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+	middlewareRegistry[name] = middlewareEntry{newSettings: newSettings, constructor: constructor}
+}
+
+// MiddlewareConstructor returns the constructor registered with the named
+// middleware, or nil when it has none.
+func MiddlewareConstructor(name string) interface{} {
+	middlewareMu.RLock()
+	defer middlewareMu.RUnlock()
+	return middlewareRegistry[name].constructor
+}
+
+// TimeoutSettings configures the timeout middleware.
+type TimeoutSettings struct {
+	// Duration bounds the time to the first byte of the response, and
+	// between the chunks of a stream (default: 5s)
+	Duration time.Duration `yaml:"duration"`
+}
+
+// Validate checks the timeout.
+func (s *TimeoutSettings) Validate() error {
+	if s.Duration < 0 {
+		return fmt.Errorf("negative duration: %v", s.Duration)
+	}
+	return nil
+}
+
+// RateLimitSettings configures the rate limit middleware. Without RPM,
+// the route shares the limits of the rate_limit section, if enabled.
+type RateLimitSettings struct {
+	// RPM is the number of requests allowed per minute
+	RPM int `yaml:"rpm"`
+
+	// Burst is the number of requests that can be made at once
+	// (default: RPM)
+	Burst int `yaml:"burst"`
+
+	// Scope is what requests are counted against: key, tenant, route or
+	// global (default: key)
+	Scope string `yaml:"scope"`
+}
+
+// Validate checks the limit and its scope.
+func (s *RateLimitSettings) Validate() error {
+	if s.RPM < 0 || s.Burst < 0 {
+		return fmt.Errorf("negative limit")
+	}
+	if s.RPM == 0 && (s.Burst > 0 || s.Scope != "") {
+		return fmt.Errorf("rpm must be set")
+	}
+	switch s.Scope {
+	case "", RateLimitScopeKey, RateLimitScopeTenant, RateLimitScopeRoute, RateLimitScopeGlobal:
+		return nil
+	default:
+		return fmt.Errorf("invalid scope %q", s.Scope)
+	}
+}
+
+// BodyLimitSettings configures the body_limit middleware.
+type BodyLimitSettings struct {
+	// Bytes is the largest request body accepted
+	Bytes ByteSize `yaml:"bytes"`
+}
+
+// Validate checks that a limit is set.
+func (s *BodyLimitSettings) Validate() error {
+	if s.Bytes <= 0 {
+		return fmt.Errorf("bytes must be positive")
+	}
+	return nil
+}
+
+// ByteSize is a number of bytes, written in YAML as a number or with a
+// unit: B, KB, MB or GB, each 1024 times the previous one.
+type ByteSize int64
+
+// byteUnits are the units of byte sizes, longest first
+var byteUnits = []struct {
+	suffix string
+	size   ByteSize
+}{
+	{"KB", 1 << 10},
+	{"MB", 1 << 20},
+	{"GB", 1 << 30},
+	{"B", 1},
+}
+
+// UnmarshalYAML reads a byte size, with or without a unit.
+func (b *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	size, err := ParseByteSize(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", value.Line, err)
+	}
+	*b = size
+	return nil
+}
+
+// ParseByteSize parses a byte size such as 1048576, 512KB or 1MB.
+func ParseByteSize(s string) (ByteSize, error) {
+	number := strings.TrimSpace(s)
+	unit := ByteSize(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(strings.ToUpper(number), u.suffix) {
+			number = strings.TrimSpace(number[:len(number)-len(u.suffix)])
+			unit = u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid byte size: %q", s)
+	}
+	return ByteSize(n) * unit, nil
+}
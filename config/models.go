@@ -0,0 +1,69 @@
+package config
+
+import "fmt"
+
+// ModelTarget selects the entries of the failover chain that serve a model
+// alias: the entry named Provider, or every entry of provider type
+// Provider. When Model is set, only entries configured with that model
+// match.
+type ModelTarget struct {
+	// Provider is a chain entry name (e.g. "ollama-1") or a provider type (e.g. "ollama")
+	Provider string `yaml:"provider"`
+
+	// Model restricts the target to entries serving this model (optional)
+	Model string `yaml:"model,omitempty"`
+}
+
+// Matches reports whether the chain entry with the given name, provider
+// type and model is selected by the target.
+func (t ModelTarget) Matches(name, providerType, model string) bool {
+	if t.Provider != name && t.Provider != providerType {
+		return false
+	}
+	return t.Model == "" || t.Model == model
+}
+
+// matchesChain reports whether the target matches an entry of chain.
+func (t ModelTarget) matchesChain(chain []NamedProvider) bool {
+	for _, entry := range chain {
+		if t.Matches(entry.Name, entry.Type, entry.Model) {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the target as provider or provider/model.
+func (t ModelTarget) String() string {
+	if t.Model == "" {
+		return t.Provider
+	}
+	return t.Provider + "/" + t.Model
+}
+
+// ModelRegistry maps the model names clients may request (e.g. "fast",
+// "smart", "gpt-4o") to the providers serving them. Requests naming a
+// model only go to its providers, failing over within that group.
+//
+// When the registry is empty, the requested model is ignored and any
+// provider may serve a request.
+type ModelRegistry map[string][]ModelTarget
+
+// validate checks that every alias has targets and that each target
+// matches an entry of the failover chain.
+func (r ModelRegistry) validate(chain []NamedProvider) error {
+	for alias, targets := range r {
+		if len(targets) == 0 {
+			return fmt.Errorf("no providers for model %s", alias)
+		}
+		for _, t := range targets {
+			if t.Provider == "" {
+				return fmt.Errorf("empty provider for model %s", alias)
+			}
+			if !t.matchesChain(chain) {
+				return fmt.Errorf("model %s: no provider matches %s", alias, t)
+			}
+		}
+	}
+	return nil
+}
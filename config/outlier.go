@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// OutlierDetectionConfig enables the ejection of providers whose live
+// traffic deviates from the other providers': an error rate or a p95
+// latency a given factor above theirs. Ejected providers get no traffic
+// for an ejection time that grows each time they are ejected again.
+type OutlierDetectionConfig struct {
+	// Enabled turns outlier detection on (default: false)
+	Enabled bool `yaml:"enabled"`
+
+	// Interval is the time between evaluations, over whose traffic error
+	// rates and latencies are computed (default: 10s)
+	Interval time.Duration `yaml:"interval"`
+
+	// MinRequests is the number of calls a provider needs in an interval
+	// to be evaluated (default: 10)
+	MinRequests int `yaml:"min_requests"`
+
+	// ErrorRateFactor ejects a provider whose error rate is this many times
+	// the mean of the others', and at least 10% (default: 2)
+	ErrorRateFactor float64 `yaml:"error_rate_factor"`
+
+	// LatencyFactor ejects a provider whose p95 latency is this many times
+	// the mean of the others' (default: 3)
+	LatencyFactor float64 `yaml:"latency_factor"`
+
+	// BaseEjectionTime is the length of a first ejection, multiplied by
+	// the number of consecutive ejections (default: 30s)
+	BaseEjectionTime time.Duration `yaml:"base_ejection_time"`
+
+	// MaxEjectionTime caps the length of an ejection (default: 5m)
+	MaxEjectionTime time.Duration `yaml:"max_ejection_time"`
+
+	// MaxEjectionPercent is the largest share of providers that may be
+	// ejected at once. One provider may always be ejected, but never the
+	// last one (default: 50)
+	MaxEjectionPercent float64 `yaml:"max_ejection_percent"`
+}
+
+// validate checks the factors, durations and ejection percentage.
+func (o *OutlierDetectionConfig) validate() error {
+	if o == nil || !o.Enabled {
+		return nil
+	}
+	if o.Interval < 0 || o.BaseEjectionTime < 0 || o.MaxEjectionTime < 0 {
+		return fmt.Errorf("negative outlier detection duration")
+	}
+	if o.MinRequests < 0 {
+		return fmt.Errorf("negative outlier detection min_requests")
+	}
+	if (o.ErrorRateFactor != 0 && o.ErrorRateFactor <= 1) || (o.LatencyFactor != 0 && o.LatencyFactor <= 1) {
+		return fmt.Errorf("outlier detection factors must be greater than 1")
+	}
+	if o.MaxEjectionPercent < 0 || o.MaxEjectionPercent > 100 {
+		return fmt.Errorf("max_ejection_percent must be between 0 and 100")
+	}
+	return nil
+}
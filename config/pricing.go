@@ -0,0 +1,35 @@
+package config
+
+import "fmt"
+
+// ModelPricing is the price of a model in USD per 1,000 tokens.
+type ModelPricing struct {
+	// Input is the price of 1,000 prompt tokens
+	Input float64 `yaml:"input"`
+
+	// Output is the price of 1,000 completion tokens
+	Output float64 `yaml:"output"`
+}
+
+// PricingTable maps model names (e.g., "gpt-4o", "claude-3-haiku") to
+// their prices. Models missing from the table are treated as free.
+type PricingTable map[string]ModelPricing
+
+// Cost estimates the price in USD of a generation by the given model.
+func (t PricingTable) Cost(model string, promptTokens, completionTokens int) float64 {
+	price, ok := t[model]
+	if !ok {
+		return 0
+	}
+	return (float64(promptTokens)*price.Input + float64(completionTokens)*price.Output) / 1000
+}
+
+// validate checks that no price is negative.
+func (t PricingTable) validate() error {
+	for model, price := range t {
+		if price.Input < 0 || price.Output < 0 {
+			return fmt.Errorf("negative price for model %s", model)
+		}
+	}
+	return nil
+}
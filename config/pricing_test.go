@@ -0,0 +1,24 @@
+package config
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPricingTableCost(t *testing.T) {
+	table := PricingTable{
+		"gpt-4o": {Input: 2.5, Output: 10},
+	}
+
+	if got := table.Cost("gpt-4o", 1000, 500); math.Abs(got-7.5) > 1e-9 {
+		t.Errorf("Cost() = %v, want 7.5", got)
+	}
+	if got := table.Cost("unknown", 1000, 500); got != 0 {
+		t.Errorf("Cost() of an unpriced model = %v, want 0", got)
+	}
+
+	table["bad"] = ModelPricing{Input: -1}
+	if err := table.validate(); err == nil {
+		t.Error("expected an error for a negative price")
+	}
+}
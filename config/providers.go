@@ -0,0 +1,106 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// NamedProvider is a single entry of the failover chain.
+type NamedProvider struct {
+	// Name identifies the entry in provider_preference, metrics and logs
+	Name string
+
+	ProviderConfig
+}
+
+// ProviderChain merges every configured provider into one ordered failover chain:
+// the primary provider of the llm block, its backup_providers, and the
+// providers map.
+//
+// Entries named in ProviderPreference come first, in that order. The rest
+// follow in declaration order: primary, backups, then providers sorted by name.
+//
+// Legacy entries are named after their provider type (e.g. "anthropic"); when
+// two share a type the later one is named "<type>-<model>". An entry of the
+// providers map shadows a legacy entry with the same name.
+func (c *Config) ProviderChain() []NamedProvider {
+	byName := make(map[string]ProviderConfig)
+	var order []string
+
+	add := func(name string, p ProviderConfig) {
+		if _, exists := byName[name]; exists {
+			return
+		}
+		byName[name] = p
+		order = append(order, name)
+	}
+
+	// Explicit providers are registered first so that they shadow legacy
+	// entries, but they are ordered after them below
+	explicit := make([]string, 0, len(c.Providers))
+	for name := range c.Providers {
+		explicit = append(explicit, name)
+	}
+	sort.Strings(explicit)
+	for _, name := range explicit {
+		byName[name] = c.Providers[name]
+	}
+
+	legacyName := func(provider, model string) string {
+		if _, taken := byName[provider]; !taken {
+			return provider
+		}
+		return fmt.Sprintf("%s-%s", provider, model)
+	}
+
+	if c.LLM.Provider != "" {
+		if _, shadowed := c.Providers[c.LLM.Provider]; shadowed {
+			order = append(order, c.LLM.Provider)
+		} else {
+			add(c.LLM.Provider, ProviderConfig{
+				Type:     c.LLM.Provider,
+				Model:    c.LLM.Model,
+				APIKey:   c.LLM.APIKey,
+				Endpoint: c.LLM.Endpoint,
+			})
+		}
+	}
+
+	for _, bp := range c.LLM.BackupProviders {
+		if _, shadowed := c.Providers[bp.Provider]; shadowed {
+			order = append(order, bp.Provider)
+			continue
+		}
+		add(legacyName(bp.Provider, bp.Model), ProviderConfig{
+			Type:  bp.Provider,
+			Model: bp.Model,
+			// The defaults are not passed through Load's expansion,
+			// so placeholders such as ${OPENAI_API_KEY} are resolved here
+			APIKey: os.ExpandEnv(bp.APIKey),
+		})
+	}
+
+	order = append(order, explicit...)
+
+	// Apply the preference order, then keep the remaining entries
+	chain := make([]NamedProvider, 0, len(byName))
+	seen := make(map[string]bool, len(byName))
+	appendEntry := func(name string) {
+		p, ok := byName[name]
+		if !ok || seen[name] {
+			return
+		}
+		seen[name] = true
+		chain = append(chain, NamedProvider{Name: name, ProviderConfig: p})
+	}
+
+	for _, name := range c.ProviderPreference {
+		appendEntry(name)
+	}
+	for _, name := range order {
+		appendEntry(name)
+	}
+
+	return chain
+}
@@ -0,0 +1,126 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// Rate limit scopes, selecting what a policy counts requests against
+const (
+	// RateLimitScopeKey limits each API key separately. Unauthenticated
+	// requests are limited by client address instead.
+	RateLimitScopeKey = "key"
+
+	// RateLimitScopeTenant limits each tenant, across all of its keys.
+	// Requests from keys without a tenant are not limited.
+	RateLimitScopeTenant = "tenant"
+
+	// RateLimitScopeRoute limits each request path
+	RateLimitScopeRoute = "route"
+
+	// RateLimitScopeGlobal shares one limit across all requests
+	RateLimitScopeGlobal = "global"
+)
+
+// RateLimitConfig defines request and token rate limits for the
+// completion endpoints.
+type RateLimitConfig struct {
+	// Enabled turns on rate limiting (default: false)
+	Enabled bool `yaml:"enabled"`
+
+	// IdleTimeout evicts the state of clients that made no request for
+	// this long (default: 10m)
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+
+	// Policies lists the limits to enforce. A request must satisfy every
+	// policy that applies to it. When empty, each client is allowed
+	// 10 requests per minute.
+	Policies []RateLimitPolicy `yaml:"policies,omitempty"`
+}
+
+// RateLimitPolicy limits requests and tokens per window within a scope.
+// Limits are enforced as token buckets: capacity refills continuously at
+// Requests (or Tokens) per Window, and Burst (or TokenBurst) caps how much
+// can be spent at once.
+type RateLimitPolicy struct {
+	// Name identifies the policy in responses (default: the scope, plus
+	// the match value if any)
+	Name string `yaml:"name,omitempty"`
+
+	// Scope is one of "key", "tenant", "route" or "global"
+	Scope string `yaml:"scope"`
+
+	// Match restricts the policy to one key ID, tenant or route path.
+	// Within a scope, matching policies replace those without Match,
+	// which allows giving individual clients their own limits.
+	Match string `yaml:"match,omitempty"`
+
+	// Window is the period over which Requests and Tokens are counted
+	Window time.Duration `yaml:"window"`
+
+	// Requests is the number of requests allowed per window (0: unlimited)
+	Requests int `yaml:"requests,omitempty"`
+
+	// Burst is the number of requests that can be made at once
+	// (default: Requests)
+	Burst int `yaml:"burst,omitempty"`
+
+	// Tokens is the number of prompt and completion tokens allowed per
+	// window (0: unlimited). Tokens are counted once a request completes,
+	// so a request may overshoot; later requests wait until the debt is
+	// paid back.
+	Tokens int `yaml:"tokens,omitempty"`
+
+	// TokenBurst is the number of tokens that can be spent at once
+	// (default: Tokens)
+	TokenBurst int `yaml:"token_burst,omitempty"`
+}
+
+// PolicyName returns the configured name of the policy, or one derived
+// from its scope and match value.
+func (p *RateLimitPolicy) PolicyName() string {
+	switch {
+	case p.Name != "":
+		return p.Name
+	case p.Match != "":
+		return p.Scope + ":" + p.Match
+	default:
+		return p.Scope
+	}
+}
+
+// validate checks the rate limit settings.
+func (c *RateLimitConfig) validate() error {
+	if c.IdleTimeout < 0 {
+		return fmt.Errorf("negative rate limit idle timeout: %v", c.IdleTimeout)
+	}
+
+	names := make(map[string]bool, len(c.Policies))
+	for i, p := range c.Policies {
+		switch p.Scope {
+		case RateLimitScopeKey, RateLimitScopeTenant, RateLimitScopeRoute, RateLimitScopeGlobal:
+		default:
+			return fmt.Errorf("invalid scope %q for rate limit policy %d", p.Scope, i)
+		}
+		if p.Scope == RateLimitScopeGlobal && p.Match != "" {
+			return fmt.Errorf("rate limit policy %d: global scope does not take a match value", i)
+		}
+
+		name := p.PolicyName()
+		if names[name] {
+			return fmt.Errorf("duplicate rate limit policy: %s", name)
+		}
+		names[name] = true
+
+		if p.Window <= 0 {
+			return fmt.Errorf("rate limit policy %s: window must be positive", name)
+		}
+		if p.Requests < 0 || p.Burst < 0 || p.Tokens < 0 || p.TokenBurst < 0 {
+			return fmt.Errorf("rate limit policy %s: negative limit", name)
+		}
+		if p.Requests == 0 && p.Tokens == 0 {
+			return fmt.Errorf("rate limit policy %s: requests or tokens must be set", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package config
+
+import "fmt"
+
+// DefaultRoutingAlias is the model name clients send to have their
+// requests routed by the routing rules.
+const DefaultRoutingAlias = "auto"
+
+// RoutingConfig routes requests to a model according to their content.
+// Rules are evaluated in order and the first match decides; requests
+// matching no rule get the default model.
+//
+// Rules apply to requests that name no model or name the routing alias.
+// Requests naming another model are served by that model.
+type RoutingConfig struct {
+	// Rules are evaluated in declaration order
+	Rules []RoutingRule `yaml:"rules,omitempty"`
+
+	// Default is the model registry alias of requests matching no rule.
+	// When empty, any provider may serve them.
+	Default string `yaml:"default,omitempty"`
+
+	// Alias is the model name that asks for rule-based routing (default: "auto")
+	Alias string `yaml:"alias,omitempty"`
+}
+
+// RoutingRule routes the requests meeting all of its conditions to a
+// model. Conditions left unset match every request.
+type RoutingRule struct {
+	// Name identifies the rule in metrics and logs
+	Name string `yaml:"name"`
+
+	// MinPromptTokens and MaxPromptTokens bound the prompt size, inclusive
+	MinPromptTokens int `yaml:"min_prompt_tokens,omitempty"`
+	MaxPromptTokens int `yaml:"max_prompt_tokens,omitempty"`
+
+	// HasSystem requires a system prompt to be present (true) or absent (false)
+	HasSystem *bool `yaml:"has_system,omitempty"`
+
+	// Types lists the accepted values of the "type" query parameter;
+	// requests without one have type "default"
+	Types []string `yaml:"types,omitempty"`
+
+	// Headers maps header names to their required value; "*" accepts any
+	// non-empty value
+	Headers map[string]string `yaml:"headers,omitempty"`
+
+	// KeyLabels lists the accepted labels of the API key
+	KeyLabels []string `yaml:"key_labels,omitempty"`
+
+	// Tenants lists the accepted tenants of the API key
+	Tenants []string `yaml:"tenants,omitempty"`
+
+	// Model is the alias of the model registry serving matching requests
+	Model string `yaml:"model"`
+}
+
+// RoutingAlias returns the model name that asks for rule-based routing.
+func (r *RoutingConfig) RoutingAlias() string {
+	if r.Alias == "" {
+		return DefaultRoutingAlias
+	}
+	return r.Alias
+}
+
+// validate checks the rules for missing names, duplicates, inconsistent
+// token bounds and models missing from the registry.
+func (r *RoutingConfig) validate(models ModelRegistry) error {
+	if _, ok := models[r.Default]; r.Default != "" && !ok {
+		return fmt.Errorf("unknown default routing model: %s", r.Default)
+	}
+
+	seen := make(map[string]bool)
+	for i, rule := range r.Rules {
+		if rule.Name == "" {
+			return fmt.Errorf("empty name in routing rule %d", i)
+		}
+		if seen[rule.Name] {
+			return fmt.Errorf("duplicate routing rule: %s", rule.Name)
+		}
+		seen[rule.Name] = true
+
+		if _, ok := models[rule.Model]; !ok {
+			return fmt.Errorf("routing rule %s: unknown model %q", rule.Name, rule.Model)
+		}
+		if rule.MinPromptTokens < 0 || rule.MaxPromptTokens < 0 {
+			return fmt.Errorf("routing rule %s: negative token bound", rule.Name)
+		}
+		if rule.MaxPromptTokens > 0 && rule.MinPromptTokens > rule.MaxPromptTokens {
+			return fmt.Errorf("routing rule %s: min_prompt_tokens exceeds max_prompt_tokens", rule.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package config
+
+import "fmt"
+
+// Provider selection strategies decide which entry of the failover chain
+// serves a request. The remaining entries stay failover targets.
+const (
+	// SelectionPriority always prefers the first entry of
+	// provider_preference that is available (default)
+	SelectionPriority = "priority"
+
+	// SelectionWeightedRoundRobin spreads requests across the providers in
+	// proportion to their weight
+	SelectionWeightedRoundRobin = "weighted_round_robin"
+
+	// SelectionLeastLatency prefers the provider with the lowest latency
+	// observed on its last request or health check
+	SelectionLeastLatency = "least_latency"
+
+	// SelectionLeastOutstanding prefers the provider with the fewest
+	// requests in flight
+	SelectionLeastOutstanding = "least_outstanding"
+
+	// SelectionCostAware prefers the provider whose model is cheapest
+	// according to the pricing table. Unpriced models count as free.
+	SelectionCostAware = "cost_aware"
+)
+
+// validSelection checks that strategy names a selection strategy.
+// The empty name selects the default.
+func validSelection(strategy string) error {
+	switch strategy {
+	case "", SelectionPriority, SelectionWeightedRoundRobin, SelectionLeastLatency,
+		SelectionLeastOutstanding, SelectionCostAware:
+		return nil
+	default:
+		return fmt.Errorf("invalid selection strategy: %s", strategy)
+	}
+}
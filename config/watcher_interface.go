@@ -4,5 +4,18 @@ package config
 type Watcher interface {
 	GetCurrentConfig() *Config
 	Subscribe() <-chan *Config
+	// SetApplier has apply take each new configuration before it is
+	// served and reported as loaded. A configuration apply fails is
+	// rejected like an invalid one.
+	SetApplier(apply func(*Config) error)
+	// Reload reloads the configuration on demand, keeping the current
+	// one when the new one is invalid or fails to apply
+	Reload() error
+	// Check validates the configuration a reload would load, without
+	// applying it, and returns its version
+	Check() (string, error)
+	// Status reports the version of the configuration and the outcome of
+	// the last reload
+	Status() ReloadStatus
 	Close() error
 }
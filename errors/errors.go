@@ -80,6 +80,10 @@ const (
 	// RateLimitError represents rate limiting errors
 	RateLimitError ErrorType = "rate_limit_error"
 
+	// BudgetExceededError represents requests rejected because a token or
+	// spend budget is used up for the current period
+	BudgetExceededError ErrorType = "budget_exceeded_error"
+
 	// AuthenticationError represents API key authentication failures
 	AuthenticationError ErrorType = "api_key_error"
 
@@ -93,6 +93,27 @@ func NewRateLimitError(requestID string, retryAfter int) *HapaxError {
 	}
 }
 
+// NewBudgetExceededError creates a budget error with appropriate defaults.
+// Use this when a client has used up a token or spend budget for the
+// current period. Unlike rate limits, budgets only recover when the
+// period ends, which details should report.
+//
+// Example:
+//
+//	err := NewBudgetExceededError("req_123", map[string]interface{}{
+//	    "budget":    "key",
+//	    "resets_at": "2024-02-01T00:00:00Z",
+//	})
+func NewBudgetExceededError(requestID string, details map[string]interface{}) *HapaxError {
+	return &HapaxError{
+		Type:      BudgetExceededError,
+		Message:   "Budget exceeded",
+		Code:      http.StatusTooManyRequests,
+		RequestID: requestID,
+		Details:   details,
+	}
+}
+
 // NewProviderError creates a provider error with appropriate defaults.
 // Use this when the underlying LLM provider encounters an error, such as:
 //   - Provider API errors
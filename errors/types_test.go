@@ -73,3 +73,20 @@ func TestNewRateLimitError(t *testing.T) {
 		t.Errorf("Expected retry_after %v, got %v", retryAfter, err.Details["retry_after"])
 	}
 }
+
+func TestNewBudgetExceededError(t *testing.T) {
+	requestID := "test-budget"
+	details := map[string]interface{}{"budget": "daily-tokens"}
+
+	err := NewBudgetExceededError(requestID, details)
+
+	if err.Type != BudgetExceededError {
+		t.Errorf("Expected error type %v, got %v", BudgetExceededError, err.Type)
+	}
+	if err.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected code %v, got %v", http.StatusTooManyRequests, err.Code)
+	}
+	if err.Details["budget"] != "daily-tokens" {
+		t.Errorf("Expected budget detail, got %v", err.Details["budget"])
+	}
+}
@@ -0,0 +1,125 @@
+// Package cache provides response caching for LLM completions.
+// It stores generated responses keyed by a fingerprint of the normalized
+// prompt, model and generation options so that identical requests can be
+// answered without calling a provider again.
+//
+// Three backends are available, matching config.CacheConfig:
+//   - "memory": an in-process LRU bounded by number of entries
+//   - "file":   a directory of entries bounded by total size in bytes
+//   - "redis":  a Redis server reached over the RESP protocol
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/teilomillet/hapax/config"
+)
+
+// DefaultTTL is used when the cache configuration does not specify a TTL.
+const DefaultTTL = 24 * time.Hour
+
+// Cache stores generated responses keyed by a request fingerprint.
+// Implementations must be safe for concurrent use.
+type Cache interface {
+	// Get returns the value stored under key. The boolean reports whether
+	// a live (non-expired) entry was found.
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+
+	// Set stores value under key for the given TTL.
+	// A zero TTL means the entry never expires.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+
+	// Close releases any resources held by the cache.
+	Close() error
+}
+
+// New creates a cache from configuration and registers its metrics.
+// It returns nil and no error when caching is disabled.
+func New(cfg *config.CacheConfig, registry *prometheus.Registry) (Cache, error) {
+	if cfg == nil || !cfg.Enable {
+		return nil, nil
+	}
+
+	var (
+		backend Cache
+		err     error
+	)
+
+	m := newMetrics(cfg.Type, registry)
+
+	switch cfg.Type {
+	case "memory":
+		backend = NewMemoryCache(int(cfg.MaxSize))
+	case "file":
+		backend, err = NewFileCache(cfg.Dir, cfg.MaxSize)
+	case "redis":
+		if cfg.Redis == nil {
+			return nil, fmt.Errorf("redis configuration required when cache type is 'redis'")
+		}
+		backend = NewRedisCache(RedisOptions{
+			Address:  cfg.Redis.Address,
+			Password: cfg.Redis.Password,
+			DB:       cfg.Redis.DB,
+		})
+	default:
+		return nil, fmt.Errorf("invalid cache type: %q", cfg.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s cache: %w", cfg.Type, err)
+	}
+
+	if e, ok := backend.(evictionNotifier); ok {
+		e.setOnEvict(m.evictions.Inc)
+	}
+
+	return &instrumented{backend: backend, metrics: m}, nil
+}
+
+// TTL returns the configured entry lifetime, falling back to DefaultTTL.
+func TTL(cfg *config.CacheConfig) time.Duration {
+	if cfg == nil || cfg.TTL <= 0 {
+		return DefaultTTL
+	}
+	return cfg.TTL
+}
+
+// evictionNotifier is implemented by backends that evict entries themselves
+// (as opposed to Redis, which evicts on the server side).
+type evictionNotifier interface {
+	setOnEvict(fn func())
+}
+
+// instrumented wraps a backend and records hit and miss metrics.
+type instrumented struct {
+	backend Cache
+	metrics *metrics
+}
+
+func (c *instrumented) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, ok, err := c.backend.Get(ctx, key)
+	if err != nil {
+		c.metrics.errors.Inc()
+		return nil, false, err
+	}
+	if ok {
+		c.metrics.hits.Inc()
+	} else {
+		c.metrics.misses.Inc()
+	}
+	return value, ok, nil
+}
+
+func (c *instrumented) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := c.backend.Set(ctx, key, value, ttl); err != nil {
+		c.metrics.errors.Inc()
+		return err
+	}
+	return nil
+}
+
+func (c *instrumented) Close() error {
+	return c.backend.Close()
+}
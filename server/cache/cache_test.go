@@ -0,0 +1,236 @@
+package cache_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/server/cache"
+)
+
+func TestMemoryCache(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("evicts least recently used", func(t *testing.T) {
+		c := cache.NewMemoryCache(2)
+		require.NoError(t, c.Set(ctx, "a", []byte("1"), 0))
+		require.NoError(t, c.Set(ctx, "b", []byte("2"), 0))
+
+		// Touch "a" so that "b" becomes the eviction candidate
+		_, ok, _ := c.Get(ctx, "a")
+		require.True(t, ok)
+
+		require.NoError(t, c.Set(ctx, "c", []byte("3"), 0))
+		assert.Equal(t, 2, c.Len())
+
+		_, ok, _ = c.Get(ctx, "b")
+		assert.False(t, ok, "least recently used entry should be evicted")
+		v, ok, _ := c.Get(ctx, "a")
+		assert.True(t, ok)
+		assert.Equal(t, []byte("1"), v)
+	})
+
+	t.Run("expires entries", func(t *testing.T) {
+		c := cache.NewMemoryCache(10)
+		require.NoError(t, c.Set(ctx, "a", []byte("1"), 10*time.Millisecond))
+		time.Sleep(20 * time.Millisecond)
+		_, ok, _ := c.Get(ctx, "a")
+		assert.False(t, ok)
+	})
+}
+
+func TestFileCache(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	c, err := cache.NewFileCache(dir, 400)
+	require.NoError(t, err)
+
+	value := []byte(strings.Repeat("x", 100))
+	for i := 0; i < 5; i++ {
+		require.NoError(t, c.Set(ctx, fmt.Sprintf("key-%d", i), value, time.Hour))
+	}
+	assert.LessOrEqual(t, c.Size(), int64(400), "directory must stay within its size bound")
+
+	_, ok, err := c.Get(ctx, "key-0")
+	require.NoError(t, err)
+	assert.False(t, ok, "oldest entry should be evicted")
+
+	got, ok, err := c.Get(ctx, "key-4")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, value, got)
+
+	// Entries survive a restart
+	reopened, err := cache.NewFileCache(dir, 400)
+	require.NoError(t, err)
+	got, ok, err = reopened.Get(ctx, "key-4")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, value, got)
+}
+
+func TestRedisCache(t *testing.T) {
+	ctx := context.Background()
+	addr := startRedisStandIn(t, "secret")
+
+	c := cache.NewRedisCache(cache.RedisOptions{Address: addr, Password: "secret", DB: 1})
+	defer c.Close()
+
+	_, ok, err := c.Get(ctx, "missing")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, c.Set(ctx, "key", []byte("value\r\nwith newline"), time.Minute))
+	got, ok, err := c.Get(ctx, "key")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, []byte("value\r\nwith newline"), got)
+
+	bad := cache.NewRedisCache(cache.RedisOptions{Address: addr, Password: "wrong"})
+	defer bad.Close()
+	_, _, err = bad.Get(ctx, "key")
+	assert.Error(t, err)
+}
+
+func TestNewRecordsMetrics(t *testing.T) {
+	ctx := context.Background()
+	registry := prometheus.NewRegistry()
+
+	c, err := cache.New(&config.CacheConfig{
+		Enable:  true,
+		Type:    "memory",
+		MaxSize: 1,
+	}, registry)
+	require.NoError(t, err)
+
+	_, _, _ = c.Get(ctx, "a")
+	require.NoError(t, c.Set(ctx, "a", []byte("1"), time.Minute))
+	_, _, _ = c.Get(ctx, "a")
+	require.NoError(t, c.Set(ctx, "b", []byte("2"), time.Minute))
+
+	expected := `
+# HELP hapax_cache_evictions_total Number of cache entries evicted to respect size limits
+# TYPE hapax_cache_evictions_total counter
+hapax_cache_evictions_total{backend="memory"} 1
+# HELP hapax_cache_hits_total Number of completion requests served from the cache
+# TYPE hapax_cache_hits_total counter
+hapax_cache_hits_total{backend="memory"} 1
+# HELP hapax_cache_misses_total Number of completion requests not found in the cache
+# TYPE hapax_cache_misses_total counter
+hapax_cache_misses_total{backend="memory"} 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"hapax_cache_hits_total", "hapax_cache_misses_total", "hapax_cache_evictions_total"))
+
+	disabled, err := cache.New(&config.CacheConfig{Enable: false}, registry)
+	require.NoError(t, err)
+	assert.Nil(t, disabled)
+}
+
+// startRedisStandIn runs a tiny RESP server that understands AUTH, SELECT,
+// GET and SET, which is all the cache backend needs.
+func startRedisStandIn(t *testing.T, password string) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	var mu sync.Mutex
+	data := make(map[string]string)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				rd := bufio.NewReader(conn)
+				authed := password == ""
+				for {
+					args, err := readCommand(rd)
+					if err != nil {
+						return
+					}
+					cmd := strings.ToUpper(args[0])
+					if cmd != "AUTH" && !authed {
+						fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+						continue
+					}
+					switch cmd {
+					case "AUTH":
+						if args[1] != password {
+							fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+							continue
+						}
+						authed = true
+						fmt.Fprint(conn, "+OK\r\n")
+					case "SELECT":
+						fmt.Fprint(conn, "+OK\r\n")
+					case "SET":
+						mu.Lock()
+						data[args[1]] = args[2]
+						mu.Unlock()
+						fmt.Fprint(conn, "+OK\r\n")
+					case "GET":
+						mu.Lock()
+						v, ok := data[args[1]]
+						mu.Unlock()
+						if !ok {
+							fmt.Fprint(conn, "$-1\r\n")
+							continue
+						}
+						fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+					default:
+						fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", cmd)
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
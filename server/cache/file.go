@@ -0,0 +1,239 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxBytes bounds the file cache when no MaxSize is configured.
+const DefaultMaxBytes = 100 * 1024 * 1024 // 100MB
+
+// fileSuffix marks files owned by the file cache inside its directory.
+const fileSuffix = ".cache"
+
+// FileCache persists entries as individual files in a directory.
+// The total size of the directory is bounded; the least recently used
+// entries are removed first when the limit is exceeded.
+type FileCache struct {
+	mu        sync.Mutex
+	dir       string
+	maxBytes  int64
+	totalSize int64
+	index     map[string]*fileEntry // File name to entry metadata
+	onEvict   func()
+}
+
+// fileEntry tracks the on-disk size and last access of a cached file.
+type fileEntry struct {
+	name       string
+	size       int64
+	lastAccess time.Time
+}
+
+// fileRecord is the JSON document written for each entry.
+type fileRecord struct {
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+	Value     []byte    `json:"value"`
+}
+
+// NewFileCache creates a file cache rooted at dir, creating the directory
+// if needed. Existing entries are indexed so the size bound holds across
+// restarts. A non-positive maxBytes uses DefaultMaxBytes.
+func NewFileCache(dir string, maxBytes int64) (*FileCache, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("directory path required for file cache")
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("create cache directory: %w", err)
+	}
+
+	c := &FileCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		index:    make(map[string]*fileEntry),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read cache directory: %w", err)
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), fileSuffix) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		c.index[e.Name()] = &fileEntry{
+			name:       e.Name(),
+			size:       info.Size(),
+			lastAccess: info.ModTime(),
+		}
+		c.totalSize += info.Size()
+	}
+
+	c.mu.Lock()
+	c.evictLocked()
+	c.mu.Unlock()
+
+	return c, nil
+}
+
+// Get reads the entry for key from disk.
+func (c *FileCache) Get(_ context.Context, key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name := fileName(key)
+	entry, ok := c.index[name]
+	if !ok {
+		return nil, false, nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(c.dir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			c.forgetLocked(entry)
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("read cache entry: %w", err)
+	}
+
+	var rec fileRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		// A corrupt entry is treated as a miss and removed
+		c.removeLocked(entry)
+		return nil, false, nil
+	}
+
+	if !rec.ExpiresAt.IsZero() && time.Now().After(rec.ExpiresAt) {
+		c.removeLocked(entry)
+		return nil, false, nil
+	}
+
+	entry.lastAccess = time.Now()
+	return rec.Value, true, nil
+}
+
+// Set writes the entry for key to disk and evicts old entries if the
+// directory grows beyond its size limit.
+func (c *FileCache) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	rec := fileRecord{Value: value}
+	if ttl > 0 {
+		rec.ExpiresAt = time.Now().Add(ttl)
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("encode cache entry: %w", err)
+	}
+	if int64(len(data)) > c.maxBytes {
+		// The entry alone exceeds the budget; caching it would evict everything
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name := fileName(key)
+	path := filepath.Join(c.dir, name)
+
+	// Write to a temporary file first so readers never see partial entries
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("write cache entry: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write cache entry: %w", err)
+	}
+
+	if old, ok := c.index[name]; ok {
+		c.totalSize -= old.size
+	}
+	c.index[name] = &fileEntry{
+		name:       name,
+		size:       int64(len(data)),
+		lastAccess: time.Now(),
+	}
+	c.totalSize += int64(len(data))
+
+	c.evictLocked()
+	return nil
+}
+
+// Size returns the total number of bytes held on disk.
+func (c *FileCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.totalSize
+}
+
+// Close is a no-op for the file cache; entries stay on disk.
+func (c *FileCache) Close() error {
+	return nil
+}
+
+// evictLocked removes least recently used entries until the cache fits
+// within maxBytes. The caller must hold c.mu.
+func (c *FileCache) evictLocked() {
+	if c.totalSize <= c.maxBytes {
+		return
+	}
+
+	entries := make([]*fileEntry, 0, len(c.index))
+	for _, e := range c.index {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastAccess.Before(entries[j].lastAccess)
+	})
+
+	for _, e := range entries {
+		if c.totalSize <= c.maxBytes {
+			break
+		}
+		c.removeLocked(e)
+		if c.onEvict != nil {
+			c.onEvict()
+		}
+	}
+}
+
+// removeLocked deletes an entry from disk and from the index.
+func (c *FileCache) removeLocked(e *fileEntry) {
+	os.Remove(filepath.Join(c.dir, e.name))
+	c.forgetLocked(e)
+}
+
+// forgetLocked drops an entry from the index without touching the disk.
+func (c *FileCache) forgetLocked(e *fileEntry) {
+	if _, ok := c.index[e.name]; ok {
+		delete(c.index, e.name)
+		c.totalSize -= e.size
+	}
+}
+
+func (c *FileCache) setOnEvict(fn func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onEvict = fn
+}
+
+// fileName maps a cache key to a safe file name.
+func fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]) + fileSuffix
+}
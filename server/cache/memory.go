@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultMaxEntries bounds the memory cache when no MaxSize is configured.
+const DefaultMaxEntries = 10000
+
+// MemoryCache is an in-process LRU cache bounded by number of entries.
+// Entries are cleared on restart.
+type MemoryCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ll         *list.List               // Front is most recently used
+	items      map[string]*list.Element // Key to list element
+	onEvict    func()
+}
+
+// memoryEntry is the value stored in each list element.
+type memoryEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time // Zero means no expiry
+}
+
+// NewMemoryCache creates an LRU cache holding at most maxEntries entries.
+// A non-positive maxEntries uses DefaultMaxEntries.
+func NewMemoryCache(maxEntries int) *MemoryCache {
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxEntries
+	}
+	return &MemoryCache{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+// Get returns the value for key and marks it as recently used.
+func (c *MemoryCache) Get(_ context.Context, key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false, nil
+	}
+
+	entry := el.Value.(*memoryEntry)
+	if !entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt) {
+		c.removeElement(el)
+		return nil, false, nil
+	}
+
+	c.ll.MoveToFront(el)
+	return entry.value, true, nil
+}
+
+// Set stores value under key, evicting the least recently used entries
+// when the cache is full.
+func (c *MemoryCache) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*memoryEntry)
+		entry.value = value
+		entry.expiresAt = expiresAt
+		c.ll.MoveToFront(el)
+		return nil
+	}
+
+	c.items[key] = c.ll.PushFront(&memoryEntry{
+		key:       key,
+		value:     value,
+		expiresAt: expiresAt,
+	})
+
+	for c.ll.Len() > c.maxEntries {
+		c.removeElement(c.ll.Back())
+		if c.onEvict != nil {
+			c.onEvict()
+		}
+	}
+
+	return nil
+}
+
+// Len returns the number of entries currently held.
+func (c *MemoryCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// Close is a no-op for the memory cache.
+func (c *MemoryCache) Close() error {
+	return nil
+}
+
+func (c *MemoryCache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*memoryEntry).key)
+}
+
+func (c *MemoryCache) setOnEvict(fn func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onEvict = fn
+}
@@ -0,0 +1,49 @@
+package cache
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// metrics holds the Prometheus counters for a cache backend.
+type metrics struct {
+	hits      prometheus.Counter
+	misses    prometheus.Counter
+	evictions prometheus.Counter
+	errors    prometheus.Counter
+}
+
+// newMetrics creates the cache counters labelled with the backend type
+// and registers them when a registry is provided.
+func newMetrics(backend string, registry *prometheus.Registry) *metrics {
+	labels := prometheus.Labels{"backend": backend}
+
+	m := &metrics{
+		hits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "hapax_cache_hits_total",
+			Help:        "Number of completion requests served from the cache",
+			ConstLabels: labels,
+		}),
+		misses: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "hapax_cache_misses_total",
+			Help:        "Number of completion requests not found in the cache",
+			ConstLabels: labels,
+		}),
+		evictions: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "hapax_cache_evictions_total",
+			Help:        "Number of cache entries evicted to respect size limits",
+			ConstLabels: labels,
+		}),
+		errors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "hapax_cache_errors_total",
+			Help:        "Number of failed cache operations",
+			ConstLabels: labels,
+		}),
+	}
+
+	if registry != nil {
+		registry.MustRegister(m.hits)
+		registry.MustRegister(m.misses)
+		registry.MustRegister(m.evictions)
+		registry.MustRegister(m.errors)
+	}
+
+	return m
+}
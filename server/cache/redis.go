@@ -0,0 +1,223 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// redisKeyPrefix namespaces Hapax entries inside a shared Redis database.
+const redisKeyPrefix = "hapax:cache:"
+
+// defaultRedisTimeout bounds dialing and each command round trip.
+const defaultRedisTimeout = 2 * time.Second
+
+// RedisOptions configures the Redis cache backend.
+type RedisOptions struct {
+	// Address is the Redis server address (e.g., "localhost:6379")
+	Address string
+
+	// Password for Redis authentication (optional)
+	Password string
+
+	// DB is the Redis database number to use
+	DB int
+
+	// Timeout bounds dialing and each command (default: 2s)
+	Timeout time.Duration
+}
+
+// RedisCache stores entries in Redis using a minimal RESP client.
+// A single connection is shared and re-established after any error.
+// Eviction is left to the Redis server's maxmemory policy.
+type RedisCache struct {
+	opts RedisOptions
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// NewRedisCache creates a Redis-backed cache. The connection is opened
+// lazily on first use so that a temporarily unavailable Redis does not
+// prevent the server from starting.
+func NewRedisCache(opts RedisOptions) *RedisCache {
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultRedisTimeout
+	}
+	return &RedisCache{opts: opts}
+}
+
+// Get fetches the entry for key.
+func (c *RedisCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	reply, err := c.do(ctx, "GET", redisKeyPrefix+key)
+	if err != nil {
+		return nil, false, err
+	}
+	if reply == nil {
+		return nil, false, nil
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("redis: unexpected reply type %T for GET", reply)
+	}
+	return value, true, nil
+}
+
+// Set stores the entry for key with a millisecond expiry.
+func (c *RedisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	args := []string{"SET", redisKeyPrefix + key, string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	_, err := c.do(ctx, args...)
+	return err
+}
+
+// Close closes the underlying connection, if any.
+func (c *RedisCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.resetLocked()
+}
+
+// do sends a command and reads its reply, reconnecting as needed.
+func (c *RedisCache) do(ctx context.Context, args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		if err := c.connectLocked(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := c.roundTripLocked(ctx, args...)
+	if err != nil {
+		// Drop the connection so the next call starts from a clean state
+		_ = c.resetLocked()
+		return nil, err
+	}
+	return reply, nil
+}
+
+// connectLocked dials the server and performs AUTH and SELECT.
+func (c *RedisCache) connectLocked(ctx context.Context) error {
+	dialer := net.Dialer{Timeout: c.opts.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.opts.Address)
+	if err != nil {
+		return fmt.Errorf("redis: dial %s: %w", c.opts.Address, err)
+	}
+	c.conn = conn
+	c.rd = bufio.NewReader(conn)
+
+	if c.opts.Password != "" {
+		if _, err := c.roundTripLocked(ctx, "AUTH", c.opts.Password); err != nil {
+			_ = c.resetLocked()
+			return fmt.Errorf("redis: auth: %w", err)
+		}
+	}
+	if c.opts.DB != 0 {
+		if _, err := c.roundTripLocked(ctx, "SELECT", strconv.Itoa(c.opts.DB)); err != nil {
+			_ = c.resetLocked()
+			return fmt.Errorf("redis: select db %d: %w", c.opts.DB, err)
+		}
+	}
+	return nil
+}
+
+func (c *RedisCache) resetLocked() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	c.rd = nil
+	return err
+}
+
+// roundTripLocked writes a command as a RESP array and reads one reply.
+func (c *RedisCache) roundTripLocked(ctx context.Context, args ...string) (interface{}, error) {
+	deadline := time.Now().Add(c.opts.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, fmt.Errorf("redis: write: %w", err)
+	}
+
+	return readReply(c.rd)
+}
+
+// redisError is an error reply sent by the server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// readReply parses a single RESP reply. Bulk strings are returned as
+// []byte, a null bulk string as nil, integers as int64 and simple
+// strings as string.
+func readReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := readLine(rd)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid bulk length: %w", err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return nil, fmt.Errorf("redis: read bulk: %w", err)
+		}
+		return data[:n], nil
+	default:
+		return nil, fmt.Errorf("redis: unsupported reply type %q", line[0])
+	}
+}
+
+func readLine(rd *bufio.Reader) (string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("redis: read: %w", err)
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis: malformed reply line")
+	}
+	return line[:len(line)-2], nil
+}
@@ -5,6 +5,7 @@ package circuitbreaker
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -24,6 +25,14 @@ type Config struct {
 	Timeout time.Duration
 	// FailureThreshold is the number of consecutive failures required to trip the circuit breaker.
 	FailureThreshold uint32
+	// ErrorRate is the share of failed requests within the Interval, between 0 and 1,
+	// that trips the circuit breaker. Zero disables tripping on the error rate.
+	ErrorRate float64
+	// MinRequests is the number of requests within the Interval needed before ErrorRate applies.
+	MinRequests uint32
+	// IsExcluded reports the errors that do not count as failures, such as those
+	// caused by the request rather than the service. Optional.
+	IsExcluded func(error) bool
 	// TestMode indicates whether the circuit breaker is running in test mode.
 	TestMode bool
 }
@@ -36,8 +45,14 @@ type CircuitBreaker struct {
 	logger *zap.Logger
 	// metrics holds Prometheus metrics for the circuit breaker.
 	metrics *metrics
+	// mu protects config, breaker and forced, which Reconfigure, Force and Release replace.
+	mu sync.RWMutex
+	// config holds the current settings of the circuit breaker.
+	config Config
 	// breaker is the underlying gobreaker instance.
 	breaker *gobreaker.CircuitBreaker
+	// forced holds the state set by Force, nil while the circuit breaker trips on its own.
+	forced *gobreaker.State
 }
 
 // metrics holds Prometheus metrics for the circuit breaker.
@@ -100,9 +115,35 @@ func initCircuitBreaker(config Config, logger *zap.Logger, registry *prometheus.
 	return cb, nil
 }
 
+// settings returns the current settings of the circuit breaker.
+func (cb *CircuitBreaker) settings() Config {
+	cb.mu.RLock()
+	defer cb.mu.RUnlock()
+	return cb.config
+}
+
+// shouldTrip reports whether counts reach the consecutive failure threshold
+// or, once there are enough requests, the error rate.
+func (config Config) shouldTrip(counts gobreaker.Counts) bool {
+	if counts.ConsecutiveFailures >= config.FailureThreshold {
+		return true
+	}
+	return config.ErrorRate > 0 &&
+		counts.Requests >= config.MinRequests &&
+		float64(counts.TotalFailures) >= config.ErrorRate*float64(counts.Requests)
+}
+
+// excluded reports whether err does not count as a failure.
+func (config Config) excluded(err error) bool {
+	return config.IsExcluded != nil && config.IsExcluded(err)
+}
+
 // configureCircuitBreaker sets the configuration settings for the CircuitBreaker instance.
 // It configures the gobreaker settings, including the trip conditions and state change handlers.
+// Trip conditions are read from the current settings, so that Reconfigure can change them.
 func configureCircuitBreaker(cb *CircuitBreaker, config Config, logger *zap.Logger) {
+	cb.config = config
+
 	// Create a new gobreaker settings instance.
 	settings := gobreaker.Settings{
 		Name:        config.Name,
@@ -110,20 +151,29 @@ func configureCircuitBreaker(cb *CircuitBreaker, config Config, logger *zap.Logg
 		Interval:    config.Interval,
 		Timeout:     config.Timeout,
 
-		// ReadyToTrip determines if the circuit breaker should trip based on consecutive failures.
+		// ReadyToTrip determines if the circuit breaker should trip based on
+		// consecutive failures or the error rate.
 		ReadyToTrip: func(counts gobreaker.Counts) bool {
-			// Check if the number of consecutive failures exceeds the threshold.
-			shouldTrip := counts.ConsecutiveFailures >= config.FailureThreshold
+			current := cb.settings()
+			shouldTrip := current.shouldTrip(counts)
 			if shouldTrip {
 				// Log a message when the circuit breaker trips.
 				logger.Info("Circuit breaker tripping",
-					zap.String("name", config.Name),
+					zap.String("name", current.Name),
 					zap.Uint32("consecutive_failures", counts.ConsecutiveFailures),
-					zap.Uint32("threshold", config.FailureThreshold))
+					zap.Uint32("total_failures", counts.TotalFailures),
+					zap.Uint32("requests", counts.Requests),
+					zap.Uint32("threshold", current.FailureThreshold),
+					zap.Float64("error_rate", current.ErrorRate))
 			}
 			return shouldTrip
 		},
 
+		// IsSuccessful counts excluded errors as successes.
+		IsSuccessful: func(err error) bool {
+			return err == nil || cb.settings().excluded(err)
+		},
+
 		// OnStateChange handles actions to take when the circuit breaker state changes.
 		OnStateChange: func(name string, from, to gobreaker.State) {
 			// Log a message when the circuit breaker state changes.
@@ -166,24 +216,148 @@ func NewCircuitBreaker(config Config, logger *zap.Logger, registry *prometheus.R
 	return cb, nil
 }
 
+// Reconfigure applies new settings to the circuit breaker. Trip conditions
+// and excluded errors change in place. A change of MaxRequests, Interval or
+// Timeout replaces the underlying breaker, which starts over closed.
+// The name of the circuit breaker is kept.
+func (cb *CircuitBreaker) Reconfigure(config Config) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	config.Name = cb.name
+	previous := cb.config
+	if config.MaxRequests == previous.MaxRequests &&
+		config.Interval == previous.Interval &&
+		config.Timeout == previous.Timeout {
+		cb.config = config
+		return
+	}
+
+	// Log a message when the state of the circuit breaker is reset.
+	cb.logger.Info("Circuit breaker reset to apply new settings",
+		zap.String("name", cb.name),
+		zap.String("state", cb.breaker.State().String()))
+	configureCircuitBreaker(cb, config, cb.logger)
+	if cb.metrics != nil && cb.forced == nil {
+		cb.metrics.stateGauge.Set(0)
+	}
+}
+
+// Force holds the circuit breaker in state, open or closed, until Release.
+// A circuit breaker forced open rejects every request, while one forced
+// closed lets every request through without counting it.
+func (cb *CircuitBreaker) Force(state gobreaker.State) error {
+	if state != gobreaker.StateOpen && state != gobreaker.StateClosed {
+		return fmt.Errorf("circuit breaker can only be forced open or closed, not %s", state)
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.forced = &state
+	// Log a message when the state of the circuit breaker is forced.
+	cb.logger.Info("Circuit breaker forced",
+		zap.String("name", cb.name),
+		zap.String("state", state.String()))
+	if cb.metrics != nil {
+		if state == gobreaker.StateOpen {
+			cb.metrics.stateGauge.Set(2)
+		} else {
+			cb.metrics.stateGauge.Set(0)
+		}
+	}
+	return nil
+}
+
+// Release lets the circuit breaker trip on its own again after Force.
+// It starts over closed, with no counts.
+func (cb *CircuitBreaker) Release() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.forced == nil {
+		return
+	}
+	cb.forced = nil
+	// Log a message when the circuit breaker is released.
+	cb.logger.Info("Circuit breaker released",
+		zap.String("name", cb.name))
+	configureCircuitBreaker(cb, cb.config, cb.logger)
+	if cb.metrics != nil {
+		cb.metrics.stateGauge.Set(0)
+	}
+}
+
+// Reset starts the circuit breaker over closed, with no counts. A state
+// set by Force is kept.
+func (cb *CircuitBreaker) Reset() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.logger.Info("Circuit breaker reset",
+		zap.String("name", cb.name),
+		zap.String("state", cb.breaker.State().String()))
+	configureCircuitBreaker(cb, cb.config, cb.logger)
+	if cb.metrics != nil && cb.forced == nil {
+		cb.metrics.stateGauge.Set(0)
+	}
+}
+
+// Forced reports whether the state of the circuit breaker is forced.
+func (cb *CircuitBreaker) Forced() bool {
+	_, forced := cb.forcedState()
+	return forced
+}
+
+// forcedState returns the state set by Force, if any.
+func (cb *CircuitBreaker) forcedState() (gobreaker.State, bool) {
+	cb.mu.RLock()
+	defer cb.mu.RUnlock()
+	if cb.forced == nil {
+		return gobreaker.StateClosed, false
+	}
+	return *cb.forced, true
+}
+
+// current returns the underlying gobreaker instance.
+func (cb *CircuitBreaker) current() *gobreaker.CircuitBreaker {
+	cb.mu.RLock()
+	defer cb.mu.RUnlock()
+	return cb.breaker
+}
+
 // Execute executes a function within the circuit breaker.
 // It returns any error that occurred during execution.
 func (cb *CircuitBreaker) Execute(operation func() error) error {
-	// Execute the function within the circuit breaker.
-	result, err := cb.breaker.Execute(func() (interface{}, error) {
+	run := func() error {
 		// Call the operation function.
 		if err := operation(); err != nil {
 			// Increment the failure count if the operation fails.
-			if cb.metrics != nil {
+			if cb.metrics != nil && !cb.settings().excluded(err) {
 				cb.metrics.failureCount.Inc()
 			}
 			// Log a message when the operation fails.
 			cb.logger.Debug("Operation failed",
 				zap.String("name", cb.name),
 				zap.Error(err))
-			return nil, err
+			return err
+		}
+		return nil
+	}
+
+	// A forced state bypasses the underlying breaker.
+	if state, forced := cb.forcedState(); forced {
+		if state == gobreaker.StateClosed {
+			return run()
 		}
-		return nil, nil
+		cb.logger.Debug("Circuit breaker is forced open",
+			zap.String("name", cb.name))
+		return gobreaker.ErrOpenState
+	}
+
+	// Execute the function within the circuit breaker.
+	result, err := cb.current().Execute(func() (interface{}, error) {
+		return nil, run()
 	})
 
 	// Check if the circuit breaker is open.
@@ -201,12 +375,15 @@ func (cb *CircuitBreaker) Execute(operation func() error) error {
 	return nil
 }
 
-// State returns the current state of the circuit breaker.
+// State returns the current state of the circuit breaker, forced or not.
 func (cb *CircuitBreaker) State() gobreaker.State {
-	return cb.breaker.State()
+	if state, forced := cb.forcedState(); forced {
+		return state
+	}
+	return cb.current().State()
 }
 
 // Counts returns the current counts of the circuit breaker.
 func (cb *CircuitBreaker) Counts() gobreaker.Counts {
-	return cb.breaker.Counts()
+	return cb.current().Counts()
 }
@@ -0,0 +1,300 @@
+package handlers
+
+import (
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sony/gobreaker"
+	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/errors"
+	"github.com/teilomillet/hapax/server/middleware"
+	"github.com/teilomillet/hapax/server/provider"
+	"go.uber.org/zap"
+)
+
+// UsageResponse lists the consumption of each subject against each budget
+// during the current period.
+type UsageResponse struct {
+	Usage []middleware.BudgetUsage `json:"usage"`
+}
+
+// UsageHandler reports budget consumption to administrators.
+type UsageHandler struct {
+	budgets *middleware.Budgets
+	logger  *zap.Logger
+}
+
+// NewUsageHandler creates a handler reporting the consumption tracked by
+// budgets. When budgets are disabled (nil), it reports no usage.
+func NewUsageHandler(budgets *middleware.Budgets, logger *zap.Logger) *UsageHandler {
+	return &UsageHandler{budgets: budgets, logger: logger}
+}
+
+// ServeHTTP answers GET /admin/usage. The optional "budget" and "subject"
+// query parameters restrict the report to one budget or one key, tenant
+// or client address.
+func (h *UsageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	budget := r.URL.Query().Get("budget")
+	subject := r.URL.Query().Get("subject")
+
+	resp := UsageResponse{Usage: []middleware.BudgetUsage{}}
+	if h.budgets != nil {
+		for _, u := range h.budgets.Usage() {
+			if (budget != "" && u.Budget != budget) || (subject != "" && u.Subject != subject) {
+				continue
+			}
+			resp.Usage = append(resp.Usage, u)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		h.logger.Error("Failed to encode usage response",
+			zap.String("key_id", middleware.KeyID(r.Context())),
+			zap.Error(err))
+		errors.ErrorWithType(w, "Failed to encode response", errors.InternalError, http.StatusInternalServerError)
+	}
+}
+
+// ProvidersResponse lists the state of each provider, in order of preference.
+type ProvidersResponse struct {
+	Providers []provider.ProviderState `json:"providers"`
+}
+
+// ModeRequest sets the mode of a provider: active, draining or disabled.
+type ModeRequest struct {
+	Mode provider.ProviderMode `json:"mode"`
+}
+
+// BreakerRequest forces the circuit breaker of a provider open or closed,
+// or lets it trip on its own again with "auto".
+type BreakerRequest struct {
+	State string `json:"state"`
+}
+
+// PreferenceRequest reorders the failover chain.
+type PreferenceRequest struct {
+	Preference []string `json:"preference"`
+}
+
+// ProvidersHandler lets administrators inspect and control the providers
+// of the provider manager. Every change is logged to the "audit" logger
+// with the key that made it. Modes and forced breakers survive
+// configuration reloads, while a reload resets the preference.
+type ProvidersHandler struct {
+	manager *provider.Manager
+	logger  *zap.Logger
+	audit   *zap.Logger
+}
+
+// NewProvidersHandler creates a handler controlling the providers of
+// manager. When the manager failed to initialize (nil), every request is
+// answered with 503 Service Unavailable.
+func NewProvidersHandler(manager *provider.Manager, logger *zap.Logger) *ProvidersHandler {
+	return &ProvidersHandler{manager: manager, logger: logger, audit: logger.Named("audit")}
+}
+
+// List answers GET /admin/providers with the health, mode and circuit
+// breaker state of each provider.
+func (h *ProvidersHandler) List(w http.ResponseWriter, r *http.Request) {
+	if !h.available(w) {
+		return
+	}
+	h.respond(w, r)
+}
+
+// SetMode answers POST /admin/providers/{name}/mode, draining, disabling
+// or reactivating a provider.
+func (h *ProvidersHandler) SetMode(w http.ResponseWriter, r *http.Request) {
+	if !h.available(w) {
+		return
+	}
+	name := chi.URLParam(r, "name")
+	var req ModeRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	err := h.manager.SetProviderMode(name, req.Mode)
+	h.log(r, "set_mode", err, zap.String("provider", name), zap.String("mode", string(req.Mode)))
+	h.result(w, r, err)
+}
+
+// SetBreaker answers POST /admin/providers/{name}/breaker, forcing the
+// circuit breaker of a provider open or closed, or releasing it.
+func (h *ProvidersHandler) SetBreaker(w http.ResponseWriter, r *http.Request) {
+	if !h.available(w) {
+		return
+	}
+	name := chi.URLParam(r, "name")
+	var req BreakerRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	var err error
+	switch req.State {
+	case "open":
+		err = h.manager.ForceBreaker(name, gobreaker.StateOpen)
+	case "closed":
+		err = h.manager.ForceBreaker(name, gobreaker.StateClosed)
+	case "auto":
+		err = h.manager.ReleaseBreaker(name)
+	default:
+		err = fmt.Errorf("invalid breaker state: %q, must be open, closed or auto", req.State)
+	}
+	h.log(r, "set_breaker", err, zap.String("provider", name), zap.String("state", req.State))
+	h.result(w, r, err)
+}
+
+// SetPreference answers PUT /admin/preference, reordering the failover
+// chain. The preference must list every provider.
+func (h *ProvidersHandler) SetPreference(w http.ResponseWriter, r *http.Request) {
+	if !h.available(w) {
+		return
+	}
+	var req PreferenceRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	err := h.manager.SetPreference(req.Preference)
+	h.log(r, "set_preference", err, zap.Strings("preference", req.Preference))
+	h.result(w, r, err)
+}
+
+// available reports whether there is a manager to control, answering the
+// request otherwise.
+func (h *ProvidersHandler) available(w http.ResponseWriter) bool {
+	if h.manager == nil {
+		errors.ErrorWithType(w, "Provider manager unavailable", errors.ProviderError, http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// decodeBody reads the JSON body of r into v, answering the request when it
+// is invalid.
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		errors.ErrorWithType(w, fmt.Sprintf("Invalid request body: %v", err), errors.BadRequestError, http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// log records an administrative action, whether it succeeded or not.
+func (h *ProvidersHandler) log(r *http.Request, action string, err error, fields ...zap.Field) {
+	logAction(h.audit, r, action, err, fields...)
+}
+
+// logAction records an administrative action to the audit logger, along
+// with the key that made it.
+func logAction(audit *zap.Logger, r *http.Request, action string, err error, fields ...zap.Field) {
+	identity, _ := middleware.IdentityFromContext(r.Context())
+	fields = append(fields,
+		zap.String("action", action),
+		zap.String("key_id", identity.KeyID),
+		zap.String("label", identity.Label),
+		zap.String("remote_addr", r.RemoteAddr))
+	if err != nil {
+		audit.Warn("Admin action rejected", append(fields, zap.Error(err))...)
+		return
+	}
+	audit.Info("Admin action", fields...)
+}
+
+// result answers an action with the state of the providers, or with the
+// error that rejected it.
+func (h *ProvidersHandler) result(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case stderrors.Is(err, provider.ErrUnknownProvider):
+		errors.ErrorWithType(w, err.Error(), errors.NotFoundError, http.StatusNotFound)
+	case err != nil:
+		errors.ErrorWithType(w, err.Error(), errors.BadRequestError, http.StatusBadRequest)
+	default:
+		h.respond(w, r)
+	}
+}
+
+// respond answers with the state of the providers.
+func (h *ProvidersHandler) respond(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ProvidersResponse{Providers: h.manager.Providers()}); err != nil {
+		h.logger.Error("Failed to encode providers response",
+			zap.String("key_id", middleware.KeyID(r.Context())),
+			zap.Error(err))
+		errors.ErrorWithType(w, "Failed to encode response", errors.InternalError, http.StatusInternalServerError)
+	}
+}
+
+// CheckResponse answers a dry run of a configuration reload with the
+// version the configuration file would be served as.
+type CheckResponse struct {
+	Version string `json:"version"`
+	DryRun  bool   `json:"dry_run"`
+}
+
+// ConfigHandler lets administrators inspect and trigger configuration
+// reloads. Reloads are logged to the "audit" logger like provider changes.
+type ConfigHandler struct {
+	watcher config.Watcher
+	logger  *zap.Logger
+	audit   *zap.Logger
+}
+
+// NewConfigHandler creates a handler reporting the reloads of watcher.
+func NewConfigHandler(watcher config.Watcher, logger *zap.Logger) *ConfigHandler {
+	return &ConfigHandler{watcher: watcher, logger: logger, audit: logger.Named("audit")}
+}
+
+// Status answers GET /admin/config with the version of the configuration
+// served and the outcome of the last reload.
+func (h *ConfigHandler) Status(w http.ResponseWriter, r *http.Request) {
+	h.respond(w, r, h.watcher.Status())
+}
+
+// Reload answers POST /admin/config/reload, reloading the configuration
+// file as on SIGHUP. The server applies the configuration before it is
+// answered. With dry_run=true, the file is only validated. A configuration
+// that is invalid or fails to apply is answered with 422 Unprocessable
+// Entity, and the current one stays in place.
+func (h *ConfigHandler) Reload(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("dry_run") == "true" {
+		version, err := h.watcher.Check()
+		h.log(r, "check_config", err, zap.String("version", version))
+		if err != nil {
+			errors.ErrorWithType(w, err.Error(), errors.ConfigError, http.StatusUnprocessableEntity)
+			return
+		}
+		h.respond(w, r, CheckResponse{Version: version, DryRun: true})
+		return
+	}
+
+	err := h.watcher.Reload()
+	h.log(r, "reload_config", err)
+	if err != nil {
+		errors.ErrorWithType(w, err.Error(), errors.ConfigError, http.StatusUnprocessableEntity)
+		return
+	}
+	h.respond(w, r, h.watcher.Status())
+}
+
+// log records a reload, whether it succeeded or not.
+func (h *ConfigHandler) log(r *http.Request, action string, err error, fields ...zap.Field) {
+	logAction(h.audit, r, action, err, fields...)
+}
+
+// respond answers with v as JSON.
+func (h *ConfigHandler) respond(w http.ResponseWriter, r *http.Request, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.logger.Error("Failed to encode config response",
+			zap.String("key_id", middleware.KeyID(r.Context())),
+			zap.Error(err))
+		errors.ErrorWithType(w, "Failed to encode response", errors.InternalError, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,471 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/teilomillet/hapax/server/middleware"
+	"github.com/teilomillet/hapax/server/processing"
+	"github.com/teilomillet/hapax/server/provider"
+	"github.com/teilomillet/hapax/server/validation"
+	"go.uber.org/zap"
+)
+
+// maxMessagesTemperature is the highest temperature the Messages API accepts.
+const maxMessagesTemperature = 1.0
+
+// Anthropic error types returned in the "type" field of error objects
+const (
+	anthropicInvalidRequest = "invalid_request_error"
+	anthropicRateLimit      = "rate_limit_error"
+	anthropicAPIError       = "api_error"
+)
+
+// Anthropic stop reasons
+const (
+	anthropicEndTurn      = "end_turn"
+	anthropicMaxTokens    = "max_tokens"
+	anthropicStopSequence = "stop_sequence"
+)
+
+// ContentBlock is a block of message content. Only text blocks are supported.
+type ContentBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// MessageContent is the content of an Anthropic message or system prompt,
+// sent either as a plain string or as an array of content blocks.
+type MessageContent string
+
+// UnmarshalJSON accepts both a string and an array of text blocks.
+func (c *MessageContent) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = MessageContent(text)
+		return nil
+	}
+
+	var blocks []ContentBlock
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return fmt.Errorf("content must be a string or an array of content blocks")
+	}
+
+	var texts []string
+	for _, block := range blocks {
+		if block.Type != "text" {
+			return fmt.Errorf("unsupported content block type %q", block.Type)
+		}
+		texts = append(texts, block.Text)
+	}
+	*c = MessageContent(strings.Join(texts, "\n"))
+	return nil
+}
+
+// AnthropicMessage is a message of an Anthropic conversation.
+type AnthropicMessage struct {
+	Role    string         `json:"role"`
+	Content MessageContent `json:"content"`
+}
+
+// MessagesRequest is the body of an Anthropic Messages API request.
+// Parameters Hapax does not use are accepted and ignored.
+type MessagesRequest struct {
+	Model         string             `json:"model"`
+	System        MessageContent     `json:"system,omitempty"`
+	Messages      []AnthropicMessage `json:"messages"`
+	MaxTokens     int                `json:"max_tokens"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+	Temperature   *float64           `json:"temperature,omitempty"`
+	TopP          *float64           `json:"top_p,omitempty"`
+	Stream        bool               `json:"stream,omitempty"`
+}
+
+// MessagesResponse is an Anthropic message, as returned by the Messages API.
+type MessagesResponse struct {
+	ID           string         `json:"id"`
+	Type         string         `json:"type"`
+	Role         string         `json:"role"`
+	Model        string         `json:"model"`
+	Content      []ContentBlock `json:"content"`
+	StopReason   *string        `json:"stop_reason"`
+	StopSequence *string        `json:"stop_sequence"`
+	Usage        MessagesUsage  `json:"usage"`
+}
+
+// MessagesUsage reports the tokens consumed by a request.
+type MessagesUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// AnthropicError is an error object in the Anthropic format.
+type AnthropicError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// AnthropicErrorResponse wraps an AnthropicError, as returned by the Anthropic API.
+type AnthropicErrorResponse struct {
+	Type  string         `json:"type"`
+	Error AnthropicError `json:"error"`
+}
+
+// MessagesHandler serves the Anthropic-compatible /v1/messages endpoint,
+// so that Anthropic SDKs can use Hapax by changing their base URL.
+// Requests go through the same processor, failover chain, retries and
+// cache as native completions.
+type MessagesHandler struct {
+	processor *processing.Processor
+	logger    *zap.Logger
+}
+
+// NewMessagesHandler creates a handler for Anthropic Messages API requests.
+func NewMessagesHandler(processor *processing.Processor, logger *zap.Logger) *MessagesHandler {
+	return &MessagesHandler{
+		processor: processor,
+		logger:    logger,
+	}
+}
+
+// ServeHTTP implements http.Handler. It validates the request, maps it onto
+// a processing request and answers with an Anthropic message, or with a
+// stream of Anthropic events when "stream" is set. Errors use the
+// Anthropic error format.
+func (h *MessagesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var requestID string
+	if id := r.Context().Value(middleware.RequestIDKey); id != nil {
+		requestID = id.(string)
+	}
+
+	logger := h.logger.With(
+		zap.String("request_id", requestID),
+		zap.String("key_id", middleware.KeyID(r.Context())),
+		zap.String("path", r.URL.Path),
+	)
+
+	if r.Method != http.MethodPost {
+		writeAnthropicError(w, http.StatusMethodNotAllowed, AnthropicError{Type: anthropicInvalidRequest, Message: "Method not allowed"})
+		return
+	}
+
+	var req MessagesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, AnthropicError{
+			Type:    anthropicInvalidRequest,
+			Message: fmt.Sprintf("Invalid request body: %v", err),
+		})
+		return
+	}
+
+	if err := req.validate(); err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, AnthropicError{Type: anthropicInvalidRequest, Message: err.Error()})
+		return
+	}
+
+	messageID := "msg_" + strings.ReplaceAll(requestID, "-", "")
+	if requestID == "" {
+		messageID = "msg_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+	}
+
+	logger.Debug("Processing messages request",
+		zap.String("model", req.Model),
+		zap.Int("messages_count", len(req.Messages)),
+		zap.Bool("stream", req.Stream),
+	)
+
+	if req.Stream {
+		h.serveMessagesStream(r.Context(), w, &req, messageID, logger)
+		return
+	}
+
+	result, err := h.processor.ProcessRequest(r.Context(), req.processingRequest())
+	if err != nil {
+		status, apiErr := classifyAnthropicError(r.Context(), err, logger)
+		writeAnthropicError(w, status, apiErr)
+		return
+	}
+
+	content, matched := truncateAtStop(result.Content, req.StopSequences)
+	outputTokens := validation.CountTokens(content)
+	stopReason, stopSequence := req.stopReason(matched, result.FinishReason)
+
+	resp := &MessagesResponse{
+		ID:           messageID,
+		Type:         "message",
+		Role:         "assistant",
+		Model:        req.Model,
+		Content:      []ContentBlock{{Type: "text", Text: content}},
+		StopReason:   &stopReason,
+		StopSequence: stopSequence,
+		Usage: MessagesUsage{
+			InputTokens:  req.inputTokens(),
+			OutputTokens: outputTokens,
+		},
+	}
+	if resp.Model == "" {
+		resp.Model = result.Provider
+	}
+
+	setDeduplicated(w, result.Deduplicated)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Error("Failed to encode response", zap.Error(err))
+	}
+}
+
+// serveMessagesStream streams the message as Anthropic server-sent events:
+// message_start, content_block_start, content_block_delta for each chunk,
+// content_block_stop, message_delta and message_stop. A failure before the
+// first event is answered with a regular error response; a failure
+// afterwards is sent as an "error" event.
+func (h *MessagesHandler) serveMessagesStream(ctx context.Context, w http.ResponseWriter, req *MessagesRequest, id string, logger *zap.Logger) {
+	sse := newSSEWriter(w)
+	stops := newStopScanner(req.StopSequences)
+	var content strings.Builder
+
+	start := func() error {
+		message := &MessagesResponse{
+			ID:      id,
+			Type:    "message",
+			Role:    "assistant",
+			Model:   req.Model,
+			Content: []ContentBlock{},
+			Usage:   MessagesUsage{InputTokens: req.inputTokens()},
+		}
+		if err := sse.send("message_start", map[string]interface{}{"type": "message_start", "message": message}); err != nil {
+			return err
+		}
+		return sse.send("content_block_start", map[string]interface{}{
+			"type":          "content_block_start",
+			"index":         0,
+			"content_block": ContentBlock{Type: "text", Text: ""},
+		})
+	}
+
+	sendText := func(text string) error {
+		if text == "" {
+			return nil
+		}
+		if !sse.started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		content.WriteString(text)
+		return sse.send("content_block_delta", map[string]interface{}{
+			"type":  "content_block_delta",
+			"index": 0,
+			"delta": map[string]string{"type": "text_delta", "text": text},
+		})
+	}
+
+	result, err := h.processor.ProcessStream(ctx, req.processingRequest(), func(text string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		safe, stopped := stops.push(text)
+		if err := sendText(safe); err != nil {
+			return err
+		}
+		if stopped {
+			return errStopSequence
+		}
+		return nil
+	})
+
+	stopped := stderrors.Is(err, errStopSequence)
+	if err != nil && !stopped {
+		if ctx.Err() == context.Canceled {
+			logger.Info("Client disconnected, stream stopped")
+			return
+		}
+		status, apiErr := classifyAnthropicError(ctx, err, logger)
+		if !sse.started {
+			writeAnthropicError(w, status, apiErr)
+			return
+		}
+		if sendErr := sse.send("error", AnthropicErrorResponse{Type: "error", Error: apiErr}); sendErr != nil {
+			logger.Debug("Failed to send error event", zap.Error(sendErr))
+		}
+		return
+	}
+
+	if !stopped {
+		// Text held back while looking for a stop sequence
+		if err := sendText(stops.flush()); err != nil {
+			logger.Debug("Failed to send chunk", zap.Error(err))
+			return
+		}
+	}
+	if !sse.started {
+		// The provider produced no text: still send a well-formed message
+		if err := start(); err != nil {
+			logger.Debug("Failed to start stream", zap.Error(err))
+			return
+		}
+	}
+
+	var reported string
+	if result != nil {
+		reported = result.FinishReason
+	}
+	outputTokens := validation.CountTokens(content.String())
+	stopReason, stopSequence := req.stopReason(stops.matched, reported)
+
+	events := []struct {
+		name string
+		data interface{}
+	}{
+		{"content_block_stop", map[string]interface{}{"type": "content_block_stop", "index": 0}},
+		{"message_delta", map[string]interface{}{
+			"type":  "message_delta",
+			"delta": map[string]interface{}{"stop_reason": stopReason, "stop_sequence": stopSequence},
+			"usage": map[string]int{"output_tokens": outputTokens},
+		}},
+		{"message_stop", map[string]string{"type": "message_stop"}},
+	}
+	for _, event := range events {
+		if err := sse.send(event.name, event.data); err != nil {
+			logger.Debug("Failed to send event", zap.String("event", event.name), zap.Error(err))
+			return
+		}
+	}
+}
+
+// validate checks the request against the Messages API constraints.
+func (req *MessagesRequest) validate() error {
+	if req.MaxTokens <= 0 {
+		return fmt.Errorf("max_tokens: must be greater than 0")
+	}
+	if len(req.Messages) == 0 {
+		return fmt.Errorf("messages: at least one message is required")
+	}
+	for i, msg := range req.Messages {
+		if msg.Role != "user" && msg.Role != "assistant" {
+			return fmt.Errorf("messages.%d.role: must be \"user\" or \"assistant\"", i)
+		}
+	}
+	if req.Temperature != nil && (*req.Temperature < 0 || *req.Temperature > maxMessagesTemperature) {
+		return fmt.Errorf("temperature: must be between 0 and %g", maxMessagesTemperature)
+	}
+	if req.TopP != nil && (*req.TopP < 0 || *req.TopP > 1) {
+		return fmt.Errorf("top_p: must be between 0 and 1")
+	}
+	for _, s := range req.StopSequences {
+		if s == "" {
+			return fmt.Errorf("stop_sequences: each stop sequence must be non-empty")
+		}
+	}
+	return nil
+}
+
+// processingRequest maps the Anthropic request onto a processing request.
+// The top-level system prompt becomes a leading system message, and
+// generation parameters are passed to providers under their OpenAI names.
+func (req *MessagesRequest) processingRequest() *processing.Request {
+	messages := make([]processing.Message, 0, len(req.Messages)+1)
+	if req.System != "" {
+		messages = append(messages, processing.Message{Role: "system", Content: string(req.System)})
+	}
+	for _, msg := range req.Messages {
+		messages = append(messages, processing.Message{Role: msg.Role, Content: string(msg.Content)})
+	}
+
+	options := map[string]interface{}{
+		"max_tokens": req.MaxTokens,
+	}
+	if req.Temperature != nil {
+		options["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		options["top_p"] = *req.TopP
+	}
+	if len(req.StopSequences) > 0 {
+		options["stop"] = req.StopSequences
+	}
+
+	return &processing.Request{
+		Type:     "chat",
+		Messages: messages,
+		Model:    req.Model,
+		Options:  options,
+	}
+}
+
+// inputTokens counts the tokens of the system prompt and conversation.
+func (req *MessagesRequest) inputTokens() int {
+	total := validation.CountTokens(string(req.System))
+	for _, msg := range req.Messages {
+		total += validation.CountTokens(string(msg.Content))
+	}
+	return total
+}
+
+// stopReason reports why generation ended, from a stop sequence found in
+// the returned text or the finish reason the provider reported, and, for
+// stop_sequence, which sequence was generated. Providers do not report
+// the sequence they stopped at, so it is only known when one was requested.
+func (req *MessagesRequest) stopReason(matched, reported string) (string, *string) {
+	switch {
+	case matched != "":
+		return anthropicStopSequence, &matched
+	case reported == provider.FinishStopSequence:
+		if len(req.StopSequences) == 1 {
+			return anthropicStopSequence, &req.StopSequences[0]
+		}
+		return anthropicStopSequence, nil
+	case reported == provider.FinishLength:
+		return anthropicMaxTokens, nil
+	default:
+		return anthropicEndTurn, nil
+	}
+}
+
+// classifyAnthropicError logs a processing failure and maps it onto an
+// HTTP status and an Anthropic error object.
+func classifyAnthropicError(ctx context.Context, err error, logger *zap.Logger) (int, AnthropicError) {
+	var unknown *provider.UnknownModelError
+	if stderrors.As(err, &unknown) {
+		return http.StatusBadRequest, AnthropicError{Type: anthropicInvalidRequest, Message: fmt.Sprintf("model: %s", unknown.Model)}
+	}
+	var unsupported *provider.UnsupportedOptionError
+	if stderrors.As(err, &unsupported) {
+		return http.StatusBadRequest, AnthropicError{
+			Type:    anthropicInvalidRequest,
+			Message: fmt.Sprintf("%s: not supported by the provider serving this request", unsupported.Option),
+		}
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		logger.Error("Request timeout", zap.Error(err))
+		return http.StatusGatewayTimeout, AnthropicError{Type: anthropicAPIError, Message: "Request timed out"}
+	}
+
+	logger.Error("Failed to process request", zap.Error(err))
+	switch provider.ClassifyError(err) {
+	case provider.ErrorClassRateLimit:
+		return http.StatusTooManyRequests, AnthropicError{
+			Type:    anthropicRateLimit,
+			Message: "The upstream provider is rate limiting requests, please retry later",
+		}
+	case provider.ErrorClassTimeout:
+		return http.StatusGatewayTimeout, AnthropicError{Type: anthropicAPIError, Message: "The upstream provider timed out"}
+	default:
+		return http.StatusInternalServerError, AnthropicError{Type: anthropicAPIError, Message: "Failed to process request"}
+	}
+}
+
+// writeAnthropicError writes an error response in the Anthropic format.
+func writeAnthropicError(w http.ResponseWriter, status int, apiErr AnthropicError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(AnthropicErrorResponse{Type: "error", Error: apiErr}); err != nil {
+		zap.L().Error("Failed to encode error response", zap.Error(err))
+	}
+}
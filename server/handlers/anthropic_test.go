@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teilomillet/gollm"
+	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/server/middleware"
+	"github.com/teilomillet/hapax/server/mocks"
+	"github.com/teilomillet/hapax/server/processing"
+	"github.com/teilomillet/hapax/server/provider"
+	"go.uber.org/zap/zaptest"
+)
+
+func newMessagesHandler(t *testing.T, llm gollm.LLM) *MessagesHandler {
+	processor, err := processing.NewProcessor(&config.ProcessingConfig{
+		RequestTemplates: map[string]string{"default": "{{.Input}}"},
+	}, llm)
+	require.NoError(t, err)
+	return NewMessagesHandler(processor, zaptest.NewLogger(t))
+}
+
+func postMessages(t *testing.T, handler http.Handler, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), middleware.RequestIDKey, "test-123"))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("anthropic-version", "2023-06-01")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// TestMessages verifies the Anthropic request mapping and response schema.
+func TestMessages(t *testing.T) {
+	t.Run("returns an Anthropic message", func(t *testing.T) {
+		var prompt *gollm.Prompt
+		llm := mocks.NewMockLLM(func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			prompt = p
+			return "Paris.", nil
+		})
+		handler := newMessagesHandler(t, llm)
+
+		w := postMessages(t, handler, `{
+			"model": "claude-3-5-sonnet-latest",
+			"system": [{"type": "text", "text": "Be brief."}],
+			"messages": [
+				{"role": "user", "content": [{"type": "text", "text": "Capital of France?"}]}
+			],
+			"max_tokens": 100,
+			"temperature": 0.5
+		}`)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		var resp MessagesResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+
+		assert.Equal(t, "msg_test123", resp.ID)
+		assert.Equal(t, "message", resp.Type)
+		assert.Equal(t, "assistant", resp.Role)
+		assert.Equal(t, "claude-3-5-sonnet-latest", resp.Model)
+		assert.Equal(t, []ContentBlock{{Type: "text", Text: "Paris."}}, resp.Content)
+		require.NotNil(t, resp.StopReason)
+		assert.Equal(t, "end_turn", *resp.StopReason)
+		assert.Nil(t, resp.StopSequence)
+		assert.Positive(t, resp.Usage.InputTokens)
+		assert.Positive(t, resp.Usage.OutputTokens)
+
+		// The system prompt leads the conversation sent to the provider
+		require.Len(t, prompt.Messages, 2)
+		assert.Equal(t, "system", prompt.Messages[0].Role)
+		assert.Equal(t, "Be brief.", prompt.Messages[0].Content)
+		assert.Equal(t, "Capital of France?", prompt.Messages[1].Content)
+		assert.Equal(t, map[string]interface{}{
+			"max_tokens":  100,
+			"temperature": 0.5,
+		}, llm.LastOptions)
+	})
+
+	t.Run("reports the stop sequence", func(t *testing.T) {
+		handler := newMessagesHandler(t, mocks.NewMockLLM(func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			return "one\n\nHuman: two", nil
+		}))
+
+		w := postMessages(t, handler, `{"messages": [{"role": "user", "content": "Hi"}], "max_tokens": 100, "stop_sequences": ["\n\nHuman:"]}`)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		var resp MessagesResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, "one", resp.Content[0].Text)
+		assert.Equal(t, "stop_sequence", *resp.StopReason)
+		require.NotNil(t, resp.StopSequence)
+		assert.Equal(t, "\n\nHuman:", *resp.StopSequence)
+	})
+
+	t.Run("reports the stop reason of the provider", func(t *testing.T) {
+		var body map[string]interface{}
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			fmt.Fprint(w, `{"type": "message", "content": [{"type": "text", "text": "word word"}], "stop_reason": "max_tokens"}`)
+		}))
+		defer api.Close()
+		llm, err := provider.NewLLM(config.ProviderConfig{Type: "anthropic", Model: "claude-3-5-haiku-latest", APIKey: "sk-ant-test", Endpoint: api.URL})
+		require.NoError(t, err)
+
+		w := postMessages(t, newMessagesHandler(t, llm), `{
+			"messages": [{"role": "user", "content": "Hi"}],
+			"max_tokens": 2,
+			"temperature": 0.5,
+			"top_p": 0.9,
+			"stop_sequences": ["END"]
+		}`)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		var resp MessagesResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, "word word", resp.Content[0].Text)
+		assert.Equal(t, "max_tokens", *resp.StopReason)
+		assert.Nil(t, resp.StopSequence)
+
+		// Generation parameters are enforced by the provider
+		assert.Equal(t, 2.0, body["max_tokens"])
+		assert.Equal(t, 0.5, body["temperature"])
+		assert.Equal(t, 0.9, body["top_p"])
+		assert.Equal(t, []interface{}{"END"}, body["stop_sequences"])
+	})
+
+	t.Run("rejects parameters the provider cannot honor", func(t *testing.T) {
+		handler := newMessagesHandler(t, plainLLM{mocks.NewMockLLM(func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			return "ok", nil
+		})})
+
+		w := postMessages(t, handler, `{"messages": [{"role": "user", "content": "Hi"}], "max_tokens": 5}`)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		var resp AnthropicErrorResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, "invalid_request_error", resp.Error.Type)
+		assert.Contains(t, resp.Error.Message, "max_tokens")
+	})
+}
+
+// TestMessagesErrors verifies that failures use the Anthropic error format.
+func TestMessagesErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		providerErr error
+		wantStatus  int
+		wantType    string
+	}{
+		{"malformed body", `{"messages": `, nil, http.StatusBadRequest, "invalid_request_error"},
+		{"missing max_tokens", `{"messages": [{"role": "user", "content": "Hi"}]}`, nil, http.StatusBadRequest, "invalid_request_error"},
+		{"system role in messages", `{"messages": [{"role": "system", "content": "Hi"}], "max_tokens": 10}`, nil, http.StatusBadRequest, "invalid_request_error"},
+		{"top_p out of range", `{"messages": [{"role": "user", "content": "Hi"}], "max_tokens": 10, "top_p": 2}`, nil, http.StatusBadRequest, "invalid_request_error"},
+		{"unsupported content block", `{"messages": [{"role": "user", "content": [{"type": "image"}]}], "max_tokens": 10}`, nil, http.StatusBadRequest, "invalid_request_error"},
+		{"upstream rate limit", `{"messages": [{"role": "user", "content": "Hi"}], "max_tokens": 10}`, stderrors.New("API error: status code 429"), http.StatusTooManyRequests, "rate_limit_error"},
+		{"provider failure", `{"messages": [{"role": "user", "content": "Hi"}], "max_tokens": 10}`, stderrors.New("provider down"), http.StatusInternalServerError, "api_error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := newMessagesHandler(t, mocks.NewMockLLM(func(ctx context.Context, p *gollm.Prompt) (string, error) {
+				return "ok", tt.providerErr
+			}))
+
+			w := postMessages(t, handler, tt.body)
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			var resp AnthropicErrorResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+			assert.Equal(t, "error", resp.Type)
+			assert.Equal(t, tt.wantType, resp.Error.Type)
+			assert.NotEmpty(t, resp.Error.Message)
+		})
+	}
+}
+
+// TestMessagesStreaming verifies the Anthropic event sequence.
+func TestMessagesStreaming(t *testing.T) {
+	handler := newMessagesHandler(t, mocks.NewMockStreamingLLM("Hel", "lo"))
+
+	w := postMessages(t, handler, `{"model": "claude-3-5-haiku-latest", "messages": [{"role": "user", "content": "Hi"}], "max_tokens": 100, "stream": true}`)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+
+	var events []string
+	var text strings.Builder
+	var stopReason string
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			events = append(events, name)
+			continue
+		}
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+
+		var event struct {
+			Type  string `json:"type"`
+			Delta struct {
+				Text       string `json:"text"`
+				StopReason string `json:"stop_reason"`
+			} `json:"delta"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(data), &event))
+		assert.Equal(t, events[len(events)-1], event.Type, "event name matches the payload type")
+		text.WriteString(event.Delta.Text)
+		if event.Delta.StopReason != "" {
+			stopReason = event.Delta.StopReason
+		}
+	}
+
+	assert.Equal(t, []string{
+		"message_start",
+		"content_block_start",
+		"content_block_delta",
+		"content_block_delta",
+		"content_block_stop",
+		"message_delta",
+		"message_stop",
+	}, events)
+	assert.Equal(t, "Hello", text.String())
+	assert.Equal(t, "end_turn", stopReason)
+}
@@ -12,6 +12,7 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	stderrors "errors"
 	"fmt"
 	"net/http"
 
@@ -19,9 +20,22 @@ import (
 	"github.com/teilomillet/hapax/errors"
 	"github.com/teilomillet/hapax/server/middleware"
 	"github.com/teilomillet/hapax/server/processing"
+	"github.com/teilomillet/hapax/server/provider"
+	"github.com/teilomillet/hapax/server/validation"
 	"go.uber.org/zap"
 )
 
+// DeduplicatedHeader is set to "true" on responses shared with a
+// concurrent identical request.
+const DeduplicatedHeader = "X-Hapax-Deduplicated"
+
+// setDeduplicated marks the response as shared when it was.
+func setDeduplicated(w http.ResponseWriter, deduplicated bool) {
+	if deduplicated {
+		w.Header().Set(DeduplicatedHeader, "true")
+	}
+}
+
 // CompletionRequest represents a completion request with message history.
 // This is the primary request type that supports both simple text and chat completions.
 // All fields are validated before processing.
@@ -37,6 +51,18 @@ type CompletionRequest struct {
 	// FunctionDescription is used for function calling requests.
 	// If present, it will be included in the system context.
 	FunctionDescription string `json:"function_description,omitempty" validate:"omitempty"`
+
+	// Model names the model to use, as listed in the model registry of the
+	// configuration. Any provider may serve the request when it is empty.
+	Model string `json:"model,omitempty"`
+
+	// Options carries per-request settings. Only retry is currently honored:
+	// it overrides the server's retry policy for this request.
+	Options *validation.Options `json:"options,omitempty" validate:"omitempty"`
+
+	// Stream requests the completion as server-sent events.
+	// Sending "Accept: text/event-stream" has the same effect.
+	Stream bool `json:"stream,omitempty"`
 }
 
 // CompletionHandler handles different types of completion requests.
@@ -81,6 +107,9 @@ func convertMessages(messages []gollm.PromptMessage) []processing.Message {
 // 3. Processing using the appropriate template
 // 4. Formatting and returning the response
 //
+// Requests with "stream": true, or an Accept header asking for
+// text/event-stream, are answered with server-sent events instead.
+//
 // Error Handling:
 // - ValidationError: Invalid request format or missing fields
 // - ProcessingError: LLM or processing failures
@@ -132,6 +161,7 @@ func (h *CompletionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Set up request logger with context
 	logger := h.logger.With(
 		zap.String("request_id", requestID),
+		zap.String("key_id", middleware.KeyID(r.Context())),
 		zap.String("method", r.Method),
 		zap.String("path", r.URL.Path),
 		zap.String("remote_addr", r.RemoteAddr),
@@ -254,6 +284,24 @@ func (h *CompletionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	request := &processing.Request{
 		Type:     requestType,
 		Messages: convertMessages(messages),
+		Model:    completionReq.Model,
+	}
+
+	// Apply a per-request retry policy if one was supplied
+	if completionReq.Options != nil && completionReq.Options.Retry != nil {
+		if err := completionReq.Options.Retry.Validate(); err != nil {
+			logger.Warn("Invalid retry options", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			errors.WriteError(w, errors.NewValidationError(
+				requestID,
+				"Invalid retry options",
+				map[string]interface{}{
+					"error": err.Error(),
+				},
+			))
+			return
+		}
+		request.Retry = completionReq.Options.Retry.Config()
 	}
 
 	// Create context with timeout header if present
@@ -265,49 +313,21 @@ func (h *CompletionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Process the request
 	logger.Debug("Processing request with processor")
 
+	// Stream the completion as server-sent events when asked to
+	if completionReq.Stream || acceptsEventStream(r) {
+		h.serveStream(ctx, w, request, logger, requestID)
+		return
+	}
+
 	// Process request
 	response, err := h.processor.ProcessRequest(ctx, request)
 	if err != nil {
-		if ctx.Err() == context.DeadlineExceeded {
-			logger.Error("Request timeout",
-				zap.Error(err),
-				zap.String("request_id", requestID),
-				zap.String("request_type", requestType),
-			)
-			errors.WriteError(w, errors.NewError(
-				errors.InternalError,
-				"Request timeout",
-				http.StatusGatewayTimeout,
-				requestID,
-				map[string]interface{}{
-					"timeout": "5s",
-				},
-				err,
-			))
-			return
-		}
-
-		logger.Error("Failed to process request",
-			zap.Error(err),
-			zap.String("request_id", requestID),
-			zap.String("request_type", requestType),
-		)
-
-		errors.WriteError(w, errors.NewError(
-			errors.InternalError,
-			"Failed to process request",
-			http.StatusInternalServerError,
-			requestID,
-			map[string]interface{}{
-				"error": "LLM error",
-				"type":  requestType,
-			},
-			err,
-		))
+		errors.WriteError(w, h.processingError(ctx, err, logger, requestID, requestType))
 		return
 	}
 
 	// Write response
+	setDeduplicated(w, response.Deduplicated)
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		logger.Error("Failed to encode response",
@@ -324,3 +344,59 @@ func (h *CompletionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		zap.Int("response_length", len(response.Content)),
 	)
 }
+
+// processingError logs a processing failure and converts it into the error
+// returned to the client: 400 for an unknown model, 504 when the request
+// timed out, 500 otherwise.
+func (h *CompletionHandler) processingError(ctx context.Context, err error, logger *zap.Logger, requestID, requestType string) *errors.HapaxError {
+	var unknown *provider.UnknownModelError
+	if stderrors.As(err, &unknown) {
+		logger.Info("Unknown model requested",
+			zap.String("request_id", requestID),
+			zap.String("model", unknown.Model),
+		)
+		return errors.NewValidationError(
+			requestID,
+			fmt.Sprintf("Unknown model: %s", unknown.Model),
+			map[string]interface{}{
+				"model": unknown.Model,
+			},
+		)
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		logger.Error("Request timeout",
+			zap.Error(err),
+			zap.String("request_id", requestID),
+			zap.String("request_type", requestType),
+		)
+		return errors.NewError(
+			errors.InternalError,
+			"Request timeout",
+			http.StatusGatewayTimeout,
+			requestID,
+			map[string]interface{}{
+				"timeout": "5s",
+			},
+			err,
+		)
+	}
+
+	logger.Error("Failed to process request",
+		zap.Error(err),
+		zap.String("request_id", requestID),
+		zap.String("request_type", requestType),
+	)
+
+	return errors.NewError(
+		errors.InternalError,
+		"Failed to process request",
+		http.StatusInternalServerError,
+		requestID,
+		map[string]interface{}{
+			"error": "LLM error",
+			"type":  requestType,
+		},
+		err,
+	)
+}
@@ -257,6 +257,9 @@ func TestCompletionHandler(t *testing.T) {
 				err := json.NewDecoder(w.Body).Decode(&resp)
 				require.NoError(t, err)
 				assert.Equal(t, tt.mockResponse, resp.Content)
+				require.NotNil(t, resp.Usage)
+				assert.Positive(t, resp.Usage.PromptTokens)
+				assert.Positive(t, resp.Usage.CompletionTokens)
 			}
 		})
 	}
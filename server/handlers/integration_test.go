@@ -58,9 +58,10 @@ func TestCompletionHandlerIntegration(t *testing.T) {
 	handler := NewCompletionHandler(processor, logger)
 
 	// Create middleware chain
+	limiter := middleware.NewRateLimiter(config.RateLimitConfig{}, m)
 	chain := middleware.RequestID(
 		middleware.PrometheusMetrics(m)(
-			middleware.RateLimit(m)(
+			limiter.Handler(
 				middleware.Timeout(5*time.Second)(handler),
 			),
 		),
@@ -125,7 +126,7 @@ func TestCompletionHandlerIntegration(t *testing.T) {
 			},
 			setup: func(t *testing.T, ts *httptest.Server) {
 				// Reset rate limiters before starting
-				middleware.ResetRateLimiters()
+				limiter.Reset()
 
 				// Make 10 successful requests first
 				for i := 0; i < 10; i++ {
@@ -190,7 +191,7 @@ func TestCompletionHandlerIntegration(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			// Reset rate limiters before each test
-			middleware.ResetRateLimiters()
+			limiter.Reset()
 
 			// Run setup first if it exists
 			if tt.setup != nil {
@@ -0,0 +1,544 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/teilomillet/hapax/server/middleware"
+	"github.com/teilomillet/hapax/server/processing"
+	"github.com/teilomillet/hapax/server/provider"
+	"github.com/teilomillet/hapax/server/validation"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+// Limits and object names of the OpenAI chat completions API. Choices are
+// capped well below the 128 OpenAI accepts, as each takes a provider call.
+const (
+	maxChatChoices       = 16
+	maxConcurrentChoices = 4 // Choices generated at the same time
+	maxStopSequences     = 4
+	maxChatTemperature   = 2.0
+	openAIChatObject     = "chat.completion"
+	openAIChunkObject    = "chat.completion.chunk"
+	openAIStreamTerminal = "[DONE]"
+)
+
+// OpenAI error types returned in the "type" field of error objects
+const (
+	openAIInvalidRequest = "invalid_request_error"
+	openAIRateLimit      = "rate_limit_error"
+	openAIServerError    = "server_error"
+	openAITimeout        = "timeout"
+)
+
+// ChatMessage is a message of an OpenAI chat conversation.
+type ChatMessage struct {
+	Role    string      `json:"role"`
+	Content ChatContent `json:"content"`
+}
+
+// ChatContent is the text of a chat message. OpenAI clients send either a
+// plain string or an array of content parts; the text parts are joined.
+type ChatContent string
+
+// UnmarshalJSON accepts both a string and an array of content parts.
+func (c *ChatContent) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = ChatContent(text)
+		return nil
+	}
+
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return fmt.Errorf("content must be a string or an array of content parts")
+	}
+
+	var texts []string
+	for _, part := range parts {
+		if part.Type != "text" {
+			return fmt.Errorf("unsupported content part type %q", part.Type)
+		}
+		texts = append(texts, part.Text)
+	}
+	*c = ChatContent(strings.Join(texts, "\n"))
+	return nil
+}
+
+// StopSequences holds the "stop" parameter, which may be a string or an array.
+type StopSequences []string
+
+// UnmarshalJSON accepts both a single string and an array of strings.
+func (s *StopSequences) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*s = StopSequences{single}
+		return nil
+	}
+
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("stop must be a string or an array of strings")
+	}
+	*s = many
+	return nil
+}
+
+// ChatCompletionRequest is the body of an OpenAI chat completions request.
+// Parameters Hapax does not use are accepted and ignored, so that existing
+// clients keep working unchanged.
+type ChatCompletionRequest struct {
+	Model       string        `json:"model"`
+	Messages    []ChatMessage `json:"messages"`
+	Temperature *float64      `json:"temperature,omitempty"`
+	MaxTokens   *int          `json:"max_tokens,omitempty"`
+	TopP        *float64      `json:"top_p,omitempty"`
+	Stop        StopSequences `json:"stop,omitempty"`
+	N           *int          `json:"n,omitempty"`
+	Stream      bool          `json:"stream,omitempty"`
+}
+
+// ChatCompletionResponse is an OpenAI chat completion.
+type ChatCompletionResponse struct {
+	ID      string                 `json:"id"`
+	Object  string                 `json:"object"`
+	Created int64                  `json:"created"`
+	Model   string                 `json:"model"`
+	Choices []ChatCompletionChoice `json:"choices"`
+	Usage   ChatCompletionUsage    `json:"usage"`
+}
+
+// ChatCompletionChoice is one generated completion.
+type ChatCompletionChoice struct {
+	Index        int         `json:"index"`
+	Message      ChatMessage `json:"message"`
+	FinishReason string      `json:"finish_reason"`
+}
+
+// ChatCompletionUsage reports the tokens consumed by a request.
+type ChatCompletionUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// ChatCompletionChunk is a streamed piece of an OpenAI chat completion.
+type ChatCompletionChunk struct {
+	ID      string                      `json:"id"`
+	Object  string                      `json:"object"`
+	Created int64                       `json:"created"`
+	Model   string                      `json:"model"`
+	Choices []ChatCompletionChunkChoice `json:"choices"`
+}
+
+// ChatCompletionChunkChoice carries the text added to a choice by a chunk.
+type ChatCompletionChunkChoice struct {
+	Index        int       `json:"index"`
+	Delta        ChatDelta `json:"delta"`
+	FinishReason *string   `json:"finish_reason"`
+}
+
+// ChatDelta is the incremental content of a streamed choice.
+type ChatDelta struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+// OpenAIError is an error object in the OpenAI format.
+type OpenAIError struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+// OpenAIErrorResponse wraps an OpenAIError, as returned by the OpenAI API.
+type OpenAIErrorResponse struct {
+	Error OpenAIError `json:"error"`
+}
+
+// ChatCompletionsHandler serves the OpenAI-compatible /v1/chat/completions
+// endpoint, so that OpenAI SDKs can use Hapax by changing their base URL.
+// Requests go through the same processor, failover chain, retries and
+// cache as native completions.
+type ChatCompletionsHandler struct {
+	processor *processing.Processor
+	logger    *zap.Logger
+}
+
+// NewChatCompletionsHandler creates a handler for OpenAI chat completion requests.
+func NewChatCompletionsHandler(processor *processing.Processor, logger *zap.Logger) *ChatCompletionsHandler {
+	return &ChatCompletionsHandler{
+		processor: processor,
+		logger:    logger,
+	}
+}
+
+// ServeHTTP implements http.Handler. It validates the request, maps it onto
+// a processing request and answers with an OpenAI chat completion, or with
+// a stream of chunks when "stream" is set. Errors use the OpenAI error format.
+func (h *ChatCompletionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var requestID string
+	if id := r.Context().Value(middleware.RequestIDKey); id != nil {
+		requestID = id.(string)
+	}
+
+	logger := h.logger.With(
+		zap.String("request_id", requestID),
+		zap.String("key_id", middleware.KeyID(r.Context())),
+		zap.String("path", r.URL.Path),
+	)
+
+	if r.Method != http.MethodPost {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, newOpenAIError(openAIInvalidRequest, "Method not allowed", "", ""))
+		return
+	}
+
+	var req ChatCompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, newOpenAIError(openAIInvalidRequest,
+			fmt.Sprintf("Invalid request body: %v", err), "", ""))
+		return
+	}
+
+	if param, err := req.validate(); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, newOpenAIError(openAIInvalidRequest, err.Error(), param, ""))
+		return
+	}
+
+	request := req.processingRequest()
+	completionID := "chatcmpl-" + requestID
+	if requestID == "" {
+		completionID = "chatcmpl-" + uuid.New().String()
+	}
+
+	logger.Debug("Processing chat completion",
+		zap.String("model", req.Model),
+		zap.Int("messages_count", len(req.Messages)),
+		zap.Int("n", req.choices()),
+		zap.Bool("stream", req.Stream),
+	)
+
+	if req.Stream {
+		h.serveChatStream(r.Context(), w, &req, request, completionID, logger)
+		return
+	}
+
+	resp := &ChatCompletionResponse{
+		ID:      completionID,
+		Object:  openAIChatObject,
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+		Usage:   ChatCompletionUsage{PromptTokens: req.promptTokens()},
+	}
+
+	// Choices are generated a few at a time, each with a provider call of
+	// its own rather than one shared by deduplication. The first failure
+	// cancels the others.
+	results := make([]*processing.Response, req.choices())
+	ctx := r.Context()
+	if len(results) > 1 {
+		ctx = provider.WithDeduplication(ctx, false)
+	}
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(maxConcurrentChoices)
+	for i := range results {
+		g.Go(func() error {
+			result, err := h.processor.ProcessRequest(ctx, request)
+			results[i] = result
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		writeProcessingErrorOpenAI(w, r.Context(), err, logger)
+		return
+	}
+
+	for i, result := range results {
+		if resp.Model == "" {
+			resp.Model = result.Provider
+		}
+		setDeduplicated(w, result.Deduplicated)
+
+		content, matched := truncateAtStop(result.Content, req.Stop)
+		completionTokens := validation.CountTokens(content)
+		resp.Choices = append(resp.Choices, ChatCompletionChoice{
+			Index:        i,
+			Message:      ChatMessage{Role: "assistant", Content: ChatContent(content)},
+			FinishReason: finishReason(matched != "", result.FinishReason),
+		})
+		resp.Usage.CompletionTokens += completionTokens
+	}
+	resp.Usage.TotalTokens = resp.Usage.PromptTokens + resp.Usage.CompletionTokens
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Error("Failed to encode response", zap.Error(err))
+	}
+}
+
+// serveChatStream streams a single choice as OpenAI chat completion chunks,
+// terminated by "data: [DONE]". A failure before the first chunk is
+// answered with a regular error response; a failure afterwards is sent as
+// an error object in the stream.
+func (h *ChatCompletionsHandler) serveChatStream(ctx context.Context, w http.ResponseWriter, req *ChatCompletionRequest, request *processing.Request, id string, logger *zap.Logger) {
+	sse := newSSEWriter(w)
+	created := time.Now().Unix()
+	model := req.Model
+	stops := newStopScanner(req.Stop)
+	var content strings.Builder
+
+	chunk := func(delta ChatDelta, finishReason *string) *ChatCompletionChunk {
+		return &ChatCompletionChunk{
+			ID:      id,
+			Object:  openAIChunkObject,
+			Created: created,
+			Model:   model,
+			Choices: []ChatCompletionChunkChoice{{Index: 0, Delta: delta, FinishReason: finishReason}},
+		}
+	}
+
+	sendText := func(text string) error {
+		if text == "" {
+			return nil
+		}
+		if !sse.started {
+			// The first chunk announces the role, as OpenAI does
+			if err := sse.send("", chunk(ChatDelta{Role: "assistant"}, nil)); err != nil {
+				return err
+			}
+		}
+		content.WriteString(text)
+		return sse.send("", chunk(ChatDelta{Content: text}, nil))
+	}
+
+	result, err := h.processor.ProcessStream(ctx, request, func(text string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		safe, stopped := stops.push(text)
+		if err := sendText(safe); err != nil {
+			return err
+		}
+		if stopped {
+			return errStopSequence
+		}
+		return nil
+	})
+
+	stopped := stderrors.Is(err, errStopSequence)
+	if err != nil && !stopped {
+		if ctx.Err() == context.Canceled {
+			logger.Info("Client disconnected, stream stopped")
+			return
+		}
+		if !sse.started {
+			writeProcessingErrorOpenAI(w, ctx, err, logger)
+			return
+		}
+
+		_, apiErr := classifyProcessingError(ctx, err, logger)
+		if sendErr := sse.send("", OpenAIErrorResponse{Error: apiErr}); sendErr != nil {
+			logger.Debug("Failed to send error chunk", zap.Error(sendErr))
+		}
+		return
+	}
+
+	if !stopped {
+		// Text held back while looking for a stop sequence
+		if err := sendText(stops.flush()); err != nil {
+			logger.Debug("Failed to send chunk", zap.Error(err))
+			return
+		}
+	}
+	if model == "" && result != nil {
+		model = result.Provider
+	}
+
+	var reported string
+	if result != nil {
+		reported = result.FinishReason
+	}
+	finishReason := finishReason(stopped, reported)
+	if err := sse.send("", chunk(ChatDelta{}, &finishReason)); err != nil {
+		logger.Debug("Failed to send final chunk", zap.Error(err))
+		return
+	}
+	if err := sse.write("", []byte(openAIStreamTerminal)); err != nil {
+		logger.Debug("Failed to terminate stream", zap.Error(err))
+	}
+}
+
+// validate checks the request against the OpenAI parameter constraints.
+// It returns the name of the offending parameter along with the error.
+func (req *ChatCompletionRequest) validate() (string, error) {
+	if len(req.Messages) == 0 {
+		return "messages", fmt.Errorf("messages must contain at least one message")
+	}
+	for i, msg := range req.Messages {
+		switch msg.Role {
+		case "system", "developer", "user", "assistant":
+		default:
+			return fmt.Sprintf("messages[%d].role", i), fmt.Errorf("unsupported role %q", msg.Role)
+		}
+	}
+	if req.Temperature != nil && (*req.Temperature < 0 || *req.Temperature > maxChatTemperature) {
+		return "temperature", fmt.Errorf("temperature must be between 0 and %g", maxChatTemperature)
+	}
+	if req.MaxTokens != nil && *req.MaxTokens <= 0 {
+		return "max_tokens", fmt.Errorf("max_tokens must be greater than 0")
+	}
+	if req.TopP != nil && (*req.TopP < 0 || *req.TopP > 1) {
+		return "top_p", fmt.Errorf("top_p must be between 0 and 1")
+	}
+	if len(req.Stop) > maxStopSequences {
+		return "stop", fmt.Errorf("at most %d stop sequences are allowed", maxStopSequences)
+	}
+	for _, s := range req.Stop {
+		if s == "" {
+			return "stop", fmt.Errorf("stop sequences must not be empty")
+		}
+	}
+	if req.N != nil && (*req.N < 1 || *req.N > maxChatChoices) {
+		return "n", fmt.Errorf("n must be between 1 and %d", maxChatChoices)
+	}
+	if req.Stream && req.choices() > 1 {
+		return "n", fmt.Errorf("n greater than 1 is not supported when streaming")
+	}
+	return "", nil
+}
+
+// choices returns the number of completions requested.
+func (req *ChatCompletionRequest) choices() int {
+	if req.N == nil {
+		return 1
+	}
+	return *req.N
+}
+
+// processingRequest maps the OpenAI request onto a processing request.
+// Generation parameters are passed to providers under their OpenAI names.
+func (req *ChatCompletionRequest) processingRequest() *processing.Request {
+	messages := make([]processing.Message, len(req.Messages))
+	for i, msg := range req.Messages {
+		role := msg.Role
+		if role == "developer" {
+			// Newer OpenAI clients send system instructions as "developer"
+			role = "system"
+		}
+		messages[i] = processing.Message{Role: role, Content: string(msg.Content)}
+	}
+
+	options := make(map[string]interface{})
+	if req.Temperature != nil {
+		options["temperature"] = *req.Temperature
+	}
+	if req.MaxTokens != nil {
+		options["max_tokens"] = *req.MaxTokens
+	}
+	if req.TopP != nil {
+		options["top_p"] = *req.TopP
+	}
+	if len(req.Stop) > 0 {
+		options["stop"] = []string(req.Stop)
+	}
+
+	return &processing.Request{
+		Type:     "chat",
+		Messages: messages,
+		Model:    req.Model,
+		Options:  options,
+		// Several choices for the same prompt must not share a cached answer
+		NoCache: req.choices() > 1,
+	}
+}
+
+// promptTokens counts the tokens of the conversation.
+func (req *ChatCompletionRequest) promptTokens() int {
+	total := 0
+	for _, msg := range req.Messages {
+		total += validation.CountTokens(string(msg.Content))
+	}
+	return total
+}
+
+// finishReason reports why generation ended, as the provider reported it:
+// a stop sequence or the natural end of the completion ("stop"), or the
+// max_tokens limit ("length"). stopped reports a stop sequence found in
+// the returned text.
+func finishReason(stopped bool, reported string) string {
+	switch {
+	case stopped, reported == "", reported == provider.FinishStopSequence:
+		return provider.FinishStop
+	default:
+		return reported
+	}
+}
+
+// classifyProcessingError logs a processing failure and maps it onto an
+// HTTP status and an OpenAI error object.
+func classifyProcessingError(ctx context.Context, err error, logger *zap.Logger) (int, OpenAIError) {
+	var unknown *provider.UnknownModelError
+	if stderrors.As(err, &unknown) {
+		return http.StatusBadRequest, newOpenAIError(openAIInvalidRequest,
+			fmt.Sprintf("The model `%s` does not exist", unknown.Model), "model", "model_not_found")
+	}
+	var unsupported *provider.UnsupportedOptionError
+	if stderrors.As(err, &unsupported) {
+		return http.StatusBadRequest, newOpenAIError(openAIInvalidRequest,
+			fmt.Sprintf("%s is not supported by the provider serving this request", unsupported.Option), unsupported.Option, "")
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		logger.Error("Request timeout", zap.Error(err))
+		return http.StatusGatewayTimeout, newOpenAIError(openAITimeout, "Request timed out", "", "")
+	}
+
+	logger.Error("Failed to process request", zap.Error(err))
+	switch provider.ClassifyError(err) {
+	case provider.ErrorClassRateLimit:
+		return http.StatusTooManyRequests, newOpenAIError(openAIRateLimit,
+			"The upstream provider is rate limiting requests, please retry later", "", "rate_limit_exceeded")
+	case provider.ErrorClassTimeout:
+		return http.StatusGatewayTimeout, newOpenAIError(openAITimeout, "The upstream provider timed out", "", "")
+	default:
+		return http.StatusInternalServerError, newOpenAIError(openAIServerError, "Failed to process request", "", "")
+	}
+}
+
+// newOpenAIError builds an error object. Empty param and code are sent as null.
+func newOpenAIError(errType, message, param, code string) OpenAIError {
+	e := OpenAIError{Message: message, Type: errType}
+	if param != "" {
+		e.Param = &param
+	}
+	if code != "" {
+		e.Code = &code
+	}
+	return e
+}
+
+// writeProcessingErrorOpenAI answers a failed completion with an OpenAI error.
+func writeProcessingErrorOpenAI(w http.ResponseWriter, ctx context.Context, err error, logger *zap.Logger) {
+	status, apiErr := classifyProcessingError(ctx, err, logger)
+	writeOpenAIError(w, status, apiErr)
+}
+
+// writeOpenAIError writes an error response in the OpenAI format.
+func writeOpenAIError(w http.ResponseWriter, status int, apiErr OpenAIError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(OpenAIErrorResponse{Error: apiErr}); err != nil {
+		zap.L().Error("Failed to encode error response", zap.Error(err))
+	}
+}
@@ -0,0 +1,318 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teilomillet/gollm"
+	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/server/middleware"
+	"github.com/teilomillet/hapax/server/mocks"
+	"github.com/teilomillet/hapax/server/processing"
+	"github.com/teilomillet/hapax/server/provider"
+	"go.uber.org/zap/zaptest"
+)
+
+func newChatHandler(t *testing.T, llm gollm.LLM) *ChatCompletionsHandler {
+	processor, err := processing.NewProcessor(&config.ProcessingConfig{
+		RequestTemplates: map[string]string{"default": "{{.Input}}"},
+	}, llm)
+	require.NoError(t, err)
+	return NewChatCompletionsHandler(processor, zaptest.NewLogger(t))
+}
+
+func postChat(t *testing.T, handler http.Handler, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), middleware.RequestIDKey, "test-123"))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// TestChatCompletions verifies the OpenAI request mapping and response schema.
+func TestChatCompletions(t *testing.T) {
+	t.Run("returns an OpenAI chat completion", func(t *testing.T) {
+		var prompt *gollm.Prompt
+		llm := mocks.NewMockLLM(func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			prompt = p
+			return "Paris.", nil
+		})
+		handler := newChatHandler(t, llm)
+
+		w := postChat(t, handler, `{
+			"model": "gpt-4o",
+			"messages": [
+				{"role": "developer", "content": "Be brief."},
+				{"role": "user", "content": [{"type": "text", "text": "Capital of France?"}]}
+			],
+			"temperature": 0.2,
+			"max_tokens": 50,
+			"stop": "\n\n"
+		}`)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		var resp ChatCompletionResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+
+		assert.Equal(t, "chatcmpl-test-123", resp.ID)
+		assert.Equal(t, "chat.completion", resp.Object)
+		assert.Equal(t, "gpt-4o", resp.Model)
+		assert.NotZero(t, resp.Created)
+		require.Len(t, resp.Choices, 1)
+		assert.Equal(t, "assistant", resp.Choices[0].Message.Role)
+		assert.Equal(t, ChatContent("Paris."), resp.Choices[0].Message.Content)
+		assert.Equal(t, "stop", resp.Choices[0].FinishReason)
+		assert.Positive(t, resp.Usage.PromptTokens)
+		assert.Positive(t, resp.Usage.CompletionTokens)
+		assert.Equal(t, resp.Usage.PromptTokens+resp.Usage.CompletionTokens, resp.Usage.TotalTokens)
+
+		// Messages and generation parameters reach the provider
+		require.Len(t, prompt.Messages, 2)
+		assert.Equal(t, "system", prompt.Messages[0].Role)
+		assert.Equal(t, "Capital of France?", prompt.Messages[1].Content)
+		assert.Equal(t, map[string]interface{}{
+			"temperature": 0.2,
+			"max_tokens":  50,
+			"stop":        []string{"\n\n"},
+		}, llm.LastOptions)
+	})
+
+	t.Run("applies stop sequences and n", func(t *testing.T) {
+		var calls atomic.Int32
+		handler := newChatHandler(t, mocks.NewMockLLM(func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			calls.Add(1)
+			return "one END two", nil
+		}))
+
+		w := postChat(t, handler, `{"messages": [{"role": "user", "content": "Hi"}], "stop": ["END"], "n": 2}`)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		var resp ChatCompletionResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, int32(2), calls.Load())
+		require.Len(t, resp.Choices, 2)
+		for i, choice := range resp.Choices {
+			assert.Equal(t, i, choice.Index)
+			assert.Equal(t, ChatContent("one "), choice.Message.Content)
+			assert.Equal(t, "stop", choice.FinishReason)
+		}
+		assert.Equal(t, "mock", resp.Model, "the serving provider is reported when no model is requested")
+	})
+
+	t.Run("generates choices concurrently", func(t *testing.T) {
+		// Each call waits for the others of its batch, which only
+		// arrive when they are made at the same time
+		var arrived sync.WaitGroup
+		arrived.Add(maxConcurrentChoices)
+		handler := newChatHandler(t, mocks.NewMockLLM(func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			arrived.Done()
+			done := make(chan struct{})
+			go func() {
+				arrived.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+				return "choice", nil
+			case <-time.After(5 * time.Second):
+				return "", stderrors.New("choices were generated one after the other")
+			}
+		}))
+
+		w := postChat(t, handler, fmt.Sprintf(`{"messages": [{"role": "user", "content": "Hi"}], "n": %d}`, maxConcurrentChoices))
+
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp ChatCompletionResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Len(t, resp.Choices, maxConcurrentChoices)
+	})
+
+	t.Run("reports the finish reason of the provider", func(t *testing.T) {
+		var body map[string]interface{}
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			fmt.Fprint(w, `{"choices": [{"message": {"role": "assistant", "content": "word word word"}, "finish_reason": "length"}]}`)
+		}))
+		defer api.Close()
+		llm, err := provider.NewLLM(config.ProviderConfig{Type: "openai", Model: "gpt-4o", APIKey: "sk-test", Endpoint: api.URL})
+		require.NoError(t, err)
+
+		w := postChat(t, newChatHandler(t, llm), `{"messages": [{"role": "user", "content": "Hi"}], "max_tokens": 3, "top_p": 0.9}`)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		var resp ChatCompletionResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, ChatContent("word word word"), resp.Choices[0].Message.Content)
+		assert.Equal(t, "length", resp.Choices[0].FinishReason)
+		assert.Equal(t, 3.0, body["max_tokens"], "max_tokens is enforced by the provider")
+		assert.Equal(t, 0.9, body["top_p"])
+	})
+
+	t.Run("rejects parameters the provider cannot honor", func(t *testing.T) {
+		// Hide GenerateWithOptions, as providers without the option
+		// support do
+		handler := newChatHandler(t, plainLLM{mocks.NewMockLLM(func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			return "ok", nil
+		})})
+
+		w := postChat(t, handler, `{"messages": [{"role": "user", "content": "Hi"}], "max_tokens": 5}`)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		var resp OpenAIErrorResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, "invalid_request_error", resp.Error.Type)
+		require.NotNil(t, resp.Error.Param)
+		assert.Equal(t, "max_tokens", *resp.Error.Param)
+	})
+}
+
+// plainLLM exposes only the gollm.LLM methods of the LLM it wraps.
+type plainLLM struct{ gollm.LLM }
+
+// TestChatCompletionsErrors verifies that failures use the OpenAI error format.
+func TestChatCompletionsErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		providerErr error
+		wantStatus  int
+		wantType    string
+		wantParam   string
+		wantCode    string
+	}{
+		{
+			name:       "malformed body",
+			body:       `{"messages": `,
+			wantStatus: http.StatusBadRequest,
+			wantType:   "invalid_request_error",
+		},
+		{
+			name:       "no messages",
+			body:       `{"model": "gpt-4o", "messages": []}`,
+			wantStatus: http.StatusBadRequest,
+			wantType:   "invalid_request_error",
+			wantParam:  "messages",
+		},
+		{
+			name:       "temperature out of range",
+			body:       `{"messages": [{"role": "user", "content": "Hi"}], "temperature": 3}`,
+			wantStatus: http.StatusBadRequest,
+			wantType:   "invalid_request_error",
+			wantParam:  "temperature",
+		},
+		{
+			name:       "n too large",
+			body:       `{"messages": [{"role": "user", "content": "Hi"}], "n": 17}`,
+			wantStatus: http.StatusBadRequest,
+			wantType:   "invalid_request_error",
+			wantParam:  "n",
+		},
+		{
+			name:       "n with stream",
+			body:       `{"messages": [{"role": "user", "content": "Hi"}], "n": 2, "stream": true}`,
+			wantStatus: http.StatusBadRequest,
+			wantType:   "invalid_request_error",
+			wantParam:  "n",
+		},
+		{
+			name:        "upstream rate limit",
+			body:        `{"messages": [{"role": "user", "content": "Hi"}]}`,
+			providerErr: stderrors.New("API error: status code 429"),
+			wantStatus:  http.StatusTooManyRequests,
+			wantType:    "rate_limit_error",
+			wantCode:    "rate_limit_exceeded",
+		},
+		{
+			name:        "provider failure",
+			body:        `{"messages": [{"role": "user", "content": "Hi"}]}`,
+			providerErr: stderrors.New("provider down"),
+			wantStatus:  http.StatusInternalServerError,
+			wantType:    "server_error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := newChatHandler(t, mocks.NewMockLLM(func(ctx context.Context, p *gollm.Prompt) (string, error) {
+				return "ok", tt.providerErr
+			}))
+
+			w := postChat(t, handler, tt.body)
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			var resp OpenAIErrorResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+			assert.Equal(t, tt.wantType, resp.Error.Type)
+			assert.NotEmpty(t, resp.Error.Message)
+			if tt.wantParam != "" {
+				require.NotNil(t, resp.Error.Param)
+				assert.Equal(t, tt.wantParam, *resp.Error.Param)
+			}
+			if tt.wantCode != "" {
+				require.NotNil(t, resp.Error.Code)
+				assert.Equal(t, tt.wantCode, *resp.Error.Code)
+			}
+		})
+	}
+}
+
+// TestChatCompletionsStreaming verifies the OpenAI chunk stream, including
+// stop sequences split across chunks.
+func TestChatCompletionsStreaming(t *testing.T) {
+	handler := newChatHandler(t, mocks.NewMockStreamingLLM("Hello", " wor", "ld. ST", "OP and more"))
+
+	w := postChat(t, handler, `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}], "stream": true, "stop": "STOP"}`)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+
+	var chunks []ChatCompletionChunk
+	var terminated bool
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			terminated = true
+			continue
+		}
+		var chunk ChatCompletionChunk
+		require.NoError(t, json.Unmarshal([]byte(data), &chunk))
+		chunks = append(chunks, chunk)
+	}
+	require.True(t, terminated, "stream must end with [DONE]")
+	require.GreaterOrEqual(t, len(chunks), 3)
+
+	assert.Equal(t, "assistant", chunks[0].Choices[0].Delta.Role)
+
+	var content strings.Builder
+	for _, chunk := range chunks {
+		assert.Equal(t, "chat.completion.chunk", chunk.Object)
+		assert.Equal(t, "chatcmpl-test-123", chunk.ID)
+		assert.Equal(t, "gpt-4o", chunk.Model)
+		content.WriteString(chunk.Choices[0].Delta.Content)
+	}
+	assert.Equal(t, "Hello world. ", content.String())
+
+	last := chunks[len(chunks)-1].Choices[0]
+	require.NotNil(t, last.FinishReason)
+	assert.Equal(t, "stop", *last.FinishReason)
+	for _, chunk := range chunks[:len(chunks)-1] {
+		assert.Nil(t, chunk.Choices[0].FinishReason)
+	}
+}
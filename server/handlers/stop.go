@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	stderrors "errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// errStopSequence stops a stream once a stop sequence has been generated.
+var errStopSequence = stderrors.New("stop sequence reached")
+
+// truncateAtStop cuts content before the first stop sequence, which is
+// not part of the completion, and returns the sequence found ("" if none).
+// Providers that honor stop sequences themselves never return one, so
+// this only matters for those that do not.
+func truncateAtStop(content string, stops []string) (string, string) {
+	if i, stop := indexStop(content, stops); i >= 0 {
+		return content[:i], stop
+	}
+	return content, ""
+}
+
+// indexStop returns the position of the earliest stop sequence in s and
+// that sequence, or -1 when s contains none.
+func indexStop(s string, stops []string) (int, string) {
+	first, matched := -1, ""
+	for _, stop := range stops {
+		if i := strings.Index(s, stop); i >= 0 && (first < 0 || i < first) {
+			first, matched = i, stop
+		}
+	}
+	return first, matched
+}
+
+// stopScanner finds stop sequences in streamed text. Text that could be
+// the beginning of a stop sequence is held back until the next chunk shows
+// whether it is, so that no part of a stop sequence reaches the client.
+type stopScanner struct {
+	stops    []string
+	holdback int
+	pending  string
+	matched  string // The stop sequence reached, if any
+}
+
+func newStopScanner(stops []string) *stopScanner {
+	s := &stopScanner{stops: stops}
+	for _, stop := range stops {
+		if len(stop)-1 > s.holdback {
+			s.holdback = len(stop) - 1
+		}
+	}
+	return s
+}
+
+// push adds a chunk and returns the text that can safely be sent, and
+// whether a stop sequence was reached. Nothing may be pushed afterwards.
+func (s *stopScanner) push(chunk string) (string, bool) {
+	s.pending += chunk
+	if i, stop := indexStop(s.pending, s.stops); i >= 0 {
+		out := s.pending[:i]
+		s.pending, s.matched = "", stop
+		return out, true
+	}
+
+	cut := len(s.pending) - s.holdback
+	if cut <= 0 {
+		return "", false
+	}
+	// Never split a multi-byte character
+	for cut > 0 && cut < len(s.pending) && !utf8.RuneStart(s.pending[cut]) {
+		cut--
+	}
+	out := s.pending[:cut]
+	s.pending = s.pending[cut:]
+	return out, false
+}
+
+// flush returns the text held back at the end of the stream.
+func (s *stopScanner) flush() string {
+	out := s.pending
+	s.pending = ""
+	return out
+}
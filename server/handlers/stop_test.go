@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTruncateAtStop(t *testing.T) {
+	content, matched := truncateAtStop("one END two || three", []string{"||", "END"})
+	assert.Equal(t, "one ", content)
+	assert.Equal(t, "END", matched, "the earliest stop sequence wins")
+
+	content, matched = truncateAtStop("no stop here", []string{"END"})
+	assert.Equal(t, "no stop here", content)
+	assert.Empty(t, matched)
+}
+
+func TestStopScanner(t *testing.T) {
+	s := newStopScanner([]string{"END", "||"})
+
+	out, stopped := s.push("abcE")
+	assert.Equal(t, "ab", out, "possible start of a stop sequence is held back")
+	assert.False(t, stopped)
+
+	out, stopped = s.push("Nx")
+	assert.Equal(t, "cE", out)
+	assert.False(t, stopped)
+
+	out, stopped = s.push("yz|")
+	assert.Equal(t, "Nxy", out)
+	assert.False(t, stopped)
+
+	out, stopped = s.push("|tail")
+	assert.Equal(t, "z", out)
+	assert.True(t, stopped)
+	assert.Equal(t, "||", s.matched)
+
+	// Multi-byte characters are never split
+	s = newStopScanner([]string{"ab"})
+	out, _ = s.push("xé")
+	assert.Equal(t, "x", out)
+	assert.Equal(t, "é", s.flush())
+
+	// Without stop sequences everything passes through
+	s = newStopScanner(nil)
+	out, stopped = s.push("héllo")
+	assert.Equal(t, "héllo", out)
+	assert.False(t, stopped)
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/teilomillet/hapax/errors"
+	"github.com/teilomillet/hapax/server/processing"
+	"go.uber.org/zap"
+)
+
+// StreamChunk is the payload of each server-sent event carrying generated text.
+type StreamChunk struct {
+	Content string `json:"content"`
+}
+
+// StreamDone is the payload of the final "done" event of a stream.
+type StreamDone struct {
+	// Provider names the failover chain entry that produced the content
+	Provider string `json:"provider,omitempty"`
+
+	// Usage reports the tokens consumed and their estimated cost
+	Usage *processing.Usage `json:"usage,omitempty"`
+}
+
+// acceptsEventStream reports whether the client asked for server-sent events.
+func acceptsEventStream(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			mediaType, _, _ = strings.Cut(mediaType, ";")
+			if strings.EqualFold(strings.TrimSpace(mediaType), "text/event-stream") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sseWriter writes server-sent events, flushing each one to the client.
+// Headers are only sent with the first event, so that a failure before
+// any output can still be reported as a regular JSON error response.
+type sseWriter struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	started bool
+}
+
+func newSSEWriter(w http.ResponseWriter) *sseWriter {
+	return &sseWriter{w: w, rc: http.NewResponseController(w)}
+}
+
+// start sends the event stream headers.
+func (s *sseWriter) start() {
+	h := s.w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	h.Set("X-Accel-Buffering", "no") // Disable proxy buffering (nginx)
+
+	// The server's write timeout is meant for regular responses; a stream
+	// is bounded by the request timeout and the client's connection instead
+	if err := s.rc.SetWriteDeadline(time.Time{}); err != nil && !stderrors.Is(err, http.ErrNotSupported) {
+		zap.L().Debug("Failed to clear write deadline", zap.Error(err))
+	}
+
+	s.w.WriteHeader(http.StatusOK)
+	s.started = true
+}
+
+// send writes one event with a JSON payload and flushes it. An empty event
+// name sends an unnamed event, which clients receive as a "message".
+func (s *sseWriter) send(event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+	return s.write(event, payload)
+}
+
+// write writes one event with a raw payload and flushes it.
+func (s *sseWriter) write(event string, payload []byte) error {
+	if !s.started {
+		s.start()
+	}
+
+	if event != "" {
+		if _, err := fmt.Fprintf(s.w, "event: %s\n", event); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(s.w, "data: %s\n\n", payload); err != nil {
+		return err
+	}
+
+	if err := s.rc.Flush(); err != nil && !stderrors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// serveStream processes a request and streams the completion as
+// server-sent events:
+//
+//	data: {"content":"Hel"}
+//
+//	data: {"content":"lo"}
+//
+//	event: done
+//	data: {"provider":"openai","usage":{"prompt_tokens":5,"completion_tokens":2,"estimated_cost":0.0001}}
+//
+// A failure before the first chunk is answered with a regular JSON error.
+// A failure mid-stream ends the stream with an "error" event carrying the
+// same error body. Generation stops when the client disconnects.
+func (h *CompletionHandler) serveStream(ctx context.Context, w http.ResponseWriter, request *processing.Request, logger *zap.Logger, requestID string) {
+	sse := newSSEWriter(w)
+	chunks := 0
+
+	response, err := h.processor.ProcessStream(ctx, request, func(chunk string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		chunks++
+		return sse.send("", StreamChunk{Content: chunk})
+	})
+
+	if err != nil {
+		if ctx.Err() == context.Canceled {
+			logger.Info("Client disconnected, stream stopped",
+				zap.Int("chunks", chunks),
+			)
+			return
+		}
+
+		hapaxErr := h.processingError(ctx, err, logger, requestID, request.Type)
+		if !sse.started {
+			errors.WriteError(w, hapaxErr)
+			return
+		}
+
+		if sendErr := sse.send("error", &errors.ErrorResponse{
+			Type:      hapaxErr.Type,
+			Message:   hapaxErr.Message,
+			RequestID: hapaxErr.RequestID,
+			Details:   hapaxErr.Details,
+		}); sendErr != nil {
+			logger.Debug("Failed to send error event", zap.Error(sendErr))
+		}
+		return
+	}
+
+	if err := sse.send("done", StreamDone{Provider: response.Provider, Usage: response.Usage}); err != nil {
+		logger.Debug("Failed to send done event", zap.Error(err))
+		return
+	}
+
+	logger.Debug("Stream completed",
+		zap.Int("chunks", chunks),
+		zap.Int("response_length", len(response.Content)),
+	)
+}
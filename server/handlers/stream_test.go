@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teilomillet/gollm"
+	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/errors"
+	"github.com/teilomillet/hapax/server/middleware"
+	"github.com/teilomillet/hapax/server/mocks"
+	"github.com/teilomillet/hapax/server/processing"
+	"go.uber.org/zap/zaptest"
+)
+
+// TestCompletionStreaming verifies that completions are delivered as
+// server-sent events, and that errors are reported as JSON before the
+// first chunk and as an "error" event afterwards.
+func TestCompletionStreaming(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	newHandler := func(t *testing.T, llm gollm.LLM) *CompletionHandler {
+		processor, err := processing.NewProcessor(&config.ProcessingConfig{
+			RequestTemplates: map[string]string{"default": "{{.Input}}"},
+		}, llm)
+		require.NoError(t, err)
+		return NewCompletionHandler(processor, logger)
+	}
+
+	newRequest := func(ctx context.Context, body CompletionRequest, accept string) *http.Request {
+		data, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, "/v1/completions", bytes.NewReader(data))
+		req = req.WithContext(context.WithValue(ctx, middleware.RequestIDKey, "test-123"))
+		req.Header.Set("Content-Type", "application/json")
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		return req
+	}
+
+	tests := []struct {
+		name   string
+		body   CompletionRequest
+		accept string
+	}{
+		{"stream field", CompletionRequest{Input: "Hi", Stream: true}, ""},
+		{"accept header", CompletionRequest{Input: "Hi"}, "application/json, text/event-stream;q=0.9"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := newHandler(t, mocks.NewMockStreamingLLM("Hel", "lo"))
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, newRequest(context.Background(), tt.body, tt.accept))
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+			assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+			assert.True(t, w.Flushed)
+			body, done, ok := strings.Cut(w.Body.String(), "event: done\ndata: ")
+			require.True(t, ok, "stream ends with a done event")
+			assert.Equal(t,
+				"data: {\"content\":\"Hel\"}\n\n"+
+					"data: {\"content\":\"lo\"}\n\n",
+				body)
+
+			var doneEvent StreamDone
+			require.NoError(t, json.Unmarshal([]byte(done), &doneEvent))
+			assert.Equal(t, "mock", doneEvent.Provider)
+			require.NotNil(t, doneEvent.Usage)
+			assert.Positive(t, doneEvent.Usage.PromptTokens)
+			assert.Positive(t, doneEvent.Usage.CompletionTokens)
+		})
+	}
+
+	t.Run("error before first chunk is plain JSON", func(t *testing.T) {
+		handler := newHandler(t, mocks.NewMockLLM(func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			return "", stderrors.New("provider down")
+		}))
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest(context.Background(), CompletionRequest{Input: "Hi", Stream: true}, ""))
+
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+		var gotError errors.ErrorResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&gotError))
+		assert.Equal(t, "Failed to process request", gotError.Message)
+	})
+
+	t.Run("error mid-stream ends with an error event", func(t *testing.T) {
+		llm := mocks.NewMockStreamingLLM()
+		llm.StreamFunc = func(ctx context.Context, p *gollm.Prompt, emit func(string) error) (string, error) {
+			if err := emit("partial"); err != nil {
+				return "", err
+			}
+			return "partial", stderrors.New("connection reset")
+		}
+		handler := newHandler(t, llm)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest(context.Background(), CompletionRequest{Input: "Hi", Stream: true}, ""))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "data: {\"content\":\"partial\"}\n\n")
+		assert.Contains(t, w.Body.String(), "event: error\ndata: {\"type\":\"internal_error\"")
+		assert.NotContains(t, w.Body.String(), "event: done")
+	})
+
+	t.Run("client disconnect stops generation", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		produced := 0
+		llm := mocks.NewMockStreamingLLM()
+		llm.StreamFunc = func(ctx context.Context, p *gollm.Prompt, emit func(string) error) (string, error) {
+			for {
+				if err := emit("tick"); err != nil {
+					return "", err
+				}
+				produced++
+				if produced == 3 {
+					cancel() // The client goes away
+				}
+				select {
+				case <-ctx.Done():
+					return "", ctx.Err()
+				case <-time.After(time.Millisecond):
+				}
+			}
+		}
+		handler := newHandler(t, llm)
+
+		done := make(chan struct{})
+		w := httptest.NewRecorder()
+		go func() {
+			defer close(done)
+			handler.ServeHTTP(w, newRequest(ctx, CompletionRequest{Input: "Hi", Stream: true}, ""))
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("stream did not stop after the client disconnected")
+		}
+		assert.Equal(t, 3, produced)
+		assert.NotContains(t, w.Body.String(), "event: done")
+		assert.NotContains(t, w.Body.String(), "event: error")
+	})
+}
@@ -9,6 +9,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -343,3 +345,101 @@ func TestHTTP3_ZeroRTT(t *testing.T) {
 		require.NoError(t, waitForPortAvailable(port), "Port %d was not released after server shutdown", port)
 	}
 }
+
+// TestHTTP3Restart verifies that a reload changing the HTTP/3 settings
+// lets requests in flight on the previous server finish.
+func TestHTTP3Restart(t *testing.T) {
+	certFile, keyFile := generateTestCerts(t)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	mockLLM := mocks.NewMockLLM(func(ctx context.Context, prompt *gollm.Prompt) (string, error) {
+		once.Do(func() {
+			close(started)
+			<-release
+		})
+		return "test response", nil
+	})
+
+	cfg := config.DefaultConfig()
+	cfg.Server.Port = 9092
+	cfg.Server.ShutdownTimeout = 5 * time.Second
+	cfg.Server.HTTP3 = &config.HTTP3Config{
+		Enabled:     true,
+		Port:        9445,
+		TLSCertFile: certFile,
+		TLSKeyFile:  keyFile,
+		IdleTimeout: 30 * time.Second,
+	}
+	cfg.Auth.Keys = []config.APIKeyConfig{{ID: "test", Hash: config.HashAPIKey("sk-test")}}
+
+	watcher := NewMockConfigWatcher(cfg)
+	server, err := NewServerWithConfig(watcher, mockLLM, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	serverErrChan := make(chan error, 1)
+	go func() {
+		serverErrChan <- server.Start(ctx)
+	}()
+
+	// Each request has a connection of its own, closed once answered, so
+	// that only requests in flight keep the previous server running
+	url := fmt.Sprintf("https://localhost:%d", cfg.Server.HTTP3.Port)
+	send := func(method, path, body string) int {
+		transport := &http3.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+		defer transport.Close()
+		client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+
+		req, err := http.NewRequest(method, url+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer sk-test")
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+	healthy := func() bool { return send(http.MethodGet, "/health", "") == http.StatusOK }
+	require.Eventually(t, healthy, 5*time.Second, 100*time.Millisecond, "Server failed to start")
+
+	// A request is in flight when the HTTP/3 settings change
+	inFlight := make(chan int, 1)
+	go func() {
+		inFlight <- send(http.MethodPost, "/v1/completions", `{"input": "in flight"}`)
+	}()
+	<-started
+
+	server.mu.RLock()
+	previous := server.http3Server
+	server.mu.RUnlock()
+
+	updated := *cfg
+	http3Config := *cfg.Server.HTTP3
+	http3Config.IdleTimeout = time.Minute
+	updated.Server.HTTP3 = &http3Config
+	require.NoError(t, watcher.UpdateConfig(&updated))
+	require.Eventually(t, func() bool {
+		server.mu.RLock()
+		defer server.mu.RUnlock()
+		return server.http3Server != previous
+	}, 5*time.Second, 10*time.Millisecond)
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-inFlight)
+
+	// The new server takes over the port
+	require.Eventually(t, healthy, 5*time.Second, 100*time.Millisecond, "Server failed to restart")
+
+	cancel()
+	select {
+	case err := <-serverErrChan:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Server failed to shut down")
+	}
+}
@@ -11,12 +11,15 @@ import (
 
 // Metrics encapsulates Prometheus metrics for the server.
 type Metrics struct {
-	registry        *prometheus.Registry
-	RequestsTotal   *prometheus.CounterVec
-	RequestDuration *prometheus.HistogramVec
-	ActiveRequests  *prometheus.GaugeVec
-	ErrorsTotal     *prometheus.CounterVec
-	RateLimitHits   *prometheus.CounterVec
+	registry         *prometheus.Registry
+	RequestsTotal    *prometheus.CounterVec
+	RequestDuration  *prometheus.HistogramVec
+	ActiveRequests   *prometheus.GaugeVec
+	ErrorsTotal      *prometheus.CounterVec
+	RateLimitHits    *prometheus.CounterVec
+	AuthRequests     *prometheus.CounterVec
+	BudgetRejections *prometheus.CounterVec
+	RoutingDecisions *prometheus.CounterVec
 }
 
 // NewMetrics creates a new Metrics instance with a custom registry.
@@ -62,6 +65,27 @@ func NewMetrics() *Metrics {
 			},
 			[]string{"client"},
 		),
+		AuthRequests: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "hapax_auth_requests_total",
+				Help: "Total number of authentication attempts by API key and result",
+			},
+			[]string{"key_id", "result"},
+		),
+		BudgetRejections: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "hapax_budget_rejections_total",
+				Help: "Total number of requests rejected for exceeding a budget, by budget",
+			},
+			[]string{"budget"},
+		),
+		RoutingDecisions: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "hapax_routing_decisions_total",
+				Help: "Total number of requests routed to a model by the routing rules",
+			},
+			[]string{"rule", "model"},
+		),
 	}
 
 	// Register default Go metrics
@@ -79,6 +103,12 @@ func NewMetrics() *Metrics {
 	return m
 }
 
+// Registry returns the registry backing the metrics endpoint, so that
+// other components can expose their own collectors alongside these.
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
 // Handler returns a handler for the metrics endpoint.
 func (m *Metrics) Handler() http.Handler {
 	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{
@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/teilomillet/hapax/config"
+)
+
+// Descriptions of the configuration reload metrics
+var (
+	configInfoDesc = prometheus.NewDesc(
+		"hapax_config_info",
+		"Version of the configuration served, the SHA-256 of its files",
+		[]string{"version"}, nil,
+	)
+	configLoadedDesc = prometheus.NewDesc(
+		"hapax_config_loaded_timestamp_seconds",
+		"Time the configuration served was loaded",
+		nil, nil,
+	)
+	configReloadSuccessDesc = prometheus.NewDesc(
+		"hapax_config_last_reload_successful",
+		"Whether the last configuration reload succeeded (1) or failed (0)",
+		nil, nil,
+	)
+	configReloadsDesc = prometheus.NewDesc(
+		"hapax_config_reloads_total",
+		"Total number of configuration reloads by result",
+		[]string{"result"}, nil,
+	)
+)
+
+// RegisterReloadStatus exposes the outcome of configuration reloads. The
+// status function is called on every scrape.
+func (m *Metrics) RegisterReloadStatus(status func() config.ReloadStatus) {
+	m.registry.MustRegister(reloadCollector(status))
+}
+
+// reloadCollector reports the status of configuration reloads.
+type reloadCollector func() config.ReloadStatus
+
+// Describe implements prometheus.Collector.
+func (c reloadCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- configInfoDesc
+	ch <- configLoadedDesc
+	ch <- configReloadSuccessDesc
+	ch <- configReloadsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c reloadCollector) Collect(ch chan<- prometheus.Metric) {
+	status := c()
+
+	successful := 1.0
+	if status.LastError != "" {
+		successful = 0
+	}
+	ch <- prometheus.MustNewConstMetric(configInfoDesc, prometheus.GaugeValue, 1, status.Version)
+	ch <- prometheus.MustNewConstMetric(configLoadedDesc, prometheus.GaugeValue, float64(status.LoadedAt.UnixNano())/1e9)
+	ch <- prometheus.MustNewConstMetric(configReloadSuccessDesc, prometheus.GaugeValue, successful)
+	ch <- prometheus.MustNewConstMetric(configReloadsDesc, prometheus.CounterValue, float64(status.Reloads), "success")
+	ch <- prometheus.MustNewConstMetric(configReloadsDesc, prometheus.CounterValue, float64(status.Failures), "failure")
+}
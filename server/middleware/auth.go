@@ -1,36 +1,181 @@
 package middleware
 
 import (
+	"context"
+	stderrors "errors"
 	"net/http"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/teilomillet/hapax/config"
 	"github.com/teilomillet/hapax/errors"
+	"github.com/teilomillet/hapax/server/metrics"
 )
 
-// Authentication middleware validates API keys and manages authentication
-func Authentication(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Check for API key
-		apiKey := r.Header.Get("X-API-Key")
-		if apiKey != "" {
-			// TODO: Validate API key against configuration or database
-			// For now, we'll accept any non-empty key
-			next.ServeHTTP(w, r)
-			return
+// Authentication failures reported by KeyStore.Authenticate
+var (
+	ErrMissingAPIKey  = stderrors.New("missing API key")
+	ErrInvalidAPIKey  = stderrors.New("invalid API key")
+	ErrExpiredAPIKey  = stderrors.New("API key expired")
+	ErrDisabledAPIKey = stderrors.New("API key disabled")
+)
+
+// Identity describes the API key that authenticated a request.
+type Identity struct {
+	KeyID  string
+	Label  string
+	Tenant string
+	Admin  bool
+}
+
+// IdentityFromContext returns the identity stored by the Authentication
+// middleware, if the request was authenticated.
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(IdentityKey).(Identity)
+	return id, ok
+}
+
+// KeyID returns the ID of the API key that authenticated the request,
+// or an empty string for unauthenticated requests.
+func KeyID(ctx context.Context) string {
+	id, _ := IdentityFromContext(ctx)
+	return id.KeyID
+}
+
+// storedKey is an API key as held by the KeyStore
+type storedKey struct {
+	identity  Identity
+	expiresAt time.Time
+	disabled  bool
+}
+
+// KeyStore holds the accepted API keys, indexed by hash.
+// It is safe for concurrent use, and Update swaps the whole set at once
+// so that requests never see a partially loaded configuration.
+type KeyStore struct {
+	keys atomic.Pointer[map[string]storedKey]
+	now  func() time.Time
+}
+
+// NewKeyStore creates an empty key store, which rejects every key until
+// it is loaded with Update.
+func NewKeyStore() *KeyStore {
+	s := &KeyStore{now: time.Now}
+	s.keys.Store(&map[string]storedKey{})
+	return s
+}
+
+// Update replaces the stored keys with those of the given configuration.
+// On error the previous keys are kept.
+func (s *KeyStore) Update(cfg config.AuthConfig) error {
+	loaded, err := cfg.LoadKeys()
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]storedKey, len(loaded))
+	for _, k := range loaded {
+		keys[k.Hash] = storedKey{
+			identity:  Identity{KeyID: k.ID, Label: k.Label, Tenant: k.Tenant, Admin: k.Admin},
+			expiresAt: k.ExpiresAt,
+			disabled:  k.Disabled,
 		}
+	}
+	s.keys.Store(&keys)
+	return nil
+}
 
-		// Check for Bearer token
-		authHeader := r.Header.Get("Authorization")
-		if authHeader != "" && strings.HasPrefix(authHeader, "Bearer ") {
-			token := strings.TrimPrefix(authHeader, "Bearer ")
-			if token != "" {
-				// TODO: Validate token against configuration or database
-				// For now, we'll accept any non-empty token
-				next.ServeHTTP(w, r)
+// Len returns the number of stored keys.
+func (s *KeyStore) Len() int {
+	return len(*s.keys.Load())
+}
+
+// Authenticate looks up a presented API key. Expired and disabled keys
+// return their identity along with the error, for logging.
+func (s *KeyStore) Authenticate(key string) (Identity, error) {
+	if key == "" {
+		return Identity{}, ErrMissingAPIKey
+	}
+
+	stored, ok := (*s.keys.Load())[config.HashAPIKey(key)]
+	switch {
+	case !ok:
+		return Identity{}, ErrInvalidAPIKey
+	case stored.disabled:
+		return stored.identity, ErrDisabledAPIKey
+	case !stored.expiresAt.IsZero() && !s.now().Before(stored.expiresAt):
+		return stored.identity, ErrExpiredAPIKey
+	}
+	return stored.identity, nil
+}
+
+// presentedKey extracts the API key from the X-API-Key header or from a
+// Bearer token in the Authorization header.
+func presentedKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// Authentication middleware validates API keys against the key store and
+// stores the identity of the key in the request context (see
+// IdentityFromContext). Attempts are counted per key and result when
+// metrics are given.
+func Authentication(keys *KeyStore, m *metrics.Metrics) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity, err := keys.Authenticate(presentedKey(r))
+
+			if m != nil {
+				result := "ok"
+				switch {
+				case stderrors.Is(err, ErrMissingAPIKey):
+					result = "missing"
+				case stderrors.Is(err, ErrInvalidAPIKey):
+					result = "invalid"
+				case stderrors.Is(err, ErrExpiredAPIKey):
+					result = "expired"
+				case stderrors.Is(err, ErrDisabledAPIKey):
+					result = "disabled"
+				}
+				m.AuthRequests.WithLabelValues(identity.KeyID, result).Inc()
+			}
+
+			if err != nil {
+				message := "Missing or invalid authentication"
+				if stderrors.Is(err, ErrExpiredAPIKey) || stderrors.Is(err, ErrDisabledAPIKey) {
+					message = err.Error()
+				}
+				w.Header().Set("WWW-Authenticate", `Bearer realm="hapax"`)
+				errors.ErrorWithType(w, message, errors.AuthenticationError, http.StatusUnauthorized)
 				return
 			}
-		}
 
-		errors.ErrorWithType(w, "Missing or invalid authentication", errors.AuthenticationError, http.StatusUnauthorized)
+			ctx := context.WithValue(r.Context(), IdentityKey, identity)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RequireAdmin rejects requests that were not authenticated with an admin
+// key. It must run after the Authentication middleware.
+func RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := IdentityFromContext(r.Context())
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="hapax"`)
+			errors.ErrorWithType(w, "Missing or invalid authentication", errors.AuthenticationError, http.StatusUnauthorized)
+			return
+		}
+		if !identity.Admin {
+			errors.ErrorWithType(w, "Admin access required", errors.AuthError, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
 	})
 }
@@ -0,0 +1,131 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/server/metrics"
+	"github.com/teilomillet/hapax/server/middleware"
+)
+
+func newKeyStore(t *testing.T, keys ...config.APIKeyConfig) *middleware.KeyStore {
+	store := middleware.NewKeyStore()
+	require.NoError(t, store.Update(config.AuthConfig{Enabled: true, Keys: keys}))
+	return store
+}
+
+func TestAuthentication(t *testing.T) {
+	store := newKeyStore(t,
+		config.APIKeyConfig{ID: "billing", Label: "Billing service", Tenant: "acme", Hash: config.HashAPIKey("sk-billing")},
+		config.APIKeyConfig{ID: "old", Hash: config.HashAPIKey("sk-old"), ExpiresAt: time.Now().Add(-time.Hour)},
+		config.APIKeyConfig{ID: "revoked", Hash: config.HashAPIKey("sk-revoked"), Disabled: true},
+		config.APIKeyConfig{ID: "future", Hash: config.HashAPIKey("sk-future"), ExpiresAt: time.Now().Add(time.Hour)},
+	)
+	m := metrics.NewMetrics()
+
+	var seen middleware.Identity
+	handler := middleware.Authentication(store, m)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = middleware.IdentityFromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name       string
+		headers    map[string]string
+		wantStatus int
+		wantKeyID  string
+		result     string
+	}{
+		{"no credentials", nil, http.StatusUnauthorized, "", "missing"},
+		{"malformed authorization", map[string]string{"Authorization": "sk-billing"}, http.StatusUnauthorized, "", "missing"},
+		{"unknown key", map[string]string{"X-API-Key": "sk-unknown"}, http.StatusUnauthorized, "", "invalid"},
+		{"api key header", map[string]string{"X-API-Key": "sk-billing"}, http.StatusOK, "billing", "ok"},
+		{"bearer token", map[string]string{"Authorization": "Bearer sk-billing"}, http.StatusOK, "billing", "ok"},
+		{"expired key", map[string]string{"X-API-Key": "sk-old"}, http.StatusUnauthorized, "old", "expired"},
+		{"disabled key", map[string]string{"Authorization": "Bearer sk-revoked"}, http.StatusUnauthorized, "revoked", "disabled"},
+		{"key not yet expired", map[string]string{"X-API-Key": "sk-future"}, http.StatusOK, "future", "ok"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen = middleware.Identity{}
+			before := testutil.ToFloat64(m.AuthRequests.WithLabelValues(tt.wantKeyID, tt.result))
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/completions", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			if tt.wantStatus == http.StatusOK {
+				assert.Equal(t, tt.wantKeyID, seen.KeyID)
+			} else {
+				assert.Empty(t, seen.KeyID, "handler must not run")
+				assert.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+			}
+			assert.Equal(t, before+1, testutil.ToFloat64(m.AuthRequests.WithLabelValues(tt.wantKeyID, tt.result)))
+		})
+	}
+
+	t.Run("identity carries label and tenant", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/completions", nil)
+		req.Header.Set("X-API-Key", "sk-billing")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, middleware.Identity{KeyID: "billing", Label: "Billing service", Tenant: "acme"}, seen)
+	})
+}
+
+func TestKeyStoreUpdate(t *testing.T) {
+	store := newKeyStore(t, config.APIKeyConfig{ID: "a", Hash: config.HashAPIKey("sk-a")})
+
+	_, err := store.Authenticate("sk-a")
+	require.NoError(t, err)
+
+	// Rotating the key replaces the previous set
+	require.NoError(t, store.Update(config.AuthConfig{Keys: []config.APIKeyConfig{
+		{ID: "b", Hash: config.HashAPIKey("sk-b")},
+	}}))
+	_, err = store.Authenticate("sk-a")
+	assert.ErrorIs(t, err, middleware.ErrInvalidAPIKey)
+	id, err := store.Authenticate("sk-b")
+	require.NoError(t, err)
+	assert.Equal(t, "b", id.KeyID)
+
+	// An invalid configuration keeps the current keys
+	err = store.Update(config.AuthConfig{Keys: []config.APIKeyConfig{{ID: "c", Hash: "not-a-hash"}}})
+	assert.Error(t, err)
+	assert.Equal(t, 1, store.Len())
+	_, err = store.Authenticate("sk-b")
+	assert.NoError(t, err)
+}
+
+func TestKeyStoreKeysFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+keys:
+  - id: ci
+    label: CI pipeline
+    hash: `+config.HashAPIKey("sk-ci")+`
+`), 0600))
+
+	store := middleware.NewKeyStore()
+	require.NoError(t, store.Update(config.AuthConfig{
+		KeysFile: path,
+		Keys:     []config.APIKeyConfig{{ID: "inline", Hash: config.HashAPIKey("sk-inline")}},
+	}))
+	assert.Equal(t, 2, store.Len())
+
+	id, err := store.Authenticate("sk-ci")
+	require.NoError(t, err)
+	assert.Equal(t, "CI pipeline", id.Label)
+}
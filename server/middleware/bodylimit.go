@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/teilomillet/hapax/errors"
+)
+
+// BodyLimit rejects requests whose body is larger than limit bytes with a
+// 413. Bodies of unknown length are cut off at the limit, which fails the
+// handler's read.
+func BodyLimit(limit int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > limit {
+				errors.ErrorWithType(w, fmt.Sprintf("Request body larger than %d bytes", limit),
+					errors.ValidationError, http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,603 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/errors"
+	"github.com/teilomillet/hapax/server/metrics"
+	"github.com/teilomillet/hapax/server/usage"
+	"github.com/teilomillet/hapax/server/validation"
+	"go.uber.org/zap"
+)
+
+// budgetCounter is the consumption of one subject against one budget
+// during the current period. Counters are persisted as JSON.
+type budgetCounter struct {
+	Budget      string    `json:"budget"`
+	Subject     string    `json:"subject"`
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+	Tokens      int64     `json:"tokens"`
+	Spend       float64   `json:"spend"`
+
+	// Reserved is the prompt estimate of the requests being served, which
+	// counts against the token limit until they are charged
+	Reserved int64 `json:"-"`
+}
+
+// budgetState is the content of the budget state file.
+type budgetState struct {
+	Counters []budgetCounter `json:"counters"`
+	SavedAt  time.Time       `json:"saved_at"`
+}
+
+// BudgetUsage reports the consumption of one subject against one budget
+// during the current period.
+type BudgetUsage struct {
+	Budget      string    `json:"budget"`
+	Scope       string    `json:"scope"`
+	Subject     string    `json:"subject"`
+	Period      string    `json:"period"`
+	PeriodStart time.Time `json:"period_start"`
+	ResetsAt    time.Time `json:"resets_at"`
+	TokensUsed  int64     `json:"tokens_used"`
+	TokensLimit int64     `json:"tokens_limit,omitempty"`
+	SpendUsed   float64   `json:"spend_used"`
+	SpendLimit  float64   `json:"spend_limit,omitempty"`
+}
+
+// Budgets enforces the daily and monthly token and spend budgets of the
+// configuration. Requests are checked before they reach a provider, using
+// an estimate of their prompt tokens which is reserved while they are
+// served, and charged the tokens and cost recorded in their usage tracker
+// once served.
+//
+// When a state path is configured, consumption is saved periodically and
+// on Close, and restored by NewBudgets, so that budgets survive restarts.
+type Budgets struct {
+	limits       []config.BudgetLimit
+	statePath    string
+	saveInterval time.Duration
+	metrics      *metrics.Metrics
+	logger       *zap.Logger
+	now          func() time.Time
+
+	mu       sync.Mutex
+	counters map[string]*budgetCounter
+	changes  uint64 // Changes made to the counters
+	saved    uint64 // Changes in the state file
+
+	// lifecycle serializes Update and Close, which stop the persistence
+	// routine before changing the state file, save interval or done
+	lifecycle sync.Mutex
+	closed    bool
+	done      chan struct{} // Stops the persistence routine, nil when none runs
+	wg        sync.WaitGroup
+}
+
+// NewBudgets creates budgets enforcing the given configuration, restoring
+// the consumption saved in its state file if any. A state file that cannot
+// be read is counted in the metrics and consumption starts from zero.
+// Rejections are logged with their subject when logger is not nil.
+func NewBudgets(cfg config.BudgetConfig, m *metrics.Metrics, logger *zap.Logger) *Budgets {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	b := &Budgets{
+		limits:       cfg.Limits,
+		statePath:    cfg.StatePath,
+		saveInterval: budgetSaveInterval(cfg),
+		metrics:      m,
+		logger:       logger,
+		now:          time.Now,
+		counters:     make(map[string]*budgetCounter),
+	}
+	b.startPersistence()
+	return b
+}
+
+// budgetSaveInterval returns the save interval of cfg, 30s by default.
+func budgetSaveInterval(cfg config.BudgetConfig) time.Duration {
+	if cfg.SaveInterval <= 0 {
+		return 30 * time.Second
+	}
+	return cfg.SaveInterval
+}
+
+// Update applies new limits to the budgets. Consumption is kept for the
+// budgets that remain, and forgotten for those that are removed. Budgets
+// moving to another state file save their consumption to the previous one
+// and start over from the content of the new one.
+func (b *Budgets) Update(cfg config.BudgetConfig) {
+	b.lifecycle.Lock()
+	saveInterval := budgetSaveInterval(cfg)
+	if !b.closed && (cfg.StatePath != b.statePath || saveInterval != b.saveInterval) {
+		if err := b.stopPersistence(); err != nil && b.metrics != nil {
+			b.metrics.ErrorsTotal.WithLabelValues("budget_persistence").Inc()
+		}
+		if cfg.StatePath != b.statePath {
+			b.mu.Lock()
+			b.counters = make(map[string]*budgetCounter)
+			b.changes, b.saved = 0, 0
+			b.mu.Unlock()
+		}
+		b.statePath, b.saveInterval = cfg.StatePath, saveInterval
+		b.startPersistence()
+	}
+	b.lifecycle.Unlock()
+
+	names := make(map[string]bool, len(cfg.Limits))
+	for i := range cfg.Limits {
+		names[cfg.Limits[i].LimitName()] = true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.limits = slices.Clone(cfg.Limits)
+	for key, c := range b.counters {
+		if !names[c.Budget] {
+			delete(b.counters, key)
+			b.changes++
+		}
+	}
+}
+
+// Handler rejects requests for which a budget is used up, and charges
+// admitted requests for the tokens and cost they consumed. The prompt
+// estimate of admitted requests is reserved when they are checked, so
+// that concurrent requests cannot together overshoot a budget. Rejected
+// requests get a 429 with a budget_exceeded_error and a Retry-After header
+// pointing at the end of the period.
+func (b *Budgets) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limits := b.applicable(r)
+		if len(limits) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		estimate, err := estimatePromptTokens(r, limits)
+		if err == errBudgetBodyTooLarge {
+			errors.ErrorWithType(w, fmt.Sprintf("Request body larger than %d bytes", maxBudgetBodySize),
+				errors.ValidationError, http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			errors.ErrorWithType(w, "Failed to read request body", errors.BadRequestError, http.StatusBadRequest)
+			return
+		}
+
+		// Report the exceeded budget that resets last, so that retrying
+		// after Retry-After can succeed
+		var blocked *config.BudgetLimit
+		var snapshot budgetCounter
+		reserved := make([]*budgetCounter, len(limits))
+		b.mu.Lock()
+		now := b.now()
+		for i, l := range limits {
+			c := b.counter(l.limit, l.subject, now)
+			reserved[i] = c
+			// The estimate only covers the prompt, so a budget is also
+			// exhausted once its limit is reached
+			used := c.Tokens + c.Reserved
+			overTokens := l.limit.Tokens > 0 && (used >= l.limit.Tokens || used+estimate > l.limit.Tokens)
+			overSpend := l.limit.Spend > 0 && c.Spend >= l.limit.Spend
+			if (overTokens || overSpend) && (blocked == nil || c.PeriodEnd.After(snapshot.PeriodEnd)) {
+				blocked, snapshot = l.limit, *c
+			}
+		}
+		if blocked == nil {
+			for _, c := range reserved {
+				c.Reserved += estimate
+			}
+		}
+		b.mu.Unlock()
+
+		if blocked != nil {
+			b.reject(w, r, blocked, &snapshot, now)
+			return
+		}
+
+		ctx, tracker := usage.NewContext(r.Context())
+		defer b.settle(limits, reserved, estimate, tracker)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// settle releases the estimate reserved on the counters of a request, and
+// charges the budgets for the tokens and cost it consumed. It runs however
+// the request ended, so that failed requests give their reservation back.
+func (b *Budgets) settle(limits []applicableBudget, reserved []*budgetCounter, estimate int64, tracker *usage.Tracker) {
+	tokens, cost := tracker.TotalTokens(), tracker.Cost()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Counters replaced by a new period or an update keep their
+	// reservation, but are no longer used
+	for _, c := range reserved {
+		c.Reserved -= estimate
+	}
+	if tokens == 0 && cost == 0 {
+		return
+	}
+	now := b.now()
+	for _, l := range limits {
+		c := b.counter(l.limit, l.subject, now)
+		c.Tokens += tokens
+		c.Spend += cost
+	}
+	b.changes++
+}
+
+// applicableBudget is a budget applying to a request, with the subject
+// it is counted against.
+type applicableBudget struct {
+	limit   *config.BudgetLimit
+	subject string
+}
+
+// applicable returns the budgets that apply to the request. As for rate
+// limits, budgets matching the subject replace general ones in their scope,
+// and tenant budgets are skipped for requests without a tenant.
+func (b *Budgets) applicable(r *http.Request) []applicableBudget {
+	subjects := requestSubjects(r)
+
+	// Update replaces the limits rather than changing them
+	b.mu.Lock()
+	configured := b.limits
+	b.mu.Unlock()
+
+	matched := make(map[string]bool)
+	for i := range configured {
+		l := &configured[i]
+		if l.Match != "" && l.Match == subjects[l.Scope] {
+			matched[l.Scope] = true
+		}
+	}
+
+	var limits []applicableBudget
+	for i := range configured {
+		l := &configured[i]
+		subject := subjects[l.Scope]
+		if l.Scope == config.RateLimitScopeTenant && subject == "" {
+			continue
+		}
+		if (l.Match != "" && l.Match != subject) || (l.Match == "" && matched[l.Scope]) {
+			continue
+		}
+		limits = append(limits, applicableBudget{limit: l, subject: subject})
+	}
+	return limits
+}
+
+// counter returns the counter of subject for the budget in the period
+// containing now, creating it or starting a new period as needed.
+// Callers hold b.mu.
+func (b *Budgets) counter(l *config.BudgetLimit, subject string, now time.Time) *budgetCounter {
+	start, end := periodBounds(l.Period, now)
+	key := l.LimitName() + "\x00" + subject
+	c, ok := b.counters[key]
+	if !ok || !c.PeriodStart.Equal(start) {
+		c = &budgetCounter{Budget: l.LimitName(), Subject: subject, PeriodStart: start, PeriodEnd: end}
+		b.counters[key] = c
+	}
+	return c
+}
+
+// reject answers a request exceeding the budget l.
+func (b *Budgets) reject(w http.ResponseWriter, r *http.Request, l *config.BudgetLimit, c *budgetCounter, now time.Time) {
+	var requestID string
+	if id := r.Context().Value(RequestIDKey); id != nil {
+		requestID = id.(string)
+	}
+
+	// Subjects are logged rather than used as labels, as there can be
+	// any number of them
+	if b.metrics != nil {
+		b.metrics.BudgetRejections.WithLabelValues(c.Budget).Inc()
+	}
+	b.logger.Info("Request rejected for exceeding a budget",
+		zap.String("budget", c.Budget),
+		zap.String("subject", c.Subject),
+		zap.String("request_id", requestID))
+
+	details := map[string]interface{}{
+		"budget":    c.Budget,
+		"period":    l.Period,
+		"resets_at": c.PeriodEnd.Format(time.RFC3339),
+	}
+	if l.Tokens > 0 {
+		details["tokens_limit"] = l.Tokens
+		details["tokens_used"] = c.Tokens
+	}
+	if l.Spend > 0 {
+		details["spend_limit"] = l.Spend
+		details["spend_used"] = c.Spend
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(c.PeriodEnd.Sub(now))))
+	errors.WriteError(w, errors.NewBudgetExceededError(requestID, details))
+}
+
+// Usage reports the consumption of every subject during the current
+// period of each configured budget, sorted by budget and subject.
+func (b *Budgets) Usage() []BudgetUsage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	limits := make(map[string]*config.BudgetLimit, len(b.limits))
+	for i := range b.limits {
+		limits[b.limits[i].LimitName()] = &b.limits[i]
+	}
+
+	now := b.now()
+	report := make([]BudgetUsage, 0, len(b.counters))
+	for _, c := range b.counters {
+		l, ok := limits[c.Budget]
+		if !ok {
+			continue
+		}
+		if start, _ := periodBounds(l.Period, now); !c.PeriodStart.Equal(start) {
+			continue
+		}
+		report = append(report, BudgetUsage{
+			Budget:      c.Budget,
+			Scope:       l.Scope,
+			Subject:     c.Subject,
+			Period:      l.Period,
+			PeriodStart: c.PeriodStart,
+			ResetsAt:    c.PeriodEnd,
+			TokensUsed:  c.Tokens,
+			TokensLimit: l.Tokens,
+			SpendUsed:   c.Spend,
+			SpendLimit:  l.Spend,
+		})
+	}
+
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Budget != report[j].Budget {
+			return report[i].Budget < report[j].Budget
+		}
+		return report[i].Subject < report[j].Subject
+	})
+	return report
+}
+
+// Close stops periodic persistence and saves the consumption one last time.
+// It is safe to call more than once.
+func (b *Budgets) Close() error {
+	b.lifecycle.Lock()
+	defer b.lifecycle.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	return b.stopPersistence()
+}
+
+// startPersistence restores the counters saved in the state file, if
+// any, and starts saving them periodically. A state file that cannot be
+// read is counted in the metrics. Callers hold b.lifecycle, except
+// NewBudgets.
+func (b *Budgets) startPersistence() {
+	if b.statePath == "" {
+		return
+	}
+	if err := b.loadState(); err != nil && b.metrics != nil {
+		b.metrics.ErrorsTotal.WithLabelValues("budget_load_state").Inc()
+	}
+
+	b.done = make(chan struct{})
+	b.wg.Add(1)
+	go b.persistStateRoutine(b.done, b.saveInterval)
+}
+
+// stopPersistence stops periodic persistence and saves the counters one
+// last time. Callers hold b.lifecycle.
+func (b *Budgets) stopPersistence() error {
+	if b.done != nil {
+		close(b.done)
+		b.wg.Wait()
+		b.done = nil
+	}
+	return b.saveState()
+}
+
+// loadState restores the counters saved in the state file. A missing
+// file is not an error.
+func (b *Budgets) loadState() error {
+	data, err := os.ReadFile(b.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state budgetState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("decode budget state %s: %w", b.statePath, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := range state.Counters {
+		c := state.Counters[i]
+		b.counters[c.Budget+"\x00"+c.Subject] = &c
+	}
+	return nil
+}
+
+// saveState writes the counters of unfinished periods to the state file
+// atomically, dropping the others. It does nothing when nothing changed.
+func (b *Budgets) saveState() error {
+	if b.statePath == "" {
+		return nil
+	}
+
+	b.mu.Lock()
+	if b.saved == b.changes {
+		b.mu.Unlock()
+		return nil
+	}
+	changes := b.changes
+	now := b.now()
+	state := budgetState{SavedAt: now}
+	for key, c := range b.counters {
+		if !now.Before(c.PeriodEnd) {
+			delete(b.counters, key)
+			continue
+		}
+		state.Counters = append(state.Counters, *c)
+	}
+	b.mu.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(b.statePath), 0755); err != nil {
+		return err
+	}
+
+	// Write atomically by using a temporary file
+	tmpFile := b.statePath + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile, b.statePath); err != nil {
+		return err
+	}
+
+	// Changes made while the file was written are saved next time
+	b.mu.Lock()
+	b.saved = max(b.saved, changes)
+	b.mu.Unlock()
+	return nil
+}
+
+// persistStateRoutine saves the counters every interval until done is
+// closed. Failures are counted in the metrics.
+func (b *Budgets) persistStateRoutine(done <-chan struct{}, interval time.Duration) {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.saveState(); err != nil && b.metrics != nil {
+				b.metrics.ErrorsTotal.WithLabelValues("budget_persistence").Inc()
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// maxBudgetBodySize bounds the request bodies read to estimate their
+// prompt tokens.
+const maxBudgetBodySize = 10 << 20
+
+// errBudgetBodyTooLarge fails the estimate of a body larger than
+// maxBudgetBodySize.
+var errBudgetBodyTooLarge = fmt.Errorf("request body larger than %d bytes", maxBudgetBodySize)
+
+// promptBody holds the prompt fields of the completion, chat completion and
+// Messages request formats, and the number of chat completion choices.
+type promptBody struct {
+	Input    string          `json:"input"`
+	System   json.RawMessage `json:"system"`
+	Messages []struct {
+		Content json.RawMessage `json:"content"`
+	} `json:"messages"`
+	N int `json:"n"`
+}
+
+// estimatePromptTokens estimates the prompt tokens of a request from the
+// text of its input, system prompt and messages, counted once for each of
+// the choices of a chat completion. The body, read up to
+// maxBudgetBodySize, is restored for the next handler. It is only read when
+// a token budget applies; a body that is not a request of a known format
+// is estimated at zero tokens and left to the handler to reject.
+func estimatePromptTokens(r *http.Request, limits []applicableBudget) (int64, error) {
+	needed := false
+	for _, l := range limits {
+		needed = needed || l.limit.Tokens > 0
+	}
+	if !needed || r.Body == nil {
+		return 0, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBudgetBodySize+1))
+	if err != nil {
+		return 0, err
+	}
+	if len(body) > maxBudgetBodySize {
+		return 0, errBudgetBodyTooLarge
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var prompt promptBody
+	if json.Unmarshal(body, &prompt) != nil {
+		return 0, nil
+	}
+	tokens := validation.CountTokens(prompt.Input) + validation.CountTokens(contentText(prompt.System))
+	for _, msg := range prompt.Messages {
+		tokens += validation.CountTokens(contentText(msg.Content))
+	}
+	return int64(tokens) * int64(max(prompt.N, 1)), nil
+}
+
+// contentText returns the text of message content, sent either as a string
+// or as an array of text parts.
+func contentText(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return text
+	}
+	var parts []struct {
+		Text string `json:"text"`
+	}
+	if json.Unmarshal(raw, &parts) != nil {
+		return ""
+	}
+	texts := make([]string, len(parts))
+	for i, part := range parts {
+		texts[i] = part.Text
+	}
+	return strings.Join(texts, "\n")
+}
+
+// periodBounds returns the start and end of the budget period containing
+// now. Periods follow the calendar in UTC.
+func periodBounds(period string, now time.Time) (time.Time, time.Time) {
+	now = now.UTC()
+	if period == config.BudgetPeriodMonthly {
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	}
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 0, 1)
+}
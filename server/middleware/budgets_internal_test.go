@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/server/usage"
+	"github.com/teilomillet/hapax/server/validation"
+)
+
+func TestBudgetPeriodRollover(t *testing.T) {
+	now := time.Date(2026, time.January, 31, 23, 0, 0, 0, time.UTC)
+	b := NewBudgets(config.BudgetConfig{Limits: []config.BudgetLimit{
+		{Name: "daily", Scope: config.RateLimitScopeKey, Period: config.BudgetPeriodDaily, Tokens: 100},
+		{Name: "monthly", Scope: config.RateLimitScopeKey, Period: config.BudgetPeriodMonthly, Tokens: 150},
+	}}, nil, nil)
+	defer b.Close()
+	b.now = func() time.Time { return now }
+
+	handler := b.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		usage.Record(r.Context(), 0, 100)
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.RemoteAddr = "10.0.0.1:1000"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, serve().Code)
+	w := serve()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "3600", w.Header().Get("Retry-After"), "the daily budget resets at midnight UTC")
+
+	// Both periods start over on the first day of the month
+	now = now.Add(2 * time.Hour)
+	assert.Equal(t, http.StatusOK, serve().Code)
+	for _, u := range b.Usage() {
+		assert.Equal(t, int64(100), u.TokensUsed, u.Budget)
+		assert.Equal(t, time.Date(2026, time.February, 1, 0, 0, 0, 0, time.UTC), u.PeriodStart, u.Budget)
+	}
+
+	// The monthly budget outlasts the daily one
+	now = now.Add(24 * time.Hour)
+	w = serve()
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serve()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), `"budget":"monthly"`)
+}
+
+func TestEstimatePromptTokens(t *testing.T) {
+	limits := []applicableBudget{{limit: &config.BudgetLimit{Tokens: 100}}}
+	estimate := func(body string) (int64, error) {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		tokens, err := estimatePromptTokens(req, limits)
+		if err == nil {
+			restored, _ := io.ReadAll(req.Body)
+			assert.Equal(t, body, string(restored), "the body is restored for the next handler")
+		}
+		return tokens, err
+	}
+
+	// Only the prompt text counts, not the JSON around it
+	text := strings.Repeat("word ", 10)
+	tokens, err := estimate(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "` + text + `"}], "metadata": {"note": "` + strings.Repeat("x ", 500) + `"}}`)
+	require.NoError(t, err)
+	assert.Equal(t, int64(validation.CountTokens(text)), tokens)
+
+	// System prompts and content parts are counted
+	tokens, err = estimate(`{"system": "` + text + `", "messages": [{"role": "user", "content": [{"type": "text", "text": "` + text + `"}]}]}`)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2*validation.CountTokens(text)), tokens)
+
+	tokens, err = estimate(`not json`)
+	require.NoError(t, err)
+	assert.Zero(t, tokens)
+
+	_, err = estimate(strings.Repeat(" ", maxBudgetBodySize+1))
+	assert.ErrorIs(t, err, errBudgetBodyTooLarge)
+}
+
+func TestBudgetsSaveStateFailure(t *testing.T) {
+	dir := t.TempDir()
+	b := NewBudgets(config.BudgetConfig{Limits: []config.BudgetLimit{
+		{Scope: config.RateLimitScopeKey, Period: config.BudgetPeriodDaily, Tokens: 100},
+	}}, nil, nil)
+	defer b.Close()
+
+	handler := b.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		usage.Record(r.Context(), 0, 10)
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.RemoteAddr = "10.0.0.1:1000"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// The state path is a directory: the rename fails
+	b.statePath = dir
+	require.Error(t, b.saveState())
+
+	// The counters are still saved once the file can be written
+	b.statePath = filepath.Join(dir, "budgets.json")
+	require.NoError(t, b.saveState())
+	_, err := os.Stat(b.statePath)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,257 @@
+package middleware_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/server/metrics"
+	"github.com/teilomillet/hapax/server/middleware"
+	"github.com/teilomillet/hapax/server/usage"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// consuming returns a handler that records the given usage, as the
+// provider manager does.
+func consuming(tokens int, cost float64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		usage.Record(r.Context(), 0, tokens)
+		usage.RecordCost(r.Context(), cost)
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func postAs(handler http.Handler, keyID, tenant, body string) *httptest.ResponseRecorder {
+	req := withIdentity(httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(body)), keyID, tenant)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestBudgets(t *testing.T) {
+	t.Run("tokens are capped per key", func(t *testing.T) {
+		m := metrics.NewMetrics()
+		core, logs := observer.New(zapcore.InfoLevel)
+		budgets := middleware.NewBudgets(config.BudgetConfig{Limits: []config.BudgetLimit{
+			{Name: "daily-tokens", Scope: config.RateLimitScopeKey, Period: config.BudgetPeriodDaily, Tokens: 250},
+		}}, m, zap.New(core))
+		defer budgets.Close()
+		handler := budgets.Handler(consuming(100, 0))
+
+		assert.Equal(t, http.StatusOK, postAs(handler, "alice", "", "hi").Code)
+		assert.Equal(t, http.StatusOK, postAs(handler, "alice", "", "hi").Code)
+
+		// 200 tokens used: a prompt that would go over the budget is rejected
+		w := postAs(handler, "alice", "", `{"input": "`+strings.Repeat("word ", 100)+`"}`)
+		require.Equal(t, http.StatusTooManyRequests, w.Code)
+		retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+		require.NoError(t, err)
+		assert.Positive(t, retryAfter)
+		assert.LessOrEqual(t, retryAfter, 24*60*60)
+
+		var resp struct {
+			Type    string                 `json:"type"`
+			Details map[string]interface{} `json:"details"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, "budget_exceeded_error", resp.Type)
+		assert.Equal(t, "daily-tokens", resp.Details["budget"])
+		assert.Equal(t, float64(250), resp.Details["tokens_limit"])
+		assert.Equal(t, float64(200), resp.Details["tokens_used"])
+		assert.Equal(t, float64(1), testutil.ToFloat64(m.BudgetRejections.WithLabelValues("daily-tokens")))
+		assert.Equal(t, 1, logs.FilterField(zap.String("subject", "alice")).Len())
+
+		// Other keys have their own budget
+		assert.Equal(t, http.StatusOK, postAs(handler, "bob", "", "hi").Code)
+	})
+
+	t.Run("spend is capped per tenant", func(t *testing.T) {
+		budgets := middleware.NewBudgets(config.BudgetConfig{Limits: []config.BudgetLimit{
+			{Scope: config.RateLimitScopeTenant, Period: config.BudgetPeriodMonthly, Spend: 1},
+		}}, nil, nil)
+		defer budgets.Close()
+		handler := budgets.Handler(consuming(10, 0.6))
+
+		assert.Equal(t, http.StatusOK, postAs(handler, "alice", "acme", "hi").Code)
+		assert.Equal(t, http.StatusOK, postAs(handler, "bob", "acme", "hi").Code)
+		assert.Equal(t, http.StatusTooManyRequests, postAs(handler, "alice", "acme", "hi").Code)
+
+		// Requests without a tenant are not subject to tenant budgets
+		assert.Equal(t, http.StatusOK, postAs(handler, "carol", "", "hi").Code)
+
+		report := budgets.Usage()
+		require.Len(t, report, 1)
+		assert.Equal(t, "tenant:monthly", report[0].Budget)
+		assert.Equal(t, "acme", report[0].Subject)
+		assert.Equal(t, int64(20), report[0].TokensUsed)
+		assert.InDelta(t, 1.2, report[0].SpendUsed, 1e-9)
+		assert.Equal(t, 1.0, report[0].SpendLimit)
+	})
+
+	t.Run("matching budgets replace general ones", func(t *testing.T) {
+		budgets := middleware.NewBudgets(config.BudgetConfig{Limits: []config.BudgetLimit{
+			{Scope: config.RateLimitScopeKey, Period: config.BudgetPeriodDaily, Tokens: 100},
+			{Scope: config.RateLimitScopeKey, Match: "batch", Period: config.BudgetPeriodDaily, Tokens: 10000},
+		}}, nil, nil)
+		defer budgets.Close()
+		handler := budgets.Handler(consuming(100, 0))
+
+		assert.Equal(t, http.StatusOK, postAs(handler, "alice", "", "hi").Code)
+		assert.Equal(t, http.StatusTooManyRequests, postAs(handler, "alice", "", "hi").Code)
+		assert.Equal(t, http.StatusOK, postAs(handler, "batch", "", "hi").Code)
+		assert.Equal(t, http.StatusOK, postAs(handler, "batch", "", "hi").Code)
+	})
+
+	t.Run("prompts are counted for each choice", func(t *testing.T) {
+		budgets := middleware.NewBudgets(config.BudgetConfig{Limits: []config.BudgetLimit{
+			{Scope: config.RateLimitScopeKey, Period: config.BudgetPeriodDaily, Tokens: 150},
+		}}, nil, nil)
+		defer budgets.Close()
+		handler := budgets.Handler(consuming(0, 0))
+		messages := `"messages": [{"role": "user", "content": "` + strings.Repeat("word ", 20) + `"}]`
+
+		assert.Equal(t, http.StatusTooManyRequests, postAs(handler, "alice", "", `{`+messages+`, "n": 10}`).Code)
+		assert.Equal(t, http.StatusOK, postAs(handler, "alice", "", `{`+messages+`, "n": 2}`).Code)
+	})
+
+	t.Run("prompts in flight are reserved", func(t *testing.T) {
+		budgets := middleware.NewBudgets(config.BudgetConfig{Limits: []config.BudgetLimit{
+			{Scope: config.RateLimitScopeKey, Period: config.BudgetPeriodDaily, Tokens: 150},
+		}}, nil, nil)
+		defer budgets.Close()
+		started := make(chan struct{})
+		release := make(chan struct{})
+		handler := budgets.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		prompt := `{"input": "` + strings.Repeat("word ", 100) + `"}`
+
+		inFlight := make(chan int)
+		go func() {
+			inFlight <- postAs(handler, "alice", "", prompt).Code
+		}()
+		<-started
+
+		// Both prompts together would go over the budget
+		assert.Equal(t, http.StatusTooManyRequests, postAs(handler, "alice", "", prompt).Code)
+
+		// A failed request gives its reservation back
+		close(release)
+		assert.Equal(t, http.StatusBadGateway, <-inFlight)
+		assert.Equal(t, http.StatusOK, postAs(budgets.Handler(consuming(0, 0)), "alice", "", prompt).Code)
+	})
+}
+
+func TestBudgetsUpdate(t *testing.T) {
+	budgets := middleware.NewBudgets(config.BudgetConfig{Limits: []config.BudgetLimit{
+		{Name: "keys", Scope: config.RateLimitScopeKey, Period: config.BudgetPeriodDaily, Tokens: 1000},
+		{Name: "tenants", Scope: config.RateLimitScopeTenant, Period: config.BudgetPeriodDaily, Tokens: 1000},
+	}}, nil, nil)
+	defer budgets.Close()
+	handler := budgets.Handler(consuming(100, 0))
+
+	assert.Equal(t, http.StatusOK, postAs(handler, "alice", "acme", "hi").Code)
+	assert.Equal(t, http.StatusOK, postAs(handler, "alice", "acme", "hi").Code)
+
+	// Consumption is kept under the new limit, and dropped with its budget
+	budgets.Update(config.BudgetConfig{Limits: []config.BudgetLimit{
+		{Name: "keys", Scope: config.RateLimitScopeKey, Period: config.BudgetPeriodDaily, Tokens: 200},
+	}})
+	assert.Equal(t, http.StatusTooManyRequests, postAs(handler, "alice", "acme", "hi").Code)
+	assert.Equal(t, http.StatusOK, postAs(handler, "bob", "acme", "hi").Code)
+
+	report := budgets.Usage()
+	require.Len(t, report, 2)
+	assert.Equal(t, "keys", report[0].Budget)
+	assert.Equal(t, int64(200), report[0].TokensLimit)
+}
+
+func TestBudgetsPersistence(t *testing.T) {
+	cfg := config.BudgetConfig{
+		StatePath: filepath.Join(t.TempDir(), "budgets.json"),
+		Limits: []config.BudgetLimit{
+			{Scope: config.RateLimitScopeKey, Period: config.BudgetPeriodDaily, Tokens: 150},
+		},
+	}
+
+	budgets := middleware.NewBudgets(cfg, nil, nil)
+	assert.Equal(t, http.StatusOK, postAs(budgets.Handler(consuming(100, 0.5)), "alice", "", "hi").Code)
+	require.NoError(t, budgets.Close())
+	require.NoError(t, budgets.Close(), "closing twice is harmless")
+
+	// A restarted server resumes from the saved consumption
+	restored := middleware.NewBudgets(cfg, nil, nil)
+	defer restored.Close()
+
+	report := restored.Usage()
+	require.Len(t, report, 1)
+	assert.Equal(t, "alice", report[0].Subject)
+	assert.Equal(t, int64(100), report[0].TokensUsed)
+	assert.InDelta(t, 0.5, report[0].SpendUsed, 1e-9)
+
+	assert.Equal(t, http.StatusOK, postAs(restored.Handler(consuming(100, 0)), "alice", "", "hi").Code)
+	assert.Equal(t, http.StatusTooManyRequests, postAs(restored.Handler(consuming(100, 0)), "alice", "", "hi").Code)
+}
+
+func TestBudgetsMoveStateFile(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.BudgetConfig{
+		StatePath: filepath.Join(dir, "first.json"),
+		Limits: []config.BudgetLimit{
+			{Scope: config.RateLimitScopeKey, Period: config.BudgetPeriodDaily, Tokens: 1000},
+		},
+	}
+	budgets := middleware.NewBudgets(cfg, nil, nil)
+	defer budgets.Close()
+	assert.Equal(t, http.StatusOK, postAs(budgets.Handler(consuming(100, 0)), "alice", "", "hi").Code)
+
+	// Moving to another state file saves the consumption to the previous
+	// one and starts over from the new one
+	moved := cfg
+	moved.StatePath = filepath.Join(dir, "second.json")
+	budgets.Update(moved)
+	assert.Empty(t, budgets.Usage())
+	assert.Equal(t, http.StatusOK, postAs(budgets.Handler(consuming(50, 0)), "bob", "", "hi").Code)
+	require.NoError(t, budgets.Close())
+
+	for path, subject := range map[string]string{cfg.StatePath: "alice", moved.StatePath: "bob"} {
+		restored := middleware.NewBudgets(config.BudgetConfig{StatePath: path, Limits: cfg.Limits}, nil, nil)
+		report := restored.Usage()
+		require.Len(t, report, 1, path)
+		assert.Equal(t, subject, report[0].Subject, path)
+		require.NoError(t, restored.Close())
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	handler := middleware.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serveAs := func(identity *middleware.Identity) int {
+		req := httptest.NewRequest(http.MethodGet, "/admin/usage", nil)
+		if identity != nil {
+			req = req.WithContext(context.WithValue(req.Context(), middleware.IdentityKey, *identity))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, serveAs(nil))
+	assert.Equal(t, http.StatusForbidden, serveAs(&middleware.Identity{KeyID: "alice"}))
+	assert.Equal(t, http.StatusOK, serveAs(&middleware.Identity{KeyID: "ops", Admin: true}))
+}
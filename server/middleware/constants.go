@@ -5,4 +5,5 @@ type contextKey string
 const (
 	RequestIDKey contextKey = "request_id"
 	XTestTimeoutKey contextKey = "X-Test-Timeout"
+	IdentityKey contextKey = "identity"
 )
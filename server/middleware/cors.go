@@ -0,0 +1,165 @@
+package middleware
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/teilomillet/hapax/config"
+)
+
+// Defaults of CORS policies
+var (
+	defaultCORSMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
+	defaultCORSHeaders = []string{"Accept", "Authorization", "Content-Type", "X-API-Key", "X-Request-ID"}
+)
+
+// CORSPolicy answers cross-origin requests as configured: allowed origins
+// get CORS headers naming them, other origins get none, which makes
+// browsers reject the responses.
+type CORSPolicy struct {
+	any         bool            // Any origin is allowed, with the "*" origin
+	origins     map[string]bool // Allowed origins
+	wildcards   []originPattern // Allowed subdomains
+	methods     string
+	headers     string
+	exposed     string
+	credentials bool
+	maxAge      string
+}
+
+// originPattern matches the origins of the subdomains of a domain.
+type originPattern struct {
+	prefix string // Scheme and separator, such as "https://"
+	suffix string // Domain with a leading dot and optional port, such as ".example.com"
+}
+
+// NewCORSPolicy creates a policy from configuration. A configuration
+// without origins yields nil, which sends no CORS headers.
+func NewCORSPolicy(cfg config.CORSConfig) *CORSPolicy {
+	if len(cfg.Origins) == 0 {
+		return nil
+	}
+
+	methods := cfg.Methods
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	headers := cfg.Headers
+	if len(headers) == 0 {
+		headers = defaultCORSHeaders
+	}
+	p := &CORSPolicy{
+		origins:     make(map[string]bool),
+		methods:     strings.Join(methods, ", "),
+		headers:     strings.Join(headers, ", "),
+		exposed:     strings.Join(cfg.ExposedHeaders, ", "),
+		credentials: cfg.AllowCredentials,
+	}
+	if cfg.MaxAge > 0 {
+		p.maxAge = strconv.Itoa(int(cfg.MaxAge.Seconds()))
+	}
+
+	for _, origin := range cfg.Origins {
+		origin = strings.ToLower(origin)
+		if origin == "*" {
+			p.any = true
+			continue
+		}
+		if scheme, host, ok := strings.Cut(origin, "://*."); ok {
+			p.wildcards = append(p.wildcards, originPattern{prefix: scheme + "://", suffix: "." + host})
+			continue
+		}
+		p.origins[origin] = true
+	}
+	return p
+}
+
+// allowed reports whether an origin may make cross-origin requests.
+func (p *CORSPolicy) allowed(origin string) bool {
+	origin = strings.ToLower(origin)
+	if p.origins[origin] {
+		return true
+	}
+	for _, w := range p.wildcards {
+		if !strings.HasPrefix(origin, w.prefix) || !strings.HasSuffix(origin, w.suffix) {
+			continue
+		}
+		// At least one label must precede the domain
+		sub := origin[len(w.prefix) : len(origin)-len(w.suffix)]
+		if sub != "" && !strings.ContainsAny(sub, "/:") && !strings.HasPrefix(sub, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler applies the policy to requests, answering preflight requests
+// with a 204 without calling the next handler. A nil policy passes
+// requests through.
+func (p *CORSPolicy) Handler(next http.Handler) http.Handler {
+	if p == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		// Unless any origin gets the same answer, responses depend on the
+		// origin, so caches must tell them apart
+		if !p.any {
+			addVary(h, "Origin")
+		}
+		if preflight {
+			addVary(h, "Access-Control-Request-Method", "Access-Control-Request-Headers")
+		}
+
+		origin := r.Header.Get("Origin")
+		switch {
+		case p.any:
+			h.Set("Access-Control-Allow-Origin", "*")
+		case origin != "" && p.allowed(origin):
+			h.Set("Access-Control-Allow-Origin", origin)
+			if p.credentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+		default:
+			// Other origins get no CORS headers, and their preflight
+			// requests never reach the routes
+			if preflight {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if preflight {
+			h.Set("Access-Control-Allow-Methods", p.methods)
+			h.Set("Access-Control-Allow-Headers", p.headers)
+			if p.maxAge != "" {
+				h.Set("Access-Control-Max-Age", p.maxAge)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if p.exposed != "" {
+			h.Set("Access-Control-Expose-Headers", p.exposed)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// addVary adds values to the Vary header, unless it lists them already.
+func addVary(h http.Header, values ...string) {
+	for _, v := range values {
+		if !slices.ContainsFunc(h.Values("Vary"), func(existing string) bool {
+			return slices.ContainsFunc(strings.Split(existing, ","), func(s string) bool {
+				return strings.EqualFold(strings.TrimSpace(s), v)
+			})
+		}) {
+			h.Add("Vary", v)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/server/middleware"
+)
+
+func TestCORSPolicy(t *testing.T) {
+	policy := middleware.NewCORSPolicy(config.CORSConfig{
+		Origins:          []string{"https://app.example.com", "https://*.partner.io"},
+		ExposedHeaders:   []string{"X-Request-ID"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	})
+
+	tests := []struct {
+		name        string
+		method      string
+		origin      string
+		preflight   bool
+		wantOrigin  string
+		wantStatus  int
+		wantReached bool
+	}{
+		{"exact origin", http.MethodPost, "https://app.example.com", false, "https://app.example.com", http.StatusOK, true},
+		{"other origin", http.MethodPost, "https://evil.com", false, "", http.StatusOK, true},
+		{"subdomain", http.MethodPost, "https://api.partner.io", false, "https://api.partner.io", http.StatusOK, true},
+		{"nested subdomain", http.MethodPost, "https://a.b.partner.io", false, "https://a.b.partner.io", http.StatusOK, true},
+		{"wildcard domain itself", http.MethodPost, "https://partner.io", false, "", http.StatusOK, true},
+		{"domain ending like the wildcard", http.MethodPost, "https://evilpartner.io", false, "", http.StatusOK, true},
+		{"wildcard with another scheme", http.MethodPost, "http://api.partner.io", false, "", http.StatusOK, true},
+		{"same-origin request", http.MethodGet, "", false, "", http.StatusOK, true},
+		{"preflight", http.MethodOptions, "https://app.example.com", true, "https://app.example.com", http.StatusNoContent, false},
+		{"preflight of other origin", http.MethodOptions, "https://evil.com", true, "", http.StatusNoContent, false},
+		{"options without preflight", http.MethodOptions, "https://app.example.com", false, "https://app.example.com", http.StatusOK, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reached := false
+			handler := policy.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				reached = true
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequest(tt.method, "/v1/completions", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+				req.Header.Set("Access-Control-Request-Headers", "X-API-Key")
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, tt.wantReached, reached)
+			assert.Equal(t, tt.wantOrigin, rec.Header().Get("Access-Control-Allow-Origin"))
+			assert.Contains(t, rec.Header().Values("Vary"), "Origin")
+
+			allowed := tt.wantOrigin != ""
+			if allowed {
+				assert.Equal(t, "true", rec.Header().Get("Access-Control-Allow-Credentials"))
+			} else {
+				assert.Empty(t, rec.Header().Get("Access-Control-Allow-Credentials"))
+			}
+			if allowed && tt.preflight {
+				assert.Equal(t, "GET, POST, PUT, DELETE, OPTIONS", rec.Header().Get("Access-Control-Allow-Methods"))
+				assert.Contains(t, rec.Header().Get("Access-Control-Allow-Headers"), "X-API-Key")
+				assert.Equal(t, "600", rec.Header().Get("Access-Control-Max-Age"))
+				assert.Contains(t, rec.Header().Values("Vary"), "Access-Control-Request-Headers")
+			} else {
+				assert.Empty(t, rec.Header().Get("Access-Control-Allow-Methods"))
+			}
+			if allowed && !tt.preflight {
+				assert.Equal(t, "X-Request-ID", rec.Header().Get("Access-Control-Expose-Headers"))
+			}
+		})
+	}
+}
+
+func TestCORSPolicyAnyOrigin(t *testing.T) {
+	handler := middleware.NewCORSPolicy(config.CORSConfig{Origins: []string{"*"}}).Handler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.Header.Set("Origin", "https://anywhere.com")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	// The answer is the same for every origin, so caches need not vary on it
+	assert.Equal(t, "*", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, rec.Header().Values("Vary"))
+}
+
+func TestCORSPolicyDisabled(t *testing.T) {
+	policy := middleware.NewCORSPolicy(config.CORSConfig{})
+	assert.Nil(t, policy)
+
+	handler := policy.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+}
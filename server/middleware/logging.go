@@ -10,8 +10,9 @@ import (
 // ResponseWriter wraps http.ResponseWriter to capture status code and size
 type ResponseWriter struct {
 	http.ResponseWriter
-	status int
-	size   int64
+	status   int
+	size     int64
+	streamed bool
 }
 
 // NewResponseWriter creates a new ResponseWriter
@@ -30,6 +31,19 @@ func (w *ResponseWriter) Write(b []byte) (int, error) {
 	return size, err
 }
 
+// Flush sends buffered data to the client and marks the response as streamed.
+func (w *ResponseWriter) Flush() {
+	w.streamed = true
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying writer for http.ResponseController.
+func (w *ResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 // Status returns the status code
 func (w *ResponseWriter) Status() int {
 	if w.status == 0 {
@@ -43,6 +57,12 @@ func (w *ResponseWriter) Size() int64 {
 	return w.size
 }
 
+// Streamed reports whether the response was flushed before completion,
+// as server-sent events are.
+func (w *ResponseWriter) Streamed() bool {
+	return w.streamed
+}
+
 // Logging middleware logs request and response details
 func Logging(logger *zap.Logger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -65,6 +85,7 @@ func Logging(logger *zap.Logger) func(http.Handler) http.Handler {
 				zap.Duration("duration", time.Since(start)),
 				zap.Int("status", rw.Status()),
 				zap.Int64("size", rw.Size()),
+				zap.Bool("streamed", rw.Streamed()),
 			)
 		})
 	}
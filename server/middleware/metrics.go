@@ -86,3 +86,19 @@ func (rw *responseWriter) Write(b []byte) (int, error) {
     // Call the original Write method to write the response
     return rw.ResponseWriter.Write(b)
 }
+
+// Flush sends buffered data to the client, so that streamed responses
+// pass through the metrics middleware unbuffered.
+func (rw *responseWriter) Flush() {
+    if !rw.wroteHeader {
+        rw.WriteHeader(http.StatusOK)
+    }
+    if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+        f.Flush()
+    }
+}
+
+// Unwrap returns the underlying writer for http.ResponseController.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+    return rw.ResponseWriter
+}
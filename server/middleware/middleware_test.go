@@ -1,13 +1,17 @@
 package middleware_test
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
+	"github.com/teilomillet/hapax/config"
 	"github.com/teilomillet/hapax/server/metrics"
 	"github.com/teilomillet/hapax/server/middleware"
 )
@@ -124,57 +128,91 @@ func TestCORS(t *testing.T) {
 	}
 }
 
-func TestAuthentication(t *testing.T) {
-	// Create test handler
+func TestTimeout(t *testing.T) {
+	// Create test handler that sleeps
 	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(2 * time.Second)
 		w.WriteHeader(http.StatusOK)
 	})
-	handler := middleware.Authentication(nextHandler)
+	handler := middleware.Timeout(1 * time.Second)(nextHandler)
 
-	// Test without auth header
+	// Test timeout
 	req := httptest.NewRequest("GET", "/", nil)
 	w := httptest.NewRecorder()
 	handler.ServeHTTP(w, req)
-	assert.Equal(t, http.StatusUnauthorized, w.Code)
-
-	// Test with invalid auth header
-	req = httptest.NewRequest("GET", "/", nil)
-	req.Header.Set("Authorization", "invalid")
-	w = httptest.NewRecorder()
-	handler.ServeHTTP(w, req)
-	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
 
-	// Test with valid auth header
+	// Test success (no timeout)
+	nextHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler = middleware.Timeout(1 * time.Second)(nextHandler)
 	req = httptest.NewRequest("GET", "/", nil)
-	req.Header.Set("Authorization", "Bearer valid-token")
 	w = httptest.NewRecorder()
 	handler.ServeHTTP(w, req)
 	assert.Equal(t, http.StatusOK, w.Code)
 }
 
-func TestTimeout(t *testing.T) {
-	// Create test handler that sleeps
-	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		time.Sleep(2 * time.Second)
+func TestTimeoutDefault(t *testing.T) {
+	// Requests served concurrently share the default timeout
+	handler := middleware.Timeout(0)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, ok := r.Context().Deadline()
+		assert.True(t, ok)
+		assert.WithinDuration(t, time.Now().Add(5*time.Second), deadline, time.Second)
 		w.WriteHeader(http.StatusOK)
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			assert.Equal(t, http.StatusOK, w.Code)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestTimeoutStreaming(t *testing.T) {
+	// A stream that keeps flushing outlives the timeout
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		for i := 0; i < 5; i++ {
+			time.Sleep(50 * time.Millisecond)
+			if r.Context().Err() != nil {
+				return
+			}
+			w.Write([]byte("data: tick\n\n"))
+			assert.NoError(t, rc.Flush())
+		}
 	})
-	handler := middleware.Timeout(1 * time.Second)(nextHandler)
+	handler := middleware.Timeout(100 * time.Millisecond)(nextHandler)
 
-	// Test timeout
 	req := httptest.NewRequest("GET", "/", nil)
 	w := httptest.NewRecorder()
 	handler.ServeHTTP(w, req)
-	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, w.Flushed)
+	assert.Equal(t, 5, strings.Count(w.Body.String(), "data: tick"))
 
-	// Test success (no timeout)
+	// A stream that stalls is canceled without a timeout error being
+	// appended to the partial response
+	stalled := make(chan error, 1)
 	nextHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("data: tick\n\n"))
+		http.NewResponseController(w).Flush()
+		<-r.Context().Done()
+		stalled <- r.Context().Err()
 	})
-	handler = middleware.Timeout(1 * time.Second)(nextHandler)
-	req = httptest.NewRequest("GET", "/", nil)
+	handler = middleware.Timeout(100 * time.Millisecond)(nextHandler)
+
 	w = httptest.NewRecorder()
 	handler.ServeHTTP(w, req)
 	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "data: tick\n\n", w.Body.String())
+	assert.Equal(t, context.DeadlineExceeded, <-stalled)
 }
 
 func TestRateLimit(t *testing.T) {
@@ -190,7 +228,7 @@ func TestRateLimit(t *testing.T) {
 	})
 
 	// Create middleware handler
-	handler := middleware.RateLimit(m)(nextHandler)
+	handler := middleware.RateLimit(config.RateLimitConfig{}, m)(nextHandler)
 
 	// Test rate limit
 	for i := 0; i < 11; i++ {
@@ -1,105 +1,416 @@
 package middleware
 
 import (
+	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/teilomillet/hapax/config"
 	"github.com/teilomillet/hapax/errors"
 	"github.com/teilomillet/hapax/server/metrics"
-	"golang.org/x/time/rate"
+	"github.com/teilomillet/hapax/server/usage"
 )
 
-// rateLimiters holds the rate limiters for each visitor IP address
-// and ensures safe concurrent access using a read-write mutex.
-type rateLimiters struct {
-	// visitors is a map of IP addresses to their corresponding rate limiters.
-	visitors map[string]*rate.Limiter
-	// mu is a read-write mutex that protects access to the visitors map.
-	mu sync.RWMutex
+// defaultRateLimitPolicy applies when rate limiting is configured without
+// policies: 10 requests per minute for each client.
+var defaultRateLimitPolicy = config.RateLimitPolicy{
+	Name:     "default",
+	Scope:    config.RateLimitScopeKey,
+	Requests: 10,
+	Window:   time.Minute,
 }
 
-// limiters is a global instance of rateLimiters to manage rate limiting.
-var (
-	limiters = &rateLimiters{
-		visitors: make(map[string]*rate.Limiter),
+// bucket is a token bucket refilling continuously at rate units per second
+// up to capacity. The level may go negative when usage is charged after
+// the fact, as tokens are.
+type bucket struct {
+	rate     float64
+	capacity float64
+	level    float64
+	updated  time.Time
+}
+
+// newBucket creates a full bucket allowing limit units per window,
+// at most burst of them at once.
+func newBucket(limit, burst int, window time.Duration, now time.Time) *bucket {
+	if burst <= 0 {
+		burst = limit
 	}
-)
+	return &bucket{
+		rate:     float64(limit) / window.Seconds(),
+		capacity: float64(burst),
+		level:    float64(burst),
+		updated:  now,
+	}
+}
+
+// refill adds the capacity accumulated since the last update.
+func (b *bucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.level = math.Min(b.capacity, b.level+elapsed*b.rate)
+		b.updated = now
+	}
+}
+
+// wait returns how long until one unit is available.
+func (b *bucket) wait() time.Duration {
+	if b.level >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.level) / b.rate * float64(time.Second))
+}
+
+// reset returns how long until the bucket is full again.
+func (b *bucket) reset() time.Duration {
+	return time.Duration(math.Max(0, b.capacity-b.level) / b.rate * float64(time.Second))
+}
+
+// limiterState holds the buckets of one policy for one subject.
+type limiterState struct {
+	requests *bucket
+	tokens   *bucket
+	lastUsed time.Time
+}
+
+// quota is one request or token bucket applying to a request, as
+// reported in the RateLimit headers.
+type quota struct {
+	policy *config.RateLimitPolicy
+	limit  int
+	bucket *bucket
+}
+
+// RateLimiter enforces the rate limit policies of the configuration.
+// Policies are scoped to API keys, tenants, routes, or all requests;
+// see config.RateLimitPolicy. The state of subjects that stay idle for
+// longer than the configured idle timeout is evicted.
+type RateLimiter struct {
+	policies    []config.RateLimitPolicy
+	idleTimeout time.Duration
+	metrics     *metrics.Metrics
+	now         func() time.Time
+
+	mu        sync.Mutex
+	states    map[string]*limiterState
+	lastSweep time.Time
+}
+
+// NewRateLimiter creates a rate limiter enforcing the given configuration.
+// Rejections are counted in the metrics when they are given.
+func NewRateLimiter(cfg config.RateLimitConfig, m *metrics.Metrics) *RateLimiter {
+	policies := cfg.Policies
+	if len(policies) == 0 {
+		policies = []config.RateLimitPolicy{defaultRateLimitPolicy}
+	}
+	idleTimeout := cfg.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = 10 * time.Minute
+	}
+
+	return &RateLimiter{
+		policies:    policies,
+		idleTimeout: idleTimeout,
+		metrics:     m,
+		now:         time.Now,
+		states:      make(map[string]*limiterState),
+	}
+}
+
+// Update applies a new configuration to the limiter. Subjects keep the
+// consumption of the policies that remain, under their new limits;
+// policies that are removed are forgotten, and new ones start full.
+func (l *RateLimiter) Update(cfg config.RateLimitConfig) {
+	updated := NewRateLimiter(cfg, l.metrics)
 
-// GetOrCreate retrieves the rate limiter for the given IP address,
-// creating a new one if it does not exist.
-func (l *rateLimiters) GetOrCreate(ip string, create func() *rate.Limiter) *rate.Limiter {
-	// Lock the mutex to ensure exclusive access to the visitors map.
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	// Check if a rate limiter already exists for the given IP address.
-	limiter, exists := l.visitors[ip]
-	if !exists {
-		// If not, create a new rate limiter using the provided create function.
-		limiter = create()
-		// Store the new rate limiter in the visitors map.
-		l.visitors[ip] = limiter
+	policies := make(map[string]*config.RateLimitPolicy, len(updated.policies))
+	for i := range updated.policies {
+		policies[updated.policies[i].PolicyName()] = &updated.policies[i]
 	}
 
-	return limiter
+	now := l.now()
+	for key, state := range l.states {
+		name, _, _ := strings.Cut(key, "\x00")
+		p, ok := policies[name]
+		if !ok {
+			delete(l.states, key)
+			continue
+		}
+		state.requests = resize(state.requests, p.Requests, p.Burst, p.Window, now)
+		state.tokens = resize(state.tokens, p.Tokens, p.TokenBurst, p.Window, now)
+	}
+	l.policies = updated.policies
+	l.idleTimeout = updated.idleTimeout
 }
 
-// RateLimit creates a new rate limit middleware that applies rate limiting
-// to incoming requests and tracks metrics.
-func RateLimit(metrics *metrics.Metrics) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Extract the IP address from the request.
-			ip := r.RemoteAddr
-			if idx := strings.LastIndex(ip, ":"); idx != -1 {
-				// Strip the port number if present.
-				ip = ip[:idx]
+// resize gives a bucket new limits, keeping its level within its new
+// capacity. A bucket without a limit is dropped, and one gaining a limit
+// starts full.
+func resize(b *bucket, limit, burst int, window time.Duration, now time.Time) *bucket {
+	if limit <= 0 {
+		return nil
+	}
+	resized := newBucket(limit, burst, window, now)
+	if b != nil {
+		b.refill(now)
+		resized.level = math.Min(resized.capacity, b.level)
+	}
+	return resized
+}
+
+// RateLimit creates a rate limit middleware that enforces the given
+// configuration and tracks rejections in the metrics.
+func RateLimit(cfg config.RateLimitConfig, m *metrics.Metrics) func(http.Handler) http.Handler {
+	return NewRateLimiter(cfg, m).Handler
+}
+
+// Handler admits a request only if every applicable policy has capacity
+// left, and charges the tokens the request consumed once it completes.
+// Requests generating several completions, such as chat completions with
+// several choices, are charged one request per completion.
+// Responses carry RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset
+// and RateLimit-Policy headers describing the closest limit; rejected
+// requests get a 429 with Retry-After.
+func (l *RateLimiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.mu.Lock()
+		now := l.now()
+		states, policies := l.applicable(r, now)
+		if len(states) == 0 {
+			l.mu.Unlock()
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var quotas []quota
+		var blocked *quota
+		var retryAfter time.Duration
+		for i, state := range states {
+			p := policies[i]
+			state.lastUsed = now
+			if state.requests != nil {
+				state.requests.refill(now)
+				quotas = append(quotas, quota{policy: p, limit: p.Requests, bucket: state.requests})
+			}
+			if state.tokens != nil {
+				state.tokens.refill(now)
+				quotas = append(quotas, quota{policy: p, limit: p.Tokens, bucket: state.tokens})
+			}
+		}
+		for i := range quotas {
+			if wait := quotas[i].bucket.wait(); wait > retryAfter {
+				retryAfter = wait
+				blocked = &quotas[i]
 			}
-			
-			// Get the rate limiter for the IP address, creating a new one if necessary.
-			limiter := limiters.GetOrCreate(ip, func() *rate.Limiter {
-				// Create a new rate limiter that allows 10 requests per minute.
-				return rate.NewLimiter(rate.Every(time.Minute), 10)
-			})
-
-			// Try to allow the request.
-			if !limiter.Allow() {
-				// If the request is not allowed, increment the rate limit hit metric.
-				metrics.RateLimitHits.WithLabelValues(ip).Inc()
-				var requestID string
-				if id := r.Context().Value(RequestIDKey); id != nil {
-					requestID = id.(string)
+		}
+		if blocked == nil {
+			// Admitted: the request counts against every request quota
+			for _, state := range states {
+				if state.requests != nil {
+					state.requests.level--
+				}
+			}
+		}
+		setRateLimitHeaders(w.Header(), quotas, blocked)
+		l.mu.Unlock()
+
+		if blocked != nil {
+			l.reject(w, r, blocked, retryAfter)
+			return
+		}
+
+		ctx, tracker := usage.NewContext(r.Context())
+		next.ServeHTTP(w, r.WithContext(ctx))
+
+		// Charge the tokens consumed and the completions beyond the first,
+		// which may put the buckets in debt
+		tokens, extra := tracker.TotalTokens(), tracker.Generations()-1
+		if tokens > 0 || extra > 0 {
+			l.mu.Lock()
+			now := l.now()
+			for _, state := range states {
+				if state.tokens != nil && tokens > 0 {
+					state.tokens.refill(now)
+					state.tokens.level -= float64(tokens)
 				}
+				if state.requests != nil && extra > 0 {
+					state.requests.refill(now)
+					state.requests.level -= float64(extra)
+				}
+			}
+			l.mu.Unlock()
+		}
+	})
+}
+
+// applicable returns the state of each policy that applies to the request,
+// along with the policies themselves, creating state as needed.
+// Callers hold l.mu.
+func (l *RateLimiter) applicable(r *http.Request, now time.Time) ([]*limiterState, []*config.RateLimitPolicy) {
+	subjects := requestSubjects(r)
+
+	// Within a scope, policies matching the subject replace general ones
+	matched := make(map[string]bool)
+	for i := range l.policies {
+		p := &l.policies[i]
+		if p.Match != "" && p.Match == subjects[p.Scope] {
+			matched[p.Scope] = true
+		}
+	}
 
-				// Create an error response for the rate limit exceeded error.
-				errResp := errors.NewError(
-					errors.RateLimitError,
-					"Rate limit exceeded",
-					http.StatusTooManyRequests,
-					requestID,
-					map[string]interface{}{
-						"limit":  int64(10), // Use int64 to ensure it's not converted to float64
-						"window": "1m0s",
-					},
-					nil,
-				)
-
-				// Write the error response to the writer.
-				errors.WriteError(w, errResp)
-				return
+	l.evictIdle(now)
+
+	var states []*limiterState
+	var policies []*config.RateLimitPolicy
+	for i := range l.policies {
+		p := &l.policies[i]
+		subject := subjects[p.Scope]
+		if p.Scope == config.RateLimitScopeTenant && subject == "" {
+			continue
+		}
+		if (p.Match != "" && p.Match != subject) || (p.Match == "" && matched[p.Scope]) {
+			continue
+		}
+
+		key := p.PolicyName() + "\x00" + subject
+		state, ok := l.states[key]
+		if !ok {
+			state = &limiterState{lastUsed: now}
+			if p.Requests > 0 {
+				state.requests = newBucket(p.Requests, p.Burst, p.Window, now)
+			}
+			if p.Tokens > 0 {
+				state.tokens = newBucket(p.Tokens, p.TokenBurst, p.Window, now)
 			}
+			l.states[key] = state
+		}
+		states = append(states, state)
+		policies = append(policies, p)
+	}
+	return states, policies
+}
 
-			// If the request is allowed, serve the next handler.
-			next.ServeHTTP(w, r)
-		})
+// requestSubjects returns the subject of the request in each scope: the
+// API key ID (or the client address when unauthenticated), the tenant,
+// the route path, and the empty subject shared by all requests.
+func requestSubjects(r *http.Request) map[string]string {
+	identity, authenticated := IdentityFromContext(r.Context())
+	subjects := map[string]string{
+		config.RateLimitScopeKey:    identity.KeyID,
+		config.RateLimitScopeTenant: identity.Tenant,
+		config.RateLimitScopeRoute:  r.URL.Path,
+		config.RateLimitScopeGlobal: "",
+	}
+	if !authenticated {
+		subjects[config.RateLimitScopeKey] = clientAddr(r)
+	}
+	return subjects
+}
+
+// evictIdle drops the state of subjects idle for longer than the idle
+// timeout. It sweeps at most twice per timeout. Callers hold l.mu.
+func (l *RateLimiter) evictIdle(now time.Time) {
+	if now.Sub(l.lastSweep) < l.idleTimeout/2 {
+		return
+	}
+	l.lastSweep = now
+	for key, state := range l.states {
+		if now.Sub(state.lastUsed) > l.idleTimeout {
+			delete(l.states, key)
+		}
+	}
+}
+
+// reject answers a request exceeding the blocked quota.
+func (l *RateLimiter) reject(w http.ResponseWriter, r *http.Request, blocked *quota, retryAfter time.Duration) {
+	var requestID string
+	if id := r.Context().Value(RequestIDKey); id != nil {
+		requestID = id.(string)
+	}
+
+	if l.metrics != nil {
+		client := KeyID(r.Context())
+		if client == "" {
+			client = clientAddr(r)
+		}
+		l.metrics.RateLimitHits.WithLabelValues(client).Inc()
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+	errors.WriteError(w, errors.NewError(
+		errors.RateLimitError,
+		"Rate limit exceeded",
+		http.StatusTooManyRequests,
+		requestID,
+		map[string]interface{}{
+			"limit":  int64(blocked.limit), // Use int64 to ensure it's not converted to float64
+			"window": blocked.policy.Window.String(),
+		},
+		nil,
+	))
+}
+
+// Len returns the number of subjects currently tracked.
+func (l *RateLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.states)
+}
+
+// Reset forgets all tracked subjects. Only used for testing.
+func (l *RateLimiter) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.states = make(map[string]*limiterState)
+}
+
+// setRateLimitHeaders describes the quota closest to exhaustion, or the
+// blocked one, in the RateLimit headers, and lists all policies.
+func setRateLimitHeaders(h http.Header, quotas []quota, blocked *quota) {
+	if len(quotas) == 0 {
+		return
+	}
+
+	closest := blocked
+	if closest == nil {
+		closest = &quotas[0]
+		for i := range quotas[1:] {
+			q := &quotas[i+1]
+			if q.bucket.level/q.bucket.capacity < closest.bucket.level/closest.bucket.capacity {
+				closest = q
+			}
+		}
+	}
+
+	policies := make([]string, len(quotas))
+	for i, q := range quotas {
+		policies[i] = fmt.Sprintf("%d;w=%d", q.limit, ceilSeconds(q.policy.Window))
+	}
+
+	remaining := int(math.Max(0, math.Floor(closest.bucket.level)))
+	h.Set("RateLimit-Limit", strconv.Itoa(closest.limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(closest.bucket.reset())))
+	h.Set("RateLimit-Policy", strings.Join(policies, ", "))
+}
+
+// clientAddr returns the host part of the request's remote address.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
 	}
+	return host
 }
 
-// ResetRateLimiters resets all rate limiters. Only used for testing.
-func ResetRateLimiters() {
-	limiters.mu.Lock()
-	defer limiters.mu.Unlock()
-	limiters.visitors = make(map[string]*rate.Limiter)
+// ceilSeconds rounds d up to whole seconds.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
 }
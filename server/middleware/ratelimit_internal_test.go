@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/teilomillet/hapax/config"
+)
+
+func TestRateLimiterRefillAndEviction(t *testing.T) {
+	now := time.Now()
+	l := NewRateLimiter(config.RateLimitConfig{
+		IdleTimeout: time.Minute,
+		Policies: []config.RateLimitPolicy{
+			{Scope: config.RateLimitScopeKey, Requests: 60, Burst: 2, Window: time.Minute},
+		},
+	}, nil)
+	l.now = func() time.Time { return now }
+
+	handler := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(addr string) int {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Burst allows two requests at once, then one per second
+	assert.Equal(t, http.StatusOK, serve("10.0.0.1:1000"))
+	assert.Equal(t, http.StatusOK, serve("10.0.0.1:1001"))
+	assert.Equal(t, http.StatusTooManyRequests, serve("10.0.0.1:1002"))
+	now = now.Add(time.Second)
+	assert.Equal(t, http.StatusOK, serve("10.0.0.1:1003"))
+	assert.Equal(t, http.StatusOK, serve("10.0.0.2:1000"))
+	assert.Equal(t, 2, l.Len())
+
+	// Idle clients are forgotten
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, http.StatusOK, serve("10.0.0.3:1000"))
+	assert.Equal(t, 1, l.Len())
+}
+
+func TestRateLimiterUpdate(t *testing.T) {
+	now := time.Now()
+	l := NewRateLimiter(config.RateLimitConfig{
+		Policies: []config.RateLimitPolicy{
+			{Name: "requests", Scope: config.RateLimitScopeKey, Requests: 60, Burst: 3, Window: time.Minute},
+			{Name: "global", Scope: config.RateLimitScopeGlobal, Requests: 1000, Window: time.Minute},
+		},
+	}, nil)
+	l.now = func() time.Time { return now }
+
+	handler := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.RemoteAddr = "10.0.0.1:1000"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, serve())
+	}
+
+	// The client keeps its consumption under the new limit, and the
+	// removed policy is forgotten
+	l.Update(config.RateLimitConfig{
+		Policies: []config.RateLimitPolicy{
+			{Name: "requests", Scope: config.RateLimitScopeKey, Requests: 60, Burst: 2, Window: time.Minute},
+		},
+	})
+	assert.Equal(t, 1, l.Len())
+	assert.Equal(t, http.StatusTooManyRequests, serve())
+	now = now.Add(time.Second)
+	assert.Equal(t, http.StatusOK, serve())
+}
@@ -1,25 +1,28 @@
 package middleware_test
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teilomillet/hapax/config"
 	"github.com/teilomillet/hapax/server/metrics"
 	"github.com/teilomillet/hapax/server/middleware"
+	"github.com/teilomillet/hapax/server/usage"
 )
 
 func TestRateLimitMetrics(t *testing.T) {
 	// Create new metrics instance for testing
 	m := metrics.NewMetrics()
 
-	// Reset rate limiters
-	middleware.ResetRateLimiters()
-
 	// Create test handler
-	handler := middleware.RateLimit(m)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	handler := middleware.RateLimit(config.RateLimitConfig{}, m)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	}))
 
@@ -51,3 +54,151 @@ func TestRateLimitMetrics(t *testing.T) {
 		}
 	}
 }
+
+// withIdentity simulates a request authenticated by the given key.
+func withIdentity(r *http.Request, keyID, tenant string) *http.Request {
+	ctx := context.WithValue(r.Context(), middleware.IdentityKey, middleware.Identity{KeyID: keyID, Tenant: tenant})
+	return r.WithContext(ctx)
+}
+
+func serve(handler http.Handler, path, keyID, tenant string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, nil)
+	if keyID != "" {
+		req = withIdentity(req, keyID, tenant)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestRateLimitPolicies(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	t.Run("keys are limited separately", func(t *testing.T) {
+		handler := middleware.RateLimit(config.RateLimitConfig{Policies: []config.RateLimitPolicy{
+			{Scope: config.RateLimitScopeKey, Requests: 2, Window: time.Minute},
+		}}, nil)(ok)
+
+		assert.Equal(t, http.StatusOK, serve(handler, "/v1/completions", "a", "").Code)
+		assert.Equal(t, http.StatusOK, serve(handler, "/v1/completions", "a", "").Code)
+		assert.Equal(t, http.StatusTooManyRequests, serve(handler, "/v1/completions", "a", "").Code)
+		assert.Equal(t, http.StatusOK, serve(handler, "/v1/completions", "b", "").Code)
+	})
+
+	t.Run("tenants share a limit across keys", func(t *testing.T) {
+		handler := middleware.RateLimit(config.RateLimitConfig{Policies: []config.RateLimitPolicy{
+			{Scope: config.RateLimitScopeTenant, Requests: 2, Window: time.Minute},
+		}}, nil)(ok)
+
+		assert.Equal(t, http.StatusOK, serve(handler, "/v1/completions", "a", "acme").Code)
+		assert.Equal(t, http.StatusOK, serve(handler, "/v1/completions", "b", "acme").Code)
+		assert.Equal(t, http.StatusTooManyRequests, serve(handler, "/v1/completions", "c", "acme").Code)
+		assert.Equal(t, http.StatusOK, serve(handler, "/v1/completions", "d", "globex").Code)
+		// Keys without a tenant are not subject to tenant policies
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, http.StatusOK, serve(handler, "/v1/completions", "e", "").Code)
+		}
+	})
+
+	t.Run("matching policies override general ones", func(t *testing.T) {
+		handler := middleware.RateLimit(config.RateLimitConfig{Policies: []config.RateLimitPolicy{
+			{Scope: config.RateLimitScopeKey, Requests: 1, Window: time.Minute},
+			{Scope: config.RateLimitScopeKey, Match: "batch", Requests: 3, Window: time.Minute},
+		}}, nil)(ok)
+
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, http.StatusOK, serve(handler, "/v1/completions", "batch", "").Code)
+		}
+		assert.Equal(t, http.StatusTooManyRequests, serve(handler, "/v1/completions", "batch", "").Code)
+
+		assert.Equal(t, http.StatusOK, serve(handler, "/v1/completions", "other", "").Code)
+		assert.Equal(t, http.StatusTooManyRequests, serve(handler, "/v1/completions", "other", "").Code)
+	})
+
+	t.Run("routes are limited per path", func(t *testing.T) {
+		handler := middleware.RateLimit(config.RateLimitConfig{Policies: []config.RateLimitPolicy{
+			{Scope: config.RateLimitScopeRoute, Match: "/v1/messages", Requests: 1, Window: time.Minute},
+		}}, nil)(ok)
+
+		assert.Equal(t, http.StatusOK, serve(handler, "/v1/messages", "a", "").Code)
+		assert.Equal(t, http.StatusTooManyRequests, serve(handler, "/v1/messages", "b", "").Code)
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, http.StatusOK, serve(handler, "/v1/completions", "a", "").Code)
+		}
+	})
+
+	t.Run("the strictest policy applies", func(t *testing.T) {
+		handler := middleware.RateLimit(config.RateLimitConfig{Policies: []config.RateLimitPolicy{
+			{Scope: config.RateLimitScopeKey, Requests: 5, Window: time.Minute},
+			{Scope: config.RateLimitScopeGlobal, Requests: 2, Window: time.Minute},
+		}}, nil)(ok)
+
+		assert.Equal(t, http.StatusOK, serve(handler, "/v1/completions", "a", "").Code)
+		assert.Equal(t, http.StatusOK, serve(handler, "/v1/completions", "b", "").Code)
+		assert.Equal(t, http.StatusTooManyRequests, serve(handler, "/v1/completions", "c", "").Code)
+	})
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	handler := middleware.RateLimit(config.RateLimitConfig{Policies: []config.RateLimitPolicy{
+		{Scope: config.RateLimitScopeKey, Requests: 2, Window: time.Minute},
+	}}, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	w := serve(handler, "/v1/completions", "a", "")
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "30", w.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "2;w=60", w.Header().Get("RateLimit-Policy"))
+	assert.Empty(t, w.Header().Get("Retry-After"))
+
+	serve(handler, "/v1/completions", "a", "")
+	w = serve(handler, "/v1/completions", "a", "")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.InDelta(t, 30, retryAfter, 1, "one request refills every 30s")
+}
+
+func TestRateLimitTokens(t *testing.T) {
+	handler := middleware.RateLimit(config.RateLimitConfig{Policies: []config.RateLimitPolicy{
+		{Scope: config.RateLimitScopeKey, Tokens: 100, Window: time.Minute},
+	}}, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		usage.Record(r.Context(), 40, 80)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// The first request overshoots the budget, which blocks the next one
+	assert.Equal(t, http.StatusOK, serve(handler, "/v1/completions", "a", "").Code)
+	w := serve(handler, "/v1/completions", "a", "")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "100", w.Header().Get("RateLimit-Limit"))
+
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.InDelta(t, 13, retryAfter, 1, "21 tokens at 100 per minute")
+
+	assert.Equal(t, http.StatusOK, serve(handler, "/v1/completions", "b", "").Code)
+}
+
+func TestRateLimitGenerations(t *testing.T) {
+	handler := middleware.RateLimit(config.RateLimitConfig{Policies: []config.RateLimitPolicy{
+		{Scope: config.RateLimitScopeKey, Requests: 4, Window: time.Minute},
+	}}, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			usage.Record(r.Context(), 1, 1)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// A request generating three completions is charged three requests
+	assert.Equal(t, http.StatusOK, serve(handler, "/v1/chat/completions", "a", "").Code)
+	w := serve(handler, "/v1/chat/completions", "a", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, http.StatusTooManyRequests, serve(handler, "/v1/chat/completions", "a", "").Code)
+}
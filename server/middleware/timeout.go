@@ -4,6 +4,8 @@ package middleware
 import (
 	"context"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/teilomillet/hapax/errors"
@@ -11,11 +13,91 @@ import (
 
 const defaultTimeout = 5 * time.Second
 
+// idleTimeoutContext is a context whose deadline can be pushed back.
+// It is canceled with context.DeadlineExceeded when no activity was
+// reported for the timeout duration, or when its parent is done.
+type idleTimeoutContext struct {
+	context.Context
+
+	timeout time.Duration
+	done    chan struct{}
+
+	mu       sync.Mutex
+	deadline time.Time
+	timer    *time.Timer
+	err      error
+	stop     func() bool
+}
+
+// newIdleTimeoutContext returns a context that expires after timeout
+// unless extend is called, and a function to release its resources.
+func newIdleTimeoutContext(parent context.Context, timeout time.Duration) (*idleTimeoutContext, context.CancelFunc) {
+	c := &idleTimeoutContext{
+		Context:  parent,
+		timeout:  timeout,
+		done:     make(chan struct{}),
+		deadline: time.Now().Add(timeout),
+	}
+
+	// Hold the lock so that neither callback runs before both are set up
+	c.mu.Lock()
+	c.timer = time.AfterFunc(timeout, func() { c.cancel(context.DeadlineExceeded) })
+	c.stop = context.AfterFunc(parent, func() { c.cancel(parent.Err()) })
+	c.mu.Unlock()
+
+	return c, func() { c.cancel(context.Canceled) }
+}
+
+// extend restarts the idle timer, unless the context is already done.
+func (c *idleTimeoutContext) extend() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.deadline = time.Now().Add(c.timeout)
+	c.timer.Reset(c.timeout)
+}
+
+func (c *idleTimeoutContext) cancel(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	c.timer.Stop()
+	c.stop()
+	close(c.done)
+}
+
+// Deadline returns the current deadline, which moves on every extend.
+func (c *idleTimeoutContext) Deadline() (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deadline, true
+}
+
+// Done returns a channel closed when the context expires or is canceled.
+func (c *idleTimeoutContext) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns context.DeadlineExceeded after the idle timeout elapsed.
+func (c *idleTimeoutContext) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
 // timeoutWriter wraps http.ResponseWriter to track if a response has been written
 // It uses a channel to signal when the response has been sent.
+// Flushes mark the response as streaming and push the timeout back.
 type timeoutWriter struct {
 	http.ResponseWriter
-	written chan bool
+	written   chan bool
+	ctx       *idleTimeoutContext
+	streaming atomic.Bool
 }
 
 // Write writes the data to the connection and tracks if the response has been written.
@@ -30,6 +112,22 @@ func (tw *timeoutWriter) Write(b []byte) (int, error) {
 	return n, err
 }
 
+// Flush sends buffered data to the client. A flushed response is a stream,
+// so the timeout is restarted: it bounds the idle time between chunks
+// rather than the duration of the whole stream.
+func (tw *timeoutWriter) Flush() {
+	tw.streaming.Store(true)
+	tw.ctx.extend()
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying writer for http.ResponseController.
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
 // WriteHeader sends an HTTP response header and tracks if the response has been written.
 func (tw *timeoutWriter) WriteHeader(code int) {
 	// Call the original WriteHeader method.
@@ -56,14 +154,20 @@ func (tw *timeoutWriter) hasWritten() bool {
 // The Timeout middleware works by creating a new context with a timeout, and using a custom 
 // timeoutWriter to track whether a response has been written. If the request times out and 
 // no response has been written, it sends a timeout error response.
+//
+// Streaming responses (handlers that flush) restart the timeout on every flush,
+// so a long-lived stream is only aborted when it stalls. Once a stream has
+// started no error response is written: the context is canceled and the
+// middleware waits for the handler to stop writing.
 func Timeout(timeout time.Duration) func(http.Handler) http.Handler {
+	// Set once, as requests share the closure
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			// Create a context with timeout
-			if timeout == 0 {
-				timeout = defaultTimeout
-			}
-			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			ctx, cancel := newIdleTimeoutContext(r.Context(), timeout)
 			defer cancel() // Ensure cancel is called to release resources
 			
 			// Create a channel to signal completion
@@ -73,6 +177,7 @@ func Timeout(timeout time.Duration) func(http.Handler) http.Handler {
 			tw := &timeoutWriter{
 				ResponseWriter: w,
 				written:       make(chan bool, 1),
+				ctx:           ctx,
 			}
 
 			// Process the request in a goroutine
@@ -93,6 +198,12 @@ func Timeout(timeout time.Duration) func(http.Handler) http.Handler {
 				return
 			case <-ctx.Done():
 				// Request timed out
+				if tw.streaming.Load() {
+					// Part of the stream was sent, so the status can no
+					// longer change; let the handler observe cancellation
+					<-done
+					return
+				}
 				if !tw.hasWritten() {
 					// Only write error if nothing has been written yet
 					var requestID string
@@ -1,6 +1,7 @@
 package mocks
 
 import (
+	"sync"
 	"sync/atomic"
 
 	"github.com/teilomillet/hapax/config"
@@ -10,6 +11,8 @@ import (
 type MockConfigWatcher struct {
 	currentConfig atomic.Value
 	subscribers   []chan *config.Config
+	mu            sync.Mutex // serializes updates
+	apply         func(*config.Config) error
 }
 
 // Verify at compile time that MockConfigWatcher implements config.Watcher
@@ -44,6 +47,28 @@ func (m *MockConfigWatcher) Subscribe() <-chan *config.Config {
 	return ch
 }
 
+// SetApplier implements config.Watcher
+func (m *MockConfigWatcher) SetApplier(apply func(*config.Config) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.apply = apply
+}
+
+// Reload implements config.Watcher. There is no file to reload.
+func (m *MockConfigWatcher) Reload() error {
+	return nil
+}
+
+// Check implements config.Watcher
+func (m *MockConfigWatcher) Check() (string, error) {
+	return "mock", nil
+}
+
+// Status implements config.Watcher
+func (m *MockConfigWatcher) Status() config.ReloadStatus {
+	return config.ReloadStatus{Version: "mock"}
+}
+
 // Close implements config.Watcher
 func (m *MockConfigWatcher) Close() error {
 	for _, ch := range m.subscribers {
@@ -53,8 +78,17 @@ func (m *MockConfigWatcher) Close() error {
 	return nil
 }
 
-// UpdateConfig is a test helper that simulates configuration changes
-func (m *MockConfigWatcher) UpdateConfig(cfg *config.Config) {
+// UpdateConfig is a test helper that simulates configuration changes. Like
+// a reload, the change is applied before it is stored; when the applier
+// fails, its error is returned and the configuration is unchanged.
+func (m *MockConfigWatcher) UpdateConfig(cfg *config.Config) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.apply != nil {
+		if err := m.apply(cfg); err != nil {
+			return err
+		}
+	}
 	m.currentConfig.Store(cfg)
 
 	for _, ch := range m.subscribers {
@@ -64,4 +98,5 @@ func (m *MockConfigWatcher) UpdateConfig(cfg *config.Config) {
 			// Skip if channel is blocked
 		}
 	}
+	return nil
 }
@@ -2,6 +2,7 @@ package mocks
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/teilomillet/gollm"
@@ -28,6 +29,13 @@ type MockLLM struct {
 	DebugFunc    func(string, ...interface{})
 	Provider     string // Provider name for testing
 	Model        string // Model name for testing
+
+	// LastOptions holds the generation options of the last GenerateWithOptions call
+	LastOptions map[string]interface{}
+	optionsMu   sync.Mutex // Serializes concurrent calls recording LastOptions
+
+	// FinishReason is reported by GenerateWithOptions and GenerateStream
+	FinishReason string
 }
 
 // NewMockLLM creates a new MockLLM with optional generate function.
@@ -66,6 +74,16 @@ func (m *MockLLM) Generate(ctx context.Context, prompt *gollm.Prompt, opts ...ll
 	return "", nil
 }
 
+// GenerateWithOptions records the per-request generation options in
+// LastOptions and otherwise behaves like Generate, reporting FinishReason.
+func (m *MockLLM) GenerateWithOptions(ctx context.Context, prompt *gollm.Prompt, options map[string]interface{}) (string, string, error) {
+	m.optionsMu.Lock()
+	m.LastOptions = options
+	m.optionsMu.Unlock()
+	content, err := m.Generate(ctx, prompt)
+	return content, m.FinishReason, err
+}
+
 // Debug captures debug messages if DebugFunc is provided.
 // This allows tests to verify logging behavior if needed.
 func (m *MockLLM) Debug(format string, args ...interface{}) {
@@ -162,3 +180,46 @@ func (m *MockLLM) SetOllamaEndpoint(endpoint string) error {
 func (m *MockLLM) SetSystemPrompt(prompt string, cacheType llm.CacheType) {
 	// No-op for mock
 }
+
+// MockStreamingLLM extends MockLLM with incremental generation, for testing
+// streaming responses. GenerateStream uses StreamFunc when set and otherwise
+// emits the result of Generate as a single chunk.
+type MockStreamingLLM struct {
+	*MockLLM
+	StreamFunc func(ctx context.Context, prompt *gollm.Prompt, emit func(string) error) (string, error)
+}
+
+// NewMockStreamingLLM creates a streaming mock that emits the given chunks in order.
+func NewMockStreamingLLM(chunks ...string) *MockStreamingLLM {
+	return &MockStreamingLLM{
+		MockLLM: NewMockLLM(nil),
+		StreamFunc: func(ctx context.Context, prompt *gollm.Prompt, emit func(string) error) (string, error) {
+			var content string
+			for _, chunk := range chunks {
+				if err := ctx.Err(); err != nil {
+					return content, err
+				}
+				if err := emit(chunk); err != nil {
+					return content, err
+				}
+				content += chunk
+			}
+			return content, nil
+		},
+	}
+}
+
+// GenerateStream delivers the response chunk by chunk through emit,
+// reporting FinishReason. Options are recorded in LastOptions.
+func (m *MockStreamingLLM) GenerateStream(ctx context.Context, prompt *gollm.Prompt, options map[string]interface{}, emit func(string) error) (string, string, error) {
+	m.LastOptions = options
+	if m.StreamFunc != nil {
+		content, err := m.StreamFunc(ctx, prompt, emit)
+		return content, m.FinishReason, err
+	}
+	content, err := m.Generate(ctx, prompt)
+	if err != nil {
+		return "", "", err
+	}
+	return content, m.FinishReason, emit(content)
+}
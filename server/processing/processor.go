@@ -10,6 +10,9 @@ import (
 
 	"github.com/teilomillet/gollm"
 	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/server/provider"
+	"github.com/teilomillet/hapax/server/usage"
+	"github.com/teilomillet/hapax/server/validation"
 )
 
 // Processor handles request processing and response formatting for LLM interactions.
@@ -29,6 +32,7 @@ type Processor struct {
 	templates     map[string]*template.Template // Compiled templates for request formatting
 	config        *config.ProcessingConfig      // Configuration for processing behavior
 	defaultPrompt string                        // Default system prompt for all requests
+	manager       *provider.Manager             // Optional provider manager (failover, caching)
 }
 
 // NewProcessor creates a new processor instance with the given configuration and LLM.
@@ -86,6 +90,84 @@ func NewProcessor(cfg *config.ProcessingConfig, llm gollm.LLM) (*Processor, erro
 // The processor will use the "default" template if no matching template
 // is found for the request type.
 func (p *Processor) ProcessRequest(ctx context.Context, req *Request) (*Response, error) {
+	prompt, err := p.buildPrompt(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := p.generate(ctx, prompt, req)
+	if err != nil {
+		return nil, fmt.Errorf("LLM processing failed: %w", err)
+	}
+
+	response := p.formatResponse(resp.Content)
+	response.Provider = resp.Provider
+	response.Usage = usageOf(resp)
+	response.Deduplicated = resp.Deduplicated
+	response.FinishReason = resp.FinishReason
+	return response, nil
+}
+
+// ProcessStream is the streaming counterpart of ProcessRequest. Generated text
+// is passed to emit chunk by chunk as the provider produces it. Response
+// formatting is not applied to streamed chunks, since it needs the whole
+// response; the returned Response carries the complete raw content.
+//
+// emit returning an error (for example because the client went away)
+// stops generation.
+func (p *Processor) ProcessStream(ctx context.Context, req *Request, emit func(chunk string) error) (*Response, error) {
+	prompt, err := p.buildPrompt(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.manager == nil {
+		// Text streamed before a failure was generated, and is accounted for too
+		var streamed strings.Builder
+		defer func() {
+			if streamed.Len() > 0 {
+				usage.Record(ctx, provider.PromptTokens(prompt), validation.CountTokens(streamed.String()))
+			}
+		}()
+
+		content, finishReason, err := provider.StreamFrom(ctx, p.llm, prompt, req.Options, func(chunk string) error {
+			streamed.WriteString(chunk)
+			return emit(chunk)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("LLM processing failed: %w", err)
+		}
+		return &Response{
+			Content:  content,
+			Provider: p.llm.GetProvider(),
+			Usage: &Usage{
+				PromptTokens:     provider.PromptTokens(prompt),
+				CompletionTokens: validation.CountTokens(content),
+			},
+			FinishReason: finishReason,
+		}, nil
+	}
+
+	// The provider manager records usage itself
+	resp, err := p.manager.GenerateStream(ctx, generateRequest(prompt, req), emit)
+	if err != nil {
+		return nil, fmt.Errorf("LLM processing failed: %w", err)
+	}
+	return &Response{Content: resp.Content, Provider: resp.Provider, Usage: usageOf(resp), FinishReason: resp.FinishReason}, nil
+}
+
+// usageOf reports the usage of a generation to the client.
+func usageOf(resp *provider.GenerateResponse) *Usage {
+	return &Usage{
+		PromptTokens:     resp.PromptTokens,
+		CompletionTokens: resp.CompletionTokens,
+		EstimatedCost:    resp.Cost,
+	}
+}
+
+// buildPrompt validates the request and converts it into an LLM prompt,
+// prepending the default system prompt and applying templates to single inputs.
+func (p *Processor) buildPrompt(req *Request) (*gollm.Prompt, error) {
 	if req == nil {
 		return nil, fmt.Errorf("request cannot be nil")
 	}
@@ -146,12 +228,43 @@ func (p *Processor) ProcessRequest(ctx context.Context, req *Request) (*Response
 		fmt.Printf("DEBUG: Message[%d] - Role: '%s', Content: '%s'\n", i, msg.Role, msg.Content)
 	}
 
-	response, err := p.llm.Generate(ctx, prompt)
-	if err != nil {
-		return nil, fmt.Errorf("LLM processing failed: %w", err)
+	return prompt, nil
+}
+
+// generate sends the prompt through the provider manager when one is set,
+// so that failover, retries and response caching apply, and falls back to
+// the processor's LLM otherwise. Token usage is recorded in the usage
+// tracker of ctx on both paths; without a manager, no cost is estimated.
+func (p *Processor) generate(ctx context.Context, prompt *gollm.Prompt, req *Request) (*provider.GenerateResponse, error) {
+	if p.manager == nil {
+		content, finishReason, err := provider.GenerateFrom(ctx, p.llm, prompt, req.Options)
+		if err != nil {
+			return nil, err
+		}
+		resp := &provider.GenerateResponse{
+			Content:          content,
+			Provider:         p.llm.GetProvider(),
+			Model:            p.llm.GetModel(),
+			PromptTokens:     provider.PromptTokens(prompt),
+			CompletionTokens: validation.CountTokens(content),
+			FinishReason:     finishReason,
+		}
+		usage.Record(ctx, resp.PromptTokens, resp.CompletionTokens)
+		return resp, nil
 	}
 
-	return p.formatResponse(response), nil
+	return p.manager.Generate(ctx, generateRequest(prompt, req))
+}
+
+// generateRequest describes req to the provider manager.
+func generateRequest(prompt *gollm.Prompt, req *Request) *provider.GenerateRequest {
+	return &provider.GenerateRequest{
+		Prompt:  prompt,
+		Model:   req.Model,
+		Options: req.Options,
+		NoCache: req.NoCache,
+		Retry:   req.Retry,
+	}
 }
 
 // formatResponse applies configured formatting options to the LLM response:
@@ -174,6 +287,12 @@ func (p *Processor) formatResponse(content string) *Response {
 	return &Response{Content: content}
 }
 
+// SetManager routes generation through the given provider manager
+// instead of calling the processor's LLM directly.
+func (p *Processor) SetManager(m *provider.Manager) {
+	p.manager = m
+}
+
 // SetDefaultPrompt sets the system prompt to be used for all requests.
 // This prompt provides context and instructions to the LLM.
 func (p *Processor) SetDefaultPrompt(prompt string) {
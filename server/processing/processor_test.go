@@ -9,6 +9,7 @@ import (
 	"github.com/teilomillet/gollm"
 	"github.com/teilomillet/hapax/config"
 	"github.com/teilomillet/hapax/server/mocks"
+	"github.com/teilomillet/hapax/server/usage"
 )
 
 // TestNewProcessor verifies the initialization of the Processor.
@@ -504,3 +505,47 @@ func TestAnthropicStyleConversations(t *testing.T) {
 		})
 	}
 }
+
+// TestUsageRecording verifies that generated tokens are recorded in the
+// usage tracker of the request context, including text streamed before
+// a failure.
+func TestUsageRecording(t *testing.T) {
+	cfg := &config.ProcessingConfig{RequestTemplates: map[string]string{"default": "{{.Input}}"}}
+
+	t.Run("completion", func(t *testing.T) {
+		processor, err := NewProcessor(cfg, mocks.NewMockLLM(func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			return "four words long here", nil
+		}))
+		assert.NoError(t, err)
+
+		ctx, tracker := usage.NewContext(context.Background())
+		_, err = processor.ProcessRequest(ctx, &Request{Input: "Hello there"})
+		assert.NoError(t, err)
+		assert.Positive(t, tracker.PromptTokens())
+		assert.Positive(t, tracker.CompletionTokens())
+	})
+
+	t.Run("interrupted stream", func(t *testing.T) {
+		processor, err := NewProcessor(cfg, mocks.NewMockStreamingLLM("partial ", "answer"))
+		assert.NoError(t, err)
+
+		ctx, tracker := usage.NewContext(context.Background())
+		_, err = processor.ProcessStream(ctx, &Request{Input: "Hello"}, func(chunk string) error {
+			return fmt.Errorf("client went away")
+		})
+		assert.Error(t, err)
+		assert.Positive(t, tracker.CompletionTokens(), "text already generated is accounted for")
+	})
+
+	t.Run("failed generation", func(t *testing.T) {
+		processor, err := NewProcessor(cfg, mocks.NewMockLLM(func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			return "", fmt.Errorf("provider down")
+		}))
+		assert.NoError(t, err)
+
+		ctx, tracker := usage.NewContext(context.Background())
+		_, err = processor.ProcessRequest(ctx, &Request{Input: "Hello"})
+		assert.Error(t, err)
+		assert.Zero(t, tracker.TotalTokens())
+	})
+}
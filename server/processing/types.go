@@ -2,6 +2,8 @@
 // It handles template-based request transformation, LLM communication, and response formatting.
 package processing
 
+import "github.com/teilomillet/hapax/config"
+
 // Message represents a single message in a conversation.
 // This follows the standard chat format used by most LLM providers,
 // where each message has a role (e.g., "user", "assistant", "system")
@@ -26,6 +28,15 @@ type Request struct {
 	Messages []Message `json:"messages,omitempty"` // Used for chat completion requests
 	// FunctionDescription is used for function-calling requests
 	FunctionDescription string `json:"function_description,omitempty"`
+	// Retry overrides the server's retry policy for this request (optional)
+	Retry *config.RetryConfig `json:"-"`
+	// Model is the model requested by the client (optional)
+	Model string `json:"-"`
+	// Options holds generation parameters such as temperature (optional)
+	Options map[string]interface{} `json:"-"`
+	// NoCache bypasses the response cache, e.g. when several distinct
+	// completions are requested for the same prompt
+	NoCache bool `json:"-"`
 }
 
 // Response represents the processed output from the LLM.
@@ -35,10 +46,28 @@ type Request struct {
 // Future extensions might include:
 // - Metadata about the processing (e.g., truncation info)
 // - Multiple response formats (e.g., text, structured data)
-// - Usage statistics (tokens, processing time)
 type Response struct {
 	// Content is the processed response content
 	Content string `json:"content"` // The processed response content
+	// Provider names the provider that served the request
+	Provider string `json:"provider,omitempty"`
+	// Usage reports the tokens consumed and their estimated cost
+	Usage *Usage `json:"usage,omitempty"`
+	// Deduplicated reports whether the response was shared with a
+	// concurrent identical request
+	Deduplicated bool `json:"-"`
+	// FinishReason tells why generation ended, as reported by the provider
+	// (see provider.GenerateResponse)
+	FinishReason string `json:"-"`
 	// Error holds any error information
 	Error string `json:"error,omitempty"`
 }
+
+// Usage reports the tokens consumed by a request and their estimated cost
+// in USD, based on the pricing table of the configuration. Responses served
+// from the cache cost nothing.
+type Usage struct {
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	EstimatedCost    float64 `json:"estimated_cost"`
+}
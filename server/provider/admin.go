@@ -0,0 +1,188 @@
+package provider
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/sony/gobreaker"
+	"github.com/teilomillet/hapax/server/circuitbreaker"
+)
+
+// ProviderMode tells whether a provider gets traffic. Modes are set at
+// runtime and last until the providers are rebuilt from configuration.
+type ProviderMode string
+
+const (
+	// ModeActive providers get traffic (default)
+	ModeActive ProviderMode = "active"
+	// ModeDraining providers get new traffic only when no active provider
+	// can serve it, while their requests in flight complete
+	ModeDraining ProviderMode = "draining"
+	// ModeDisabled providers get no traffic
+	ModeDisabled ProviderMode = "disabled"
+)
+
+// ProviderState is the state of a provider as reported to administrators.
+type ProviderState struct {
+	Name     string         `json:"name"`
+	Type     string         `json:"type"`
+	Model    string         `json:"model"`
+	Mode     ProviderMode   `json:"mode"`
+	InFlight int64          `json:"in_flight"` // Requests in flight, none once a draining provider is drained
+	Health   ProviderHealth `json:"health"`
+	Breaker  BreakerState   `json:"breaker"`
+}
+
+// BreakerState is the state and counts of a provider's circuit breaker.
+type BreakerState struct {
+	State                string `json:"state"`  // closed, half-open or open
+	Forced               bool   `json:"forced"` // Whether the state is forced by an administrator
+	Requests             uint32 `json:"requests"`
+	TotalSuccesses       uint32 `json:"total_successes"`
+	TotalFailures        uint32 `json:"total_failures"`
+	ConsecutiveSuccesses uint32 `json:"consecutive_successes"`
+	ConsecutiveFailures  uint32 `json:"consecutive_failures"`
+}
+
+// Providers returns the state of each provider, in order of preference.
+func (m *Manager) Providers() []ProviderState {
+	preference := m.getProviderPreference()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	states := make([]ProviderState, 0, len(preference))
+	for _, name := range preference {
+		provider, exists := m.providers[name]
+		if !exists {
+			continue
+		}
+		state := ProviderState{
+			Name:     name,
+			Type:     provider.GetProvider(),
+			Model:    provider.GetModel(),
+			Mode:     m.mode(name),
+			InFlight: m.inFlight(name).Load(),
+			Health:   m.providerHealth(name),
+		}
+		if breaker := m.breakers[name]; breaker != nil {
+			counts := breaker.Counts()
+			state.Breaker = BreakerState{
+				State:                breaker.State().String(),
+				Forced:               breaker.Forced(),
+				Requests:             counts.Requests,
+				TotalSuccesses:       counts.TotalSuccesses,
+				TotalFailures:        counts.TotalFailures,
+				ConsecutiveSuccesses: counts.ConsecutiveSuccesses,
+				ConsecutiveFailures:  counts.ConsecutiveFailures,
+			}
+		}
+		states = append(states, state)
+	}
+	return states
+}
+
+// SetProviderMode sets whether the named provider gets traffic.
+func (m *Manager) SetProviderMode(name string, mode ProviderMode) error {
+	switch mode {
+	case ModeActive, ModeDraining, ModeDisabled:
+	default:
+		return fmt.Errorf("invalid provider mode: %s", mode)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.providers[name]; !exists {
+		return fmt.Errorf("%s: %w", name, ErrUnknownProvider)
+	}
+	if mode == ModeActive {
+		delete(m.modes, name)
+	} else {
+		m.modes[name] = mode
+	}
+	return nil
+}
+
+// ForceBreaker holds the circuit breaker of the named provider open or
+// closed until ReleaseBreaker.
+func (m *Manager) ForceBreaker(name string, state gobreaker.State) error {
+	breaker, err := m.breaker(name)
+	if err != nil {
+		return err
+	}
+	return breaker.Force(state)
+}
+
+// ReleaseBreaker lets the circuit breaker of the named provider trip on
+// its own again, starting over closed.
+func (m *Manager) ReleaseBreaker(name string) error {
+	breaker, err := m.breaker(name)
+	if err != nil {
+		return err
+	}
+	breaker.Release()
+	return nil
+}
+
+// SetPreference reorders the failover chain. preference must list every
+// provider exactly once; disabling a provider takes it out of rotation.
+func (m *Manager) SetPreference(preference []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seen := make(map[string]bool, len(preference))
+	for _, name := range preference {
+		if _, exists := m.providers[name]; !exists {
+			return fmt.Errorf("%s: %w", name, ErrUnknownProvider)
+		}
+		if seen[name] {
+			return fmt.Errorf("provider %s is listed more than once", name)
+		}
+		seen[name] = true
+	}
+	if len(seen) != len(m.providers) {
+		return fmt.Errorf("preference must list all %d providers", len(m.providers))
+	}
+
+	m.preference = slices.Clone(preference)
+	return nil
+}
+
+// breaker returns the circuit breaker of the named provider.
+func (m *Manager) breaker(name string) (*circuitbreaker.CircuitBreaker, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	breaker, exists := m.breakers[name]
+	if !exists {
+		return nil, fmt.Errorf("%s: %w", name, ErrUnknownProvider)
+	}
+	return breaker, nil
+}
+
+// mode returns the mode of the named provider. Callers hold m.mu.
+func (m *Manager) mode(name string) ProviderMode {
+	if mode, ok := m.modes[name]; ok {
+		return mode
+	}
+	return ModeActive
+}
+
+// serving splits preference into the active providers and the draining
+// ones, leaving the disabled ones out.
+func (m *Manager) serving(preference []string) (active, draining []string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	active = make([]string, 0, len(preference))
+	for _, name := range preference {
+		switch m.mode(name) {
+		case ModeActive:
+			active = append(active, name)
+		case ModeDraining:
+			draining = append(draining, name)
+		}
+	}
+	return active, draining
+}
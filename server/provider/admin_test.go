@@ -0,0 +1,86 @@
+package provider_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sony/gobreaker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teilomillet/gollm"
+	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/server/mocks"
+	"github.com/teilomillet/hapax/server/provider"
+	"go.uber.org/zap"
+)
+
+func TestProviderAdministration(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		TestMode: true,
+		CircuitBreaker: config.CircuitBreakerConfig{
+			Timeout:  time.Minute,
+			TestMode: true,
+		},
+	}
+	manager, err := provider.NewManager(cfg, zap.NewNop(), prometheus.NewRegistry())
+	require.NoError(t, err)
+	for _, name := range []string{"primary", "secondary", "backup"} {
+		name := name
+		require.NoError(t, manager.SetProvider(name, mocks.NewMockLLMWithConfig("openai", "gpt-4o",
+			func(ctx context.Context, p *gollm.Prompt) (string, error) {
+				return name, nil
+			})))
+	}
+	serving := func() string {
+		resp, err := manager.Generate(context.Background(), experimentRequest())
+		require.NoError(t, err)
+		return resp.Provider
+	}
+
+	t.Run("preference", func(t *testing.T) {
+		assert.ErrorIs(t, manager.SetPreference([]string{"backup", "primary", "unknown"}), provider.ErrUnknownProvider)
+		assert.Error(t, manager.SetPreference([]string{"backup", "primary"}), "every provider must be listed")
+		assert.Error(t, manager.SetPreference([]string{"backup", "primary", "primary"}))
+
+		require.NoError(t, manager.SetPreference([]string{"secondary", "primary", "backup"}))
+		assert.Equal(t, "secondary", serving())
+		require.NoError(t, manager.SetPreference([]string{"primary", "secondary", "backup"}))
+	})
+
+	t.Run("modes", func(t *testing.T) {
+		// A draining provider is passed over, but still serves when no
+		// active provider is left
+		require.NoError(t, manager.SetProviderMode("primary", provider.ModeDraining))
+		assert.Equal(t, "secondary", serving())
+		require.NoError(t, manager.SetProviderMode("secondary", provider.ModeDisabled))
+		require.NoError(t, manager.SetProviderMode("backup", provider.ModeDisabled))
+		assert.Equal(t, "primary", serving())
+
+		for _, name := range []string{"primary", "secondary", "backup"} {
+			require.NoError(t, manager.SetProviderMode(name, provider.ModeActive))
+		}
+		assert.Equal(t, "primary", serving())
+		assert.ErrorIs(t, manager.SetProviderMode("unknown", provider.ModeDisabled), provider.ErrUnknownProvider)
+		assert.Error(t, manager.SetProviderMode("primary", "paused"))
+	})
+
+	t.Run("breakers", func(t *testing.T) {
+		require.NoError(t, manager.ForceBreaker("primary", gobreaker.StateOpen))
+		assert.Equal(t, "secondary", serving())
+
+		states := manager.Providers()
+		require.Len(t, states, 3)
+		assert.Equal(t, "primary", states[0].Name)
+		assert.Equal(t, "open", states[0].Breaker.State)
+		assert.True(t, states[0].Breaker.Forced)
+		assert.Zero(t, states[0].Health.ErrorCount, "rejected calls do not count against the provider")
+
+		require.NoError(t, manager.ReleaseBreaker("primary"))
+		assert.Equal(t, "primary", serving())
+		assert.ErrorIs(t, manager.ForceBreaker("unknown", gobreaker.StateOpen), provider.ErrUnknownProvider)
+	})
+}
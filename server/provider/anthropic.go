@@ -0,0 +1,186 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/teilomillet/gollm"
+	"github.com/teilomillet/gollm/llm"
+)
+
+const (
+	// anthropicVersion is the version of the Messages API requested
+	anthropicVersion = "2023-06-01"
+
+	// anthropicMaxTokens caps completions that set no max_tokens, which
+	// the Messages API requires
+	anthropicMaxTokens = 4096
+)
+
+// anthropicLLM calls the Anthropic Messages API.
+type anthropicLLM struct {
+	apiClient
+}
+
+// anthropicRequest is the body of a Messages API request.
+type anthropicRequest struct {
+	Model         string        `json:"model"`
+	System        string        `json:"system,omitempty"`
+	Messages      []chatMessage `json:"messages"`
+	MaxTokens     int           `json:"max_tokens"`
+	Temperature   *float64      `json:"temperature,omitempty"`
+	TopP          *float64      `json:"top_p,omitempty"`
+	StopSequences []string      `json:"stop_sequences,omitempty"`
+	Stream        bool          `json:"stream,omitempty"`
+}
+
+// anthropicFinishReasons maps the stop reasons of the Messages API onto
+// the Finish reasons.
+var anthropicFinishReasons = map[string]string{
+	"end_turn":      FinishStop,
+	"max_tokens":    FinishLength,
+	"stop_sequence": FinishStopSequence,
+}
+
+// anthropicResponse is a message.
+type anthropicResponse struct {
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	StopReason string `json:"stop_reason"`
+}
+
+// anthropicEvent is an event of a message stream. Only the fields of the
+// events that carry text, the stop reason or errors are read.
+type anthropicEvent struct {
+	Type  string `json:"type"`
+	Delta struct {
+		Type       string `json:"type"`
+		Text       string `json:"text"`
+		StopReason string `json:"stop_reason"`
+	} `json:"delta"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Generate implements gollm.LLM.
+func (l *anthropicLLM) Generate(ctx context.Context, prompt *gollm.Prompt, _ ...llm.GenerateOption) (string, error) {
+	content, _, err := l.complete(ctx, prompt, nil, nil)
+	return content, err
+}
+
+// GenerateWithOptions implements ParameterizedLLM, passing stop as the
+// stop_sequences of the message.
+func (l *anthropicLLM) GenerateWithOptions(ctx context.Context, prompt *gollm.Prompt, options map[string]interface{}) (string, string, error) {
+	return l.complete(ctx, prompt, options, nil)
+}
+
+// GenerateStream implements StreamingLLM, reading the text deltas of the
+// message as the provider sends them.
+func (l *anthropicLLM) GenerateStream(ctx context.Context, prompt *gollm.Prompt, options map[string]interface{}, emit func(chunk string) error) (string, string, error) {
+	return l.complete(ctx, prompt, options, emit)
+}
+
+// complete requests a message, streamed to emit unless it is nil.
+func (l *anthropicLLM) complete(ctx context.Context, prompt *gollm.Prompt, options map[string]interface{}, emit func(chunk string) error) (content, finishReason string, err error) {
+	opts, err := parseOptions(l.GetProvider(), options)
+	if err != nil {
+		return "", "", err
+	}
+
+	// System messages are a parameter of the Messages API
+	req := &anthropicRequest{
+		Model:         l.model,
+		MaxTokens:     anthropicMaxTokens,
+		Temperature:   opts.temperature,
+		TopP:          opts.topP,
+		StopSequences: opts.stop,
+		Stream:        emit != nil,
+	}
+	if opts.maxTokens != nil {
+		req.MaxTokens = *opts.maxTokens
+	}
+	var system []string
+	for _, msg := range chatMessages(prompt) {
+		if msg.Role == "system" {
+			system = append(system, msg.Content)
+			continue
+		}
+		req.Messages = append(req.Messages, msg)
+	}
+	req.System = strings.Join(system, "\n\n")
+
+	header := http.Header{}
+	header.Set("anthropic-version", anthropicVersion)
+	if l.apiKey != "" {
+		header.Set("x-api-key", l.apiKey)
+	}
+	resp, err := l.post(ctx, "/v1/messages", header, req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	var text strings.Builder
+	if emit == nil {
+		var message anthropicResponse
+		if err := json.NewDecoder(resp.Body).Decode(&message); err != nil {
+			return "", "", llm.NewLLMError(llm.ErrorTypeResponse, "failed to decode response", err)
+		}
+		for _, block := range message.Content {
+			if block.Type == "text" {
+				text.WriteString(block.Text)
+			}
+		}
+		return text.String(), anthropicFinishReason(message.StopReason), nil
+	}
+
+	finished := false
+	err = readEvents(resp.Body, func(_, data string) error {
+		var event anthropicEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return llm.NewLLMError(llm.ErrorTypeResponse, "failed to decode event", err)
+		}
+		switch event.Type {
+		case "content_block_delta":
+			if event.Delta.Type != "text_delta" || event.Delta.Text == "" {
+				return nil
+			}
+			text.WriteString(event.Delta.Text)
+			return emit(event.Delta.Text)
+		case "message_delta":
+			if event.Delta.StopReason != "" {
+				finishReason = anthropicFinishReason(event.Delta.StopReason)
+			}
+		case "message_stop":
+			finished = true
+			return errStreamEnd
+		case "error":
+			return fmt.Errorf("%s API error: %s: %s", l.GetProvider(), event.Error.Type, event.Error.Message)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStreamEnd) {
+		return text.String(), finishReason, err
+	}
+	if !finished {
+		return text.String(), finishReason, fmt.Errorf("%s stream ended before completion", l.GetProvider())
+	}
+	return text.String(), finishReason, nil
+}
+
+// anthropicFinishReason maps a stop reason of the Messages API onto the
+// Finish reasons, passing through those without an equivalent.
+func anthropicFinishReason(stopReason string) string {
+	if reason, ok := anthropicFinishReasons[stopReason]; ok {
+		return reason
+	}
+	return stopReason
+}
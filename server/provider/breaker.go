@@ -0,0 +1,65 @@
+package provider
+
+import (
+	"errors"
+	"time"
+
+	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/server/circuitbreaker"
+)
+
+// breakerConfig returns the circuit breaker settings of the named provider
+// in cfg, with defaults for the fields left unset.
+func breakerConfig(cfg *config.Config, name string) circuitbreaker.Config {
+	settings := cfg.CircuitBreakerFor(name)
+
+	cbConfig := circuitbreaker.Config{
+		Name:             name,
+		MaxRequests:      1,               // Allow 1 request in half-open state
+		Interval:         time.Minute * 2, // Cyclic period of closed state
+		Timeout:          time.Minute,     // Period of open state
+		FailureThreshold: 3,               // Trip after 3 consecutive failures
+		ErrorRate:        settings.ErrorRate / 100,
+		MinRequests:      10, // Requests before the error rate applies
+		IsExcluded:       excludedFromBreaker,
+		TestMode:         settings.TestMode,
+	}
+
+	// Override with config values if provided
+	if settings.MaxRequests > 0 {
+		cbConfig.MaxRequests = settings.MaxRequests
+	}
+	if settings.Interval > 0 {
+		cbConfig.Interval = settings.Interval
+	}
+	if settings.Timeout > 0 {
+		cbConfig.Timeout = settings.Timeout
+	}
+	if settings.FailureThreshold > 0 {
+		cbConfig.FailureThreshold = settings.FailureThreshold
+	}
+	if settings.MinRequests > 0 {
+		cbConfig.MinRequests = settings.MinRequests
+	}
+	return cbConfig
+}
+
+// UpdateCircuitBreakers applies the circuit breaker settings of cfg to the
+// breakers of the current providers, and to those added later. Breakers
+// keep their state unless their timing settings change.
+func (m *Manager) UpdateCircuitBreakers(cfg *config.Config) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.breakerCfg = cfg
+	for name, breaker := range m.breakers {
+		breaker.Reconfigure(breakerConfig(cfg, name))
+	}
+}
+
+// excludedFromBreaker reports the errors that do not count as failures of
+// a provider: client errors, and calls their caller abandoned.
+func excludedFromBreaker(err error) bool {
+	var abandoned *abandonedError
+	return errors.As(err, &abandoned) || isClientError(err)
+}
@@ -0,0 +1,121 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sony/gobreaker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teilomillet/gollm"
+	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/server/mocks"
+	"go.uber.org/zap"
+)
+
+func TestCircuitBreakerSettings(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		TestMode: true,
+		Providers: map[string]config.ProviderConfig{
+			"primary": {CircuitBreaker: &config.CircuitBreakerConfig{FailureThreshold: 2}},
+		},
+		CircuitBreaker: config.CircuitBreakerConfig{
+			Timeout:          time.Minute,
+			FailureThreshold: 5,
+			TestMode:         true,
+		},
+	}
+	m, err := NewManager(cfg, zap.NewNop(), prometheus.NewRegistry())
+	require.NoError(t, err)
+
+	var failure error
+	require.NoError(t, m.SetProvider("primary", mocks.NewMockLLMWithConfig("openai", "gpt-4o",
+		func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			return "", failure
+		})))
+	require.NoError(t, m.SetProvider("backup", mocks.NewMockLLMWithConfig("anthropic", "claude-3-haiku",
+		func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			return "backup", nil
+		})))
+
+	generate := func() error {
+		_, err := m.Generate(context.Background(), &GenerateRequest{
+			Prompt:  &gollm.Prompt{Messages: []gollm.PromptMessage{{Role: "user", Content: "hello"}}},
+			NoCache: true,
+		})
+		return err
+	}
+
+	// The provider's own threshold takes precedence over the global one
+	assert.Equal(t, uint32(2), breakerConfig(cfg, "primary").FailureThreshold)
+	assert.Equal(t, uint32(5), breakerConfig(cfg, "backup").FailureThreshold)
+
+	// Client errors never trip the circuit
+	failure = errors.New("API request failed with status code 400: invalid request")
+	for i := 0; i < 3; i++ {
+		assert.Error(t, generate())
+	}
+	assert.Equal(t, gobreaker.StateClosed, m.breakers["primary"].State())
+
+	// A lower threshold applies to the running breakers in place
+	updated := *cfg
+	updated.Providers = map[string]config.ProviderConfig{
+		"primary": {CircuitBreaker: &config.CircuitBreakerConfig{FailureThreshold: 1}},
+	}
+	m.UpdateCircuitBreakers(&updated)
+
+	failure = errors.New("API request failed with status code 503: service unavailable")
+	assert.NoError(t, generate(), "the tripped circuit fails over to the backup")
+	assert.Equal(t, gobreaker.StateOpen, m.breakers["primary"].State())
+}
+
+func TestAbandonedCallsSkipBreaker(t *testing.T) {
+	t.Parallel()
+
+	m, err := NewManager(&config.Config{
+		TestMode:       true,
+		CircuitBreaker: config.CircuitBreakerConfig{Timeout: time.Minute, FailureThreshold: 1, TestMode: true},
+	}, zap.NewNop(), prometheus.NewRegistry())
+	require.NoError(t, err)
+
+	calls := 0
+	started := make(chan struct{}, 1)
+	require.NoError(t, m.SetProvider("primary", mocks.NewMockLLMWithConfig("openai", "gpt-4o",
+		func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			calls++
+			started <- struct{}{}
+			<-ctx.Done()
+			return "", errors.New("API request failed with status code 503: connection closed")
+		})))
+	generate := func(ctx context.Context) error {
+		// Each caller has its own call, which ends with its context
+		_, err := m.Generate(WithDeduplication(ctx, false), &GenerateRequest{
+			Prompt:  &gollm.Prompt{Messages: []gollm.PromptMessage{{Role: "user", Content: "hello"}}},
+			NoCache: true,
+		})
+		return err
+	}
+
+	// A call abandoned before it starts never reaches the provider
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, generate(ctx))
+	assert.Zero(t, calls)
+	assert.Zero(t, m.breakers["primary"].Counts().Requests)
+
+	// A call abandoned while in flight is not a failure of the provider
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	assert.Error(t, generate(ctx))
+	assert.Equal(t, 1, calls)
+	assert.Zero(t, m.breakers["primary"].Counts().TotalFailures)
+	assert.Equal(t, gobreaker.StateClosed, m.breakers["primary"].State())
+}
@@ -0,0 +1,81 @@
+package provider
+
+import (
+	"context"
+	"time"
+
+	"github.com/teilomillet/hapax/server/middleware"
+)
+
+// sharedCallTimeout bounds a deduplicated call whose first caller set no
+// deadline.
+const sharedCallTimeout = 5 * time.Minute
+
+// dedupKey is the context key of the deduplication switch of a request.
+type dedupKey struct{}
+
+// WithDeduplication returns a context under which concurrent identical
+// requests are coalesced into one provider call (the default) or, when
+// enabled is false, each get their own. Routes use it to apply their
+// dedup setting.
+func WithDeduplication(ctx context.Context, enabled bool) context.Context {
+	return context.WithValue(ctx, dedupKey{}, enabled)
+}
+
+// deduplicates reports whether requests made with ctx may be coalesced.
+func deduplicates(ctx context.Context) bool {
+	enabled, ok := ctx.Value(dedupKey{}).(bool)
+	return !ok || enabled
+}
+
+// coalescingKey scopes the fingerprint of a request to the API key of
+// ctx, so that callers of different keys never share a provider call.
+func coalescingKey(ctx context.Context, fingerprint string) string {
+	return middleware.KeyID(ctx) + "\x00" + fingerprint
+}
+
+// flight is a deduplicated call and the callers waiting for it. The call
+// runs on ctx, which outlives the cancellation of any one caller and is
+// cancelled once none is left.
+type flight struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
+}
+
+// joinFlight registers a caller of the deduplicated call of key, starting
+// a flight if none is in progress. The flight's context keeps the values
+// and deadline of the caller that started it, with a deadline of
+// sharedCallTimeout when that caller set none.
+func (m *Manager) joinFlight(ctx context.Context, key string) *flight {
+	m.flightsMu.Lock()
+	defer m.flightsMu.Unlock()
+
+	f, ok := m.flights[key]
+	if !ok {
+		f = &flight{}
+		if deadline, ok := ctx.Deadline(); ok {
+			f.ctx, f.cancel = context.WithDeadline(context.WithoutCancel(ctx), deadline)
+		} else {
+			f.ctx, f.cancel = context.WithTimeout(context.WithoutCancel(ctx), sharedCallTimeout)
+		}
+		m.flights[key] = f
+	}
+	f.waiters++
+	return f
+}
+
+// leaveFlight unregisters a caller of the flight of key, cancelling the
+// call when it was the last one. The cancelled call is forgotten, so that
+// callers arriving before it returns start a new one rather than join it.
+func (m *Manager) leaveFlight(key string, f *flight) {
+	m.flightsMu.Lock()
+	defer m.flightsMu.Unlock()
+
+	if f.waiters--; f.waiters > 0 {
+		return
+	}
+	f.cancel()
+	m.group.Forget(key)
+	delete(m.flights, key)
+}
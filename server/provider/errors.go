@@ -1,8 +1,35 @@
 package provider
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	// ErrNoHealthyProvider indicates that no healthy provider is available
 	ErrNoHealthyProvider = errors.New("no healthy provider available")
+
+	// ErrUnknownProvider indicates that no provider has the given name
+	ErrUnknownProvider = errors.New("unknown provider")
 )
+
+// UnknownModelError indicates that a request named a model that is
+// neither in the model registry nor served by any provider.
+type UnknownModelError struct {
+	Model string
+}
+
+func (e *UnknownModelError) Error() string {
+	return fmt.Sprintf("unknown model: %s", e.Model)
+}
+
+// UnsupportedOptionError indicates that a request set a generation option,
+// such as top_p, that the provider serving it cannot honor.
+type UnsupportedOptionError struct {
+	Provider string // Type of the provider
+	Option   string // Name of the option
+}
+
+func (e *UnsupportedOptionError) Error() string {
+	return fmt.Sprintf("%s provider does not support the %s option", e.Provider, e.Option)
+}
@@ -2,7 +2,9 @@ package provider
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
 	"time"
 
 	"github.com/sony/gobreaker"
@@ -13,31 +15,85 @@ import (
 
 // result represents the outcome of an LLM operation
 type result struct {
-	err    error
-	status HealthStatus
-	name   string
+	err          error
+	name         string
+	model        string // Model of the provider that produced the content
+	content      string // Generated text, shared with deduplicated callers
+	finishReason string // Why generation ended, empty when the provider does not say
 }
 
-// Execute coordinates provider execution with proper error handling
+// operationFunc is a provider call that yields generated text and why
+// generation ended. It must make the call with ctx, which is cancelled
+// when the call is abandoned.
+type operationFunc func(ctx context.Context, llm gollm.LLM) (content, finishReason string, err error)
+
+// Execute coordinates provider execution with proper error handling.
+// Concurrent calls with the same prompt and API key share one execution.
 func (m *Manager) Execute(ctx context.Context, operation func(llm gollm.LLM) error, prompt *gollm.Prompt) error {
-	key := m.generateRequestKey(prompt)
+	key := coalescingKey(ctx, requestFingerprint(&GenerateRequest{Prompt: prompt}))
 	m.logger.Debug("Starting Execute", zap.String("key", key))
 
-	v, err, shared := m.group.Do(key, func() (interface{}, error) {
-		return m.executeWithRetries(ctx, operation)
+	_, _, err := m.execute(ctx, key, m.retry.Load(), nil, func(_ context.Context, llm gollm.LLM) (string, string, error) {
+		return "", "", operation(llm)
 	})
+	return err
+}
+
+// execute runs operation through the providers serving req (any, when
+// nil), deduplicating concurrent calls that share the same key unless ctx
+// disables it; shared reports whether the result came from such a call.
+// A deduplicated call is not cancelled with the caller that started it,
+// only once all its callers are gone. Transient failures are retried on
+// the same provider according to policy before failing over. Completions
+// are hedged when hedging is enabled.
+func (m *Manager) execute(ctx context.Context, key string, policy *RetryPolicy, req *GenerateRequest, operation operationFunc) (r *result, shared bool, err error) {
+	run := func(ctx context.Context) (interface{}, error) {
+		if hedging := m.hedging.Load(); req != nil && hedging != nil {
+			return m.executeHedged(ctx, hedging, policy, req, operation)
+		}
+		return m.executeWithRetries(ctx, policy, req, operation)
+	}
+
+	var v interface{}
+	if deduplicates(ctx) {
+		// A caller already gone must not start a call
+		if err := ctx.Err(); err != nil {
+			return nil, false, err
+		}
+		f := m.joinFlight(ctx, key)
+		defer m.leaveFlight(key, f)
+
+		select {
+		case res := <-m.group.DoChan(key, func() (interface{}, error) { return run(f.ctx) }):
+			v, err, shared = res.Val, res.Err, res.Shared
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	} else {
+		v, err = run(ctx)
+	}
 
 	if err != nil {
 		m.logger.Debug("Execute failed", zap.Error(err))
-		return err
+		return nil, shared, err
 	}
 
 	m.handleRequestMetrics(shared)
-	return m.processResult(v.(*result))
+	r = v.(*result)
+	return r, shared, m.processResult(r)
 }
 
-func (m *Manager) executeWithRetries(ctx context.Context, operation func(llm gollm.LLM) error) (*result, error) {
-	preference := m.getProviderPreference()
+func (m *Manager) executeWithRetries(ctx context.Context, policy *RetryPolicy, req *GenerateRequest, operation operationFunc) (*result, error) {
+	preference, err := m.selectionOrder(ctx, req)
+	if err != nil {
+		return &result{err: err}, err
+	}
+	return m.tryProviders(ctx, policy, preference, operation)
+}
+
+// tryProviders runs operation on the providers of preference in turn,
+// failing over as the circuit breakers allow.
+func (m *Manager) tryProviders(ctx context.Context, policy *RetryPolicy, preference []string, operation operationFunc) (*result, error) {
 	if len(preference) == 0 {
 		return &result{
 			err: fmt.Errorf("no providers configured"),
@@ -49,12 +105,12 @@ func (m *Manager) executeWithRetries(ctx context.Context, operation func(llm gol
 	// Try each provider in sequence
 	for _, name := range preference {
 		provider, breaker, status := m.getProviderResources(name)
-		if provider == nil || breaker == nil || !status.Healthy {
+		if provider == nil || breaker == nil || !status.Healthy || m.outliers.Load().ejected(name) {
 			continue
 		}
 
 		// Try the current provider
-		currentResult := m.executeOperation(ctx, operation, provider, breaker, status, name)
+		currentResult := m.attemptProvider(ctx, policy, operation, provider, breaker, name)
 		lastResult = currentResult
 
 		if currentResult.err == nil {
@@ -62,6 +118,12 @@ func (m *Manager) executeWithRetries(ctx context.Context, operation func(llm gol
 			return currentResult, nil
 		}
 
+		// Part of a streamed response already reached the client, so
+		// another provider cannot take over
+		if isPartialStream(currentResult.err) {
+			return currentResult, currentResult.err
+		}
+
 		// **Key Insight**
 		// =================
 		//
@@ -117,26 +179,87 @@ func (m *Manager) executeWithRetries(ctx context.Context, operation func(llm gol
 	return lastResult, lastResult.err
 }
 
+// attemptProvider calls a single provider, retrying failures whose class
+// the policy marks as retryable. Retrying stops as soon as the provider's
+// breaker opens so that failover to the next provider is not delayed.
+func (m *Manager) attemptProvider(
+	ctx context.Context,
+	policy *RetryPolicy,
+	operation operationFunc,
+	provider gollm.LLM,
+	breaker *circuitbreaker.CircuitBreaker,
+	name string) *result {
+
+	for retries := 0; ; retries++ {
+		r := m.executeOperation(ctx, operation, provider, breaker, name)
+		if r.err == nil {
+			return r
+		}
+
+		class := ClassifyError(r.err)
+		if !policy.shouldRetry(class, retries) || breaker.State() == gobreaker.StateOpen {
+			return r
+		}
+
+		delay := policy.backoff(retries, retryAfterHint(r.err))
+		if err := sleep(ctx, delay); err != nil {
+			m.logger.Debug("giving up retries",
+				zap.String("provider", name),
+				zap.String("class", string(class)),
+				zap.Duration("delay", delay),
+				zap.Error(err))
+			return r
+		}
+
+		m.logger.Debug("retrying provider call",
+			zap.String("provider", name),
+			zap.String("class", string(class)),
+			zap.Int("retry", retries+1),
+			zap.Duration("delay", delay))
+		m.retries.WithLabelValues(name, string(class)).Inc()
+	}
+}
+
 // executeOperation handles a single operation attempt with proper resource cleanup
 func (m *Manager) executeOperation(
 	ctx context.Context,
-	operation func(llm gollm.LLM) error,
+	operation operationFunc,
 	provider gollm.LLM,
 	breaker *circuitbreaker.CircuitBreaker,
-	status HealthStatus,
 	name string) *result {
 
+	// A call abandoned before it starts does not reach the breaker
+	if err := ctx.Err(); err != nil {
+		return &result{err: err, name: name}
+	}
+
 	start := time.Now()
 
+	inFlight := m.inFlight(name)
+	inFlight.Add(1)
+	defer inFlight.Add(-1)
+
+	var content, finishReason string
 	err := breaker.Execute(func() error {
-		// Always check context before executing operation
-		if err := ctx.Err(); err != nil {
-			return err
+		var err error
+		content, finishReason, err = operation(ctx, provider)
+		if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+			return &abandonedError{err: err}
 		}
-		return operation(provider)
+		return err
 	})
+	var abandoned *abandonedError
+	if errors.As(err, &abandoned) {
+		err = abandoned.err
+	}
 
 	duration := time.Since(start)
+	// Calls the breaker rejected never reached the provider
+	rejected := errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests)
+	if abandoned == nil && !rejected {
+		m.recordCall(name, duration, err)
+		m.outliers.Load().record(name, duration, err)
+	}
 	breakerState := breaker.State()
 	breakerCounts := breaker.Counts()
 
@@ -149,45 +272,40 @@ func (m *Manager) executeOperation(
 			zap.Uint32("consecutive_failures", breakerCounts.ConsecutiveFailures))
 
 		return &result{
-			err: err,
-			status: HealthStatus{
-				Healthy:          false,
-				LastCheck:        time.Now(),
-				ErrorCount:       status.ErrorCount + 1,
-				ConsecutiveFails: int(breakerCounts.ConsecutiveFailures),
-				Latency:          duration,
-				RequestCount:     status.RequestCount + 1,
-			},
+			err:  err,
 			name: name,
 		}
 	}
 
+	if hedging := m.hedging.Load(); hedging != nil {
+		hedging.observe(name, duration)
+	}
+
 	return &result{
-		err: nil,
-		status: HealthStatus{
-			Healthy:          true,
-			LastCheck:        time.Now(),
-			ErrorCount:       0,
-			ConsecutiveFails: 0,
-			Latency:          duration,
-			RequestCount:     status.RequestCount + 1,
-		},
-		name: name,
+		err:          nil,
+		name:         name,
+		model:        provider.GetModel(),
+		content:      content,
+		finishReason: finishReason,
 	}
 }
 
-// generateRequestKey creates a consistent key based on the prompt content and role
-func (m *Manager) generateRequestKey(prompt *gollm.Prompt) string {
-	return fmt.Sprintf("%s-%s", prompt.Messages[0].Content, prompt.Messages[0].Role)
+// abandonedError is the error of a call its caller cancelled (client gone,
+// hedge lost), which says nothing about the provider's health: the breaker
+// excludes it from its failures.
+type abandonedError struct {
+	err error
 }
 
+func (e *abandonedError) Error() string { return e.err.Error() }
+
+func (e *abandonedError) Unwrap() error { return e.err }
+
 // getProviderPreference safely retrieves the current provider preference list
 func (m *Manager) getProviderPreference() []string {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	preference := make([]string, len(m.cfg.ProviderPreference))
-	copy(preference, m.cfg.ProviderPreference)
-	return preference
+	return slices.Clone(m.preference)
 }
 
 // getProviderResources safely retrieves provider-related resources
@@ -210,10 +328,14 @@ func (m *Manager) handleRequestMetrics(shared bool) {
 	}
 }
 
-// processResult handles the final result and updates provider health status
+// processResult handles the final result, marking the provider that
+// served it healthy
 func (m *Manager) processResult(r *result) error {
 	if r.name != "" {
-		m.UpdateHealthStatus(r.name, r.status)
+		status := m.GetHealthStatus(r.name)
+		status.Healthy = true
+		status.LastCheck = time.Now()
+		m.UpdateHealthStatus(r.name, status)
 	}
 	return r.err
 }
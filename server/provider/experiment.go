@@ -0,0 +1,161 @@
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"time"
+
+	"github.com/teilomillet/gollm"
+	"github.com/teilomillet/hapax/config"
+	"go.uber.org/zap"
+)
+
+// Experiment variants, as labeled in metrics
+const (
+	variantControl   = "control"
+	variantCandidate = "candidate"
+	variantShadow    = "shadow"
+)
+
+// shadowTimeout bounds a shadow call, which outlives the client request.
+const shadowTimeout = time.Minute
+
+// maxShadowCalls bounds the shadow calls in flight. Sampled requests
+// beyond it are not shadowed, so that a slow candidate cannot pile up
+// goroutines.
+const maxShadowCalls = 64
+
+// sample reports whether a request falls in the sampled percentage.
+func sample(percent float64) bool {
+	return rand.Float64()*100 < percent
+}
+
+// experimentKey is the context key of the traffic split of a request.
+type experimentKey struct{}
+
+// WithExperiment returns a context under which the manager applies the
+// given traffic split to requests. Routes use it to run their experiment.
+func WithExperiment(ctx context.Context, split *config.TrafficSplit) context.Context {
+	return context.WithValue(ctx, experimentKey{}, split)
+}
+
+// runExperiment serves req with call, applying the traffic split of ctx.
+// In split mode, sampled requests are restricted to the candidate. In
+// shadow mode, every request is served as usual and, once it succeeds, a
+// copy of the sampled ones is sent to the candidate in the background.
+// The latency and outcome of each variant are recorded.
+func (m *Manager) runExperiment(ctx context.Context, req *GenerateRequest, call func(*GenerateRequest) (*GenerateResponse, error)) (*GenerateResponse, error) {
+	split, _ := ctx.Value(experimentKey{}).(*config.TrafficSplit)
+	if split == nil {
+		return call(req)
+	}
+
+	sampled := sample(split.Percent)
+	variant := variantControl
+	served := req
+	if sampled && !split.Shadow() {
+		variant = variantCandidate
+		candidate := *req
+		candidate.Target = &split.Candidate
+		served = &candidate
+	}
+
+	start := time.Now()
+	resp, err := call(served)
+	latency := time.Since(start)
+	m.recordVariant(split.Name, variant, latency, err)
+
+	if sampled && split.Shadow() && err == nil {
+		m.shadow(ctx, split, req, resp, latency)
+	}
+	return resp, err
+}
+
+// shadow sends a copy of req to the first provider matching the candidate
+// of split and logs the length and hash of its response, and whether it
+// matches the primary one; the content is only logged, at debug level,
+// when the split opts in with LogResponses. The call runs in the
+// background, detached from the cancellation of ctx, and goes straight to
+// the provider: it bypasses the cache, deduplication, usage accounting and
+// circuit breakers, so it can neither slow down nor trip anything serving
+// clients.
+func (m *Manager) shadow(ctx context.Context, split *config.TrafficSplit, req *GenerateRequest, primary *GenerateResponse, primaryLatency time.Duration) {
+	name, llm := m.candidateProvider(split.Candidate)
+	if llm == nil {
+		m.logger.Warn("No provider for shadow candidate",
+			zap.String("experiment", split.Name),
+			zap.String("candidate", split.Candidate.String()))
+		m.experimentRequests.WithLabelValues(split.Name, variantShadow, "dropped").Inc()
+		return
+	}
+
+	select {
+	case m.shadowSlots <- struct{}{}:
+	default:
+		m.experimentRequests.WithLabelValues(split.Name, variantShadow, "dropped").Inc()
+		return
+	}
+
+	go func() {
+		defer func() { <-m.shadowSlots }()
+
+		shadowCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shadowTimeout)
+		defer cancel()
+
+		start := time.Now()
+		content, _, err := GenerateFrom(shadowCtx, llm, req.Prompt, req.Options)
+		latency := time.Since(start)
+		m.recordVariant(split.Name, variantShadow, latency, err)
+
+		fields := []zap.Field{
+			zap.String("experiment", split.Name),
+			zap.String("provider", name),
+			zap.Duration("latency", latency),
+			zap.String("primary_provider", primary.Provider),
+			zap.Duration("primary_latency", primaryLatency),
+		}
+		if err != nil {
+			m.logger.Info("Shadow request failed", append(fields, zap.Error(err))...)
+			return
+		}
+		hash := sha256.Sum256([]byte(content))
+		fields = append(fields,
+			zap.Bool("matches_primary", content == primary.Content),
+			zap.Int("response_length", len(content)),
+			zap.String("response_sha256", hex.EncodeToString(hash[:])))
+		m.logger.Info("Shadow request completed", fields...)
+		if split.LogResponses {
+			m.logger.Debug("Shadow response", append(fields,
+				zap.String("response", content),
+				zap.String("primary_response", primary.Content))...)
+		}
+	}()
+}
+
+// candidateProvider returns the first active provider in preference order
+// that matches target, or a nil provider when none does.
+func (m *Manager) candidateProvider(target config.ModelTarget) (string, gollm.LLM) {
+	preference, _ := m.serving(m.getProviderPreference())
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, name := range preference {
+		if llm, exists := m.providers[name]; exists && target.Matches(name, llm.GetProvider(), llm.GetModel()) {
+			return name, llm
+		}
+	}
+	return "", nil
+}
+
+// recordVariant records the latency and outcome of a request served by a
+// variant of an experiment.
+func (m *Manager) recordVariant(experiment, variant string, latency time.Duration, err error) {
+	status := "ok"
+	if err != nil {
+		status = "error"
+	}
+	m.experimentRequests.WithLabelValues(experiment, variant, status).Inc()
+	m.experimentLatency.WithLabelValues(experiment, variant).Observe(latency.Seconds())
+}
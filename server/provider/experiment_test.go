@@ -0,0 +1,174 @@
+package provider_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teilomillet/gollm"
+	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/server/mocks"
+	"github.com/teilomillet/hapax/server/provider"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func newExperimentManager(t *testing.T, registry *prometheus.Registry, logger *zap.Logger, candidate func(ctx context.Context, p *gollm.Prompt) (string, error)) *provider.Manager {
+	cfg := &config.Config{
+		TestMode: true,
+		CircuitBreaker: config.CircuitBreakerConfig{
+			Timeout:  time.Minute,
+			TestMode: true,
+		},
+	}
+
+	manager, err := provider.NewManager(cfg, logger, registry)
+	require.NoError(t, err)
+	require.NoError(t, manager.SetProvider("primary", mocks.NewMockLLMWithConfig("openai", "gpt-4o",
+		func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			return "primary", nil
+		})))
+	require.NoError(t, manager.SetProvider("candidate", mocks.NewMockLLMWithConfig("anthropic", "claude-3-5-sonnet", candidate)))
+	return manager
+}
+
+func experimentRequest() *provider.GenerateRequest {
+	return &provider.GenerateRequest{
+		Prompt:  &gollm.Prompt{Messages: []gollm.PromptMessage{{Role: "user", Content: "hello"}}},
+		NoCache: true,
+	}
+}
+
+func TestTrafficSplit(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+	manager := newExperimentManager(t, registry, zap.NewNop(), func(ctx context.Context, p *gollm.Prompt) (string, error) {
+		return "candidate", nil
+	})
+
+	generate := func(percent float64) *provider.GenerateResponse {
+		ctx := provider.WithExperiment(context.Background(), &config.TrafficSplit{
+			Name:      "sonnet",
+			Percent:   percent,
+			Candidate: config.ModelTarget{Provider: "anthropic"},
+		})
+		resp, err := manager.Generate(ctx, experimentRequest())
+		require.NoError(t, err)
+		return resp
+	}
+
+	assert.Equal(t, "candidate", generate(100).Provider, "sampled requests go to the candidate")
+	assert.Equal(t, "primary", generate(0).Provider, "other requests are served as usual")
+
+	// Without an experiment, the candidate only serves as a failover target
+	resp, err := manager.Generate(context.Background(), experimentRequest())
+	require.NoError(t, err)
+	assert.Equal(t, "primary", resp.Provider)
+
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP hapax_experiment_requests_total Requests served by experiment variant (control, candidate or shadow) and status
+# TYPE hapax_experiment_requests_total counter
+hapax_experiment_requests_total{experiment="sonnet",status="ok",variant="candidate"} 1
+hapax_experiment_requests_total{experiment="sonnet",status="ok",variant="control"} 1
+`), "hapax_experiment_requests_total"))
+	count, err := testutil.GatherAndCount(registry, "hapax_experiment_request_duration_seconds")
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func TestTrafficShadow(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+	called := make(chan struct{}, 1)
+	release := make(chan struct{})
+	manager := newExperimentManager(t, registry, zap.NewNop(), func(ctx context.Context, p *gollm.Prompt) (string, error) {
+		called <- struct{}{}
+		<-release
+		return "", fmt.Errorf("candidate overloaded")
+	})
+
+	// The client request is cancelled as soon as it returns, which must
+	// not cancel the shadow call
+	ctx, cancel := context.WithCancel(provider.WithExperiment(context.Background(), &config.TrafficSplit{
+		Name:      "sonnet",
+		Mode:      config.SplitModeShadow,
+		Percent:   100,
+		Candidate: config.ModelTarget{Provider: "candidate"},
+	}))
+	resp, err := manager.Generate(ctx, experimentRequest())
+	cancel()
+
+	// The client gets the primary response while the candidate is still busy
+	require.NoError(t, err)
+	assert.Equal(t, "primary", resp.Provider)
+	assert.Equal(t, "primary", resp.Content)
+
+	select {
+	case <-called:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the candidate was not called")
+	}
+	close(release)
+
+	assert.Eventually(t, func() bool {
+		count, err := testutil.GatherAndCount(registry, "hapax_experiment_request_duration_seconds")
+		return err == nil && count == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP hapax_experiment_requests_total Requests served by experiment variant (control, candidate or shadow) and status
+# TYPE hapax_experiment_requests_total counter
+hapax_experiment_requests_total{experiment="sonnet",status="error",variant="shadow"} 1
+hapax_experiment_requests_total{experiment="sonnet",status="ok",variant="control"} 1
+`), "hapax_experiment_requests_total"))
+}
+
+func TestTrafficShadowLogs(t *testing.T) {
+	t.Parallel()
+
+	for _, logResponses := range []bool{false, true} {
+		core, logs := observer.New(zapcore.DebugLevel)
+		manager := newExperimentManager(t, prometheus.NewRegistry(), zap.New(core), func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			return "secret answer", nil
+		})
+
+		ctx := provider.WithExperiment(context.Background(), &config.TrafficSplit{
+			Name:         "sonnet",
+			Mode:         config.SplitModeShadow,
+			Percent:      100,
+			Candidate:    config.ModelTarget{Provider: "candidate"},
+			LogResponses: logResponses,
+		})
+		_, err := manager.Generate(ctx, experimentRequest())
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			return logs.FilterMessage("Shadow request completed").Len() == 1
+		}, 5*time.Second, 10*time.Millisecond)
+
+		// Only the length and hash of the response are logged at info level
+		fields := logs.FilterMessage("Shadow request completed").All()[0].ContextMap()
+		assert.Equal(t, false, fields["matches_primary"])
+		assert.Equal(t, int64(len("secret answer")), fields["response_length"])
+		assert.Len(t, fields["response_sha256"], 64)
+		assert.NotContains(t, fields, "response")
+
+		// The content is logged at debug level when the split opts in
+		debug := logs.FilterMessage("Shadow response").All()
+		if !logResponses {
+			assert.Empty(t, debug)
+			continue
+		}
+		require.Len(t, debug, 1)
+		assert.Equal(t, zapcore.DebugLevel, debug[0].Level)
+		assert.Equal(t, "secret answer", debug[0].ContextMap()["response"])
+	}
+}
@@ -0,0 +1,306 @@
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/teilomillet/gollm"
+	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/server/middleware"
+	"github.com/teilomillet/hapax/server/usage"
+	"github.com/teilomillet/hapax/server/validation"
+	"go.uber.org/zap"
+)
+
+// GenerateRequest describes a single completion routed through the Manager.
+type GenerateRequest struct {
+	// Prompt is the conversation sent to the provider
+	Prompt *gollm.Prompt
+
+	// Model is the model requested by the client (optional)
+	Model string
+
+	// Target restricts the request to the providers it matches, in place
+	// of those serving Model (optional)
+	Target *config.ModelTarget
+
+	// Options holds generation parameters such as temperature.
+	// They are part of the cache key, so requests with different
+	// options never share a cached response. Providers implementing
+	// ParameterizedLLM receive them; others fail the request with an
+	// *UnsupportedOptionError.
+	Options map[string]interface{}
+
+	// NoCache bypasses the response cache for this request
+	NoCache bool
+
+	// Retry overrides the manager's retry policy for this request (optional)
+	Retry *config.RetryConfig
+}
+
+// ParameterizedLLM is implemented by providers that accept generation
+// parameters, such as temperature or max_tokens, on each request.
+type ParameterizedLLM interface {
+	gollm.LLM
+
+	// GenerateWithOptions is Generate with per-request parameters, keyed
+	// by their OpenAI names (temperature, max_tokens, top_p and stop). It
+	// also returns why generation ended, as one of the Finish reasons or
+	// as reported by the provider, or empty when the provider does not say.
+	GenerateWithOptions(ctx context.Context, prompt *gollm.Prompt, options map[string]interface{}) (content, finishReason string, err error)
+}
+
+// Reasons why generation ended, as reported by providers
+const (
+	FinishStop         = "stop"          // The completion ended naturally
+	FinishLength       = "length"        // The completion reached max_tokens
+	FinishStopSequence = "stop_sequence" // The completion generated a stop sequence
+)
+
+// GenerateResponse is the outcome of a completion.
+type GenerateResponse struct {
+	// Content is the generated text
+	Content string
+
+	// Provider names the failover chain entry that produced the content
+	Provider string
+
+	// Model is the model that produced the content
+	Model string
+
+	// Cached reports whether the response was served from the cache
+	Cached bool
+
+	// Deduplicated reports whether the response was shared with a
+	// concurrent identical request
+	Deduplicated bool
+
+	// PromptTokens and CompletionTokens count the tokens consumed
+	PromptTokens     int
+	CompletionTokens int
+
+	// Cost is the estimated cost in USD, zero for cached responses
+	Cost float64
+
+	// FinishReason tells why generation ended, as one of the Finish
+	// reasons or as reported by the provider. It is empty when the
+	// provider does not say.
+	FinishReason string
+}
+
+// cachedResponse is the value stored in the response cache.
+type cachedResponse struct {
+	Content      string `json:"content"`
+	Provider     string `json:"provider"`
+	Model        string `json:"model,omitempty"`
+	FinishReason string `json:"finish_reason,omitempty"`
+}
+
+// Generate produces a completion for req using the failover chain, or
+// only the providers serving req.Model when a model registry is configured.
+// A model that no provider serves yields an *UnknownModelError. A model
+// set on ctx with WithModel takes precedence over req.Model, and an
+// experiment set with WithExperiment may hand the request to its candidate.
+// When a response cache is configured, identical requests (same normalized
+// prompt, model and options) are answered from the cache and only misses
+// reach a provider. Failed generations are never cached. Concurrent
+// identical requests made with the same API key share one provider call,
+// unless WithDeduplication disables it.
+//
+// The tokens and estimated cost of the completion are recorded in the
+// usage tracker of ctx, if any. Cache hits count tokens but cost nothing.
+func (m *Manager) Generate(ctx context.Context, req *GenerateRequest) (*GenerateResponse, error) {
+	return m.runExperiment(ctx, routedRequest(ctx, req), func(req *GenerateRequest) (*GenerateResponse, error) {
+		return m.generate(ctx, req)
+	})
+}
+
+// generate is Generate once the model and experiment variant are decided.
+func (m *Manager) generate(ctx context.Context, req *GenerateRequest) (*GenerateResponse, error) {
+	key := requestFingerprint(req)
+
+	useCache := m.cache != nil && !req.NoCache
+	if useCache {
+		if resp, ok := m.lookupCache(ctx, key); ok {
+			m.recordUsage(ctx, resp, req.Prompt)
+			return resp, nil
+		}
+	}
+
+	policy := m.retry.Load()
+	if req.Retry != nil {
+		policy = NewRetryPolicy(req.Retry)
+	}
+
+	r, shared, err := m.execute(ctx, coalescingKey(ctx, key), policy, req, func(ctx context.Context, llm gollm.LLM) (string, string, error) {
+		return GenerateFrom(ctx, llm, req.Prompt, req.Options)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if useCache {
+		m.storeCache(ctx, key, r)
+	}
+
+	resp := &GenerateResponse{Content: r.content, Provider: r.name, Model: r.model, Deduplicated: shared, FinishReason: r.finishReason}
+	m.recordUsage(ctx, resp, req.Prompt)
+	return resp, nil
+}
+
+// recordUsage counts the tokens of a completion and estimates its cost,
+// filling in the usage fields of resp. They are recorded in the usage
+// tracker of ctx and, unless the response came from the cache, in the
+// token and cost metrics labeled by provider, model and API key.
+func (m *Manager) recordUsage(ctx context.Context, resp *GenerateResponse, prompt *gollm.Prompt) {
+	resp.PromptTokens = PromptTokens(prompt)
+	resp.CompletionTokens = validation.CountTokens(resp.Content)
+	usage.Record(ctx, resp.PromptTokens, resp.CompletionTokens)
+	if resp.Cached {
+		return
+	}
+
+	resp.Cost = m.config().Pricing.Cost(resp.Model, resp.PromptTokens, resp.CompletionTokens)
+	usage.RecordCost(ctx, resp.Cost)
+
+	keyID := middleware.KeyID(ctx)
+	m.tokens.WithLabelValues(resp.Provider, resp.Model, keyID, "prompt").Add(float64(resp.PromptTokens))
+	m.tokens.WithLabelValues(resp.Provider, resp.Model, keyID, "completion").Add(float64(resp.CompletionTokens))
+	m.cost.WithLabelValues(resp.Provider, resp.Model, keyID).Add(resp.Cost)
+}
+
+// PromptTokens estimates the number of tokens in a prompt.
+func PromptTokens(prompt *gollm.Prompt) int {
+	if prompt == nil {
+		return 0
+	}
+	total := validation.CountTokens(prompt.SystemPrompt)
+	for _, msg := range prompt.Messages {
+		total += validation.CountTokens(msg.Content)
+	}
+	return total
+}
+
+// GenerateFrom calls llm with the given generation options and returns
+// the generated text and why generation ended. Options given to a
+// provider that does not implement ParameterizedLLM fail the call with an
+// *UnsupportedOptionError rather than being dropped.
+func GenerateFrom(ctx context.Context, llm gollm.LLM, prompt *gollm.Prompt, options map[string]interface{}) (content, finishReason string, err error) {
+	if p, ok := llm.(ParameterizedLLM); ok {
+		return p.GenerateWithOptions(ctx, prompt, options)
+	}
+	if err := unsupportedOptions(llm, options); err != nil {
+		return "", "", err
+	}
+	content, err = llm.Generate(ctx, prompt)
+	return content, "", err
+}
+
+// unsupportedOptions fails when options are given to a provider that
+// cannot take them.
+func unsupportedOptions(llm gollm.LLM, options map[string]interface{}) error {
+	if len(options) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return &UnsupportedOptionError{Provider: llm.GetProvider(), Option: names[0]}
+}
+
+// lookupCache returns a cached response for key, if any.
+// Cache failures are logged and treated as misses.
+func (m *Manager) lookupCache(ctx context.Context, key string) (*GenerateResponse, bool) {
+	data, ok, err := m.cache.Get(ctx, key)
+	if err != nil {
+		m.logger.Warn("Cache lookup failed", zap.Error(err))
+		return nil, false
+	}
+	if !ok {
+		return nil, false
+	}
+
+	var entry cachedResponse
+	if err := json.Unmarshal(data, &entry); err != nil {
+		m.logger.Warn("Discarding malformed cache entry", zap.Error(err))
+		return nil, false
+	}
+
+	return &GenerateResponse{
+		Content:      entry.Content,
+		Provider:     entry.Provider,
+		Model:        entry.Model,
+		Cached:       true,
+		FinishReason: entry.FinishReason,
+	}, true
+}
+
+// storeCache saves a successful response. Failures are logged only,
+// since the client already has its answer.
+func (m *Manager) storeCache(ctx context.Context, key string, r *result) {
+	data, err := json.Marshal(cachedResponse{Content: r.content, Provider: r.name, Model: r.model, FinishReason: r.finishReason})
+	if err != nil {
+		m.logger.Warn("Failed to encode cache entry", zap.Error(err))
+		return
+	}
+	if err := m.cache.Set(ctx, key, data, m.cacheTTL); err != nil {
+		m.logger.Warn("Failed to store cache entry", zap.Error(err))
+	}
+}
+
+// requestFingerprint derives a stable key from the whole normalized
+// prompt, the model, the target and the generation options of a request.
+// Fields are separated so that different requests cannot encode alike.
+func requestFingerprint(req *GenerateRequest) string {
+	h := sha256.New()
+	write := func(field string) {
+		h.Write([]byte(field))
+		h.Write([]byte{0})
+	}
+
+	write(req.Model)
+	if req.Target != nil {
+		write(req.Target.String())
+	} else {
+		write("")
+	}
+
+	if p := req.Prompt; p != nil {
+		write(normalizeText(p.SystemPrompt))
+		write(strconv.Itoa(len(p.Messages)))
+		for _, msg := range p.Messages {
+			write(strings.ToLower(strings.TrimSpace(msg.Role)))
+			write(normalizeText(msg.Content))
+		}
+		write(normalizeText(p.Input))
+		write(normalizeText(p.Context))
+		write(normalizeText(p.Output))
+		write(strconv.Itoa(p.MaxLength))
+		if extras, err := json.Marshal([]interface{}{p.Directives, p.Examples, p.Tools, p.ToolChoice}); err == nil {
+			write(string(extras))
+		}
+	}
+
+	// encoding/json sorts map keys, so equal option sets encode identically
+	if len(req.Options) > 0 {
+		if opts, err := json.Marshal(req.Options); err == nil {
+			h.Write(opts)
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// normalizeText removes differences that do not change a prompt's meaning:
+// line ending style and surrounding whitespace.
+func normalizeText(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.TrimSpace(s)
+}
@@ -2,10 +2,16 @@ package provider
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/teilomillet/gollm"
+	"github.com/teilomillet/hapax/config"
 	"go.uber.org/zap"
 )
 
@@ -19,9 +25,82 @@ type HealthStatus struct {
 	RequestCount     int64         // Total number of requests
 }
 
-// startHealthChecks begins monitoring all providers
+const (
+	// defaultHealthInterval and defaultHealthTimeout apply when
+	// llm.health_check leaves them unset
+	defaultHealthInterval = time.Minute
+	defaultHealthTimeout  = 5 * time.Second
+
+	// passiveWindow is the number of recent calls from which the error
+	// rate of a passively checked provider is computed
+	passiveWindow = 20
+
+	// passiveMinCalls is the number of calls needed before a passively
+	// checked provider can be marked unhealthy
+	passiveMinCalls = 5
+
+	// passiveErrorRate is the error rate at which a passively checked
+	// provider is marked unhealthy
+	passiveErrorRate = 0.5
+)
+
+// modelsPaths lists the path, under the API endpoint, that lists the
+// models of each provider type, which health checks call in models mode.
+var modelsPaths = map[string]string{
+	"openai":    "/v1/models",
+	"anthropic": "/v1/models",
+	"ollama":    "/api/tags",
+	"groq":      "/v1/models",
+	"mistral":   "/v1/models",
+}
+
+// healthSettings returns the interval, timeout and failure threshold of
+// health checks, with their defaults applied.
+func (m *Manager) healthSettings() (interval, timeout time.Duration, threshold int) {
+	interval, timeout, threshold = defaultHealthInterval, defaultHealthTimeout, 1
+	if hc := m.config().LLM.HealthCheck; hc != nil {
+		if hc.Interval > 0 {
+			interval = hc.Interval
+		}
+		if hc.Timeout > 0 {
+			timeout = hc.Timeout
+		}
+		if hc.FailureThreshold > 0 {
+			threshold = hc.FailureThreshold
+		}
+	}
+	return interval, timeout, threshold
+}
+
+// passive reports whether the named provider is judged by its live
+// traffic rather than probed. This needs health checks to be enabled, as
+// they restore the providers that live traffic marked unhealthy.
+func (m *Manager) passive(name string) bool {
+	cfg := m.config()
+	hc := cfg.LLM.HealthCheck
+	return hc != nil && hc.Enabled && cfg.HealthProbe(name).Mode == config.HealthModePassive
+}
+
+// restartHealthChecks stops the running health checks, then starts them
+// with the settings of cfg if they are enabled.
+func (m *Manager) restartHealthChecks(cfg *config.Config) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopHealth != nil {
+		m.stopHealth()
+		m.stopHealth = nil
+	}
+	if hc := cfg.LLM.HealthCheck; hc != nil && hc.Enabled {
+		ctx, cancel := context.WithCancel(context.Background())
+		m.stopHealth = cancel
+		go m.startHealthChecks(ctx)
+	}
+}
+
+// startHealthChecks begins monitoring all providers, until ctx is done
 func (m *Manager) startHealthChecks(ctx context.Context) {
-	interval := time.Minute
+	interval, _, _ := m.healthSettings()
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
@@ -35,89 +114,331 @@ func (m *Manager) startHealthChecks(ctx context.Context) {
 	}
 }
 
-// checkAllProviders performs health checks on all providers
+// checkAllProviders checks every provider concurrently and records the
+// outcome. Passively checked providers are not probed; those that live
+// traffic marked unhealthy get traffic again once an interval has passed.
 func (m *Manager) checkAllProviders() {
-	for name, provider := range m.providers {
-		start := time.Now()
-
-		// Get the current health status
-		var status HealthStatus
-		if val, ok := m.healthStates.Load(name); ok {
-			status = val.(HealthStatus)
-		}
-
-		// Perform health check
-		err := m.healthCheck(provider)
-		duration := time.Since(start)
-
-		// Update metrics
-		m.healthCheckDuration.Observe(duration.Seconds())
+	m.mu.RLock()
+	providers := make(map[string]gollm.LLM, len(m.providers))
+	for name, llm := range m.providers {
+		providers[name] = llm
+	}
+	m.mu.RUnlock()
 
-		if err != nil {
-			m.healthCheckErrors.WithLabelValues(name).Inc()
-			status.Healthy = false
-			status.ErrorCount++
-		} else {
-			status.Healthy = true
-			status.ErrorCount = 0
+	var wg sync.WaitGroup
+	for name, llm := range providers {
+		if m.passive(name) {
+			m.restorePassive(name)
+			continue
 		}
 
-		status.LastCheck = time.Now()
-		m.UpdateHealthStatus(name, status)
+		wg.Add(1)
+		go func(name string, llm gollm.LLM) {
+			defer wg.Done()
+			result := m.checkProviderHealth(name, llm)
+			m.updateHealthStatus(name, result.apply,
+				zap.String("mode", m.config().HealthProbe(name).Mode),
+				zap.Error(result.err))
+		}(name, llm)
 	}
+	wg.Wait()
 }
 
 // CheckProviderHealth performs a health check on a provider
 func (m *Manager) CheckProviderHealth(name string, llm gollm.LLM) HealthStatus {
-	return m.checkProviderHealth(name, llm)
+	status := HealthStatus{Healthy: true}
+	if val, ok := m.healthStates.Load(name); ok {
+		status = val.(HealthStatus)
+	}
+	m.checkProviderHealth(name, llm).apply(&status)
+	return status
 }
 
-// checkProviderHealth performs a health check on a provider
-func (m *Manager) checkProviderHealth(name string, llm gollm.LLM) HealthStatus {
-	start := time.Now()
-	status := HealthStatus{
-		LastCheck: start,
-		Healthy:   true,
+// probeResult is the outcome of a health probe, applied to the status of
+// the provider once the probe is over so that the calls recorded in the
+// meantime are kept.
+type probeResult struct {
+	start     time.Time
+	latency   time.Duration // Set by the probes that make a completion
+	threshold int
+	err       error
+}
+
+// apply updates status with the outcome of the probe. The provider turns
+// unhealthy once the configured number of consecutive probes have failed.
+// Probes are not counted as requests.
+func (r probeResult) apply(status *HealthStatus) {
+	status.LastCheck = r.start
+	if r.latency > 0 {
+		status.Latency = r.latency
 	}
 
-	// Get previous status if any
-	if val, ok := m.healthStates.Load(name); ok {
-		prevStatus := val.(HealthStatus)
-		status.ConsecutiveFails = prevStatus.ConsecutiveFails
-		status.ErrorCount = prevStatus.ErrorCount
-		status.RequestCount = prevStatus.RequestCount
+	if r.err != nil {
+		status.ConsecutiveFails++
+		status.ErrorCount++
+		status.Healthy = status.Healthy && status.ConsecutiveFails < r.threshold
+		return
+	}
+	status.Healthy = true
+	status.ConsecutiveFails = 0
+}
+
+// checkProviderHealth probes a provider and returns the outcome.
+func (m *Manager) checkProviderHealth(name string, llm gollm.LLM) probeResult {
+	_, timeout, threshold := m.healthSettings()
+	result := probeResult{start: time.Now(), threshold: threshold}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	probe := m.config().HealthProbe(name)
+	result.err = m.probe(ctx, name, llm, probe)
+	duration := time.Since(result.start)
+	m.healthCheckDuration.Observe(duration.Seconds())
+
+	// Only a completion tells the latency that selection strategies compare
+	if probe.Mode == config.HealthModeGenerate {
+		result.latency = duration
+	}
+
+	if result.err != nil {
+		m.healthCheckErrors.WithLabelValues(name).Inc()
+		m.logger.Debug("Provider health check failed",
+			zap.String("provider", name),
+			zap.String("mode", probe.Mode),
+			zap.Error(result.err),
+			zap.Duration("latency", duration),
+		)
+	}
+	return result
+}
+
+// probe checks that a provider answers, the way its health check mode says.
+func (m *Manager) probe(ctx context.Context, name string, llm gollm.LLM, probe config.HealthProbe) error {
+	switch probe.Mode {
+	case config.HealthModePing:
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, probe.URL, nil)
+		if err != nil {
+			return err
+		}
+		return get(req)
+
+	case config.HealthModeModels:
+		entry := m.chainEntry(name)
+		providerType := llm.GetProvider()
+		url := probe.URL
+		if path, ok := modelsPaths[providerType]; ok && url == "" {
+			endpoint := strings.TrimSuffix(entry.Endpoint, "/")
+			if endpoint == "" {
+				endpoint = defaultEndpoints[providerType]
+			}
+			url = endpoint + path
+		}
+		// A models mode set for every provider falls back to a
+		// completion for the types whose models endpoint is unknown
+		if url == "" {
+			break
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		authorize(req, providerType, entry.APIKey)
+		return get(req)
 	}
 
-	// Simple health check prompt
+	// A completion is the one call every provider supports, capped at one
+	// token for the providers that take max_tokens
 	prompt := &gollm.Prompt{
 		Messages: []gollm.PromptMessage{
-			{Role: "user", Content: "health check"},
+			{Role: "user", Content: "ping"},
 		},
 	}
+	var options map[string]interface{}
+	if _, ok := llm.(ParameterizedLLM); ok {
+		options = map[string]interface{}{"max_tokens": 1}
+	}
+	_, _, err := GenerateFrom(ctx, llm, prompt, options)
+	return err
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// chainEntry returns the configuration of the named chain entry.
+func (m *Manager) chainEntry(name string) config.ProviderConfig {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, entry := range m.cfg.ProviderChain() {
+		if entry.Name == name {
+			return entry.ProviderConfig
+		}
+	}
+	return config.ProviderConfig{}
+}
 
-	_, err := llm.Generate(ctx, prompt)
-	status.Latency = time.Since(start)
-	m.healthCheckDuration.Observe(status.Latency.Seconds())
+// authorize adds the credentials of the given provider type to req.
+func authorize(req *http.Request, providerType, apiKey string) {
+	if apiKey == "" {
+		return
+	}
+	switch providerType {
+	case "anthropic":
+		req.Header.Set("x-api-key", apiKey)
+		req.Header.Set("anthropic-version", "2023-06-01")
+	default:
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+}
 
+// get sends req and fails unless the response has a success or
+// redirection status.
+func get(req *http.Request) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("health check %s: status %d", req.URL.Redacted(), resp.StatusCode)
+	}
+	return nil
+}
+
+// trafficWindow holds the outcomes of the latest calls to a passively
+// checked provider.
+type trafficWindow struct {
+	mu       sync.Mutex
+	failed   [passiveWindow]bool
+	next     int
+	calls    int
+	failures int
+}
+
+// record adds the outcome of a call and reports whether the error rate
+// of the window now marks the provider unhealthy, in which case the
+// window starts over.
+func (w *trafficWindow) record(failed bool, threshold int) (unhealthy bool, failures, calls int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.calls == passiveWindow && w.failed[w.next] {
+		w.failures--
+	}
+	w.failed[w.next] = failed
+	w.next = (w.next + 1) % passiveWindow
+	w.calls = min(w.calls+1, passiveWindow)
+	if failed {
+		w.failures++
+	}
+
+	failures, calls = w.failures, w.calls
+	unhealthy = calls >= passiveMinCalls &&
+		failures >= threshold &&
+		float64(failures) >= passiveErrorRate*float64(calls)
+	if unhealthy {
+		w.failed = [passiveWindow]bool{}
+		w.next, w.calls, w.failures = 0, 0, 0
+	}
+	return unhealthy, failures, calls
+}
+
+// recordCall adds a call to the request, error and latency figures of a
+// provider's health status. A passively checked provider is marked
+// unhealthy when its recent error rate is too high.
+func (m *Manager) recordCall(name string, latency time.Duration, err error) {
+	// Client errors say nothing about the provider's health, as for the
+	// breaker
+	if err != nil && isClientError(err) {
+		return
+	}
+
+	m.mu.Lock()
+	var status HealthStatus
+	if val, ok := m.healthStates.Load(name); ok {
+		status = val.(HealthStatus)
+	}
+	status.RequestCount++
 	if err != nil {
-		status.Healthy = false
-		status.ConsecutiveFails++
 		status.ErrorCount++
-		m.healthCheckErrors.WithLabelValues(name).Inc()
-		m.logger.Warn("Provider health check failed",
-			zap.String("provider", name),
-			zap.Error(err),
-			zap.Duration("latency", status.Latency),
-		)
+		status.ConsecutiveFails++
 	} else {
 		status.ConsecutiveFails = 0
+		status.Latency = latency
 	}
+	m.healthStates.Store(name, status)
+	m.mu.Unlock()
 
-	status.RequestCount++
-	return status
+	if !m.passive(name) {
+		return
+	}
+
+	val, _ := m.traffic.LoadOrStore(name, &trafficWindow{})
+	_, _, threshold := m.healthSettings()
+	unhealthy, failures, calls := val.(*trafficWindow).record(err != nil, threshold)
+	if !unhealthy {
+		return
+	}
+
+	m.updateHealthStatus(name, func(status *HealthStatus) {
+		status.Healthy = false
+		status.LastCheck = time.Now()
+		status.ConsecutiveFails = failures
+	}, zap.String("mode", config.HealthModePassive),
+		zap.Float64("error_rate", float64(failures)/float64(calls)),
+		zap.Error(err))
+}
+
+// restorePassive gives traffic back to a passively checked provider that
+// has been unhealthy for an interval, since nothing else would tell that
+// it recovered.
+func (m *Manager) restorePassive(name string) {
+	interval, _, _ := m.healthSettings()
+	status := m.GetHealthStatus(name)
+	if status.Healthy || time.Since(status.LastCheck) < interval {
+		return
+	}
+
+	status.Healthy = true
+	status.LastCheck = time.Now()
+	status.ConsecutiveFails = 0
+	m.setHealthStatus(name, status, zap.String("mode", config.HealthModePassive))
+}
+
+// ProviderHealth is the state of a provider as reported by /health.
+type ProviderHealth struct {
+	Healthy          bool      `json:"healthy"`
+	LastCheck        time.Time `json:"last_check"`
+	ConsecutiveFails int       `json:"consecutive_fails"`
+	LatencyMS        int64     `json:"latency_ms"`
+	ErrorCount       int64     `json:"error_count"`
+	RequestCount     int64     `json:"request_count"`
+	Ejection         *Ejection `json:"ejection,omitempty"` // Set while outlier detection ejects the provider
+}
+
+// Health returns the state of each provider of the failover chain.
+func (m *Manager) Health() map[string]ProviderHealth {
+	report := make(map[string]ProviderHealth)
+	for _, name := range m.getProviderPreference() {
+		report[name] = m.providerHealth(name)
+	}
+	return report
+}
+
+// providerHealth returns the state of the named provider.
+func (m *Manager) providerHealth(name string) ProviderHealth {
+	status := m.GetHealthStatus(name)
+	state := ProviderHealth{
+		Healthy:          status.Healthy,
+		LastCheck:        status.LastCheck,
+		ConsecutiveFails: status.ConsecutiveFails,
+		LatencyMS:        status.Latency.Milliseconds(),
+		ErrorCount:       status.ErrorCount,
+		RequestCount:     status.RequestCount,
+	}
+	if e, ok := m.outliers.Load().ejection(name); ok {
+		state.Ejection = &e
+	}
+	return state
 }
 
 // GetHealthCheckErrors returns the health check errors counter for testing
@@ -135,29 +456,39 @@ func (m *Manager) GetHealthStatus(name string) HealthStatus {
 
 // UpdateHealthStatus updates the health status for a provider
 func (m *Manager) UpdateHealthStatus(name string, status HealthStatus) {
+	m.setHealthStatus(name, status)
+}
+
+// setHealthStatus stores the health status of a provider and logs the
+// transitions between healthy and unhealthy, with the given fields.
+func (m *Manager) setHealthStatus(name string, status HealthStatus, fields ...zap.Field) {
+	m.updateHealthStatus(name, func(current *HealthStatus) { *current = status }, fields...)
+}
+
+// updateHealthStatus applies update to the health status of a provider,
+// healthy until told otherwise, and logs the transitions between healthy
+// and unhealthy, with the given fields. The status is reloaded under the
+// lock, so that concurrent updates are not lost.
+func (m *Manager) updateHealthStatus(name string, update func(*HealthStatus), fields ...zap.Field) {
 	m.mu.Lock()
-	defer m.mu.Unlock()
 
 	// Get the current status
-	var currentStatus HealthStatus
-	if val, ok := m.healthStates.Load(name); ok {
-		currentStatus = val.(HealthStatus)
-	}
-
-	// Update the status
-	newStatus := HealthStatus{
-		Healthy:    status.Healthy,
-		LastCheck:  status.LastCheck,
-		ErrorCount: status.ErrorCount,
+	status := HealthStatus{Healthy: true}
+	current, known := m.healthStates.Load(name)
+	if known {
+		status = current.(HealthStatus)
 	}
+	wasHealthy := known && status.Healthy
+	update(&status)
 
 	// If the status is becoming healthy, reset error count
-	if status.Healthy && !currentStatus.Healthy {
-		newStatus.ErrorCount = 0
+	if status.Healthy && !wasHealthy {
+		status.ErrorCount = 0
 	}
 
 	// Store the new status
-	m.healthStates.Store(name, newStatus)
+	m.healthStates.Store(name, status)
+	m.mu.Unlock()
 
 	// Update metrics
 	if status.Healthy {
@@ -165,51 +496,20 @@ func (m *Manager) UpdateHealthStatus(name string, status HealthStatus) {
 	} else {
 		m.healthyProviders.WithLabelValues(name).Set(0)
 	}
-}
 
-func (m *Manager) healthCheck(provider gollm.LLM) error {
-	// Simple health check prompt
-	prompt := &gollm.Prompt{
-		Messages: []gollm.PromptMessage{
-			{Role: "user", Content: "health check"},
-		},
+	if !known || wasHealthy == status.Healthy {
+		return
 	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	_, err := provider.Generate(ctx, prompt)
-	return err
+	fields = append([]zap.Field{zap.String("provider", name)}, fields...)
+	if status.Healthy {
+		m.logger.Info("Provider became healthy", fields...)
+		return
+	}
+	m.logger.Warn("Provider became unhealthy",
+		append(fields, zap.Int("consecutive_failures", status.ConsecutiveFails))...)
 }
 
 // PerformHealthCheck performs a health check on all providers
 func (m *Manager) PerformHealthCheck() {
-	for name, provider := range m.providers {
-		start := time.Now()
-
-		// Get the current health status
-		var status HealthStatus
-		if val, ok := m.healthStates.Load(name); ok {
-			status = val.(HealthStatus)
-		}
-
-		// Perform health check
-		err := m.healthCheck(provider)
-		duration := time.Since(start)
-
-		// Update metrics
-		m.healthCheckDuration.Observe(duration.Seconds())
-
-		if err != nil {
-			m.healthCheckErrors.WithLabelValues(name).Inc()
-			status.Healthy = false
-			status.ErrorCount++
-		} else {
-			status.Healthy = true
-			status.ErrorCount = 0
-		}
-
-		status.LastCheck = time.Now()
-		m.UpdateHealthStatus(name, status)
-	}
+	m.checkAllProviders()
 }
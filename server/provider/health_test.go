@@ -0,0 +1,247 @@
+package provider_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teilomillet/gollm"
+	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/server/mocks"
+	"github.com/teilomillet/hapax/server/provider"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestHealthCheckModes(t *testing.T) {
+	t.Parallel()
+
+	var status atomic.Int32
+	status.Store(http.StatusServiceUnavailable)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	cfg := &config.Config{
+		TestMode: true,
+		LLM: config.LLMConfig{
+			HealthCheck: &config.ProviderHealthCheck{
+				Timeout:          time.Second,
+				FailureThreshold: 2,
+			},
+		},
+		Providers: map[string]config.ProviderConfig{
+			"pinged": {Type: "ollama", HealthCheck: &config.HealthProbe{Mode: config.HealthModePing, URL: server.URL}},
+		},
+		CircuitBreaker: config.CircuitBreakerConfig{
+			Timeout:  time.Minute,
+			TestMode: true,
+		},
+	}
+	manager, err := provider.NewManager(cfg, zap.New(core), prometheus.NewRegistry())
+	require.NoError(t, err)
+
+	var pingedCalls atomic.Int32
+	require.NoError(t, manager.SetProvider("pinged", mocks.NewMockLLMWithConfig("ollama", "llama3",
+		func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			pingedCalls.Add(1)
+			return "pong", nil
+		})))
+	generated := mocks.NewMockLLMWithConfig("openai", "gpt-4o", func(ctx context.Context, p *gollm.Prompt) (string, error) {
+		return "pong", nil
+	})
+	require.NoError(t, manager.SetProvider("generated", generated))
+
+	// A failed ping is tolerated up to the failure threshold
+	manager.PerformHealthCheck()
+	assert.True(t, manager.GetHealthStatus("pinged").Healthy)
+	assert.Equal(t, 1, manager.GetHealthStatus("pinged").ConsecutiveFails)
+
+	manager.PerformHealthCheck()
+	assert.False(t, manager.GetHealthStatus("pinged").Healthy)
+	assert.Equal(t, 1, logs.FilterMessage("Provider became unhealthy").FilterField(zap.String("provider", "pinged")).Len())
+
+	status.Store(http.StatusOK)
+	manager.PerformHealthCheck()
+	assert.True(t, manager.GetHealthStatus("pinged").Healthy)
+	assert.Equal(t, 1, logs.FilterMessage("Provider became healthy").FilterField(zap.String("provider", "pinged")).Len())
+
+	// Pinged providers are never asked for a completion, while others
+	// are asked for a single token
+	assert.Zero(t, pingedCalls.Load())
+	assert.Equal(t, map[string]interface{}{"max_tokens": 1}, generated.LastOptions)
+	assert.True(t, manager.GetHealthStatus("generated").Healthy)
+}
+
+func TestHealthCheckProviderAPI(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	var completion map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests[r.Method+" "+r.URL.Path]++
+		switch r.URL.Path {
+		case "/v1/chat/completions":
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&completion))
+			fmt.Fprint(w, `{"choices": [{"message": {"content": "p"}, "finish_reason": "length"}]}`)
+		case "/v1/models":
+			assert.Equal(t, "Bearer sk-test", r.Header.Get("Authorization"))
+			fmt.Fprint(w, `{"data": []}`)
+		case "/api/tags":
+			fmt.Fprint(w, `{"models": []}`)
+		}
+	}))
+	defer server.Close()
+
+	cfg := &config.Config{
+		TestMode: true,
+		LLM:      config.LLMConfig{HealthCheck: &config.ProviderHealthCheck{Timeout: time.Second}},
+		Providers: map[string]config.ProviderConfig{
+			"listed":    {Type: "openai", Model: "gpt-4o", APIKey: "sk-test", Endpoint: server.URL},
+			"local":     {Type: "ollama", Model: "llama3", Endpoint: server.URL},
+			"generated": {Type: "openai", Model: "gpt-4o", APIKey: "sk-test", Endpoint: server.URL, HealthCheck: &config.HealthProbe{Mode: config.HealthModeGenerate}},
+		},
+		CircuitBreaker: config.CircuitBreakerConfig{Timeout: time.Minute, TestMode: true},
+	}
+	manager, err := provider.NewManager(cfg, zap.NewNop(), prometheus.NewRegistry())
+	require.NoError(t, err)
+	for name, entry := range cfg.Providers {
+		llm, err := provider.NewLLM(entry)
+		require.NoError(t, err)
+		require.NoError(t, manager.SetProvider(name, llm))
+	}
+
+	manager.PerformHealthCheck()
+	for name := range cfg.Providers {
+		assert.True(t, manager.GetHealthStatus(name).Healthy, name)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// Known provider types list their models by default, at their
+	// configured endpoint, and generating providers ask for one token
+	assert.Equal(t, map[string]int{
+		"GET /v1/models":            1,
+		"GET /api/tags":             1,
+		"POST /v1/chat/completions": 1,
+	}, requests)
+	assert.Equal(t, 1.0, completion["max_tokens"])
+}
+
+func TestPassiveHealthCheck(t *testing.T) {
+	t.Parallel()
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	cfg := &config.Config{
+		TestMode: true,
+		LLM: config.LLMConfig{
+			HealthCheck: &config.ProviderHealthCheck{
+				Enabled:  true,
+				Interval: 200 * time.Millisecond,
+				Mode:     config.HealthModePassive,
+			},
+		},
+		CircuitBreaker: config.CircuitBreakerConfig{
+			Timeout:  time.Minute,
+			TestMode: true,
+		},
+	}
+	manager, err := provider.NewManager(cfg, zap.New(core), prometheus.NewRegistry())
+	require.NoError(t, err)
+
+	// The primary fails every other call, which never trips its breaker
+	var calls atomic.Int32
+	require.NoError(t, manager.SetProvider("primary", mocks.NewMockLLMWithConfig("openai", "gpt-4o",
+		func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			if calls.Add(1)%2 == 1 {
+				return "", errors.New("service unavailable")
+			}
+			return "primary", nil
+		})))
+	require.NoError(t, manager.SetProvider("backup", mocks.NewMockLLMWithConfig("anthropic", "claude-3-haiku",
+		func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			return "backup", nil
+		})))
+
+	// Five calls with three errors make the primary unhealthy
+	for i := 0; i < 5; i++ {
+		_, _ = manager.Generate(context.Background(), experimentRequest())
+	}
+	assert.False(t, manager.GetHealthStatus("primary").Healthy)
+	assert.Equal(t, 1, logs.FilterMessage("Provider became unhealthy").FilterField(zap.String("mode", config.HealthModePassive)).Len())
+
+	resp, err := manager.Generate(context.Background(), experimentRequest())
+	require.NoError(t, err)
+	assert.Equal(t, "backup", resp.Provider)
+	assert.Equal(t, int32(5), calls.Load(), "passive checks send no requests")
+
+	// The primary gets traffic again after an interval
+	assert.Eventually(t, func() bool {
+		return manager.GetHealthStatus("primary").Healthy
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestHealthCheckKeepsCalls(t *testing.T) {
+	t.Parallel()
+
+	probing := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(probing)
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	cfg := &config.Config{
+		TestMode: true,
+		LLM:      config.LLMConfig{HealthCheck: &config.ProviderHealthCheck{Timeout: 5 * time.Second, FailureThreshold: 3}},
+		Providers: map[string]config.ProviderConfig{
+			"primary": {Type: "ollama", HealthCheck: &config.HealthProbe{Mode: config.HealthModePing, URL: server.URL}},
+		},
+		CircuitBreaker: config.CircuitBreakerConfig{Timeout: time.Minute, TestMode: true},
+	}
+	manager, err := provider.NewManager(cfg, zap.NewNop(), prometheus.NewRegistry())
+	require.NoError(t, err)
+	require.NoError(t, manager.SetProvider("primary", mocks.NewMockLLMWithConfig("ollama", "llama3",
+		func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			return "primary", nil
+		})))
+
+	// Calls made while a probe is in flight are kept once it fails
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		manager.PerformHealthCheck()
+	}()
+	<-probing
+	for i := 0; i < 3; i++ {
+		_, err := manager.Generate(context.Background(), experimentRequest())
+		require.NoError(t, err)
+	}
+	close(release)
+	<-done
+
+	status := manager.GetHealthStatus("primary")
+	assert.Equal(t, int64(3), status.RequestCount, "probes are not counted as requests")
+	assert.Equal(t, int64(1), status.ErrorCount)
+	assert.Equal(t, 1, status.ConsecutiveFails)
+	assert.True(t, status.Healthy)
+	assert.Positive(t, status.Latency)
+}
@@ -0,0 +1,257 @@
+package provider
+
+import (
+	"context"
+	"math"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sony/gobreaker"
+	"github.com/teilomillet/hapax/config"
+	"go.uber.org/zap"
+)
+
+const (
+	// latencyWindow is the number of recent latencies kept per provider
+	latencyWindow = 256
+
+	// minLatencySamples is the number of latencies needed before the
+	// hedging delay follows them rather than the configured delay
+	minLatencySamples = 20
+
+	// hedgeBurst caps the hedges saved up while traffic was fast, so that
+	// a sudden slowdown cannot hedge many more requests than the budget
+	hedgeBurst = 10
+)
+
+// HedgingPolicy decides when a completion is hedged. It tracks the recent
+// latencies of each provider and a budget of hedges: every request earns
+// a fraction of a hedge, and hedging spends a whole one.
+type HedgingPolicy struct {
+	percentile float64
+	delay      time.Duration
+	minDelay   time.Duration
+	ratio      float64
+
+	mu        sync.Mutex
+	tokens    float64
+	latencies map[string]*latencies
+}
+
+// latencies is a ring buffer of recent latencies.
+type latencies struct {
+	samples []time.Duration
+	next    int
+}
+
+// add records a latency, replacing the oldest once the buffer is full.
+func (l *latencies) add(d time.Duration) {
+	if len(l.samples) < latencyWindow {
+		l.samples = append(l.samples, d)
+		return
+	}
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % latencyWindow
+}
+
+// percentile returns the given percentile of samples, which it sorts.
+func percentile(samples []time.Duration, p float64) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	rank := int(math.Ceil(p/100*float64(len(samples)))) - 1
+	return samples[max(rank, 0)]
+}
+
+// NewHedgingPolicy builds a policy from configuration.
+// A nil or disabled config yields nil, which disables hedging.
+func NewHedgingPolicy(cfg *config.HedgingConfig) *HedgingPolicy {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+
+	p := &HedgingPolicy{
+		percentile: cfg.Percentile,
+		delay:      cfg.Delay,
+		minDelay:   cfg.MinDelay,
+		ratio:      cfg.Budget / 100,
+		latencies:  make(map[string]*latencies),
+	}
+	if p.percentile <= 0 {
+		p.percentile = 95
+	}
+	if p.delay <= 0 {
+		p.delay = 2 * time.Second
+	}
+	if p.minDelay <= 0 {
+		p.minDelay = 50 * time.Millisecond
+	}
+	if p.ratio <= 0 {
+		p.ratio = 0.1
+	}
+	return p
+}
+
+// observe records the latency of a successful call to the named provider.
+func (p *HedgingPolicy) observe(name string, d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	l, ok := p.latencies[name]
+	if !ok {
+		l = &latencies{samples: make([]time.Duration, 0, latencyWindow)}
+		p.latencies[name] = l
+	}
+	l.add(d)
+}
+
+// delayFor returns how long to wait for the named provider before
+// hedging: the configured percentile of its recent latencies, or the
+// configured delay until enough of them are known.
+func (p *HedgingPolicy) delayFor(name string) time.Duration {
+	p.mu.Lock()
+	var sorted []time.Duration
+	if l, ok := p.latencies[name]; ok && len(l.samples) >= minLatencySamples {
+		sorted = make([]time.Duration, len(l.samples))
+		copy(sorted, l.samples)
+	}
+	p.mu.Unlock()
+
+	d := p.delay
+	if sorted != nil {
+		d = percentile(sorted, p.percentile)
+	}
+	return max(d, p.minDelay)
+}
+
+// admit credits the budget with the share of a hedge a request earns.
+func (p *HedgingPolicy) admit() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tokens = math.Min(p.tokens+p.ratio, hedgeBurst)
+}
+
+// allow spends a hedge from the budget, reporting whether one was left.
+// The tolerance absorbs rounding, as ten requests at 10% add up to
+// slightly less than one.
+func (p *HedgingPolicy) allow() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tokens < 1-1e-9 {
+		return false
+	}
+	p.tokens--
+	return true
+}
+
+// attempt is the outcome of one leg of a hedged request.
+type attempt struct {
+	r     *result
+	hedge bool
+}
+
+// executeHedged runs operation like executeWithRetries, and if no answer
+// has come after the hedging delay of the first available provider, runs
+// it on the next available provider as well. The primary call starts with
+// the first and fails over to the providers after it, except the hedge
+// target. The first success wins and the other call is cancelled; the
+// error of the primary call is returned when both fail. Hedges beyond the
+// budget are not sent.
+func (m *Manager) executeHedged(ctx context.Context, hedging *HedgingPolicy, policy *RetryPolicy, req *GenerateRequest, operation operationFunc) (*result, error) {
+	preference, err := m.selectionOrder(ctx, req)
+	if err != nil {
+		return &result{err: err}, err
+	}
+	hedging.admit()
+
+	primary, hedge := m.hedgeTargets(preference)
+	if hedge == "" {
+		return m.tryProviders(ctx, policy, preference, operation)
+	}
+
+	// The primary call must not reach the hedge target, which would then
+	// serve both calls
+	chain := slices.DeleteFunc(slices.Clone(preference[slices.Index(preference, primary):]), func(name string) bool {
+		return name == hedge
+	})
+	attempts := make(chan attempt, 2)
+	primaryCtx, cancelPrimary := context.WithCancel(ctx)
+	defer cancelPrimary()
+	go func() {
+		r, _ := m.tryProviders(primaryCtx, policy, chain, operation)
+		attempts <- attempt{r: r}
+	}()
+
+	timer := time.NewTimer(hedging.delayFor(primary))
+	defer timer.Stop()
+	select {
+	case a := <-attempts:
+		return a.r, a.r.err
+	case <-timer.C:
+	}
+
+	provider, breaker, _ := m.getProviderResources(hedge)
+	if provider == nil || breaker == nil {
+		a := <-attempts
+		return a.r, a.r.err
+	}
+	if !hedging.allow() {
+		m.hedgesOverBudget.Inc()
+		a := <-attempts
+		return a.r, a.r.err
+	}
+
+	m.logger.Debug("hedging request",
+		zap.String("primary", primary),
+		zap.String("hedge", hedge))
+	hedgeCtx, cancelHedge := context.WithCancel(ctx)
+	defer cancelHedge()
+	go func() {
+		attempts <- attempt{r: m.attemptProvider(hedgeCtx, policy, operation, provider, breaker, hedge), hedge: true}
+	}()
+
+	var failed *result
+	hedgeDone := false
+	for i := 0; i < 2; i++ {
+		a := <-attempts
+		switch {
+		case a.r.err == nil && a.hedge:
+			cancelPrimary()
+			m.hedges.WithLabelValues(hedge, "won").Inc()
+			return a.r, nil
+		case a.r.err == nil:
+			cancelHedge()
+			if !hedgeDone {
+				m.hedges.WithLabelValues(hedge, "lost").Inc()
+			}
+			return a.r, nil
+		case a.hedge:
+			hedgeDone = true
+			m.hedges.WithLabelValues(hedge, "error").Inc()
+		}
+		if failed == nil || !a.hedge {
+			failed = a.r
+		}
+	}
+	return failed, failed.err
+}
+
+// hedgeTargets returns the first two providers of preference that are
+// healthy and whose breaker is not open. hedge is empty when there is no
+// second provider to hedge with.
+func (m *Manager) hedgeTargets(preference []string) (primary, hedge string) {
+	var targets []string
+	for _, name := range preference {
+		provider, breaker, status := m.getProviderResources(name)
+		if provider == nil || breaker == nil || !status.Healthy || m.outliers.Load().ejected(name) || breaker.State() == gobreaker.StateOpen {
+			continue
+		}
+		if targets = append(targets, name); len(targets) == 2 {
+			return targets[0], targets[1]
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,158 @@
+package provider_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teilomillet/gollm"
+	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/server/mocks"
+	"github.com/teilomillet/hapax/server/provider"
+	"go.uber.org/zap"
+)
+
+// newHedgingManager returns a manager hedging after 20ms whose primary
+// provider answers after latency, or when its call is cancelled, which is
+// reported on cancelled.
+func newHedgingManager(t *testing.T, registry *prometheus.Registry, budget float64, latency *atomic.Int64, cancelled chan<- struct{}) *provider.Manager {
+	cfg := &config.Config{
+		TestMode: true,
+		LLM: config.LLMConfig{
+			Hedging: &config.HedgingConfig{
+				Enabled:  true,
+				Delay:    20 * time.Millisecond,
+				MinDelay: time.Millisecond,
+				Budget:   budget,
+			},
+		},
+		CircuitBreaker: config.CircuitBreakerConfig{
+			Timeout:  time.Minute,
+			TestMode: true,
+		},
+	}
+
+	manager, err := provider.NewManager(cfg, zap.NewNop(), registry)
+	require.NoError(t, err)
+	require.NoError(t, manager.SetProvider("primary", mocks.NewMockLLMWithConfig("openai", "gpt-4o",
+		func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			select {
+			case <-time.After(time.Duration(latency.Load())):
+				return "primary", nil
+			case <-ctx.Done():
+				select {
+				case cancelled <- struct{}{}:
+				default:
+				}
+				return "", ctx.Err()
+			}
+		})))
+	require.NoError(t, manager.SetProvider("backup", mocks.NewMockLLMWithConfig("anthropic", "claude-3-haiku",
+		func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			return "backup", nil
+		})))
+	return manager
+}
+
+func TestHedging(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+	var latency atomic.Int64
+	latency.Store(int64(5 * time.Second))
+	cancelled := make(chan struct{}, 1)
+	manager := newHedgingManager(t, registry, 100, &latency, cancelled)
+
+	// A slow primary is hedged and the backup answers
+	start := time.Now()
+	resp, err := manager.Generate(context.Background(), experimentRequest())
+	require.NoError(t, err)
+	assert.Equal(t, "backup", resp.Provider)
+	assert.Less(t, time.Since(start), time.Second)
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the primary call was not cancelled")
+	}
+
+	// The cancelled call does not count against the primary, which
+	// serves again once it is fast
+	latency.Store(0)
+	resp, err = manager.Generate(context.Background(), experimentRequest())
+	require.NoError(t, err)
+	assert.Equal(t, "primary", resp.Provider)
+
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP hapax_hedge_requests_total Hedged provider calls by provider and outcome (won, lost or error)
+# TYPE hapax_hedge_requests_total counter
+hapax_hedge_requests_total{outcome="won",provider="backup"} 1
+`), "hapax_hedge_requests_total"))
+}
+
+func TestHedgingBudget(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+	var latency atomic.Int64
+	latency.Store(int64(50 * time.Millisecond))
+	manager := newHedgingManager(t, registry, 10, &latency, make(chan struct{}, 1))
+
+	// Ten requests earn one hedge
+	providers := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		resp, err := manager.Generate(context.Background(), experimentRequest())
+		require.NoError(t, err)
+		providers[resp.Provider]++
+	}
+	assert.Equal(t, map[string]int{"primary": 9, "backup": 1}, providers)
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP hapax_hedge_budget_exhausted_total Requests that were not hedged because the hedging budget was spent
+# TYPE hapax_hedge_budget_exhausted_total counter
+hapax_hedge_budget_exhausted_total 9
+`), "hapax_hedge_budget_exhausted_total"))
+}
+
+func TestHedgingSkipsHedgeTargetOnFailover(t *testing.T) {
+	t.Parallel()
+
+	manager, err := provider.NewManager(&config.Config{
+		TestMode: true,
+		LLM: config.LLMConfig{
+			Hedging: &config.HedgingConfig{Enabled: true, Delay: 20 * time.Millisecond, MinDelay: time.Millisecond, Budget: 100},
+		},
+		CircuitBreaker: config.CircuitBreakerConfig{Timeout: time.Minute, FailureThreshold: 1, TestMode: true},
+	}, zap.NewNop(), prometheus.NewRegistry())
+	require.NoError(t, err)
+
+	// The primary fails once the hedge is sent, which opens its breaker
+	// and fails its call over
+	require.NoError(t, manager.SetProvider("primary", mocks.NewMockLLMWithConfig("openai", "gpt-4o",
+		func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			time.Sleep(50 * time.Millisecond)
+			return "", fmt.Errorf("API request failed with status code 503: unavailable")
+		})))
+	var backupCalls atomic.Int32
+	require.NoError(t, manager.SetProvider("backup", mocks.NewMockLLMWithConfig("anthropic", "claude-3-haiku",
+		func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			backupCalls.Add(1)
+			select {
+			case <-time.After(100 * time.Millisecond):
+				return "backup", nil
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		})))
+
+	resp, err := manager.Generate(context.Background(), experimentRequest())
+	require.NoError(t, err)
+	assert.Equal(t, "backup", resp.Provider)
+	assert.Equal(t, int32(1), backupCalls.Load(), "the hedge target only serves the hedge")
+}
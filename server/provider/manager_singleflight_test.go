@@ -13,6 +13,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/teilomillet/gollm"
 	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/server/middleware"
 	"github.com/teilomillet/hapax/server/mocks"
 	"go.uber.org/zap"
 )
@@ -111,6 +112,212 @@ func TestManagerSingleflight(t *testing.T) {
 				assert.Equal(t, int32(3), callCount.Load())
 			},
 		},
+		{
+			name: "Conversations sharing a first message are not deduplicated",
+			testFn: func(t *testing.T, m *Manager) {
+				callCount := setCountingProvider(m)
+
+				var wg sync.WaitGroup
+				for i := 0; i < 3; i++ {
+					wg.Add(1)
+					go func(idx int) {
+						defer wg.Done()
+						prompt := &gollm.Prompt{Messages: []gollm.PromptMessage{
+							{Role: "system", Content: "You are a helpful assistant"},
+							{Role: "user", Content: fmt.Sprintf("question %d", idx)},
+						}}
+						_ = m.Execute(context.Background(), func(llm gollm.LLM) error {
+							_, err := llm.Generate(context.Background(), prompt)
+							return err
+						}, prompt)
+					}(i)
+				}
+
+				waitWithTimeout(&wg, t, time.Second)
+				assert.Equal(t, int32(3), callCount.Load())
+			},
+		},
+		{
+			name: "Deduplicated generations are reported",
+			testFn: func(t *testing.T, m *Manager) {
+				callCount := setCountingProvider(m)
+
+				responses := generateConcurrently(t, m, context.Background(), context.Background(), context.Background())
+				assert.Equal(t, int32(1), callCount.Load())
+				for _, resp := range responses {
+					assert.True(t, resp.Deduplicated)
+				}
+			},
+		},
+		{
+			name: "Requests of different API keys are not deduplicated",
+			testFn: func(t *testing.T, m *Manager) {
+				callCount := setCountingProvider(m)
+
+				withKey := func(id string) context.Context {
+					return context.WithValue(context.Background(), middleware.IdentityKey, middleware.Identity{KeyID: id})
+				}
+				generateConcurrently(t, m, withKey("app-1"), withKey("app-2"))
+				assert.Equal(t, int32(2), callCount.Load())
+			},
+		},
+		{
+			name: "Shared calls outlive the caller that started them",
+			testFn: func(t *testing.T, m *Manager) {
+				started := make(chan struct{})
+				release := make(chan struct{})
+				cancelled := make(chan struct{})
+				m.SetProviders(map[string]gollm.LLM{"test": mocks.NewMockLLMWithConfig("test", "model", func(ctx context.Context, prompt *gollm.Prompt) (string, error) {
+					close(started)
+					select {
+					case <-release:
+						return "response", nil
+					case <-ctx.Done():
+						close(cancelled)
+						return "", ctx.Err()
+					}
+				})})
+				m.UpdateHealthStatus("test", HealthStatus{Healthy: true, LastCheck: time.Now()})
+				req := &GenerateRequest{
+					Prompt:  &gollm.Prompt{Messages: []gollm.PromptMessage{{Role: "user", Content: "test"}}},
+					NoCache: true,
+				}
+
+				first, cancelFirst := context.WithCancel(context.Background())
+				firstErr := make(chan error, 1)
+				go func() {
+					_, err := m.Generate(first, req)
+					firstErr <- err
+				}()
+				<-started
+
+				second, cancelSecond := context.WithCancel(context.Background())
+				defer cancelSecond()
+				secondResp := make(chan *GenerateResponse, 1)
+				go func() {
+					resp, err := m.Generate(second, req)
+					assert.NoError(t, err)
+					secondResp <- resp
+				}()
+				require.Eventually(t, func() bool {
+					m.flightsMu.Lock()
+					defer m.flightsMu.Unlock()
+					return len(m.flights) == 1 && m.flights[coalescingKey(second, requestFingerprint(req))].waiters == 2
+				}, time.Second, time.Millisecond)
+
+				// The first caller leaves without cancelling the call the
+				// second one waits for
+				cancelFirst()
+				assert.ErrorIs(t, <-firstErr, context.Canceled)
+				close(release)
+				resp := <-secondResp
+				require.NotNil(t, resp)
+				assert.Equal(t, "response", resp.Content)
+				assert.True(t, resp.Deduplicated)
+				select {
+				case <-cancelled:
+					t.Fatal("the shared call was cancelled")
+				default:
+				}
+			},
+		},
+		{
+			name: "Shared calls are cancelled once all callers are gone",
+			testFn: func(t *testing.T, m *Manager) {
+				started := make(chan struct{})
+				cancelled := make(chan struct{})
+				m.SetProviders(map[string]gollm.LLM{"test": mocks.NewMockLLMWithConfig("test", "model", func(ctx context.Context, prompt *gollm.Prompt) (string, error) {
+					close(started)
+					<-ctx.Done()
+					close(cancelled)
+					return "", ctx.Err()
+				})})
+				m.UpdateHealthStatus("test", HealthStatus{Healthy: true, LastCheck: time.Now()})
+
+				ctx, cancel := context.WithCancel(context.Background())
+				go func() {
+					<-started
+					cancel()
+				}()
+				_, err := m.Generate(ctx, &GenerateRequest{
+					Prompt:  &gollm.Prompt{Messages: []gollm.PromptMessage{{Role: "user", Content: "test"}}},
+					NoCache: true,
+				})
+				assert.ErrorIs(t, err, context.Canceled)
+
+				select {
+				case <-cancelled:
+				case <-time.After(5 * time.Second):
+					t.Fatal("the shared call was not cancelled")
+				}
+			},
+		},
+		{
+			name: "Callers arriving after a cancelled call get a new one",
+			testFn: func(t *testing.T, m *Manager) {
+				started := make(chan struct{})
+				release := make(chan struct{})
+				defer close(release)
+				var calls atomic.Int32
+				m.SetProviders(map[string]gollm.LLM{"test": mocks.NewMockLLMWithConfig("test", "model", func(ctx context.Context, prompt *gollm.Prompt) (string, error) {
+					if calls.Add(1) > 1 {
+						return "response", nil
+					}
+					// The first call only returns once released, after its
+					// caller is gone
+					close(started)
+					<-release
+					return "", ctx.Err()
+				})})
+				m.UpdateHealthStatus("test", HealthStatus{Healthy: true, LastCheck: time.Now()})
+				req := &GenerateRequest{
+					Prompt:  &gollm.Prompt{Messages: []gollm.PromptMessage{{Role: "user", Content: "test"}}},
+					NoCache: true,
+				}
+
+				first, cancelFirst := context.WithCancel(context.Background())
+				firstErr := make(chan error, 1)
+				go func() {
+					_, err := m.Generate(first, req)
+					firstErr <- err
+				}()
+				<-started
+				cancelFirst()
+				assert.ErrorIs(t, <-firstErr, context.Canceled)
+
+				// The cancelled call is still running
+				type outcome struct {
+					resp *GenerateResponse
+					err  error
+				}
+				second := make(chan outcome, 1)
+				go func() {
+					resp, err := m.Generate(context.Background(), req)
+					second <- outcome{resp, err}
+				}()
+				select {
+				case out := <-second:
+					require.NoError(t, out.err)
+					assert.Equal(t, "response", out.resp.Content)
+					assert.False(t, out.resp.Deduplicated)
+				case <-time.After(5 * time.Second):
+					t.Fatal("the second caller joined the cancelled call")
+				}
+			},
+		},
+		{
+			name: "Deduplication can be disabled",
+			testFn: func(t *testing.T, m *Manager) {
+				callCount := setCountingProvider(m)
+
+				ctx := WithDeduplication(context.Background(), false)
+				responses := generateConcurrently(t, m, ctx, ctx, ctx)
+				assert.Equal(t, int32(3), callCount.Load())
+				for _, resp := range responses {
+					assert.False(t, resp.Deduplicated)
+				}
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -139,6 +346,40 @@ func TestManagerSingleflight(t *testing.T) {
 	}
 }
 
+// setCountingProvider installs a healthy provider answering after 50ms and
+// returns its call counter.
+func setCountingProvider(m *Manager) *atomic.Int32 {
+	var callCount atomic.Int32
+	m.SetProviders(map[string]gollm.LLM{"test": mocks.NewMockLLMWithConfig("test", "model", func(ctx context.Context, prompt *gollm.Prompt) (string, error) {
+		callCount.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		return "response", nil
+	})})
+	m.UpdateHealthStatus("test", HealthStatus{Healthy: true, LastCheck: time.Now()})
+	return &callCount
+}
+
+// generateConcurrently generates the same uncached completion once per
+// context, concurrently.
+func generateConcurrently(t *testing.T, m *Manager, ctxs ...context.Context) []*GenerateResponse {
+	responses := make([]*GenerateResponse, len(ctxs))
+	var wg sync.WaitGroup
+	for i, ctx := range ctxs {
+		wg.Add(1)
+		go func(idx int, ctx context.Context) {
+			defer wg.Done()
+			resp, err := m.Generate(ctx, &GenerateRequest{
+				Prompt:  &gollm.Prompt{Messages: []gollm.PromptMessage{{Role: "user", Content: "test"}}},
+				NoCache: true,
+			})
+			assert.NoError(t, err)
+			responses[idx] = resp
+		}(i, ctx)
+	}
+	waitWithTimeout(&wg, t, time.Second)
+	return responses
+}
+
 // Helper function to wait for WaitGroup with timeout
 func waitWithTimeout(wg *sync.WaitGroup, t *testing.T, timeout time.Duration) {
 	done := make(chan struct{})
@@ -29,9 +29,63 @@ func (m *Manager) initializeMetrics(registry *prometheus.Registry) {
 		Help: "Number of healthy providers",
 	}, []string{"provider"})
 
+	m.retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hapax_provider_retries_total",
+		Help: "Number of retried provider calls by provider and error class",
+	}, []string{"provider", "class"})
+
+	m.tokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hapax_llm_tokens_total",
+		Help: "Tokens consumed by provider, model, API key and type (prompt or completion)",
+	}, []string{"provider", "model", "key_id", "type"})
+
+	m.cost = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hapax_llm_cost_usd_total",
+		Help: "Estimated cost of completions in USD by provider, model and API key",
+	}, []string{"provider", "model", "key_id"})
+
+	m.experimentRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hapax_experiment_requests_total",
+		Help: "Requests served by experiment variant (control, candidate or shadow) and status",
+	}, []string{"experiment", "variant", "status"})
+
+	m.experimentLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "hapax_experiment_request_duration_seconds",
+		Help: "Latency of requests by experiment variant",
+	}, []string{"experiment", "variant"})
+
+	m.hedges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hapax_hedge_requests_total",
+		Help: "Hedged provider calls by provider and outcome (won, lost or error)",
+	}, []string{"provider", "outcome"})
+
+	m.hedgesOverBudget = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "hapax_hedge_budget_exhausted_total",
+		Help: "Requests that were not hedged because the hedging budget was spent",
+	})
+
+	m.ejectedProviders = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hapax_provider_ejected",
+		Help: "Whether a provider is ejected by outlier detection (1) or not (0)",
+	}, []string{"provider"})
+
+	m.ejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hapax_provider_ejections_total",
+		Help: "Provider ejections by outlier detection, by provider and reason (error_rate or latency)",
+	}, []string{"provider", "reason"})
+
 	registry.MustRegister(m.healthCheckDuration)
 	registry.MustRegister(m.healthCheckErrors)
 	registry.MustRegister(m.requestLatency)
 	registry.MustRegister(m.deduplicatedRequests)
 	registry.MustRegister(m.healthyProviders)
+	registry.MustRegister(m.retries)
+	registry.MustRegister(m.tokens)
+	registry.MustRegister(m.cost)
+	registry.MustRegister(m.experimentRequests)
+	registry.MustRegister(m.experimentLatency)
+	registry.MustRegister(m.hedges)
+	registry.MustRegister(m.hedgesOverBudget)
+	registry.MustRegister(m.ejectedProviders)
+	registry.MustRegister(m.ejections)
 }
@@ -0,0 +1,266 @@
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/teilomillet/gollm"
+	"github.com/teilomillet/gollm/llm"
+	"github.com/teilomillet/hapax/config"
+)
+
+// maxEventSize bounds a single line of a server-sent event stream.
+const maxEventSize = 1 << 20
+
+// NewLLM creates the client of a provider. OpenAI, Anthropic and the
+// providers with an OpenAI-compatible API (Groq, Mistral and Ollama) are
+// called through their HTTP API directly, which streams their responses;
+// the gollm client serves the rest of the gollm.LLM interface.
+func NewLLM(cfg config.ProviderConfig) (gollm.LLM, error) {
+	base, err := gollm.NewLLM(
+		gollm.SetProvider(cfg.Type),
+		gollm.SetModel(cfg.Model),
+		gollm.SetAPIKey(cfg.APIKey),
+		// Retries are handled by the manager, which needs to see the
+		// provider's actual error to classify it
+		gollm.SetMaxRetries(0),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := strings.TrimSuffix(cfg.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = defaultEndpoints[cfg.Type]
+	}
+
+	api := apiClient{LLM: base, endpoint: endpoint, apiKey: cfg.APIKey, model: cfg.Model}
+	switch cfg.Type {
+	case "anthropic":
+		return &anthropicLLM{apiClient: api}, nil
+	case "openai", "groq", "mistral", "ollama":
+		return &openAILLM{apiClient: api}, nil
+	default:
+		return base, nil
+	}
+}
+
+// defaultEndpoints lists the API base URL of each provider type, used when
+// a provider does not configure its endpoint.
+var defaultEndpoints = map[string]string{
+	"openai":    "https://api.openai.com",
+	"anthropic": "https://api.anthropic.com",
+	"groq":      "https://api.groq.com/openai",
+	"mistral":   "https://api.mistral.ai",
+	"ollama":    "http://localhost:11434",
+}
+
+// apiClient holds what the adapters of provider APIs share. The gollm
+// client it embeds serves the methods the adapters do not override.
+type apiClient struct {
+	gollm.LLM
+	endpoint string // API base URL, without a trailing slash
+	apiKey   string
+	model    string
+}
+
+// post sends body as JSON to path and returns the response, or an
+// *apiError when the provider answers with an error status.
+func (c *apiClient) post(ctx context.Context, path string, header http.Header, body interface{}) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, llm.NewLLMError(llm.ErrorTypeRequest, "failed to encode request", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, llm.NewLLMError(llm.ErrorTypeRequest, "failed to create request", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		return nil, newAPIError(c.GetProvider(), resp)
+	}
+	return resp, nil
+}
+
+// apiError is an error answered by a provider's API. Its message carries
+// the status code, from which ClassifyError tells how to handle it.
+type apiError struct {
+	provider   string
+	statusCode int
+	message    string
+	retryAfter time.Duration
+}
+
+// newAPIError reads the error response of a provider.
+func newAPIError(provider string, resp *http.Response) *apiError {
+	e := &apiError{provider: provider, statusCode: resp.StatusCode}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var payload struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &payload) == nil && payload.Error.Message != "" {
+		e.message = payload.Error.Message
+	} else {
+		e.message = strings.TrimSpace(string(body))
+	}
+
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		e.retryAfter = time.Duration(seconds) * time.Second
+	}
+	return e
+}
+
+func (e *apiError) Error() string {
+	if e.message == "" {
+		return fmt.Sprintf("%s API error: status code %d", e.provider, e.statusCode)
+	}
+	return fmt.Sprintf("%s API error: status code %d: %s", e.provider, e.statusCode, e.message)
+}
+
+// RetryAfter returns the delay the provider asked for, if any.
+func (e *apiError) RetryAfter() time.Duration { return e.retryAfter }
+
+// chatMessage is a message of a chat API request.
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// chatMessages converts prompt into the messages of a chat API request.
+// A prompt built from a single input is sent as one user message, which
+// carries its context, directives and examples as gollm formats them.
+func chatMessages(prompt *gollm.Prompt) []chatMessage {
+	var messages []chatMessage
+	if prompt.SystemPrompt != "" {
+		messages = append(messages, chatMessage{Role: "system", Content: prompt.SystemPrompt})
+	}
+	for _, msg := range prompt.Messages {
+		messages = append(messages, chatMessage{Role: msg.Role, Content: msg.Content})
+	}
+	if prompt.Input != "" || len(prompt.Messages) == 0 {
+		input := *prompt
+		input.SystemPrompt, input.Messages = "", nil
+		messages = append(messages, chatMessage{Role: "user", Content: input.String()})
+	}
+	return messages
+}
+
+// generationOptions are the per-request generation parameters the
+// adapters forward to providers.
+type generationOptions struct {
+	temperature *float64
+	maxTokens   *int
+	topP        *float64
+	stop        []string
+}
+
+// parseOptions reads per-request generation parameters, keyed by their
+// OpenAI names. Other options, and values of the wrong type, fail with an
+// *UnsupportedOptionError.
+func parseOptions(provider string, options map[string]interface{}) (generationOptions, error) {
+	var opts generationOptions
+	for name, value := range options {
+		var ok bool
+		switch name {
+		case "temperature":
+			var v float64
+			v, ok = toFloat(value)
+			opts.temperature = &v
+		case "top_p":
+			var v float64
+			v, ok = toFloat(value)
+			opts.topP = &v
+		case "max_tokens":
+			var v float64
+			v, ok = toFloat(value)
+			n := int(v)
+			opts.maxTokens = &n
+			ok = ok && float64(n) == v
+		case "stop":
+			switch stop := value.(type) {
+			case string:
+				opts.stop, ok = []string{stop}, true
+			case []string:
+				opts.stop, ok = stop, true
+			}
+		}
+		if !ok {
+			return opts, &UnsupportedOptionError{Provider: provider, Option: name}
+		}
+	}
+	return opts, nil
+}
+
+// toFloat converts a numeric option value.
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// readEvents calls handle with the event name and data of each
+// server-sent event of r, in order, until r ends or handle fails.
+func readEvents(r io.Reader, handle func(event, data string) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxEventSize)
+
+	var event string
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if len(data) > 0 {
+				if err := handle(event, strings.Join(data, "\n")); err != nil {
+					return err
+				}
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, ":"):
+			// Comment, sent to keep the connection alive
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		return handle(event, strings.Join(data, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package provider_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teilomillet/gollm"
+	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/server/provider"
+	"go.uber.org/zap"
+)
+
+// sendEvents answers with the given server-sent events, flushing each.
+func sendEvents(w http.ResponseWriter, events ...string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	for _, event := range events {
+		fmt.Fprint(w, event+"\n\n")
+		w.(http.Flusher).Flush()
+	}
+}
+
+func TestOpenAIAdapter(t *testing.T) {
+	t.Parallel()
+
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/chat/completions", r.URL.Path)
+		assert.Equal(t, "Bearer sk-test", r.Header.Get("Authorization"))
+		body = nil
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+
+		switch body["messages"].([]interface{})[0].(map[string]interface{})["content"] {
+		case "busy":
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"error": {"message": "Rate limit reached"}}`)
+		case "cut":
+			sendEvents(w, `data: {"choices": [{"delta": {"content": "Hel"}}]}`)
+		default:
+			if body["stream"] == true {
+				sendEvents(w,
+					`data: {"choices": [{"delta": {"role": "assistant"}}]}`,
+					`data: {"choices": [{"delta": {"content": "Hel"}}]}`,
+					`data: {"choices": [{"delta": {"content": "lo"}, "finish_reason": "stop"}]}`,
+					`data: [DONE]`)
+				return
+			}
+			fmt.Fprint(w, `{"choices": [{"message": {"role": "assistant", "content": "Hello"}, "finish_reason": "stop"}]}`)
+		}
+	}))
+	defer server.Close()
+
+	llm, err := provider.NewLLM(config.ProviderConfig{Type: "openai", Model: "gpt-4o", APIKey: "sk-test", Endpoint: server.URL})
+	require.NoError(t, err)
+	require.Implements(t, (*provider.StreamingLLM)(nil), llm)
+	prompt := func(text string) *gollm.Prompt {
+		return &gollm.Prompt{Messages: []gollm.PromptMessage{{Role: "user", Content: text}}}
+	}
+
+	t.Run("streams chunks as they arrive", func(t *testing.T) {
+		var chunks []string
+		content, finishReason, err := provider.StreamFrom(context.Background(), llm, prompt("hi"),
+			map[string]interface{}{"max_tokens": 5, "temperature": 0.2, "stop": []string{"END"}},
+			func(chunk string) error {
+				chunks = append(chunks, chunk)
+				return nil
+			})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Hel", "lo"}, chunks)
+		assert.Equal(t, "Hello", content)
+		assert.Equal(t, provider.FinishStop, finishReason)
+
+		assert.Equal(t, "gpt-4o", body["model"])
+		assert.Equal(t, true, body["stream"])
+		assert.Equal(t, 5.0, body["max_tokens"])
+		assert.Equal(t, 0.2, body["temperature"])
+		assert.Equal(t, []interface{}{"END"}, body["stop"])
+	})
+
+	t.Run("generates without streaming", func(t *testing.T) {
+		content, err := llm.Generate(context.Background(), prompt("hi"))
+		require.NoError(t, err)
+		assert.Equal(t, "Hello", content)
+		assert.NotContains(t, body, "stream")
+		assert.NotContains(t, body, "max_tokens", "providers apply their defaults")
+	})
+
+	t.Run("forwards generation options", func(t *testing.T) {
+		content, finishReason, err := provider.GenerateFrom(context.Background(), llm, prompt("hi"),
+			map[string]interface{}{"top_p": 0.5, "stop": []string{"a", "b"}})
+		require.NoError(t, err)
+		assert.Equal(t, "Hello", content)
+		assert.Equal(t, provider.FinishStop, finishReason)
+		assert.Equal(t, 0.5, body["top_p"])
+		assert.Equal(t, []interface{}{"a", "b"}, body["stop"])
+	})
+
+	t.Run("rejects options it cannot forward", func(t *testing.T) {
+		_, _, err := provider.GenerateFrom(context.Background(), llm, prompt("hi"), map[string]interface{}{"logit_bias": 1})
+		var unsupported *provider.UnsupportedOptionError
+		require.ErrorAs(t, err, &unsupported)
+		assert.Equal(t, "logit_bias", unsupported.Option)
+	})
+
+	t.Run("reports the status of errors", func(t *testing.T) {
+		_, err := llm.Generate(context.Background(), prompt("busy"))
+		require.Error(t, err)
+		assert.Equal(t, provider.ErrorClassRateLimit, provider.ClassifyError(err))
+		assert.Contains(t, err.Error(), "Rate limit reached")
+
+		var hint provider.RetryAfterError
+		require.True(t, errors.As(err, &hint))
+		assert.Equal(t, 3*time.Second, hint.RetryAfter())
+	})
+
+	t.Run("fails streams that end early", func(t *testing.T) {
+		content, _, err := provider.StreamFrom(context.Background(), llm, prompt("cut"), nil, func(string) error { return nil })
+		require.Error(t, err)
+		assert.Equal(t, "Hel", content)
+	})
+
+	t.Run("streams through the manager", func(t *testing.T) {
+		manager, err := provider.NewManager(&config.Config{
+			TestMode:       true,
+			CircuitBreaker: config.CircuitBreakerConfig{Timeout: time.Minute, TestMode: true},
+		}, zap.NewNop(), prometheus.NewRegistry())
+		require.NoError(t, err)
+		require.NoError(t, manager.SetProvider("openai", llm))
+
+		var chunks []string
+		resp, err := manager.GenerateStream(context.Background(), &provider.GenerateRequest{Prompt: prompt("hi")},
+			func(chunk string) error {
+				chunks = append(chunks, chunk)
+				return nil
+			})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Hel", "lo"}, chunks)
+		assert.Equal(t, "Hello", resp.Content)
+		assert.Equal(t, "gpt-4o", resp.Model)
+		assert.Equal(t, provider.FinishStop, resp.FinishReason)
+	})
+}
+
+func TestAnthropicAdapter(t *testing.T) {
+	t.Parallel()
+
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/messages", r.URL.Path)
+		assert.Equal(t, "sk-ant-test", r.Header.Get("x-api-key"))
+		assert.NotEmpty(t, r.Header.Get("anthropic-version"))
+		body = nil
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+
+		if body["stream"] == true {
+			sendEvents(w,
+				"event: message_start\ndata: {\"type\": \"message_start\", \"message\": {}}",
+				"event: content_block_start\ndata: {\"type\": \"content_block_start\", \"index\": 0, \"content_block\": {\"type\": \"text\", \"text\": \"\"}}",
+				"event: ping\ndata: {\"type\": \"ping\"}",
+				"event: content_block_delta\ndata: {\"type\": \"content_block_delta\", \"index\": 0, \"delta\": {\"type\": \"text_delta\", \"text\": \"Bon\"}}",
+				"event: content_block_delta\ndata: {\"type\": \"content_block_delta\", \"index\": 0, \"delta\": {\"type\": \"text_delta\", \"text\": \"jour\"}}",
+				"event: content_block_stop\ndata: {\"type\": \"content_block_stop\", \"index\": 0}",
+				"event: message_delta\ndata: {\"type\": \"message_delta\", \"delta\": {\"stop_reason\": \"max_tokens\"}}",
+				"event: message_stop\ndata: {\"type\": \"message_stop\"}")
+			return
+		}
+		fmt.Fprint(w, `{"type": "message", "content": [{"type": "text", "text": "Bonjour"}], "stop_reason": "end_turn"}`)
+	}))
+	defer server.Close()
+
+	llm, err := provider.NewLLM(config.ProviderConfig{Type: "anthropic", Model: "claude-3-5-haiku-latest", APIKey: "sk-ant-test", Endpoint: server.URL})
+	require.NoError(t, err)
+	prompt := &gollm.Prompt{Messages: []gollm.PromptMessage{
+		{Role: "system", Content: "Answer in French."},
+		{Role: "user", Content: "hello"},
+	}}
+
+	t.Run("streams text deltas", func(t *testing.T) {
+		var chunks []string
+		content, finishReason, err := provider.StreamFrom(context.Background(), llm, prompt, map[string]interface{}{"max_tokens": 20},
+			func(chunk string) error {
+				chunks = append(chunks, chunk)
+				return nil
+			})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Bon", "jour"}, chunks)
+		assert.Equal(t, "Bonjour", content)
+		assert.Equal(t, provider.FinishLength, finishReason)
+
+		// System messages are sent as the system parameter
+		assert.Equal(t, "Answer in French.", body["system"])
+		assert.Equal(t, []interface{}{map[string]interface{}{"role": "user", "content": "hello"}}, body["messages"])
+		assert.Equal(t, 20.0, body["max_tokens"])
+	})
+
+	t.Run("generates without streaming", func(t *testing.T) {
+		content, err := llm.Generate(context.Background(), prompt)
+		require.NoError(t, err)
+		assert.Equal(t, "Bonjour", content)
+		assert.Positive(t, body["max_tokens"], "max_tokens is required by the Messages API")
+	})
+
+	t.Run("passes stop as stop_sequences", func(t *testing.T) {
+		_, finishReason, err := provider.GenerateFrom(context.Background(), llm, prompt,
+			map[string]interface{}{"stop": []string{"\n\nHuman:"}, "temperature": 0.5})
+		require.NoError(t, err)
+		assert.Equal(t, provider.FinishStop, finishReason)
+		assert.Equal(t, []interface{}{"\n\nHuman:"}, body["stop_sequences"])
+		assert.Equal(t, 0.5, body["temperature"])
+	})
+}
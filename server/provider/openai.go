@@ -0,0 +1,149 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/teilomillet/gollm"
+	"github.com/teilomillet/gollm/llm"
+)
+
+// openAIStreamTerminal is the data of the last event of a stream.
+const openAIStreamTerminal = "[DONE]"
+
+// openAILLM calls the chat completions API of OpenAI, or of a provider
+// offering the same API.
+type openAILLM struct {
+	apiClient
+}
+
+// openAIRequest is the body of a chat completions request.
+type openAIRequest struct {
+	Model       string        `json:"model"`
+	Messages    []chatMessage `json:"messages"`
+	Temperature *float64      `json:"temperature,omitempty"`
+	MaxTokens   *int          `json:"max_tokens,omitempty"`
+	TopP        *float64      `json:"top_p,omitempty"`
+	Stop        []string      `json:"stop,omitempty"`
+	Stream      bool          `json:"stream,omitempty"`
+}
+
+// openAIChoice is a choice of a completion, or of a chunk of a stream.
+type openAIChoice struct {
+	Message struct {
+		Content string `json:"content"`
+	} `json:"message"`
+	Delta struct {
+		Content string `json:"content"`
+	} `json:"delta"`
+	FinishReason *string `json:"finish_reason"`
+}
+
+// openAIResponse is a completion, or a chunk of a stream.
+type openAIResponse struct {
+	Choices []openAIChoice `json:"choices"`
+	Error   *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Generate implements gollm.LLM.
+func (l *openAILLM) Generate(ctx context.Context, prompt *gollm.Prompt, _ ...llm.GenerateOption) (string, error) {
+	content, _, err := l.complete(ctx, prompt, nil, nil)
+	return content, err
+}
+
+// GenerateWithOptions implements ParameterizedLLM. The finish reason is
+// the one the provider reports.
+func (l *openAILLM) GenerateWithOptions(ctx context.Context, prompt *gollm.Prompt, options map[string]interface{}) (string, string, error) {
+	return l.complete(ctx, prompt, options, nil)
+}
+
+// GenerateStream implements StreamingLLM, reading the chunks of the
+// completion as the provider sends them.
+func (l *openAILLM) GenerateStream(ctx context.Context, prompt *gollm.Prompt, options map[string]interface{}, emit func(chunk string) error) (string, string, error) {
+	return l.complete(ctx, prompt, options, emit)
+}
+
+// complete requests a completion, streamed to emit unless it is nil.
+func (l *openAILLM) complete(ctx context.Context, prompt *gollm.Prompt, options map[string]interface{}, emit func(chunk string) error) (content, finishReason string, err error) {
+	opts, err := parseOptions(l.GetProvider(), options)
+	if err != nil {
+		return "", "", err
+	}
+
+	header := http.Header{}
+	if l.apiKey != "" {
+		header.Set("Authorization", "Bearer "+l.apiKey)
+	}
+	resp, err := l.post(ctx, "/v1/chat/completions", header, &openAIRequest{
+		Model:       l.model,
+		Messages:    chatMessages(prompt),
+		Temperature: opts.temperature,
+		MaxTokens:   opts.maxTokens,
+		TopP:        opts.topP,
+		Stop:        opts.stop,
+		Stream:      emit != nil,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	if emit == nil {
+		var completion openAIResponse
+		if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+			return "", "", llm.NewLLMError(llm.ErrorTypeResponse, "failed to decode response", err)
+		}
+		if len(completion.Choices) == 0 {
+			return "", "", llm.NewLLMError(llm.ErrorTypeResponse, "no choices in response", nil)
+		}
+		choice := completion.Choices[0]
+		if choice.FinishReason != nil {
+			finishReason = *choice.FinishReason
+		}
+		return choice.Message.Content, finishReason, nil
+	}
+
+	var text strings.Builder
+	finished := false
+	err = readEvents(resp.Body, func(_, data string) error {
+		if data == openAIStreamTerminal {
+			finished = true
+			return errStreamEnd
+		}
+		var chunk openAIResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return llm.NewLLMError(llm.ErrorTypeResponse, "failed to decode chunk", err)
+		}
+		if chunk.Error != nil {
+			return fmt.Errorf("%s API error: %s", l.GetProvider(), chunk.Error.Message)
+		}
+		if len(chunk.Choices) == 0 {
+			return nil
+		}
+		choice := chunk.Choices[0]
+		if choice.FinishReason != nil {
+			finishReason = *choice.FinishReason
+		}
+		if choice.Delta.Content == "" {
+			return nil
+		}
+		text.WriteString(choice.Delta.Content)
+		return emit(choice.Delta.Content)
+	})
+	if err != nil && !errors.Is(err, errStreamEnd) {
+		return text.String(), finishReason, err
+	}
+	if !finished {
+		return text.String(), finishReason, fmt.Errorf("%s stream ended before completion", l.GetProvider())
+	}
+	return text.String(), finishReason, nil
+}
+
+// errStreamEnd stops reading a stream once its last event has arrived.
+var errStreamEnd = errors.New("end of stream")
@@ -0,0 +1,337 @@
+package provider
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/teilomillet/hapax/config"
+	"go.uber.org/zap"
+)
+
+// minOutlierErrorRate is the error rate below which a provider is never
+// ejected, however low the others' error rate is.
+const minOutlierErrorRate = 0.1
+
+// Ejection reasons, as labeled in metrics
+const (
+	ejectionErrorRate = "error_rate"
+	ejectionLatency   = "latency"
+)
+
+// Ejection describes a provider taken out of rotation by outlier detection.
+type Ejection struct {
+	Reason string    `json:"reason"` // error_rate or latency
+	Until  time.Time `json:"until"`  // End of the ejection
+	Count  int       `json:"count"`  // Consecutive ejections, which lengthen the next one
+}
+
+// outlierDetector ejects the providers whose error rate or p95 latency
+// deviates from the other providers'. Ejections last longer each time a
+// provider is ejected again, and the count of ejections decreases by one
+// for every interval a provider spends back in rotation.
+type outlierDetector struct {
+	interval         time.Duration
+	minRequests      int
+	errorRateFactor  float64
+	latencyFactor    float64
+	baseEjectionTime time.Duration
+	maxEjectionTime  time.Duration
+	maxEjectionRatio float64
+
+	mu        sync.Mutex
+	stats     map[string]*trafficStats  // Calls since the last evaluation
+	ejections map[string]*ejectionState // Providers ejected, or not for long
+}
+
+// trafficStats accounts the calls to a provider over an interval.
+type trafficStats struct {
+	calls     int
+	errors    int
+	latencies latencies // Latencies of successful calls
+}
+
+// ejectionState is an ejection along with whether it is still in effect.
+type ejectionState struct {
+	Ejection
+	active bool
+}
+
+// ejectionEvent reports a provider ejected by an evaluation.
+type ejectionEvent struct {
+	name      string
+	errorRate float64
+	p95       time.Duration
+	duration  time.Duration
+	Ejection
+}
+
+// newOutlierDetector builds a detector from configuration.
+// A nil or disabled config yields nil, which disables outlier detection.
+func newOutlierDetector(cfg *config.OutlierDetectionConfig) *outlierDetector {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+
+	d := &outlierDetector{
+		interval:         cfg.Interval,
+		minRequests:      cfg.MinRequests,
+		errorRateFactor:  cfg.ErrorRateFactor,
+		latencyFactor:    cfg.LatencyFactor,
+		baseEjectionTime: cfg.BaseEjectionTime,
+		maxEjectionTime:  cfg.MaxEjectionTime,
+		maxEjectionRatio: cfg.MaxEjectionPercent / 100,
+		stats:            make(map[string]*trafficStats),
+		ejections:        make(map[string]*ejectionState),
+	}
+	if d.interval <= 0 {
+		d.interval = 10 * time.Second
+	}
+	if d.minRequests <= 0 {
+		d.minRequests = 10
+	}
+	if d.errorRateFactor <= 0 {
+		d.errorRateFactor = 2
+	}
+	if d.latencyFactor <= 0 {
+		d.latencyFactor = 3
+	}
+	if d.baseEjectionTime <= 0 {
+		d.baseEjectionTime = 30 * time.Second
+	}
+	if d.maxEjectionTime <= 0 {
+		d.maxEjectionTime = 5 * time.Minute
+	}
+	if d.maxEjectionRatio <= 0 {
+		d.maxEjectionRatio = 0.5
+	}
+	return d
+}
+
+// record accounts a call to the named provider.
+func (d *outlierDetector) record(name string, latency time.Duration, err error) {
+	// Client errors are the caller's fault, not the provider's, as for the
+	// breaker
+	if d == nil || (err != nil && isClientError(err)) {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s, ok := d.stats[name]
+	if !ok {
+		s = &trafficStats{}
+		d.stats[name] = s
+	}
+	s.calls++
+	if err != nil {
+		s.errors++
+		return
+	}
+	s.latencies.add(latency)
+}
+
+// ejection returns the ejection of the named provider, if it is ejected.
+func (d *outlierDetector) ejection(name string) (Ejection, bool) {
+	if d == nil {
+		return Ejection{}, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	e, ok := d.ejections[name]
+	if !ok || !e.active || !time.Now().Before(e.Until) {
+		return Ejection{}, false
+	}
+	return e.Ejection, true
+}
+
+// forget drops the traffic and ejection of the named provider, which
+// starts over as a new one.
+func (d *outlierDetector) forget(name string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.stats, name)
+	delete(d.ejections, name)
+}
+
+// ejected reports whether the named provider is ejected.
+func (d *outlierDetector) ejected(name string) bool {
+	_, ok := d.ejection(name)
+	return ok
+}
+
+// evaluate ends the ejections that are over and ejects the providers
+// whose traffic since the last evaluation deviates from the others'. It
+// returns the providers ejected and those returned to rotation.
+func (d *outlierDetector) evaluate(providers []string, now time.Time) (ejected []ejectionEvent, returned []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stats := d.stats
+	d.stats = make(map[string]*trafficStats)
+
+	// Ejections that are over put providers back in rotation
+	inRotation := make(map[string]bool)
+	active := 0
+	for _, name := range providers {
+		if e, ok := d.ejections[name]; ok && e.active {
+			if now.Before(e.Until) {
+				active++
+				continue
+			}
+			e.active = false
+			returned = append(returned, name)
+		}
+		inRotation[name] = true
+	}
+
+	// Providers in rotation with enough traffic are compared
+	type sample struct {
+		name      string
+		errorRate float64
+		p95       time.Duration
+	}
+	var samples []sample
+	for _, name := range providers {
+		s, ok := stats[name]
+		if !inRotation[name] || !ok || s.calls < d.minRequests {
+			continue
+		}
+		samples = append(samples, sample{
+			name:      name,
+			errorRate: float64(s.errors) / float64(s.calls),
+			p95:       percentile(s.latencies.samples, 95),
+		})
+	}
+
+	limit := max(int(d.maxEjectionRatio*float64(len(providers))), 1)
+	for i, candidate := range samples {
+		var errorRates float64
+		var latencies time.Duration
+		others, timed := 0, 0
+		for j, other := range samples {
+			if i == j {
+				continue
+			}
+			others++
+			errorRates += other.errorRate
+			if other.p95 > 0 {
+				timed++
+				latencies += other.p95
+			}
+		}
+		if others == 0 {
+			break
+		}
+
+		reason := ""
+		switch {
+		case candidate.errorRate >= minOutlierErrorRate &&
+			candidate.errorRate >= d.errorRateFactor*errorRates/float64(others):
+			reason = ejectionErrorRate
+		case timed > 0 && candidate.p95 > 0 &&
+			float64(candidate.p95) >= d.latencyFactor*float64(latencies)/float64(timed):
+			reason = ejectionLatency
+		}
+		if reason == "" || active >= limit || active+1 >= len(providers) {
+			continue
+		}
+
+		e, ok := d.ejections[candidate.name]
+		if !ok {
+			e = &ejectionState{}
+			d.ejections[candidate.name] = e
+		}
+		e.Count++
+		duration := min(d.baseEjectionTime*time.Duration(e.Count), d.maxEjectionTime)
+		e.Reason = reason
+		e.Until = now.Add(duration)
+		e.active = true
+		active++
+
+		ejected = append(ejected, ejectionEvent{
+			name:      candidate.name,
+			errorRate: candidate.errorRate,
+			p95:       candidate.p95,
+			duration:  duration,
+			Ejection:  e.Ejection,
+		})
+	}
+
+	// Providers that spent the interval in rotation without being ejected
+	// are forgiven one ejection
+	for name, e := range d.ejections {
+		if e.active || !inRotation[name] || slices.Contains(returned, name) {
+			continue
+		}
+		if e.Count--; e.Count == 0 {
+			delete(d.ejections, name)
+		}
+	}
+	return ejected, returned
+}
+
+// restartOutlierDetection stops the running outlier detection, then
+// starts evaluating with the given detector unless it is nil.
+func (m *Manager) restartOutlierDetection(detector *outlierDetector) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopOutliers != nil {
+		m.stopOutliers()
+		m.stopOutliers = nil
+	}
+	m.outliers.Store(detector)
+	if detector != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		m.stopOutliers = cancel
+		go m.startOutlierDetection(ctx, detector.interval)
+	}
+}
+
+// startOutlierDetection evaluates the traffic of the providers at every
+// interval of outlier detection, until ctx is done.
+func (m *Manager) startOutlierDetection(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.detectOutliers()
+		}
+	}
+}
+
+// detectOutliers runs an evaluation of outlier detection, logging and
+// counting its ejections.
+func (m *Manager) detectOutliers() {
+	detector := m.outliers.Load()
+	if detector == nil {
+		return
+	}
+	ejected, returned := detector.evaluate(m.getProviderPreference(), time.Now())
+
+	for _, e := range ejected {
+		m.ejections.WithLabelValues(e.name, e.Reason).Inc()
+		m.ejectedProviders.WithLabelValues(e.name).Set(1)
+		m.logger.Warn("Provider ejected",
+			zap.String("provider", e.name),
+			zap.String("reason", e.Reason),
+			zap.Float64("error_rate", e.errorRate),
+			zap.Duration("p95_latency", e.p95),
+			zap.Duration("ejection_time", e.duration),
+			zap.Int("ejections", e.Count))
+	}
+	for _, name := range returned {
+		m.ejectedProviders.WithLabelValues(name).Set(0)
+		m.logger.Info("Provider returned from ejection", zap.String("provider", name))
+	}
+}
@@ -0,0 +1,189 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teilomillet/gollm"
+	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/server/mocks"
+	"go.uber.org/zap"
+)
+
+// recordCalls records calls to a provider: errors failed ones, then
+// successful ones taking latency.
+func recordCalls(d *outlierDetector, name string, errs, successes int, latency time.Duration) {
+	for i := 0; i < errs; i++ {
+		d.record(name, 0, errors.New("service unavailable"))
+	}
+	for i := 0; i < successes; i++ {
+		d.record(name, latency, nil)
+	}
+}
+
+func TestOutlierDetection(t *testing.T) {
+	t.Parallel()
+
+	newDetector := func() *outlierDetector {
+		return newOutlierDetector(&config.OutlierDetectionConfig{
+			Enabled:          true,
+			MinRequests:      10,
+			BaseEjectionTime: time.Minute,
+			MaxEjectionTime:  3 * time.Minute,
+		})
+	}
+	providers := []string{"a", "b", "c"}
+	now := time.Now()
+
+	t.Run("error rate", func(t *testing.T) {
+		d := newDetector()
+		recordCalls(d, "a", 5, 5, time.Millisecond)
+		recordCalls(d, "b", 0, 10, time.Millisecond)
+		recordCalls(d, "c", 1, 9, time.Millisecond)
+
+		ejected, _ := d.evaluate(providers, now)
+		require.Len(t, ejected, 1)
+		assert.Equal(t, "a", ejected[0].name)
+		assert.Equal(t, ejectionErrorRate, ejected[0].Reason)
+		assert.Equal(t, time.Minute, ejected[0].duration)
+	})
+
+	t.Run("latency", func(t *testing.T) {
+		d := newDetector()
+		recordCalls(d, "a", 0, 10, time.Millisecond)
+		recordCalls(d, "b", 0, 10, 10*time.Millisecond)
+		recordCalls(d, "c", 0, 10, time.Millisecond)
+
+		ejected, _ := d.evaluate(providers, now)
+		require.Len(t, ejected, 1)
+		assert.Equal(t, "b", ejected[0].name)
+		assert.Equal(t, ejectionLatency, ejected[0].Reason)
+	})
+
+	t.Run("too few requests", func(t *testing.T) {
+		d := newDetector()
+		recordCalls(d, "a", 9, 0, 0)
+		recordCalls(d, "b", 0, 10, time.Millisecond)
+
+		ejected, _ := d.evaluate(providers, now)
+		assert.Empty(t, ejected)
+	})
+
+	t.Run("client errors", func(t *testing.T) {
+		d := newDetector()
+		for i := 0; i < 10; i++ {
+			d.record("a", 0, errors.New("openai API error: status code 400: invalid model"))
+		}
+		recordCalls(d, "a", 0, 10, time.Millisecond)
+		recordCalls(d, "b", 0, 10, time.Millisecond)
+
+		ejected, _ := d.evaluate(providers, now)
+		assert.Empty(t, ejected)
+	})
+
+	t.Run("max ejection percent", func(t *testing.T) {
+		d := newDetector()
+		recordCalls(d, "a", 10, 0, 0)
+		recordCalls(d, "b", 10, 0, 0)
+		recordCalls(d, "c", 0, 10, time.Millisecond)
+
+		// Half of three providers rounds down, but one may always be ejected
+		ejected, _ := d.evaluate(providers, now)
+		require.Len(t, ejected, 1)
+		assert.Equal(t, "a", ejected[0].name)
+		assert.False(t, d.ejected("b"))
+	})
+
+	t.Run("growing ejection time", func(t *testing.T) {
+		d := newDetector()
+		ejectA := func(at time.Time) []ejectionEvent {
+			recordCalls(d, "a", 10, 0, 0)
+			recordCalls(d, "b", 0, 10, time.Millisecond)
+			ejected, _ := d.evaluate(providers, at)
+			return ejected
+		}
+
+		require.Len(t, ejectA(now), 1)
+
+		// Still ejected, so not evaluated again
+		assert.Empty(t, ejectA(now.Add(30*time.Second)))
+
+		// Back in rotation, then ejected again for twice as long
+		at := now.Add(time.Minute)
+		_, returned := d.evaluate(providers, at)
+		assert.Equal(t, []string{"a"}, returned)
+		ejected := ejectA(at.Add(time.Second))
+		require.Len(t, ejected, 1)
+		assert.Equal(t, 2*time.Minute, ejected[0].duration)
+		assert.Equal(t, 2, ejected[0].Count)
+
+		// Up to the maximum
+		at = at.Add(3 * time.Minute)
+		_, returned = d.evaluate(providers, at)
+		assert.Equal(t, []string{"a"}, returned)
+		ejected = ejectA(at.Add(time.Second))
+		require.Len(t, ejected, 1)
+		assert.Equal(t, 3*time.Minute, ejected[0].duration)
+	})
+}
+
+func TestOutlierEjection(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+	cfg := &config.Config{
+		TestMode: true,
+		LLM: config.LLMConfig{
+			OutlierDetection: &config.OutlierDetectionConfig{
+				Enabled:  true,
+				Interval: time.Hour,
+			},
+		},
+		CircuitBreaker: config.CircuitBreakerConfig{
+			Timeout:  time.Minute,
+			TestMode: true,
+		},
+	}
+	m, err := NewManager(cfg, zap.NewNop(), registry)
+	require.NoError(t, err)
+	for _, name := range []string{"primary", "backup"} {
+		name := name
+		require.NoError(t, m.SetProvider(name, mocks.NewMockLLMWithConfig("openai", "gpt-4o",
+			func(ctx context.Context, p *gollm.Prompt) (string, error) {
+				return name, nil
+			})))
+	}
+
+	recordCalls(m.outliers.Load(), "primary", 10, 0, 0)
+	recordCalls(m.outliers.Load(), "backup", 0, 10, time.Millisecond)
+	m.detectOutliers()
+
+	// The ejected primary gets no traffic
+	resp, err := m.Generate(context.Background(), &GenerateRequest{
+		Prompt:  &gollm.Prompt{Messages: []gollm.PromptMessage{{Role: "user", Content: "hello"}}},
+		NoCache: true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "backup", resp.Provider)
+
+	health := m.Health()
+	require.NotNil(t, health["primary"].Ejection)
+	assert.Equal(t, ejectionErrorRate, health["primary"].Ejection.Reason)
+	assert.Nil(t, health["backup"].Ejection)
+
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP hapax_provider_ejected Whether a provider is ejected by outlier detection (1) or not (0)
+# TYPE hapax_provider_ejected gauge
+hapax_provider_ejected{provider="primary"} 1
+# HELP hapax_provider_ejections_total Provider ejections by outlier detection, by provider and reason (error_rate or latency)
+# TYPE hapax_provider_ejections_total counter
+hapax_provider_ejections_total{provider="primary",reason="error_rate"} 1
+`), "hapax_provider_ejected", "hapax_provider_ejections_total"))
+}
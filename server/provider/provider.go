@@ -3,13 +3,16 @@ package provider
 import (
 	"context"
 	"fmt"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sony/gobreaker"
 	"github.com/teilomillet/gollm"
 	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/server/cache"
 	"github.com/teilomillet/hapax/server/circuitbreaker"
 	"go.uber.org/zap"
 	"golang.org/x/sync/singleflight"
@@ -21,9 +24,26 @@ type Manager struct {
 	breakers     map[string]*circuitbreaker.CircuitBreaker
 	healthStates sync.Map // map[string]HealthStatus
 	logger       *zap.Logger
-	cfg          *config.Config
+	cfg          *config.Config // Configuration, replaced by Update and never modified; read it with config() outside m.mu
+	preference   []string       // Failover order of the providers, reordered at runtime
+	breakerCfg   *config.Config // Source of circuit breaker settings, replaced by UpdateCircuitBreakers
 	mu           sync.RWMutex
-	group        *singleflight.Group // For deduplicating identical requests
+	group        *singleflight.Group                       // For deduplicating identical requests
+	flights      map[string]*flight                        // Callers of the deduplicated calls in progress, by key
+	flightsMu    sync.Mutex                                // Protects flights
+	cache        cache.Cache                               // Response cache, nil when disabled
+	cacheTTL     time.Duration                             // Lifetime of cached responses
+	retry        atomic.Pointer[RetryPolicy]               // Default retry policy, nil disables retries
+	hedging      atomic.Pointer[HedgingPolicy]             // Hedging policy, nil disables hedging
+	outliers     atomic.Pointer[outlierDetector]           // Outlier detection, nil when disabled
+	strategies   map[string]Strategy                       // Selection strategies by name
+	outstanding  sync.Map                                  // map[string]*atomic.Int64, requests in flight per provider
+	shadowSlots  chan struct{}                             // Bounds the shadow calls in flight
+	traffic      sync.Map                                  // map[string]*trafficWindow, recent outcomes of passively checked providers
+	modes        map[string]ProviderMode                   // Providers drained or disabled at runtime
+	retired      map[string]*circuitbreaker.CircuitBreaker // Breakers of removed providers, reused if they return
+	stopHealth   context.CancelFunc                        // Stops health checks, nil when disabled
+	stopOutliers context.CancelFunc                        // Stops outlier detection, nil when disabled
 
 	// Metrics
 	registry             *prometheus.Registry
@@ -32,22 +52,65 @@ type Manager struct {
 	requestLatency       *prometheus.HistogramVec
 	deduplicatedRequests prometheus.Counter // New metric for tracking deduplicated requests
 	healthyProviders     *prometheus.GaugeVec
+	retries              *prometheus.CounterVec
+	tokens               *prometheus.CounterVec // Tokens consumed by provider, model and key
+	cost                 *prometheus.CounterVec // Estimated cost by provider, model and key
+	experimentRequests   *prometheus.CounterVec // Requests by experiment, variant and status
+	experimentLatency    *prometheus.HistogramVec
+	hedges               *prometheus.CounterVec // Hedge attempts by provider and outcome
+	hedgesOverBudget     prometheus.Counter
+	ejectedProviders     *prometheus.GaugeVec   // Whether each provider is ejected
+	ejections            *prometheus.CounterVec // Ejections by provider and reason
 }
 
 // NewManager creates a new provider manager
 func NewManager(cfg *config.Config, logger *zap.Logger, registry *prometheus.Registry) (*Manager, error) {
 	m := &Manager{
-		providers: make(map[string]gollm.LLM),
-		breakers:  make(map[string]*circuitbreaker.CircuitBreaker),
-		logger:    logger,
-		cfg:       cfg,
-		registry:  registry,
-		group:     &singleflight.Group{},
+		providers:   make(map[string]gollm.LLM),
+		breakers:    make(map[string]*circuitbreaker.CircuitBreaker),
+		modes:       make(map[string]ProviderMode),
+		retired:     make(map[string]*circuitbreaker.CircuitBreaker),
+		logger:      logger,
+		cfg:         cfg,
+		breakerCfg:  cfg,
+		registry:    registry,
+		group:       &singleflight.Group{},
+		flights:     make(map[string]*flight),
+		shadowSlots: make(chan struct{}, maxShadowCalls),
+		preference:  slices.Clone(cfg.ProviderPreference),
+	}
+	m.retry.Store(NewRetryPolicy(cfg.LLM.Retry))
+	m.hedging.Store(NewHedgingPolicy(cfg.LLM.Hedging))
+	m.outliers.Store(newOutlierDetector(cfg.LLM.OutlierDetection))
+
+	// Each strategy is shared by the routes selecting it, so that weighted
+	// round-robin keeps one rotation per manager
+	m.strategies = make(map[string]Strategy)
+	for _, name := range []string{
+		config.SelectionPriority,
+		config.SelectionWeightedRoundRobin,
+		config.SelectionLeastLatency,
+		config.SelectionLeastOutstanding,
+		config.SelectionCostAware,
+	} {
+		strategy, err := NewStrategy(name)
+		if err != nil {
+			return nil, err
+		}
+		m.strategies[name] = strategy
 	}
 
 	// Initialize metrics
 	m.initializeMetrics(registry)
 
+	// Initialize the response cache if configured
+	respCache, err := cache.New(cfg.LLM.Cache, registry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize response cache: %w", err)
+	}
+	m.cache = respCache
+	m.cacheTTL = cache.TTL(cfg.LLM.Cache)
+
 	// Initialize providers from both new and legacy configs
 	if !cfg.TestMode {
 		if err := m.initializeProviders(); err != nil {
@@ -55,95 +118,129 @@ func NewManager(cfg *config.Config, logger *zap.Logger, registry *prometheus.Reg
 		}
 	}
 
-	// Start health checks if enabled
-	if cfg.LLM.HealthCheck != nil && cfg.LLM.HealthCheck.Enabled {
-		go m.startHealthChecks(context.Background())
-	}
+	// Start health checks and outlier detection if enabled
+	m.restartHealthChecks(cfg)
+	m.restartOutlierDetection(m.outliers.Load())
 
 	return m, nil
 }
 
-// initializeProviders sets up LLM providers based on configuration
+// config returns the current configuration. Callers must not hold m.mu.
+func (m *Manager) config() *config.Config {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cfg
+}
+
+// initializeProviders sets up the failover chain from configuration.
+// The chain merges the llm block's primary provider, its backup providers
+// and the providers map; each entry gets its own circuit breaker. Entries
+// that fail to initialize are skipped so one bad backup does not disable
+// failover for the others.
 func (m *Manager) initializeProviders() error {
 	m.providers = make(map[string]gollm.LLM)
 	m.breakers = make(map[string]*circuitbreaker.CircuitBreaker)
 
-	for name, cfg := range m.cfg.Providers {
-		provider, err := m.initializeProvider(name, cfg)
+	chain := m.cfg.ProviderChain()
+	preference := make([]string, 0, len(chain))
+
+	for _, entry := range chain {
+		provider, err := NewLLM(entry.ProviderConfig)
 		if err != nil {
-			return fmt.Errorf("failed to initialize provider %s: %w", name, err)
+			m.logger.Warn("Skipping provider that failed to initialize",
+				zap.String("provider", entry.Name),
+				zap.String("type", entry.Type),
+				zap.Error(err))
+			continue
 		}
 
-		m.providers[name] = provider
+		if err := m.addProvider(entry.Name, provider); err != nil {
+			return err
+		}
+		preference = append(preference, entry.Name)
+
 		m.logger.Info("Created LLM",
-			zap.String("provider", name),
-			zap.String("model", cfg.Model),
-			zap.Int("api_key_length", len(cfg.APIKey)))
+			zap.String("provider", entry.Name),
+			zap.String("type", entry.Type),
+			zap.String("model", entry.Model),
+			zap.Int("api_key_length", len(entry.APIKey)))
+	}
 
-		// Initialize provider as healthy
-		m.UpdateHealthStatus(name, HealthStatus{
-			Healthy:    true,
-			LastCheck:  time.Now(),
-			ErrorCount: 0,
-		})
+	if len(chain) > 0 && len(preference) == 0 {
+		return fmt.Errorf("no provider in the failover chain could be initialized")
+	}
 
-		// Initialize circuit breaker with gobreaker configuration
-		cbConfig := circuitbreaker.Config{
-			Name:             name,
-			MaxRequests:      1,               // Allow 1 request in half-open state
-			Interval:         time.Minute * 2, // Cyclic period of closed state
-			Timeout:          time.Minute,     // Period of open state
-			FailureThreshold: 3,               // Trip after 3 failures
-			TestMode:         m.cfg.CircuitBreaker.TestMode,
-		}
+	m.mu.Lock()
+	m.preference = preference
+	m.mu.Unlock()
 
-		// Override with config values if provided
-		if m.cfg.CircuitBreaker.Timeout > 0 {
-			cbConfig.Timeout = m.cfg.CircuitBreaker.Timeout
-		}
-		if m.cfg.CircuitBreaker.MaxRequests > 0 {
-			cbConfig.MaxRequests = m.cfg.CircuitBreaker.MaxRequests
-		}
+	m.logger.Info("Provider failover chain ready", zap.Strings("chain", preference))
+	return nil
+}
 
-		breaker, err := circuitbreaker.NewCircuitBreaker(cbConfig, m.logger, m.registry)
-		if err != nil {
-			return fmt.Errorf("failed to create circuit breaker for %s: %w", name, err)
-		}
-		m.breakers[name] = breaker
+// addProvider registers a provider with a fresh circuit breaker and
+// marks it healthy.
+func (m *Manager) addProvider(name string, provider gollm.LLM) error {
+	breaker, err := m.newBreaker(name)
+	if err != nil {
+		return err
 	}
 
+	m.mu.Lock()
+	delete(m.retired, name)
+	m.providers[name] = provider
+	m.breakers[name] = breaker
+	m.mu.Unlock()
+
+	// Initialize provider as healthy
+	m.UpdateHealthStatus(name, HealthStatus{
+		Healthy:    true,
+		LastCheck:  time.Now(),
+		ErrorCount: 0,
+	})
+
 	return nil
 }
 
-// initializeProvider initializes a single LLM provider
-func (m *Manager) initializeProvider(_ string, cfg config.ProviderConfig) (gollm.LLM, error) {
-	provider, err := gollm.NewLLM(
-		gollm.SetProvider(cfg.Type),
-		gollm.SetModel(cfg.Model),
-		gollm.SetAPIKey(cfg.APIKey),
-	)
+// newBreaker returns a closed circuit breaker for the named provider. The
+// metrics of a removed provider's breaker stay registered, so its breaker
+// is reused rather than registered again; a breaker that ends up unused is
+// retired for the same reason.
+func (m *Manager) newBreaker(name string) (*circuitbreaker.CircuitBreaker, error) {
+	m.mu.RLock()
+	cbConfig := breakerConfig(m.breakerCfg, name)
+	breaker, retired := m.retired[name]
+	m.mu.RUnlock()
+
+	if retired {
+		breaker.Reconfigure(cbConfig)
+		return breaker, nil
+	}
+	breaker, err := circuitbreaker.NewCircuitBreaker(cbConfig, m.logger, m.registry)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to create circuit breaker for %s: %w", name, err)
 	}
-
-	return provider, nil
+	return breaker, nil
 }
 
-// GetProvider returns a healthy provider or error if none available
+// GetProvider returns a healthy provider, chosen by the configured
+// selection strategy, or error if none available
 func (m *Manager) GetProvider() (gollm.LLM, error) {
+	order, _ := m.selectionOrder(context.Background(), nil)
+
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	// Try each provider in order of preference
-	for _, name := range m.cfg.ProviderPreference {
+	// Try each provider in order of selection
+	for _, name := range order {
 		provider, exists := m.providers[name]
 		if !exists {
 			continue
 		}
 
-		// Skip if provider is unhealthy
+		// Skip if provider is unhealthy or ejected
 		status := m.GetHealthStatus(name)
-		if !status.Healthy {
+		if !status.Healthy || m.outliers.Load().ejected(name) {
 			continue
 		}
 
@@ -159,6 +256,33 @@ func (m *Manager) GetProvider() (gollm.LLM, error) {
 	return nil, fmt.Errorf("no healthy provider available")
 }
 
+// SetProvider installs llm as the named entry of the failover chain,
+// replacing any instance built from configuration. The entry keeps its
+// position and circuit breaker; a new name is appended to the chain.
+func (m *Manager) SetProvider(name string, llm gollm.LLM) error {
+	m.mu.Lock()
+	_, exists := m.breakers[name]
+	if exists {
+		m.providers[name] = llm
+	}
+	m.mu.Unlock()
+
+	if exists {
+		return nil
+	}
+
+	if err := m.addProvider(name, llm); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !slices.Contains(m.preference, name) {
+		m.preference = append(m.preference, name)
+	}
+	return nil
+}
+
 // SetProviders replaces the current providers with new ones (for testing)
 func (m *Manager) SetProviders(providers map[string]gollm.LLM) {
 	m.mu.Lock()
@@ -173,16 +297,7 @@ func (m *Manager) SetProviders(providers map[string]gollm.LLM) {
 		m.providers[name] = provider
 
 		// Create circuit breaker for provider
-		cbConfig := circuitbreaker.Config{
-			Name:             name,
-			MaxRequests:      1,
-			Interval:         time.Second,
-			Timeout:          m.cfg.CircuitBreaker.Timeout,
-			FailureThreshold: 2,
-			TestMode:         m.cfg.CircuitBreaker.TestMode,
-		}
-
-		breaker, err := circuitbreaker.NewCircuitBreaker(cbConfig, m.logger, m.registry)
+		breaker, err := circuitbreaker.NewCircuitBreaker(breakerConfig(m.breakerCfg, name), m.logger, m.registry)
 		if err != nil {
 			m.logger.Error("Failed to create circuit breaker",
 				zap.String("provider", name),
@@ -205,7 +320,7 @@ func (m *Manager) SetProviders(providers map[string]gollm.LLM) {
 
 	// Keep existing provider preference order for providers that still exist
 	newPreference := make([]string, 0, len(providers))
-	for _, name := range m.cfg.ProviderPreference {
+	for _, name := range m.preference {
 		if _, exists := providers[name]; exists {
 			newPreference = append(newPreference, name)
 			added[name] = true
@@ -219,6 +334,6 @@ func (m *Manager) SetProviders(providers map[string]gollm.LLM) {
 		}
 	}
 
-	m.cfg.ProviderPreference = newPreference
+	m.preference = newPreference
 	m.logger.Debug("updated provider preference list", zap.Strings("preference", newPreference))
 }
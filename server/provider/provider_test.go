@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -13,8 +14,10 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/teilomillet/gollm"
 	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/server/middleware"
 	"github.com/teilomillet/hapax/server/mocks"
 	"github.com/teilomillet/hapax/server/provider"
+	"github.com/teilomillet/hapax/server/usage"
 	"go.uber.org/zap"
 )
 
@@ -400,3 +403,293 @@ func TestMultiProviderSeamlessConnection(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, "Anthropic response", response)
 }
+
+func TestGenerateUsesResponseCache(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		TestMode: true,
+		LLM: config.LLMConfig{
+			Cache: &config.CacheConfig{
+				Enable:  true,
+				Type:    "memory",
+				TTL:     time.Minute,
+				MaxSize: 10,
+			},
+		},
+		ProviderPreference: []string{"test"},
+		CircuitBreaker: config.CircuitBreakerConfig{
+			MaxRequests:      1,
+			Interval:         time.Second,
+			Timeout:          time.Second,
+			FailureThreshold: 2,
+			TestMode:         true,
+		},
+	}
+
+	calls := 0
+	mockLLM := mocks.NewMockLLMWithConfig("test", "test-model", func(ctx context.Context, p *gollm.Prompt) (string, error) {
+		calls++
+		return fmt.Sprintf("answer %d", calls), nil
+	})
+
+	manager, err := provider.NewManager(cfg, zap.NewNop(), prometheus.NewRegistry())
+	require.NoError(t, err)
+	manager.SetProviders(map[string]gollm.LLM{"test": mockLLM})
+
+	newRequest := func(content string, temperature float64) *provider.GenerateRequest {
+		return &provider.GenerateRequest{
+			Prompt: &gollm.Prompt{
+				Messages: []gollm.PromptMessage{{Role: "user", Content: content}},
+			},
+			Options: map[string]interface{}{"temperature": temperature},
+		}
+	}
+
+	first, err := manager.Generate(context.Background(), newRequest("classify this", 0.1))
+	require.NoError(t, err)
+	assert.False(t, first.Cached)
+	assert.Equal(t, "answer 1", first.Content)
+
+	// Identical after normalization: served from the cache
+	second, err := manager.Generate(context.Background(), newRequest("  classify this\r\n", 0.1))
+	require.NoError(t, err)
+	assert.True(t, second.Cached)
+	assert.Equal(t, "answer 1", second.Content)
+	assert.Equal(t, 1, calls)
+
+	// Different options must not share the cached response
+	third, err := manager.Generate(context.Background(), newRequest("classify this", 0.9))
+	require.NoError(t, err)
+	assert.False(t, third.Cached)
+	assert.Equal(t, 2, calls)
+
+	// Failed generations are not cached
+	mockLLM.GenerateFunc = func(ctx context.Context, p *gollm.Prompt) (string, error) {
+		return "", fmt.Errorf("provider down")
+	}
+	_, err = manager.Generate(context.Background(), newRequest("new prompt", 0.1))
+	require.Error(t, err)
+	mockLLM.GenerateFunc = func(ctx context.Context, p *gollm.Prompt) (string, error) {
+		return "recovered", nil
+	}
+	fourth, err := manager.Generate(context.Background(), newRequest("new prompt", 0.1))
+	require.NoError(t, err)
+	assert.False(t, fourth.Cached)
+	assert.Equal(t, "recovered", fourth.Content)
+}
+
+func TestGenerateReportsServingProvider(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		TestMode: true,
+		CircuitBreaker: config.CircuitBreakerConfig{
+			Timeout:  time.Minute,
+			TestMode: true,
+		},
+	}
+
+	manager, err := provider.NewManager(cfg, zap.NewNop(), prometheus.NewRegistry())
+	require.NoError(t, err)
+
+	require.NoError(t, manager.SetProvider("primary", mocks.NewMockLLMWithConfig("ollama", "llama2",
+		func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			return "", errors.New("primary down")
+		})))
+	require.NoError(t, manager.SetProvider("backup", mocks.NewMockLLMWithConfig("openai", "gpt-4",
+		func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			return "from backup", nil
+		})))
+	var names []string
+	for _, p := range manager.Providers() {
+		names = append(names, p.Name)
+	}
+	assert.Equal(t, []string{"primary", "backup"}, names)
+	assert.Empty(t, cfg.ProviderPreference, "the configuration is left as is")
+
+	req := &provider.GenerateRequest{
+		Prompt: &gollm.Prompt{Messages: []gollm.PromptMessage{{Role: "user", Content: "hello"}}},
+	}
+
+	// Failures accumulate on the primary until its breaker opens, after
+	// which the backup serves the request
+	var resp *provider.GenerateResponse
+	for i := 0; i < 5 && resp == nil; i++ {
+		resp, _ = manager.Generate(context.Background(), req)
+	}
+	require.NotNil(t, resp, "backup should serve once the primary breaker opens")
+	assert.Equal(t, "from backup", resp.Content)
+	assert.Equal(t, "backup", resp.Provider)
+}
+
+func TestGenerateRecordsUsage(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		TestMode: true,
+		LLM: config.LLMConfig{
+			Cache: &config.CacheConfig{Enable: true, Type: "memory", TTL: time.Minute, MaxSize: 10},
+		},
+		CircuitBreaker: config.CircuitBreakerConfig{
+			Timeout:  time.Minute,
+			TestMode: true,
+		},
+		Pricing: config.PricingTable{
+			"gpt-4": {Input: 10, Output: 30},
+		},
+	}
+
+	registry := prometheus.NewRegistry()
+	manager, err := provider.NewManager(cfg, zap.NewNop(), registry)
+	require.NoError(t, err)
+	require.NoError(t, manager.SetProvider("primary", mocks.NewMockLLMWithConfig("openai", "gpt-4",
+		func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			return "four words long here", nil
+		})))
+
+	req := &provider.GenerateRequest{
+		Prompt: &gollm.Prompt{Messages: []gollm.PromptMessage{{Role: "user", Content: "hello there"}}},
+	}
+
+	ctx, tracker := usage.NewContext(context.WithValue(context.Background(),
+		middleware.IdentityKey, middleware.Identity{KeyID: "billing"}))
+	resp, err := manager.Generate(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, "gpt-4", resp.Model)
+	assert.Positive(t, resp.PromptTokens)
+	assert.Positive(t, resp.CompletionTokens)
+	assert.Equal(t, int64(resp.PromptTokens), tracker.PromptTokens())
+	assert.Equal(t, int64(resp.CompletionTokens), tracker.CompletionTokens())
+	expected := cfg.Pricing.Cost("gpt-4", resp.PromptTokens, resp.CompletionTokens)
+	assert.Positive(t, expected)
+	assert.InDelta(t, expected, resp.Cost, 1e-9)
+	assert.InDelta(t, expected, tracker.Cost(), 1e-9)
+
+	// Cache hits use tokens but cost nothing
+	ctx, tracker = usage.NewContext(context.Background())
+	cached, err := manager.Generate(ctx, req)
+	require.NoError(t, err)
+	assert.True(t, cached.Cached)
+	assert.Positive(t, tracker.TotalTokens())
+	assert.Zero(t, tracker.Cost())
+	assert.Zero(t, cached.Cost)
+
+	// Only the provider call is counted in the metrics
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(fmt.Sprintf(`
+# HELP hapax_llm_cost_usd_total Estimated cost of completions in USD by provider, model and API key
+# TYPE hapax_llm_cost_usd_total counter
+hapax_llm_cost_usd_total{key_id="billing",model="gpt-4",provider="primary"} %g
+# HELP hapax_llm_tokens_total Tokens consumed by provider, model, API key and type (prompt or completion)
+# TYPE hapax_llm_tokens_total counter
+hapax_llm_tokens_total{key_id="billing",model="gpt-4",provider="primary",type="completion"} %d
+hapax_llm_tokens_total{key_id="billing",model="gpt-4",provider="primary",type="prompt"} %d
+`, resp.Cost, resp.CompletionTokens, resp.PromptTokens)), "hapax_llm_cost_usd_total", "hapax_llm_tokens_total"))
+}
+
+func TestGenerateStream(t *testing.T) {
+	t.Parallel()
+
+	newManager := func(t *testing.T, llm gollm.LLM) *provider.Manager {
+		cfg := &config.Config{
+			TestMode: true,
+			LLM: config.LLMConfig{Retry: &config.RetryConfig{
+				MaxRetries:      2,
+				InitialDelay:    time.Millisecond,
+				MaxDelay:        time.Millisecond,
+				Multiplier:      1,
+				RetryableErrors: []string{"server_error"},
+			}},
+			CircuitBreaker: config.CircuitBreakerConfig{
+				Timeout:  time.Minute,
+				TestMode: true,
+			},
+		}
+		manager, err := provider.NewManager(cfg, zap.NewNop(), prometheus.NewRegistry())
+		require.NoError(t, err)
+		require.NoError(t, manager.SetProvider("primary", llm))
+		return manager
+	}
+
+	req := &provider.GenerateRequest{
+		Prompt: &gollm.Prompt{Messages: []gollm.PromptMessage{{Role: "user", Content: "hello"}}},
+	}
+
+	collect := func(chunks *[]string) func(string) error {
+		return func(chunk string) error {
+			*chunks = append(*chunks, chunk)
+			return nil
+		}
+	}
+
+	t.Run("emits chunks in order", func(t *testing.T) {
+		manager := newManager(t, mocks.NewMockStreamingLLM("Hel", "lo", "!"))
+
+		var chunks []string
+		resp, err := manager.GenerateStream(context.Background(), req, collect(&chunks))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Hel", "lo", "!"}, chunks)
+		assert.Equal(t, "Hello!", resp.Content)
+		assert.Equal(t, "primary", resp.Provider)
+	})
+
+	t.Run("non-streaming providers send a single chunk", func(t *testing.T) {
+		manager := newManager(t, mocks.NewMockLLMWithConfig("openai", "gpt-4",
+			func(ctx context.Context, p *gollm.Prompt) (string, error) {
+				return "whole response", nil
+			}))
+
+		var chunks []string
+		resp, err := manager.GenerateStream(context.Background(), req, collect(&chunks))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"whole response"}, chunks)
+		assert.Equal(t, "whole response", resp.Content)
+	})
+
+	t.Run("retries before the first chunk only", func(t *testing.T) {
+		calls := 0
+		llm := mocks.NewMockStreamingLLM()
+		llm.StreamFunc = func(ctx context.Context, p *gollm.Prompt, emit func(string) error) (string, error) {
+			calls++
+			if calls == 1 {
+				return "", errors.New("API error: status code 503")
+			}
+			if err := emit("partial"); err != nil {
+				return "", err
+			}
+			return "partial", errors.New("API error: status code 503")
+		}
+		manager := newManager(t, llm)
+
+		var chunks []string
+		_, err := manager.GenerateStream(context.Background(), req, collect(&chunks))
+		require.Error(t, err)
+		assert.Equal(t, 2, calls, "a failure after output started must not be retried")
+		assert.Equal(t, []string{"partial"}, chunks)
+	})
+
+	t.Run("stops when emit fails", func(t *testing.T) {
+		manager := newManager(t, mocks.NewMockStreamingLLM("a", "b", "c"))
+
+		gone := errors.New("client gone")
+		sent := 0
+		_, err := manager.GenerateStream(context.Background(), req, func(string) error {
+			sent++
+			return gone
+		})
+		require.ErrorIs(t, err, gone)
+		assert.Equal(t, 1, sent)
+	})
+
+	t.Run("records usage of interrupted streams", func(t *testing.T) {
+		manager := newManager(t, mocks.NewMockStreamingLLM("partial ", "answer"))
+
+		ctx, tracker := usage.NewContext(context.Background())
+		_, err := manager.GenerateStream(ctx, req, func(string) error {
+			return errors.New("client gone")
+		})
+		require.Error(t, err)
+		assert.Positive(t, tracker.PromptTokens())
+		assert.Positive(t, tracker.CompletionTokens(), "text already sent is accounted for")
+	})
+}
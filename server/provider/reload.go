@@ -0,0 +1,237 @@
+package provider
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/teilomillet/gollm"
+	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/server/circuitbreaker"
+	"go.uber.org/zap"
+)
+
+// Update applies a new configuration to the running manager, so that a
+// configuration reload does not lose the state of providers. Providers
+// whose type, model, API key and endpoint are unchanged keep their
+// instance, circuit breaker, health and outlier ejection. Changed providers
+// are created again and start over closed, healthy and in rotation, as
+// their state described the previous instance; new providers are created,
+// and providers no longer configured are removed. Providers keep their
+// mode. Retry, hedging, outlier
+// detection and health checks take their new settings, keeping their state
+// when the settings are unchanged. Changes to the response cache apply on
+// restart.
+//
+// When no provider of a non-empty chain can be created, or the circuit
+// breaker of a new provider cannot be, the manager is left unchanged and
+// an error is returned. In test mode, providers are left as they are.
+func (m *Manager) Update(cfg *config.Config) error {
+	return m.update(cfg, nil)
+}
+
+// UpdatePrimary updates the manager like Update, with llm serving the
+// primary provider of cfg as SetProvider sets it. On error, neither
+// applies.
+func (m *Manager) UpdatePrimary(cfg *config.Config, llm gollm.LLM) error {
+	return m.update(cfg, llm)
+}
+
+// update implements Update, setting primary as the instance of the primary
+// provider of cfg unless it is nil.
+func (m *Manager) update(cfg *config.Config, primary gollm.LLM) error {
+	old := m.config()
+
+	var created map[string]gollm.LLM
+	var preference []string
+	if cfg.TestMode {
+		preference = m.getProviderPreference()
+	} else {
+		var err error
+		if created, preference, err = m.diffProviders(old, cfg); err != nil {
+			return err
+		}
+	}
+	instances := maps.Clone(created)
+	if primary != nil {
+		if instances == nil {
+			instances = make(map[string]gollm.LLM)
+		}
+		instances[cfg.LLM.Provider] = primary
+		if !slices.Contains(preference, cfg.LLM.Provider) {
+			preference = append(preference, cfg.LLM.Provider)
+		}
+	}
+
+	// The breakers of new providers are created before anything changes
+	added := make(map[string]*circuitbreaker.CircuitBreaker)
+	m.mu.RLock()
+	for name := range instances {
+		if _, exists := m.breakers[name]; !exists {
+			added[name] = nil
+		}
+	}
+	m.mu.RUnlock()
+	for name := range added {
+		breaker, err := m.newBreaker(name)
+		if err != nil {
+			m.mu.Lock()
+			for name, breaker := range added {
+				if breaker != nil {
+					m.retired[name] = breaker
+				}
+			}
+			m.mu.Unlock()
+			return err
+		}
+		added[name] = breaker
+	}
+
+	// Changed providers start over. Their circuit breaker, whose metrics
+	// are registered, is reset rather than replaced.
+	changed := make(map[string]*circuitbreaker.CircuitBreaker)
+	m.mu.Lock()
+	for name, llm := range instances {
+		m.providers[name] = llm
+		if breaker, isNew := added[name]; isNew {
+			delete(m.retired, name)
+			m.breakers[name] = breaker
+		} else if _, isChanged := created[name]; isChanged {
+			changed[name] = m.breakers[name]
+		}
+	}
+	if !cfg.TestMode {
+		m.removeProviders(preference)
+	}
+	m.preference = preference
+	m.cfg = cfg
+	m.mu.Unlock()
+
+	for name, breaker := range changed {
+		breaker.Reset()
+		m.traffic.Delete(name)
+		m.outliers.Load().forget(name)
+		m.UpdateHealthStatus(name, HealthStatus{Healthy: true, LastCheck: time.Now()})
+	}
+	for name := range added {
+		m.UpdateHealthStatus(name, HealthStatus{Healthy: true, LastCheck: time.Now()})
+	}
+
+	m.UpdateCircuitBreakers(cfg)
+
+	m.retry.Store(NewRetryPolicy(cfg.LLM.Retry))
+	if !reflect.DeepEqual(old.LLM.Hedging, cfg.LLM.Hedging) {
+		m.hedging.Store(NewHedgingPolicy(cfg.LLM.Hedging))
+	}
+	if !reflect.DeepEqual(old.LLM.OutlierDetection, cfg.LLM.OutlierDetection) {
+		m.restartOutlierDetection(newOutlierDetector(cfg.LLM.OutlierDetection))
+	}
+	if !reflect.DeepEqual(old.LLM.HealthCheck, cfg.LLM.HealthCheck) {
+		m.restartHealthChecks(cfg)
+	}
+	if !reflect.DeepEqual(old.LLM.Cache, cfg.LLM.Cache) {
+		m.logger.Warn("Response cache settings changed, they apply on restart")
+	}
+
+	m.logger.Info("Provider failover chain updated", zap.Strings("chain", preference))
+	return nil
+}
+
+// diffProviders compares the failover chains of two configurations. It
+// returns the providers it created for the entries of cfg that are new or
+// changed, along with the names of the entries that can serve, in order.
+func (m *Manager) diffProviders(old, cfg *config.Config) (map[string]gollm.LLM, []string, error) {
+	previous := make(map[string]config.ProviderConfig)
+	for _, entry := range old.ProviderChain() {
+		previous[entry.Name] = entry.ProviderConfig
+	}
+
+	m.mu.RLock()
+	running := make(map[string]bool, len(m.providers))
+	for name := range m.providers {
+		running[name] = true
+	}
+	m.mu.RUnlock()
+
+	chain := cfg.ProviderChain()
+	created := make(map[string]gollm.LLM)
+	preference := make([]string, 0, len(chain))
+	for _, entry := range chain {
+		if p, ok := previous[entry.Name]; ok && running[entry.Name] && sameInstance(p, entry.ProviderConfig) {
+			preference = append(preference, entry.Name)
+			continue
+		}
+
+		provider, err := NewLLM(entry.ProviderConfig)
+		if err != nil {
+			m.logger.Warn("Skipping provider that failed to initialize",
+				zap.String("provider", entry.Name),
+				zap.String("type", entry.Type),
+				zap.Error(err))
+			continue
+		}
+		created[entry.Name] = provider
+		preference = append(preference, entry.Name)
+
+		m.logger.Info("Created LLM",
+			zap.String("provider", entry.Name),
+			zap.String("type", entry.Type),
+			zap.String("model", entry.Model),
+			zap.Int("api_key_length", len(entry.APIKey)))
+	}
+
+	if len(chain) > 0 && len(preference) == 0 {
+		return nil, nil, fmt.Errorf("no provider in the failover chain could be initialized")
+	}
+	return created, preference, nil
+}
+
+// sameInstance reports whether two provider entries are served by the same
+// LLM instance. Their other settings are read from the configuration.
+func sameInstance(a, b config.ProviderConfig) bool {
+	return a.Type == b.Type && a.Model == b.Model && a.APIKey == b.APIKey && a.Endpoint == b.Endpoint
+}
+
+// removeProviders removes the providers that are not kept. Their circuit
+// breakers are retired rather than dropped, as their metrics stay
+// registered. Callers hold m.mu.
+func (m *Manager) removeProviders(keep []string) {
+	kept := make(map[string]bool, len(keep))
+	for _, name := range keep {
+		kept[name] = true
+	}
+
+	for name := range m.providers {
+		if kept[name] {
+			continue
+		}
+		delete(m.providers, name)
+		if breaker, ok := m.breakers[name]; ok {
+			m.retired[name] = breaker
+			delete(m.breakers, name)
+		}
+		delete(m.modes, name)
+		m.healthStates.Delete(name)
+		m.traffic.Delete(name)
+		m.healthyProviders.DeleteLabelValues(name)
+
+		m.logger.Info("Removed provider", zap.String("provider", name))
+	}
+}
+
+// Close stops the health checks and outlier detection of the manager.
+func (m *Manager) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopHealth != nil {
+		m.stopHealth()
+		m.stopHealth = nil
+	}
+	if m.stopOutliers != nil {
+		m.stopOutliers()
+		m.stopOutliers = nil
+	}
+}
@@ -0,0 +1,144 @@
+package provider
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sony/gobreaker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/server/circuitbreaker"
+	"go.uber.org/zap"
+)
+
+func TestManagerUpdate(t *testing.T) {
+	t.Parallel()
+
+	newConfig := func(providers map[string]config.ProviderConfig) *config.Config {
+		return &config.Config{
+			LLM: config.LLMConfig{
+				OutlierDetection: &config.OutlierDetectionConfig{Enabled: true, Interval: time.Hour},
+			},
+			Providers:      providers,
+			CircuitBreaker: config.CircuitBreakerConfig{FailureThreshold: 3},
+		}
+	}
+	openai := config.ProviderConfig{Type: "openai", Model: "gpt-4o", APIKey: "sk-openai"}
+	anthropic := config.ProviderConfig{Type: "anthropic", Model: "claude-3-haiku", APIKey: "sk-anthropic"}
+
+	m, err := NewManager(newConfig(map[string]config.ProviderConfig{
+		"a": openai,
+		"b": anthropic,
+	}), zap.NewNop(), prometheus.NewRegistry())
+	require.NoError(t, err)
+	defer m.Close()
+	require.NoError(t, m.SetProviderMode("a", ModeDraining))
+
+	m.mu.RLock()
+	a, b := m.providers["a"], m.providers["b"]
+	breakerA, breakerB := m.breakers["a"], m.breakers["b"]
+	m.mu.RUnlock()
+
+	// Both providers failed: their breakers are open, they are unhealthy
+	// and their errors count toward outlier detection
+	for _, breaker := range []*circuitbreaker.CircuitBreaker{breakerA, breakerB} {
+		for i := 0; i < 3; i++ {
+			_ = breaker.Execute(func() error { return errors.New("service unavailable") })
+		}
+		require.Equal(t, gobreaker.StateOpen, breaker.State())
+	}
+	for _, name := range []string{"a", "b"} {
+		m.UpdateHealthStatus(name, HealthStatus{Healthy: false, ErrorCount: 3})
+		m.outliers.Load().record(name, 0, errors.New("service unavailable"))
+	}
+
+	// b changes model, c is added and the breakers get a new threshold
+	anthropic.Model = "claude-3-opus"
+	cfg := newConfig(map[string]config.ProviderConfig{
+		"a": openai,
+		"b": anthropic,
+		"c": {Type: "openai", Model: "gpt-4o-mini", APIKey: "sk-openai"},
+	})
+	cfg.CircuitBreaker.FailureThreshold = 7
+	require.NoError(t, m.Update(cfg))
+
+	m.mu.RLock()
+	assert.Same(t, a, m.providers["a"], "unchanged providers keep their instance")
+	assert.NotSame(t, b, m.providers["b"])
+	assert.Equal(t, "claude-3-opus", m.providers["b"].GetModel())
+	assert.Same(t, breakerB, m.breakers["b"], "changed providers keep their breaker")
+	assert.Equal(t, ModeDraining, m.mode("a"))
+	m.mu.RUnlock()
+
+	// Changed providers start over, unchanged ones keep their state
+	assert.Equal(t, gobreaker.StateOpen, breakerA.State())
+	assert.Equal(t, gobreaker.StateClosed, breakerB.State())
+	assert.False(t, m.GetHealthStatus("a").Healthy)
+	assert.True(t, m.GetHealthStatus("b").Healthy)
+	detector := m.outliers.Load()
+	detector.mu.Lock()
+	assert.Contains(t, detector.stats, "a")
+	assert.NotContains(t, detector.stats, "b")
+	detector.mu.Unlock()
+
+	m.mu.RLock()
+	assert.Contains(t, m.providers, "c")
+	assert.Equal(t, uint32(7), breakerConfig(m.breakerCfg, "a").FailureThreshold)
+	m.mu.RUnlock()
+	assert.Equal(t, []string{"a", "b", "c"}, m.getProviderPreference())
+
+	// Removed providers are not served; their breaker comes back with them
+	m.mu.RLock()
+	breakerC := m.breakers["c"]
+	m.mu.RUnlock()
+	require.NoError(t, m.Update(newConfig(map[string]config.ProviderConfig{"a": openai, "b": anthropic})))
+	assert.Equal(t, []string{"a", "b"}, m.getProviderPreference())
+	assert.NotContains(t, m.Health(), "c")
+
+	require.NoError(t, m.Update(cfg))
+	m.mu.RLock()
+	assert.Same(t, breakerC, m.breakers["c"])
+	m.mu.RUnlock()
+
+	// A chain that cannot be served leaves the manager as it was
+	err = m.Update(newConfig(map[string]config.ProviderConfig{"x": {Type: "unknown"}}))
+	assert.Error(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, m.getProviderPreference())
+}
+
+func TestManagerUpdatePolicies(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		TestMode: true,
+		LLM: config.LLMConfig{
+			Hedging: &config.HedgingConfig{Enabled: true, Delay: time.Second},
+		},
+	}
+	m, err := NewManager(cfg, zap.NewNop(), prometheus.NewRegistry())
+	require.NoError(t, err)
+	defer m.Close()
+	hedging := m.hedging.Load()
+	require.NotNil(t, hedging)
+	assert.Nil(t, m.outliers.Load())
+
+	// Unchanged policies keep their state
+	same := *cfg
+	same.LLM.Hedging = &config.HedgingConfig{Enabled: true, Delay: time.Second}
+	require.NoError(t, m.Update(&same))
+	assert.Same(t, hedging, m.hedging.Load())
+
+	// Changed ones are replaced, or started
+	changed := same
+	changed.LLM.Hedging = nil
+	changed.LLM.OutlierDetection = &config.OutlierDetectionConfig{Enabled: true, Interval: time.Hour}
+	require.NoError(t, m.Update(&changed))
+	assert.Nil(t, m.hedging.Load())
+	assert.NotNil(t, m.outliers.Load())
+	m.mu.RLock()
+	assert.NotNil(t, m.stopOutliers)
+	m.mu.RUnlock()
+}
@@ -0,0 +1,226 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/teilomillet/gollm/llm"
+	"github.com/teilomillet/hapax/config"
+)
+
+// ErrorClass groups provider errors by how they should be handled.
+// The values match the names accepted in RetryConfig.RetryableErrors.
+type ErrorClass string
+
+const (
+	// ErrorClassRateLimit indicates the provider rejected the request due to rate limiting
+	ErrorClassRateLimit ErrorClass = "rate_limit"
+
+	// ErrorClassTimeout indicates the provider did not answer in time
+	ErrorClassTimeout ErrorClass = "timeout"
+
+	// ErrorClassServerError indicates a failure on the provider side (5xx)
+	ErrorClassServerError ErrorClass = "server_error"
+
+	// ErrorClassPermanent covers everything else, such as invalid input
+	// or authentication failures. These errors are never retried.
+	ErrorClassPermanent ErrorClass = "permanent"
+)
+
+var (
+	statusCodePattern = regexp.MustCompile(`status(?: code)?[:= ]+(\d{3})`)
+	retryAfterPattern = regexp.MustCompile(`(?i)(?:retry[- ]after|try again in)[:= ]*(\d+(?:\.\d+)?)\s*(ms|s|seconds?)?`)
+)
+
+// RetryAfterError is implemented by errors that carry a server-provided
+// hint (such as an HTTP Retry-After header) about when to retry.
+type RetryAfterError interface {
+	error
+	RetryAfter() time.Duration
+}
+
+// ClassifyError maps a provider error onto an ErrorClass.
+// Client cancellations are permanent: there is nobody left to retry for.
+// So are failures in the middle of a stream, which cannot be replayed.
+func ClassifyError(err error) ErrorClass {
+	if err == nil || errors.Is(err, context.Canceled) || isPartialStream(err) {
+		return ErrorClassPermanent
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorClassTimeout
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorClassTimeout
+	}
+
+	var llmErr *llm.LLMError
+	if errors.As(err, &llmErr) {
+		switch llmErr.Type {
+		case llm.ErrorTypeRateLimit:
+			return ErrorClassRateLimit
+		case llm.ErrorTypeAuthentication, llm.ErrorTypeInvalidInput:
+			return ErrorClassPermanent
+		}
+	}
+
+	msg := strings.ToLower(err.Error())
+
+	if m := statusCodePattern.FindStringSubmatch(msg); m != nil {
+		code, _ := strconv.Atoi(m[1])
+		switch {
+		case code == 429:
+			return ErrorClassRateLimit
+		case code == 408:
+			return ErrorClassTimeout
+		case code >= 500:
+			return ErrorClassServerError
+		default:
+			return ErrorClassPermanent
+		}
+	}
+
+	switch {
+	case strings.Contains(msg, "rate limit"), strings.Contains(msg, "too many requests"):
+		return ErrorClassRateLimit
+	case strings.Contains(msg, "timeout"), strings.Contains(msg, "timed out"):
+		return ErrorClassTimeout
+	case strings.Contains(msg, "internal server error"),
+		strings.Contains(msg, "bad gateway"),
+		strings.Contains(msg, "service unavailable"),
+		strings.Contains(msg, "overloaded"):
+		return ErrorClassServerError
+	}
+
+	return ErrorClassPermanent
+}
+
+// isClientError reports whether err is caused by the request rather than
+// the provider, such as a validation failure. Such errors never trip a
+// circuit breaker, since another request to the same provider may succeed.
+func isClientError(err error) bool {
+	var llmErr *llm.LLMError
+	if errors.As(err, &llmErr) && llmErr.Type == llm.ErrorTypeInvalidInput {
+		return true
+	}
+	var unsupported *UnsupportedOptionError
+	if errors.As(err, &unsupported) {
+		return true
+	}
+
+	if m := statusCodePattern.FindStringSubmatch(strings.ToLower(err.Error())); m != nil {
+		switch m[1] {
+		case "400", "404", "413", "422":
+			return true
+		}
+	}
+	return false
+}
+
+// retryAfterHint extracts the delay requested by the provider, if any.
+func retryAfterHint(err error) time.Duration {
+	var ra RetryAfterError
+	if errors.As(err, &ra) {
+		return ra.RetryAfter()
+	}
+
+	m := retryAfterPattern.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0
+	}
+	value, perr := strconv.ParseFloat(m[1], 64)
+	if perr != nil {
+		return 0
+	}
+	if m[2] == "ms" {
+		return time.Duration(value * float64(time.Millisecond))
+	}
+	return time.Duration(value * float64(time.Second))
+}
+
+// RetryPolicy decides whether and when a failed provider call is retried.
+type RetryPolicy struct {
+	maxRetries   int
+	initialDelay time.Duration
+	maxDelay     time.Duration
+	multiplier   float64
+	retryable    map[ErrorClass]bool
+}
+
+// NewRetryPolicy builds a policy from configuration.
+// A nil config yields nil, which disables retries.
+func NewRetryPolicy(cfg *config.RetryConfig) *RetryPolicy {
+	if cfg == nil || cfg.MaxRetries <= 0 {
+		return nil
+	}
+
+	p := &RetryPolicy{
+		maxRetries:   cfg.MaxRetries,
+		initialDelay: cfg.InitialDelay,
+		maxDelay:     cfg.MaxDelay,
+		multiplier:   cfg.Multiplier,
+		retryable:    make(map[ErrorClass]bool, len(cfg.RetryableErrors)),
+	}
+	if p.initialDelay <= 0 {
+		p.initialDelay = 100 * time.Millisecond
+	}
+	if p.maxDelay < p.initialDelay {
+		p.maxDelay = p.initialDelay
+	}
+	if p.multiplier < 1 {
+		p.multiplier = 1
+	}
+	for _, name := range cfg.RetryableErrors {
+		p.retryable[ErrorClass(name)] = true
+	}
+	return p
+}
+
+// shouldRetry reports whether an error of the given class may be retried
+// after the given number of retries have already been made.
+func (p *RetryPolicy) shouldRetry(class ErrorClass, retries int) bool {
+	return p != nil && retries < p.maxRetries && p.retryable[class]
+}
+
+// backoff returns the delay before retry number n (starting at 0).
+// The exponential delay is jittered between 50% and 100% of its value
+// so that clients failing together do not retry together. A provider's
+// Retry-After hint is honored even when it exceeds MaxDelay.
+func (p *RetryPolicy) backoff(n int, hint time.Duration) time.Duration {
+	d := float64(p.initialDelay) * math.Pow(p.multiplier, float64(n))
+	if d > float64(p.maxDelay) {
+		d = float64(p.maxDelay)
+	}
+	delay := time.Duration(d/2 + rand.Float64()*d/2)
+
+	if hint > delay {
+		return hint
+	}
+	return delay
+}
+
+// sleep waits for d or until ctx is done. It fails fast, without waiting,
+// when the context deadline would expire before the delay elapses.
+func sleep(ctx context.Context, d time.Duration) error {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < d {
+		return context.DeadlineExceeded
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,188 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teilomillet/gollm"
+	"github.com/teilomillet/gollm/llm"
+	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/server/mocks"
+	"go.uber.org/zap"
+)
+
+// retryAfterErr is a provider error carrying an explicit Retry-After hint.
+type retryAfterErr struct{ after time.Duration }
+
+func (e retryAfterErr) Error() string             { return "API error: status code 429" }
+func (e retryAfterErr) RetryAfter() time.Duration { return e.after }
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{"deadline", context.DeadlineExceeded, ErrorClassTimeout},
+		{"canceled", context.Canceled, ErrorClassPermanent},
+		{"gollm rate limit", &llm.LLMError{Type: llm.ErrorTypeRateLimit, Message: "slow down"}, ErrorClassRateLimit},
+		{"gollm auth", &llm.LLMError{Type: llm.ErrorTypeAuthentication, Message: "bad key"}, ErrorClassPermanent},
+		{"status 429", &llm.LLMError{Type: llm.ErrorTypeAPI, Message: "API error: status code 429"}, ErrorClassRateLimit},
+		{"status 503", fmt.Errorf("call failed: %w", &llm.LLMError{Type: llm.ErrorTypeAPI, Message: "API error: status code 503"}), ErrorClassServerError},
+		{"status 400", errors.New("API error: status code 400"), ErrorClassPermanent},
+		{"timeout text", errors.New("request timed out"), ErrorClassTimeout},
+		{"overloaded text", errors.New("model is overloaded"), ErrorClassServerError},
+		{"unknown", errors.New("primary error"), ErrorClassPermanent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, ClassifyError(tt.err))
+		})
+	}
+}
+
+func TestRetryAfterHint(t *testing.T) {
+	assert.Equal(t, 3*time.Second, retryAfterHint(retryAfterErr{after: 3 * time.Second}))
+	assert.Equal(t, 1500*time.Millisecond, retryAfterHint(errors.New("rate limited, please try again in 1.5s")))
+	assert.Equal(t, 200*time.Millisecond, retryAfterHint(errors.New("Retry-After: 200ms")))
+	assert.Zero(t, retryAfterHint(errors.New("status code 500")))
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := NewRetryPolicy(&config.RetryConfig{
+		MaxRetries:      3,
+		InitialDelay:    100 * time.Millisecond,
+		MaxDelay:        300 * time.Millisecond,
+		Multiplier:      2,
+		RetryableErrors: []string{"rate_limit"},
+	})
+	require.NotNil(t, p)
+
+	for n, max := range []time.Duration{100, 200, 300, 300} {
+		max *= time.Millisecond
+		d := p.backoff(n, 0)
+		assert.GreaterOrEqual(t, d, max/2, "retry %d", n)
+		assert.LessOrEqual(t, d, max, "retry %d", n)
+	}
+
+	// Retry-After wins over the computed delay, even beyond MaxDelay
+	assert.Equal(t, time.Second, p.backoff(0, time.Second))
+
+	assert.True(t, p.shouldRetry(ErrorClassRateLimit, 2))
+	assert.False(t, p.shouldRetry(ErrorClassRateLimit, 3))
+	assert.False(t, p.shouldRetry(ErrorClassServerError, 0))
+	assert.Nil(t, NewRetryPolicy(nil))
+	assert.False(t, (*RetryPolicy)(nil).shouldRetry(ErrorClassTimeout, 0))
+}
+
+func TestManagerRetries(t *testing.T) {
+	newManager := func(t *testing.T, retry *config.RetryConfig, generate func(context.Context, *gollm.Prompt) (string, error)) (*Manager, *prometheus.Registry) {
+		registry := prometheus.NewRegistry()
+		cfg := &config.Config{
+			TestMode:           true,
+			LLM:                config.LLMConfig{Retry: retry},
+			ProviderPreference: []string{"primary"},
+			CircuitBreaker: config.CircuitBreakerConfig{
+				Timeout:  time.Second,
+				TestMode: true,
+			},
+		}
+		m, err := NewManager(cfg, zap.NewNop(), registry)
+		require.NoError(t, err)
+		m.SetProviders(map[string]gollm.LLM{
+			"primary": mocks.NewMockLLMWithConfig("primary", "model", generate),
+		})
+		return m, registry
+	}
+
+	retryConfig := &config.RetryConfig{
+		MaxRetries:      3,
+		InitialDelay:    time.Millisecond,
+		MaxDelay:        5 * time.Millisecond,
+		Multiplier:      2,
+		RetryableErrors: []string{"rate_limit", "server_error"},
+	}
+	prompt := &gollm.Prompt{Messages: []gollm.PromptMessage{{Role: "user", Content: "hi"}}}
+
+	t.Run("retries retryable errors until success", func(t *testing.T) {
+		calls := 0
+		m, registry := newManager(t, retryConfig, func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			calls++
+			if calls == 1 {
+				return "", errors.New("API error: status code 429")
+			}
+			return "ok", nil
+		})
+
+		resp, err := m.Generate(context.Background(), &GenerateRequest{Prompt: prompt})
+		require.NoError(t, err)
+		assert.Equal(t, "ok", resp.Content)
+		assert.Equal(t, 2, calls)
+
+		count, err := testutil.GatherAndCount(registry, "hapax_provider_retries_total")
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("does not retry permanent errors", func(t *testing.T) {
+		calls := 0
+		m, _ := newManager(t, retryConfig, func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			calls++
+			return "", errors.New("API error: status code 400")
+		})
+
+		_, err := m.Generate(context.Background(), &GenerateRequest{Prompt: prompt})
+		require.Error(t, err)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("per-request options override the global policy", func(t *testing.T) {
+		calls := 0
+		m, _ := newManager(t, nil, func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			calls++
+			if calls == 1 {
+				return "", errors.New("request timed out")
+			}
+			return "ok", nil
+		})
+
+		resp, err := m.Generate(context.Background(), &GenerateRequest{
+			Prompt: prompt,
+			Retry: &config.RetryConfig{
+				MaxRetries:      1,
+				InitialDelay:    time.Millisecond,
+				MaxDelay:        2 * time.Millisecond,
+				Multiplier:      2,
+				RetryableErrors: []string{"timeout"},
+			},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "ok", resp.Content)
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("gives up when Retry-After exceeds the deadline", func(t *testing.T) {
+		calls := 0
+		m, _ := newManager(t, retryConfig, func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			calls++
+			return "", retryAfterErr{after: time.Minute}
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err := m.Generate(ctx, &GenerateRequest{Prompt: prompt})
+		require.Error(t, err)
+		assert.Equal(t, 1, calls)
+		assert.Less(t, time.Since(start), 50*time.Millisecond, "should fail fast instead of sleeping")
+	})
+}
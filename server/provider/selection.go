@@ -0,0 +1,257 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sony/gobreaker"
+	"github.com/teilomillet/hapax/config"
+)
+
+// Candidate describes an available provider to a selection Strategy.
+type Candidate struct {
+	Name        string
+	Weight      int           // Configured weight, at least 1
+	Latency     time.Duration // Latency of the last request or health check, 0 when unknown
+	Outstanding int64         // Requests in flight
+	Price       float64       // USD per 1K prompt plus 1K completion tokens of the provider's model
+}
+
+// Strategy decides which provider serves a request. Order receives the
+// available providers in preference order and returns them in the order
+// they should be tried: the first serves the request, the others are
+// failover targets. Strategies are shared by concurrent requests.
+type Strategy interface {
+	Order(candidates []Candidate) []Candidate
+}
+
+// NewStrategy returns the selection strategy with the given name, one of
+// the config.Selection constants. The empty name selects priority order.
+func NewStrategy(name string) (Strategy, error) {
+	switch name {
+	case "", config.SelectionPriority:
+		return priority{}, nil
+	case config.SelectionWeightedRoundRobin:
+		return &weightedRoundRobin{current: make(map[string]int)}, nil
+	case config.SelectionLeastLatency:
+		return leastBy(func(a, b Candidate) bool { return a.Latency < b.Latency }), nil
+	case config.SelectionLeastOutstanding:
+		return leastBy(func(a, b Candidate) bool { return a.Outstanding < b.Outstanding }), nil
+	case config.SelectionCostAware:
+		return leastBy(func(a, b Candidate) bool { return a.Price < b.Price }), nil
+	default:
+		return nil, fmt.Errorf("unknown selection strategy: %s", name)
+	}
+}
+
+// priority keeps the preference order.
+type priority struct{}
+
+func (priority) Order(candidates []Candidate) []Candidate {
+	return candidates
+}
+
+// leastBy orders candidates by ascending less, keeping the preference
+// order between equals. Providers without latency measurements yet sort
+// first under least latency, so that they get measured.
+type leastBy func(a, b Candidate) bool
+
+func (less leastBy) Order(candidates []Candidate) []Candidate {
+	ordered := make([]Candidate, len(candidates))
+	copy(ordered, candidates)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return less(ordered[i], ordered[j])
+	})
+	return ordered
+}
+
+// weightedRoundRobin implements smooth weighted round-robin: over any
+// run of requests, each provider serves in proportion to its weight, and
+// selections are interleaved rather than bunched. The providers not
+// selected follow in preference order.
+type weightedRoundRobin struct {
+	mu      sync.Mutex
+	current map[string]int
+}
+
+func (s *weightedRoundRobin) Order(candidates []Candidate) []Candidate {
+	if len(candidates) < 2 {
+		return candidates
+	}
+
+	s.mu.Lock()
+	total, best := 0, 0
+	for i, c := range candidates {
+		s.current[c.Name] += c.Weight
+		total += c.Weight
+		if s.current[c.Name] > s.current[candidates[best].Name] {
+			best = i
+		}
+	}
+	s.current[candidates[best].Name] -= total
+	s.mu.Unlock()
+
+	ordered := make([]Candidate, 0, len(candidates))
+	ordered = append(ordered, candidates[best])
+	ordered = append(ordered, candidates[:best]...)
+	return append(ordered, candidates[best+1:]...)
+}
+
+// selectionKey is the context key of the strategy chosen for a request.
+type selectionKey struct{}
+
+// WithSelection returns a context under which the manager selects
+// providers with the named strategy instead of the configured default.
+// Routes use it to apply their own strategy.
+func WithSelection(ctx context.Context, strategy string) context.Context {
+	return context.WithValue(ctx, selectionKey{}, strategy)
+}
+
+// modelKey is the context key of the model chosen for a request.
+type modelKey struct{}
+
+// WithModel returns a context under which the manager serves requests with
+// the given model instead of the one they name. The empty model lets any
+// provider serve them. Routing rules use it.
+func WithModel(ctx context.Context, model string) context.Context {
+	return context.WithValue(ctx, modelKey{}, model)
+}
+
+// routedRequest returns req, with the model set by WithModel if any.
+func routedRequest(ctx context.Context, req *GenerateRequest) *GenerateRequest {
+	model, ok := ctx.Value(modelKey{}).(string)
+	if !ok || model == req.Model {
+		return req
+	}
+	routed := *req
+	routed.Model = model
+	return &routed
+}
+
+// strategy returns the strategy applying to requests made with ctx.
+func (m *Manager) strategy(ctx context.Context) Strategy {
+	name, _ := ctx.Value(selectionKey{}).(string)
+	if name == "" {
+		name = m.config().Selection
+	}
+	if s, ok := m.strategies[name]; ok {
+		return s
+	}
+	return priority{}
+}
+
+// selectionOrder returns the providers serving req (any, when nil) in the
+// order a request made with ctx tries them. Providers that are unhealthy
+// or whose breaker is open are left out of the selection and follow the
+// others, then come draining providers. Disabled providers are left out.
+func (m *Manager) selectionOrder(ctx context.Context, req *GenerateRequest) ([]string, error) {
+	group, err := m.modelGroup(m.getProviderPreference(), req)
+	if err != nil {
+		return nil, err
+	}
+	preference, draining := m.serving(group)
+	strategy := m.strategy(ctx)
+	if _, ok := strategy.(priority); ok {
+		return append(preference, draining...), nil
+	}
+
+	m.mu.RLock()
+	candidates := make([]Candidate, 0, len(preference))
+	var unavailable []string
+	for _, name := range preference {
+		provider, exists := m.providers[name]
+		breaker := m.breakers[name]
+		status := m.GetHealthStatus(name)
+		if !exists || breaker == nil || !status.Healthy || breaker.State() == gobreaker.StateOpen {
+			unavailable = append(unavailable, name)
+			continue
+		}
+
+		weight := m.cfg.Providers[name].Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		price := m.cfg.Pricing[provider.GetModel()]
+		candidates = append(candidates, Candidate{
+			Name:        name,
+			Weight:      weight,
+			Latency:     status.Latency,
+			Outstanding: m.inFlight(name).Load(),
+			Price:       price.Input + price.Output,
+		})
+	}
+	m.mu.RUnlock()
+
+	order := make([]string, 0, len(preference))
+	for _, c := range strategy.Order(candidates) {
+		order = append(order, c.Name)
+	}
+	order = append(order, unavailable...)
+	return append(order, draining...), nil
+}
+
+// modelGroup narrows preference down to the providers serving req: those
+// matching its target, the targets of the registry alias it names, or
+// else the providers configured with the model it names. Without a model
+// registry, or without a requested model, every provider qualifies.
+func (m *Manager) modelGroup(preference []string, req *GenerateRequest) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if req != nil && req.Target != nil {
+		group := make([]string, 0, len(preference))
+		for _, name := range preference {
+			if llm, exists := m.providers[name]; exists && req.Target.Matches(name, llm.GetProvider(), llm.GetModel()) {
+				group = append(group, name)
+			}
+		}
+		if len(group) == 0 {
+			return nil, fmt.Errorf("%s: %w", req.Target, ErrNoHealthyProvider)
+		}
+		return group, nil
+	}
+
+	if req == nil || req.Model == "" || len(m.cfg.Models) == 0 {
+		return preference, nil
+	}
+
+	model := req.Model
+	targets, alias := m.cfg.Models[model]
+	group := make([]string, 0, len(preference))
+	for _, name := range preference {
+		llm, exists := m.providers[name]
+		if !exists {
+			continue
+		}
+		if !alias {
+			if llm.GetModel() == model {
+				group = append(group, name)
+			}
+			continue
+		}
+		for _, t := range targets {
+			if t.Matches(name, llm.GetProvider(), llm.GetModel()) {
+				group = append(group, name)
+				break
+			}
+		}
+	}
+
+	if len(group) == 0 {
+		if alias {
+			return nil, fmt.Errorf("model %s: %w", model, ErrNoHealthyProvider)
+		}
+		return nil, &UnknownModelError{Model: model}
+	}
+	return group, nil
+}
+
+// inFlight returns the counter of requests in flight to the named provider.
+func (m *Manager) inFlight(name string) *atomic.Int64 {
+	v, _ := m.outstanding.LoadOrStore(name, new(atomic.Int64))
+	return v.(*atomic.Int64)
+}
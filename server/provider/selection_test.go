@@ -0,0 +1,241 @@
+package provider_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teilomillet/gollm"
+	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/server/mocks"
+	"github.com/teilomillet/hapax/server/provider"
+	"go.uber.org/zap"
+)
+
+func names(candidates []provider.Candidate) []string {
+	out := make([]string, len(candidates))
+	for i, c := range candidates {
+		out[i] = c.Name
+	}
+	return out
+}
+
+func TestStrategies(t *testing.T) {
+	t.Parallel()
+
+	candidates := []provider.Candidate{
+		{Name: "ollama-a", Weight: 3, Latency: 300 * time.Millisecond, Outstanding: 4, Price: 0},
+		{Name: "ollama-b", Weight: 1, Latency: 100 * time.Millisecond, Outstanding: 1, Price: 0},
+		{Name: "openai", Weight: 1, Latency: 200 * time.Millisecond, Outstanding: 0, Price: 0.04},
+	}
+
+	tests := []struct {
+		strategy string
+		want     []string
+	}{
+		{config.SelectionPriority, []string{"ollama-a", "ollama-b", "openai"}},
+		{config.SelectionLeastLatency, []string{"ollama-b", "openai", "ollama-a"}},
+		{config.SelectionLeastOutstanding, []string{"openai", "ollama-b", "ollama-a"}},
+		{config.SelectionCostAware, []string{"ollama-a", "ollama-b", "openai"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			strategy, err := provider.NewStrategy(tt.strategy)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, names(strategy.Order(candidates)))
+		})
+	}
+
+	t.Run(config.SelectionWeightedRoundRobin, func(t *testing.T) {
+		strategy, err := provider.NewStrategy(config.SelectionWeightedRoundRobin)
+		require.NoError(t, err)
+
+		var first []string
+		for i := 0; i < 10; i++ {
+			order := names(strategy.Order(candidates))
+			assert.ElementsMatch(t, names(candidates), order)
+			first = append(first, order[0])
+		}
+
+		// Selections follow the weights and are interleaved
+		assert.Equal(t, []string{
+			"ollama-a", "ollama-b", "ollama-a", "openai", "ollama-a",
+			"ollama-a", "ollama-b", "ollama-a", "openai", "ollama-a",
+		}, first)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		_, err := provider.NewStrategy("random")
+		assert.EqualError(t, err, "unknown selection strategy: random")
+	})
+}
+
+func TestManagerSelection(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		TestMode:  true,
+		Selection: config.SelectionWeightedRoundRobin,
+		Providers: map[string]config.ProviderConfig{
+			"local":  {Type: "ollama", Model: "llama2", Weight: 2},
+			"remote": {Type: "openai", Model: "gpt-4"},
+		},
+		Pricing: config.PricingTable{
+			"gpt-4": {Input: 10, Output: 30},
+		},
+		CircuitBreaker: config.CircuitBreakerConfig{
+			Timeout:  time.Minute,
+			TestMode: true,
+		},
+	}
+
+	manager, err := provider.NewManager(cfg, zap.NewNop(), prometheus.NewRegistry())
+	require.NoError(t, err)
+	require.NoError(t, manager.SetProvider("remote", mocks.NewMockLLMWithConfig("openai", "gpt-4",
+		func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			return "remote", nil
+		})))
+	require.NoError(t, manager.SetProvider("local", mocks.NewMockLLMWithConfig("ollama", "llama2",
+		func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			return "local", nil
+		})))
+
+	generate := func(ctx context.Context, i int) string {
+		resp, err := manager.Generate(ctx, &provider.GenerateRequest{
+			Prompt: &gollm.Prompt{Messages: []gollm.PromptMessage{{Role: "user", Content: fmt.Sprintf("request %d", i)}}},
+		})
+		require.NoError(t, err)
+		return resp.Provider
+	}
+
+	// The configured strategy spreads the traffic by weight
+	served := make(map[string]int)
+	for i := 0; i < 9; i++ {
+		served[generate(context.Background(), i)]++
+	}
+	assert.Equal(t, map[string]int{"local": 6, "remote": 3}, served)
+
+	// A route's strategy overrides the default: the unpriced local model is cheapest
+	ctx := provider.WithSelection(context.Background(), config.SelectionCostAware)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "local", generate(ctx, i))
+	}
+
+	// Priority order keeps the preference order
+	ctx = provider.WithSelection(context.Background(), config.SelectionPriority)
+	assert.Equal(t, "remote", generate(ctx, 0))
+}
+
+func TestManagerModelRouting(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		TestMode: true,
+		Models: config.ModelRegistry{
+			"fast":  {{Provider: "ollama", Model: "llama3"}},
+			"smart": {{Provider: "openai"}},
+		},
+		CircuitBreaker: config.CircuitBreakerConfig{
+			Timeout:  time.Minute,
+			TestMode: true,
+		},
+	}
+
+	manager, err := provider.NewManager(cfg, zap.NewNop(), prometheus.NewRegistry())
+	require.NoError(t, err)
+	require.NoError(t, manager.SetProvider("openai", mocks.NewMockLLMWithConfig("openai", "gpt-4o",
+		func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			return "openai", nil
+		})))
+	require.NoError(t, manager.SetProvider("ollama-1", mocks.NewMockLLMWithConfig("ollama", "llama3",
+		func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			return "", fmt.Errorf("ollama-1 down")
+		})))
+	require.NoError(t, manager.SetProvider("ollama-2", mocks.NewMockLLMWithConfig("ollama", "llama3",
+		func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			return "ollama-2", nil
+		})))
+
+	generate := func(model string) (*provider.GenerateResponse, error) {
+		return manager.Generate(context.Background(), &provider.GenerateRequest{
+			Prompt: &gollm.Prompt{Messages: []gollm.PromptMessage{{Role: "user", Content: "hello"}}},
+			Model:  model,
+		})
+	}
+
+	// Without a model, the first provider of the chain serves
+	resp, err := generate("")
+	require.NoError(t, err)
+	assert.Equal(t, "openai", resp.Provider)
+
+	resp, err = generate("smart")
+	require.NoError(t, err)
+	assert.Equal(t, "openai", resp.Provider)
+
+	// Models served by a provider can be requested directly
+	resp, err = generate("gpt-4o")
+	require.NoError(t, err)
+	assert.Equal(t, "openai", resp.Provider)
+
+	// Failover stays within the providers of the alias
+	resp = nil
+	for i := 0; i < 5 && resp == nil; i++ {
+		resp, err = generate("fast")
+		if err != nil {
+			assert.ErrorContains(t, err, "ollama-1 down")
+		}
+	}
+	require.NotNil(t, resp, "ollama-2 should serve once the ollama-1 breaker opens")
+	assert.Equal(t, "ollama-2", resp.Provider)
+
+	_, err = generate("gpt-5")
+	var unknown *provider.UnknownModelError
+	require.ErrorAs(t, err, &unknown)
+	assert.Equal(t, "gpt-5", unknown.Model)
+}
+
+func TestManagerRoutedModel(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		TestMode: true,
+		Models: config.ModelRegistry{
+			"local": {{Provider: "ollama"}},
+		},
+		CircuitBreaker: config.CircuitBreakerConfig{
+			Timeout:  time.Minute,
+			TestMode: true,
+		},
+	}
+
+	manager, err := provider.NewManager(cfg, zap.NewNop(), prometheus.NewRegistry())
+	require.NoError(t, err)
+	require.NoError(t, manager.SetProvider("openai", mocks.NewMockLLMWithConfig("openai", "gpt-4o",
+		func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			return "openai", nil
+		})))
+	require.NoError(t, manager.SetProvider("ollama", mocks.NewMockLLMWithConfig("ollama", "llama3",
+		func(ctx context.Context, p *gollm.Prompt) (string, error) {
+			return "ollama", nil
+		})))
+
+	req := &provider.GenerateRequest{
+		Prompt: &gollm.Prompt{Messages: []gollm.PromptMessage{{Role: "user", Content: "hello"}}},
+		Model:  "auto",
+	}
+
+	// The model chosen by the routing rules replaces the requested one
+	resp, err := manager.Generate(provider.WithModel(context.Background(), "local"), req)
+	require.NoError(t, err)
+	assert.Equal(t, "ollama", resp.Provider)
+	assert.Equal(t, "auto", req.Model, "the request is left untouched")
+
+	// Routing to no model in particular lets any provider serve
+	resp, err = manager.Generate(provider.WithModel(context.Background(), ""), req)
+	require.NoError(t, err)
+	assert.Equal(t, "openai", resp.Provider)
+}
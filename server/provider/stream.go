@@ -0,0 +1,169 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/teilomillet/gollm"
+	"go.uber.org/zap"
+)
+
+// StreamingLLM is implemented by providers that can deliver a completion
+// incrementally. Providers without streaming support can still serve
+// streaming requests: their full response is delivered as a single chunk.
+type StreamingLLM interface {
+	gollm.LLM
+
+	// GenerateStream calls emit with each chunk of generated text, in order,
+	// and returns the complete text and why generation ended. It stops as
+	// soon as emit returns an error. options carries per-request generation
+	// parameters, as for ParameterizedLLM.
+	GenerateStream(ctx context.Context, prompt *gollm.Prompt, options map[string]interface{}, emit func(chunk string) error) (content, finishReason string, err error)
+}
+
+// partialStreamError reports a failure after part of a response was
+// already sent to the client. Such failures cannot be retried or failed
+// over without duplicating output.
+type partialStreamError struct {
+	err error
+}
+
+func (e *partialStreamError) Error() string { return e.err.Error() }
+func (e *partialStreamError) Unwrap() error { return e.err }
+
+// isPartialStream reports whether err happened mid-stream.
+func isPartialStream(err error) bool {
+	var pe *partialStreamError
+	return errors.As(err, &pe)
+}
+
+// GenerateStream is the streaming counterpart of Generate. Chunks are passed
+// to emit as the provider produces them. Retries and failover only happen
+// before the first chunk; once output has started, an error ends the stream.
+// Cache hits are delivered as a single chunk. Streams are not deduplicated,
+// since each caller needs its own sequence of chunks.
+//
+// An error returned by emit stops generation and is returned as is; it does
+// not count against the provider. Usage is recorded as for Generate,
+// including the text streamed before a failure.
+func (m *Manager) GenerateStream(ctx context.Context, req *GenerateRequest, emit func(chunk string) error) (*GenerateResponse, error) {
+	return m.runExperiment(ctx, routedRequest(ctx, req), func(req *GenerateRequest) (*GenerateResponse, error) {
+		return m.generateStream(ctx, req, emit)
+	})
+}
+
+// generateStream is GenerateStream once the model and experiment variant
+// are decided.
+func (m *Manager) generateStream(ctx context.Context, req *GenerateRequest, emit func(chunk string) error) (*GenerateResponse, error) {
+	key := requestFingerprint(req)
+
+	useCache := m.cache != nil && !req.NoCache
+	if useCache {
+		if resp, ok := m.lookupCache(ctx, key); ok {
+			if err := emit(resp.Content); err != nil {
+				return nil, err
+			}
+			m.recordUsage(ctx, resp, req.Prompt)
+			return resp, nil
+		}
+	}
+
+	policy := m.retry.Load()
+	if req.Retry != nil {
+		policy = NewRetryPolicy(req.Retry)
+	}
+
+	// emitErr records why the consumer stopped the stream (client gone,
+	// stop sequence reached, ...). That is not a provider failure, so it
+	// is kept away from the circuit breaker and retry logic.
+	var emitErr error
+
+	// servedModel and streamed describe the attempt whose output reached
+	// the client, which is what gets billed
+	var servedModel, streamed string
+
+	r, err := m.executeWithRetries(ctx, policy, req, func(ctx context.Context, llm gollm.LLM) (string, string, error) {
+		var forwarded strings.Builder
+		forward := func(chunk string) error {
+			if chunk == "" {
+				return nil
+			}
+			forwarded.WriteString(chunk)
+			if err := emit(chunk); err != nil {
+				emitErr = err
+				return err
+			}
+			return nil
+		}
+
+		content, finishReason, err := StreamFrom(ctx, llm, req.Prompt, req.Options, forward)
+
+		// Once output has started this attempt is the last one, whatever
+		// its outcome
+		started := forwarded.Len() > 0
+		if started {
+			servedModel, streamed = llm.GetModel(), forwarded.String()
+		}
+
+		if emitErr != nil {
+			return content, finishReason, nil
+		}
+		if err != nil && started {
+			return content, finishReason, &partialStreamError{err: err}
+		}
+		return content, finishReason, err
+	})
+
+	// Streamed text is billed even when the stream did not complete
+	billed := &GenerateResponse{Content: streamed, Model: servedModel}
+	if streamed != "" {
+		if r != nil {
+			billed.Provider = r.name
+		}
+		m.recordUsage(ctx, billed, req.Prompt)
+	}
+
+	if err != nil {
+		m.logger.Debug("Stream failed", zap.Error(err))
+		return nil, err
+	}
+
+	if err := m.processResult(r); err != nil {
+		return nil, err
+	}
+
+	// A stream cut short by its consumer is incomplete and must not be cached
+	if emitErr != nil {
+		return nil, emitErr
+	}
+
+	if useCache {
+		m.storeCache(ctx, key, r)
+	}
+
+	return &GenerateResponse{
+		Content:          r.content,
+		Provider:         r.name,
+		Model:            r.model,
+		PromptTokens:     billed.PromptTokens,
+		CompletionTokens: billed.CompletionTokens,
+		Cost:             billed.Cost,
+		FinishReason:     r.finishReason,
+	}, nil
+}
+
+// StreamFrom generates with llm, streaming when the provider supports it
+// and delivering the whole response as one chunk otherwise. Options are
+// handled as by GenerateFrom.
+func StreamFrom(ctx context.Context, llm gollm.LLM, prompt *gollm.Prompt, options map[string]interface{}, emit func(chunk string) error) (content, finishReason string, err error) {
+	if s, ok := llm.(StreamingLLM); ok {
+		return s.GenerateStream(ctx, prompt, options, emit)
+	}
+
+	content, finishReason, err = GenerateFrom(ctx, llm, prompt, options)
+	if err != nil {
+		return "", "", err
+	}
+	return content, finishReason, emit(content)
+}
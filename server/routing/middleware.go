@@ -0,0 +1,188 @@
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/server/metrics"
+	"github.com/teilomillet/hapax/server/middleware"
+	"go.uber.org/zap"
+)
+
+// MiddlewareEnv is the server state available to the constructors of
+// route middleware.
+type MiddlewareEnv struct {
+	Config      *config.Config          // Server configuration
+	Route       config.RouteConfig      // Route the middleware is built for
+	Logger      *zap.Logger             // Server logger
+	Metrics     *metrics.Metrics        // Server metrics
+	Keys        *middleware.KeyStore    // API keys accepted by the server
+	Budgets     *middleware.Budgets     // Token and spend budgets, nil when disabled
+	RateLimiter *middleware.RateLimiter // Limiter of the rate_limit section, nil when disabled
+	Limiters    *RouteLimiters          // Limiters of routes with limits of their own
+}
+
+// RouteLimiters holds the rate limiters of routes with limits of their
+// own, by route, so that they outlive the routers built on configuration
+// reloads. The limiters a router is built with only take its settings, and
+// new ones are only kept, once Commit is called, so that a router that is
+// not used leaves them unchanged.
+type RouteLimiters struct {
+	mu       sync.Mutex
+	limiters map[string]*middleware.RateLimiter
+	pending  map[string]routeLimit // Limits of the router being built
+}
+
+// routeLimit is the limiter of a route with the settings it takes on
+// Commit.
+type routeLimit struct {
+	limiter *middleware.RateLimiter
+	cfg     config.RateLimitConfig
+}
+
+// NewRouteLimiters creates an empty set of route limiters.
+func NewRouteLimiters() *RouteLimiters {
+	return &RouteLimiters{
+		limiters: make(map[string]*middleware.RateLimiter),
+		pending:  make(map[string]routeLimit),
+	}
+}
+
+// limiter returns the limiter of the route, creating it on first use. It
+// takes cfg on Commit.
+func (l *RouteLimiters) limiter(route config.RouteConfig, cfg config.RateLimitConfig, m *metrics.Metrics) *middleware.RateLimiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	path := versionedPath(route)
+	limiter, ok := l.limiters[path]
+	if !ok {
+		limiter = middleware.NewRateLimiter(cfg, m)
+	}
+	l.pending[path] = routeLimit{limiter: limiter, cfg: cfg}
+	return limiter
+}
+
+// Commit keeps the limiters of the router built last, updated to its
+// settings. Call it once that router serves.
+func (l *RouteLimiters) Commit() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for path, p := range l.pending {
+		if _, ok := l.limiters[path]; ok {
+			p.limiter.Update(p.cfg)
+		}
+		l.limiters[path] = p.limiter
+	}
+	clear(l.pending)
+}
+
+// Discard forgets the limits of the router built last, which is not used.
+func (l *RouteLimiters) Discard() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	clear(l.pending)
+}
+
+// constructor builds a route middleware from its decoded settings.
+type constructor func(settings interface{}, env MiddlewareEnv) (func(http.Handler) http.Handler, error)
+
+// RegisterMiddleware makes a middleware available to routes under the
+// given name, replacing any middleware registered under it before. The
+// settings of the name in route configurations decode into T, which may
+// implement Validate() error to be checked with the configuration; use
+// struct{} for middleware without settings. build is called for every
+// route listing the name, each time the routes are built; a nil
+// middleware leaves the route unchanged.
+//
+// Middleware is usually registered from an init function, so that
+// configurations naming it are valid when they are loaded.
+func RegisterMiddleware[T any](name string, build func(settings *T, env MiddlewareEnv) (func(http.Handler) http.Handler, error)) {
+	config.RegisterMiddleware(name, func() interface{} { return new(T) },
+		constructor(func(settings interface{}, env MiddlewareEnv) (func(http.Handler) http.Handler, error) {
+			return build(settings.(*T), env)
+		}))
+}
+
+// resolveMiddleware decodes the settings of a middleware and returns them
+// along with its constructor. Middleware registered with configurations
+// only, which has no constructor, fails.
+func resolveMiddleware(mw config.MiddlewareConfig) (constructor, interface{}, error) {
+	settings, err := mw.Settings()
+	if err != nil {
+		return nil, nil, err
+	}
+	build, ok := config.MiddlewareConstructor(mw.Name).(constructor)
+	if !ok {
+		return nil, nil, fmt.Errorf("middleware %s: no constructor registered", mw.Name)
+	}
+	return build, settings, nil
+}
+
+func init() {
+	// Routes listing auth require a valid key whether or not auth is
+	// enabled, which only decides the middleware of completion routes
+	// listing none
+	RegisterMiddleware("auth", func(_ *struct{}, env MiddlewareEnv) (func(http.Handler) http.Handler, error) {
+		return middleware.Authentication(env.Keys, env.Metrics), nil
+	})
+
+	// Without settings, routes share the limits of the rate_limit section;
+	// with an rpm, a route gets a limit of its own
+	rateLimit := func(s *config.RateLimitSettings, env MiddlewareEnv) (func(http.Handler) http.Handler, error) {
+		if s.RPM == 0 {
+			if env.RateLimiter == nil {
+				return nil, nil
+			}
+			return env.RateLimiter.Handler, nil
+		}
+		scope := s.Scope
+		if scope == "" {
+			scope = config.RateLimitScopeKey
+		}
+		cfg := config.RateLimitConfig{
+			Enabled: true,
+			Policies: []config.RateLimitPolicy{{
+				Scope:    scope,
+				Window:   time.Minute,
+				Requests: s.RPM,
+				Burst:    s.Burst,
+			}},
+		}
+		if env.Limiters == nil {
+			return middleware.RateLimit(cfg, env.Metrics), nil
+		}
+		return env.Limiters.limiter(env.Route, cfg, env.Metrics).Handler, nil
+	}
+	RegisterMiddleware("ratelimit", rateLimit)
+	RegisterMiddleware("rate-limit", rateLimit)
+
+	RegisterMiddleware("budget", func(_ *struct{}, env MiddlewareEnv) (func(http.Handler) http.Handler, error) {
+		if env.Budgets == nil {
+			return nil, nil
+		}
+		return env.Budgets.Handler, nil
+	})
+
+	// The router applies the CORS settings of routes before routing, so
+	// that they answer preflight requests
+	RegisterMiddleware("cors", func(_ *config.CORSSettings, env MiddlewareEnv) (func(http.Handler) http.Handler, error) {
+		return nil, nil
+	})
+
+	RegisterMiddleware("logging", func(_ *struct{}, env MiddlewareEnv) (func(http.Handler) http.Handler, error) {
+		return middleware.Logging(env.Logger), nil
+	})
+
+	RegisterMiddleware("timeout", func(s *config.TimeoutSettings, env MiddlewareEnv) (func(http.Handler) http.Handler, error) {
+		return middleware.Timeout(s.Duration), nil
+	})
+
+	RegisterMiddleware("body_limit", func(s *config.BodyLimitSettings, env MiddlewareEnv) (func(http.Handler) http.Handler, error) {
+		return middleware.BodyLimit(int64(s.Bytes)), nil
+	})
+}
@@ -0,0 +1,62 @@
+package routing
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/teilomillet/hapax/config"
+)
+
+// Registry resolves the handler names of configured routes to handlers.
+// A handler may come with default middleware, applied to the routes that
+// name it without listing middleware of their own.
+type Registry struct {
+	handlers   map[string]http.Handler
+	middleware map[string][]config.MiddlewareConfig
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		handlers:   make(map[string]http.Handler),
+		middleware: make(map[string][]config.MiddlewareConfig),
+	}
+}
+
+// Register makes a handler available to routes under the given name,
+// replacing any handler registered under it before.
+func (r *Registry) Register(name string, handler http.Handler, middleware ...string) {
+	r.handlers[name] = handler
+	if len(middleware) > 0 {
+		r.middleware[name] = config.Middleware(middleware...)
+	} else {
+		delete(r.middleware, name)
+	}
+}
+
+// Validate checks that the handlers of routes are registered, and that
+// their middleware, or the default middleware of their handler, has a
+// constructor.
+func (r *Registry) Validate(routes []config.RouteConfig) error {
+	for _, route := range routes {
+		if _, ok := r.handlers[route.Handler]; !ok {
+			return fmt.Errorf("route %s: unknown handler: %s", route.Path, route.Handler)
+		}
+		mws := route.Middleware
+		if len(mws) == 0 {
+			mws = r.middleware[route.Handler]
+		}
+		for _, mw := range mws {
+			if _, _, err := resolveMiddleware(mw); err != nil {
+				return fmt.Errorf("route %s: %w", route.Path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Handler returns the handler registered under the given name.
+func (r *Registry) Handler(name string) (http.Handler, bool) {
+	h, ok := r.handlers[name]
+	return h, ok
+}
@@ -2,9 +2,12 @@
 package routing
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,68 +16,199 @@ import (
 	"github.com/teilomillet/hapax/errors"
 	"github.com/teilomillet/hapax/server/metrics"
 	"github.com/teilomillet/hapax/server/middleware"
+	"github.com/teilomillet/hapax/server/provider"
 	"go.uber.org/zap"
 )
 
 // Router handles dynamic HTTP routing with versioning and health checks.
 // It utilizes chi for routing and provides middleware support for metrics and authentication.
 type Router struct {
-	router      chi.Router              // Chi router instance for HTTP routing
-	handlers    map[string]http.Handler // Map of handler names to implementations
-	healthState sync.Map                // Thread-safe map for storing health states
-	logger      *zap.Logger             // Logger instance for error and debug logging
-	cfg         *config.Config          // Server configuration
-	metrics     *metrics.Metrics        // Metrics instance for monitoring
+	router      chi.Router                           // Chi router instance for HTTP routing
+	handlers    map[string]http.Handler              // Map of handler names to implementations
+	defaults    map[string][]config.MiddlewareConfig // Middleware of the routes listing none, by handler name
+	healthState sync.Map                             // Thread-safe map for storing health states
+	logger      *zap.Logger                          // Logger instance for error and debug logging
+	cfg         *config.Config                       // Server configuration
+	metrics     *metrics.Metrics                     // Metrics instance for monitoring
+	keys        *middleware.KeyStore                 // API keys accepted by the auth middleware
+	budgets     *middleware.Budgets                  // Budgets charged by the budget middleware, nil when disabled
+	limiter     *middleware.RateLimiter              // Rate limiter shared by the routes, nil when disabled
+	limiters    *RouteLimiters                       // Rate limiters of routes with limits of their own
+	stop        context.CancelFunc                   // Stops the health checks of the routes
+	cors        *middleware.CORSPolicy               // CORS policy of the cors section
+	corsPaths   map[string]*middleware.CORSPolicy    // CORS policies of the routes overriding it, by path
+}
+
+// Options holds the state shared with the rest of the server by the
+// middleware of routes.
+type Options struct {
+	// Keys are the API keys accepted by the auth middleware. When nil,
+	// they are loaded from the auth configuration.
+	Keys *middleware.KeyStore
+
+	// Budgets are charged by the budget middleware, which is skipped
+	// when nil.
+	Budgets *middleware.Budgets
+
+	// RateLimiter enforces the rate_limit section on the routes sharing
+	// its limits. When nil, one is created if rate limiting is enabled.
+	RateLimiter *middleware.RateLimiter
+
+	// Limiters holds the rate limiters of routes with limits of their own.
+	// Routers given the same limiters keep the consumption of clients;
+	// their settings apply once the caller commits them. When nil, the
+	// router creates its own.
+	Limiters *RouteLimiters
 }
 
 // NewRouter creates a new router with the given configuration and initializes routes.
-func NewRouter(cfg *config.Config, handlers map[string]http.Handler, logger *zap.Logger, metrics *metrics.Metrics) *Router {
+func NewRouter(cfg *config.Config, handlers map[string]http.Handler, logger *zap.Logger, metrics *metrics.Metrics) (*Router, error) {
+	return NewRouterWithRegistry(cfg, &Registry{handlers: handlers}, Options{}, logger, metrics)
+}
+
+// NewRouterWithRegistry creates a router serving the configured routes
+// with the handlers of the registry. It fails when a route names a handler
+// the registry does not know, or when its middleware cannot be built. Call
+// Close when the router is no longer used, to stop the health checks of
+// its routes.
+func NewRouterWithRegistry(cfg *config.Config, registry *Registry, opts Options, logger *zap.Logger, metrics *metrics.Metrics) (*Router, error) {
+	if err := registry.Validate(cfg.Routes); err != nil {
+		return nil, err
+	}
+
 	r := &Router{
 		router:   chi.NewRouter(),
-		handlers: handlers,
+		handlers: registry.handlers,
+		defaults: registry.middleware,
 		logger:   logger,
 		cfg:      cfg,
 		metrics:  metrics,
+		keys:     opts.Keys,
+		budgets:  opts.Budgets,
+		limiter:  opts.RateLimiter,
+		limiters: opts.Limiters,
+	}
+	ownLimiters := r.limiters == nil
+	if ownLimiters {
+		r.limiters = NewRouteLimiters()
+	}
+
+	// Load API keys; on failure every key is rejected
+	if r.keys == nil {
+		r.keys = middleware.NewKeyStore()
+		if err := r.keys.Update(cfg.Auth); err != nil {
+			logger.Error("Failed to load API keys", zap.Error(err))
+		}
 	}
 
 	// Configure routes
-	r.setupRoutes()
+	if err := r.setupRoutes(); err != nil {
+		r.limiters.Discard()
+		r.Close()
+		return nil, err
+	}
+	if ownLimiters {
+		r.limiters.Commit()
+	}
 
-	return r
+	return r, nil
 }
 
 // setupRoutes configures all routes based on the configuration provided in the server config.
-func (r *Router) setupRoutes() {
+func (r *Router) setupRoutes() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.stop = cancel
+
+	// Answer cross-origin requests before routing, so that preflight
+	// requests get the policy of their route without running its middleware
+	r.cors = middleware.NewCORSPolicy(r.cfg.CORS)
+	r.corsPaths = make(map[string]*middleware.CORSPolicy)
+	r.router.Use(r.CORS)
+
 	// Add global middleware for metrics monitoring
 	r.router.Use(middleware.PrometheusMetrics(r.metrics))
 
+	// Routes limited by the rate_limit section share its limits
+	if r.cfg.RateLimit.Enabled && r.limiter == nil {
+		r.limiter = middleware.NewRateLimiter(r.cfg.RateLimit, r.metrics)
+	}
+
+	// Paths already taken by a route; the first route on a path wins
+	mounted := make(map[string]bool)
+
 	// Configure routes from config
 	for _, route := range r.cfg.Routes {
-		// Get handler for the route
-		handler, ok := r.handlers[route.Handler]
-		if !ok {
-			r.logger.Error("handler not found", zap.String("handler", route.Handler))
-			continue
+		// Handlers were checked against the registry
+		handler := r.handlers[route.Handler]
+
+		// Build the route's middleware, or the default middleware of its
+		// handler
+		mws := route.Middleware
+		if len(mws) == 0 {
+			mws = r.defaults[route.Handler]
+		}
+		chain, cors, err := r.middleware(route, mws)
+		if err != nil {
+			return fmt.Errorf("route %s: %w", route.Path, err)
 		}
 
-		// Add version prefix to the path if specified
-		path := route.Path
-		if route.Version != "" {
-			path = fmt.Sprintf("/%s%s", route.Version, path)
+		// Routes are served under their version prefix, and on their
+		// path as configured unless another route takes it
+		path := versionedPath(route)
+		paths := []string{path}
+		if route.Path != path {
+			paths = append(paths, route.Path)
+		}
+		var free []string
+		for _, p := range paths {
+			if mounted[p] {
+				r.logger.Warn("path already served by another route",
+					zap.String("path", p),
+					zap.String("handler", route.Handler))
+				continue
+			}
+			mounted[p] = true
+			free = append(free, p)
+			if cors != nil {
+				r.corsPaths[p] = middleware.NewCORSPolicy(*cors)
+			}
+		}
+		if len(free) == 0 {
+			continue
 		}
 
 		// Create route group with specified middleware
 		r.router.Group(func(router chi.Router) {
 			// Add route-specific middleware
-			for _, mw := range route.Middleware {
-				switch mw {
-				case "auth":
-					router.Use(middleware.Authentication) // Add authentication middleware
-				case "ratelimit":
-					router.Use(middleware.RateLimit(r.metrics)) // Add rate limiting middleware
-				default:
-					r.logger.Warn("unknown middleware requested", zap.String("middleware", mw))
-				}
+			router.Use(chain...)
+
+			// Select providers with the route's strategy
+			if route.Selection != "" {
+				strategy := route.Selection
+				router.Use(func(next http.Handler) http.Handler {
+					return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						next.ServeHTTP(w, r.WithContext(provider.WithSelection(r.Context(), strategy)))
+					})
+				})
+			}
+
+			// Apply the route's dedup setting
+			if route.Dedup != nil {
+				enabled := *route.Dedup
+				router.Use(func(next http.Handler) http.Handler {
+					return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						next.ServeHTTP(w, r.WithContext(provider.WithDeduplication(r.Context(), enabled)))
+					})
+				})
+			}
+
+			// Run the route's traffic split
+			if split := route.Experiment(); split != nil {
+				router.Use(func(next http.Handler) http.Handler {
+					return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						next.ServeHTTP(w, r.WithContext(provider.WithExperiment(r.Context(), split)))
+					})
+				})
 			}
 
 			// Add header validation middleware if headers are specified
@@ -102,35 +236,104 @@ func (r *Router) setupRoutes() {
 			}
 
 			// Handle methods for the route
-			if len(route.Methods) > 0 {
-				for _, method := range route.Methods {
-					router.Method(method, path, handler) // Register method-specific handler
+			for _, p := range free {
+				if len(route.Methods) > 0 {
+					for _, method := range route.Methods {
+						router.Method(method, p, handler) // Register method-specific handler
+					}
+				} else {
+					router.Handle(p, handler) // Default to handle for all methods
 				}
-			} else {
-				router.Handle(path, handler) // Default to handle for all methods
 			}
 
 			// Configure health check if enabled
-			if route.HealthCheck != nil {
+			if route.HealthCheck != nil && route.HealthCheck.Enabled {
 				healthPath := fmt.Sprintf("%s/health", path)
-				router.Get(healthPath, r.healthCheckHandler(route)) // Register health check handler
-				r.startHealthCheck(route)                           // Start health check routine
+				router.Get(healthPath, r.healthCheckHandler(path)) // Register health check handler
+				r.startHealthCheck(ctx, route, path)               // Start health check routine
 			}
 		})
 	}
 
-	// Add global health check endpoint
-	r.router.Get("/health", r.globalHealthCheckHandler())
+	// Add global health check endpoint, unless a route serves it
+	if !mounted["/health"] {
+		r.router.Get("/health", r.globalHealthCheckHandler())
+	}
+
+	// Add metrics endpoint, unless a route serves it
+	if !mounted["/metrics"] {
+		r.router.Handle("/metrics", r.metrics.Handler())
+	}
+	return nil
+}
+
+// versionedPath returns the path of a route under its version prefix. Paths
+// that already start with the prefix are left as is.
+func versionedPath(route config.RouteConfig) string {
+	if route.Version == "" {
+		return route.Path
+	}
+	prefix := "/" + route.Version
+	if route.Path == prefix || strings.HasPrefix(route.Path, prefix+"/") {
+		return route.Path
+	}
+	return prefix + route.Path
+}
+
+// middleware builds the middleware of a route from the registered
+// constructors, along with the CORS configuration of the route when its
+// cors middleware overrides the cors section.
+func (r *Router) middleware(route config.RouteConfig, mws []config.MiddlewareConfig) ([]func(http.Handler) http.Handler, *config.CORSConfig, error) {
+	env := MiddlewareEnv{
+		Config:      r.cfg,
+		Route:       route,
+		Logger:      r.logger,
+		Metrics:     r.metrics,
+		Keys:        r.keys,
+		Budgets:     r.budgets,
+		RateLimiter: r.limiter,
+		Limiters:    r.limiters,
+	}
+
+	var chain []func(http.Handler) http.Handler
+	var cors *config.CORSConfig
+	for _, mw := range mws {
+		build, settings, err := resolveMiddleware(mw)
+		if err != nil {
+			return nil, nil, err
+		}
+		if s, ok := settings.(*config.CORSSettings); ok {
+			merged := r.cfg.CORS.Override(s)
+			cors = &merged
+		}
+		handler, err := build(settings, env)
+		if err != nil {
+			return nil, nil, fmt.Errorf("middleware %s: %w", mw.Name, err)
+		}
+		if handler != nil {
+			chain = append(chain, handler)
+		}
+	}
+	return chain, cors, nil
+}
 
-	// Add metrics endpoint
-	r.router.Handle("/metrics", r.metrics.Handler())
+// CORS applies the CORS policy of the requested path: that of the cors
+// middleware of the route serving it, or else that of the cors section.
+func (r *Router) CORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		policy, ok := r.corsPaths[req.URL.Path]
+		if !ok {
+			policy = r.cors
+		}
+		policy.Handler(next).ServeHTTP(w, req)
+	})
 }
 
 // healthCheckHandler returns a handler for route-specific health checks.
-func (r *Router) healthCheckHandler(route config.RouteConfig) http.HandlerFunc {
+func (r *Router) healthCheckHandler(path string) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		status := "healthy"
-		if v, ok := r.healthState.Load(route.Path); ok && !v.(bool) {
+		if v, ok := r.healthState.Load(path); ok && !v.(bool) {
 			status = "unhealthy"
 			w.WriteHeader(http.StatusServiceUnavailable)
 		}
@@ -140,7 +343,7 @@ func (r *Router) healthCheckHandler(route config.RouteConfig) http.HandlerFunc {
 		if err := json.NewEncoder(w).Encode(map[string]string{"status": status}); err != nil {
 			// Log the error and send a generic error response
 			r.logger.Error("Failed to encode health check response",
-				zap.String("route", route.Path),
+				zap.String("route", path),
 				zap.Error(err))
 
 			// Send a fallback error response
@@ -191,41 +394,66 @@ func (r *Router) globalHealthCheckHandler() http.HandlerFunc {
 	}
 }
 
-// startHealthCheck starts a health check goroutine for the given route.
-// It periodically checks the health of the route and updates the health state.
-func (r *Router) startHealthCheck(route config.RouteConfig) {
-	if route.HealthCheck == nil {
-		return // Exit if no health check configuration
+// startHealthCheck starts a health check goroutine for the route served on
+// the given path. It periodically checks the health of the route and
+// updates the health state, until the context is done.
+func (r *Router) startHealthCheck(ctx context.Context, route config.RouteConfig, path string) {
+	hc := *route.HealthCheck
+	if hc.Interval <= 0 {
+		hc.Interval = 30 * time.Second
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = 5 * time.Second
+	}
+	if hc.Threshold <= 0 {
+		hc.Threshold = 1
+	}
+
+	// Unknown check types are reported once and skipped
+	checks := make(map[string]string, len(hc.Checks))
+	for name, checkType := range hc.Checks {
+		switch checkType {
+		case "http", "tcp":
+			checks[name] = checkType
+		default:
+			r.logger.Warn("unknown health check type",
+				zap.String("type", checkType),
+				zap.String("check", name),
+				zap.String("route", path))
+		}
 	}
 
 	// Initialize health state
-	r.healthState.Store(route.Path, true)
+	r.healthState.Store(path, true)
 
 	// Start health check goroutine
 	go func() {
-		ticker := time.NewTicker(route.HealthCheck.Interval) // Set up ticker for health checks
+		ticker := time.NewTicker(hc.Interval) // Set up ticker for health checks
+		defer ticker.Stop()
 		failures := 0
 
-		for range ticker.C {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
 			healthy := true
 
 			// Perform health checks
-			for name, checkType := range route.HealthCheck.Checks {
+			for _, checkType := range checks {
 				switch checkType {
 				case "http":
-					healthy = r.checkHTTPHealth(route) // Perform HTTP health check
+					healthy = r.checkHTTPHealth(path, hc.Timeout) // Perform HTTP health check
 				case "tcp":
-					healthy = r.checkTCPHealth(route) // Perform TCP health check
-				default:
-					r.logger.Warn("unknown health check type",
-						zap.String("type", checkType),
-						zap.String("check", name))
+					healthy = r.checkTCPHealth(hc.Timeout) // Perform TCP health check
 				}
 
 				if !healthy {
 					failures++
-					if failures >= route.HealthCheck.Threshold {
-						r.healthState.Store(route.Path, false) // Mark route as unhealthy
+					if failures >= hc.Threshold {
+						r.healthState.Store(path, false) // Mark route as unhealthy
 					}
 					break
 				}
@@ -233,35 +461,46 @@ func (r *Router) startHealthCheck(route config.RouteConfig) {
 
 			if healthy {
 				failures = 0
-				r.healthState.Store(route.Path, true)
+				r.healthState.Store(path, true)
 			}
 		}
 	}()
 }
 
-// checkHTTPHealth performs an HTTP health check for a route.
-// It returns true if the route is healthy, false otherwise.
-func (r *Router) checkHTTPHealth(route config.RouteConfig) bool {
+// checkHTTPHealth performs an HTTP health check for the route served on the
+// given path. The route is healthy unless it fails with a server error.
+func (r *Router) checkHTTPHealth(path string, timeout time.Duration) bool {
 	client := &http.Client{
-		Timeout: route.HealthCheck.Timeout,
+		Timeout: timeout,
 	}
 
-	resp, err := client.Get(fmt.Sprintf("http://localhost:%d%s", r.cfg.Server.Port, route.Path))
+	resp, err := client.Get(fmt.Sprintf("http://localhost:%d%s", r.cfg.Server.Port, path))
 	if err != nil {
 		return false
 	}
 	defer resp.Body.Close()
 
-	return resp.StatusCode == http.StatusOK
+	return resp.StatusCode < http.StatusInternalServerError
 }
 
-// checkTCPHealth performs a TCP health check for a route.
-// It returns true if the route is healthy, false otherwise.
-func (r *Router) checkTCPHealth(route config.RouteConfig) bool {
-	// Implement TCP health check logic here
+// checkTCPHealth performs a TCP health check, which succeeds when the
+// server accepts connections.
+func (r *Router) checkTCPHealth(timeout time.Duration) bool {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", r.cfg.Server.Port), timeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
 	return true
 }
 
+// Close stops the health checks of the routes.
+func (r *Router) Close() {
+	if r.stop != nil {
+		r.stop()
+	}
+}
+
 // ServeHTTP implements the http.Handler interface.
 // It handles incoming HTTP requests.
 func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
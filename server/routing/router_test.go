@@ -4,11 +4,13 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/teilomillet/hapax/config"
 	"github.com/teilomillet/hapax/server/metrics"
 	"go.uber.org/zap"
@@ -44,7 +46,8 @@ func setupTestRouter(t *testing.T) (*Router, *httptest.Server) {
 	}
 
 	// Create router
-	router := NewRouter(cfg, handlers, logger, m)
+	router, err := NewRouter(cfg, handlers, logger, m)
+	require.NoError(t, err)
 
 	// Create test server
 	server := httptest.NewServer(router)
@@ -72,7 +75,8 @@ func TestRouter_NewRouter(t *testing.T) {
 	m := metrics.NewMetrics()
 
 	// Test
-	router := NewRouter(cfg, handlers, logger, m)
+	router, err := NewRouter(cfg, handlers, logger, m)
+	require.NoError(t, err)
 
 	// Assert
 	assert.NotNil(t, router)
@@ -80,6 +84,20 @@ func TestRouter_NewRouter(t *testing.T) {
 	assert.Equal(t, handlers, router.handlers)
 }
 
+func TestRouter_UnknownHandler(t *testing.T) {
+	cfg := &config.Config{
+		Routes: []config.RouteConfig{
+			{Path: "/test", Handler: "test", Version: "v1"},
+			{Path: "/other", Handler: "missing", Version: "v1"},
+		},
+	}
+	handlers := map[string]http.Handler{"test": http.NotFoundHandler()}
+
+	_, err := NewRouter(cfg, handlers, zap.NewNop(), metrics.NewMetrics())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown handler: missing")
+}
+
 func TestRouter_VersionedRouting(t *testing.T) {
 	// Setup
 	cfg := &config.Config{
@@ -110,7 +128,8 @@ func TestRouter_VersionedRouting(t *testing.T) {
 	}
 	logger := zap.NewNop()
 	m := metrics.NewMetrics()
-	router := NewRouter(cfg, handlers, logger, m)
+	router, err := NewRouter(cfg, handlers, logger, m)
+	require.NoError(t, err)
 
 	// Test V1
 	req := httptest.NewRequest("GET", "/v1/test", nil)
@@ -146,7 +165,8 @@ func TestRouter_HeaderValidation(t *testing.T) {
 	}
 	logger := zap.NewNop()
 	m := metrics.NewMetrics()
-	router := NewRouter(cfg, handlers, logger, m)
+	router, err := NewRouter(cfg, handlers, logger, m)
+	require.NoError(t, err)
 
 	// Test without required header
 	req := httptest.NewRequest("GET", "/v1/test", nil)
@@ -181,7 +201,8 @@ func TestRouter_MethodRestriction(t *testing.T) {
 	}
 	logger := zap.NewNop()
 	m := metrics.NewMetrics()
-	router := NewRouter(cfg, handlers, logger, m)
+	router, err := NewRouter(cfg, handlers, logger, m)
+	require.NoError(t, err)
 
 	// Test with wrong method
 	req := httptest.NewRequest("GET", "/v1/test", nil)
@@ -226,7 +247,8 @@ func TestRouter_HealthCheck(t *testing.T) {
 	}
 	logger := zap.NewNop()
 	m := metrics.NewMetrics()
-	router := NewRouter(cfg, handlers, logger, m)
+	router, err := NewRouter(cfg, handlers, logger, m)
+	require.NoError(t, err)
 
 	// Test route health check
 	req := httptest.NewRequest("GET", "/v1/test/health", nil)
@@ -235,7 +257,7 @@ func TestRouter_HealthCheck(t *testing.T) {
 	assert.Equal(t, http.StatusOK, w.Code)
 
 	var resp map[string]string
-	err := json.NewDecoder(w.Body).Decode(&resp)
+	err = json.NewDecoder(w.Body).Decode(&resp)
 	assert.NoError(t, err)
 	assert.Equal(t, "healthy", resp["status"])
 
@@ -273,7 +295,7 @@ func TestRouter_Middleware(t *testing.T) {
 				Path:       "/test",
 				Handler:    "test",
 				Version:    "v1",
-				Middleware: []string{"custom"},
+				Middleware: config.Middleware("logging"),
 			},
 		},
 	}
@@ -297,7 +319,7 @@ func TestRouter_Middleware(t *testing.T) {
 		cfg:      cfg,
 		metrics:  m,
 	}
-	router.setupRoutes()
+	require.NoError(t, router.setupRoutes())
 
 	// Test
 	req := httptest.NewRequest("GET", "/v1/test", nil)
@@ -336,3 +358,119 @@ func TestRouterMetrics(t *testing.T) {
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 	resp.Body.Close()
 }
+
+func TestRouter_Registry(t *testing.T) {
+	registry := NewRegistry()
+	registry.Register("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), "auth")
+	registry.Register("health", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	cfg := &config.Config{
+		Auth: config.AuthConfig{Enabled: true},
+		Routes: []config.RouteConfig{
+			{Path: "/test", Handler: "test", Version: "v1"},
+			{Path: "/v1/own", Handler: "test", Version: "v1", Middleware: config.Middleware("logging")},
+			{Path: "/health", Handler: "health", Version: "v1"},
+		},
+	}
+	router, err := NewRouterWithRegistry(cfg, registry, Options{}, zap.NewNop(), metrics.NewMetrics())
+	require.NoError(t, err)
+	defer router.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+	}{
+		{"versioned path with default middleware", "/v1/test", http.StatusUnauthorized},
+		{"path as configured with default middleware", "/test", http.StatusUnauthorized},
+		{"path with version prefix and own middleware", "/v1/own", http.StatusOK},
+		{"version prefix not repeated", "/v1/v1/own", http.StatusNotFound},
+		{"route replacing the global health check", "/health", http.StatusTeapot},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			assert.Equal(t, tt.wantStatus, w.Code)
+		})
+	}
+}
+
+func TestRegisterMiddleware(t *testing.T) {
+	type stampSettings struct {
+		Value string `yaml:"value"`
+	}
+	RegisterMiddleware("test_stamp", func(s *stampSettings, env MiddlewareEnv) (func(http.Handler) http.Handler, error) {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Stamp", s.Value+" "+env.Route.Path)
+				next.ServeHTTP(w, r)
+			})
+		}, nil
+	})
+
+	cfg := &config.Config{
+		Routes: []config.RouteConfig{
+			{
+				Path:    "/test",
+				Handler: "test",
+				Version: "v1",
+				Middleware: []config.MiddlewareConfig{
+					{Name: "test_stamp", Params: map[string]interface{}{"value": "stamped"}},
+					{Name: "body_limit", Params: map[string]interface{}{"bytes": "8B"}},
+					{Name: "ratelimit", Params: map[string]interface{}{"rpm": 2}},
+				},
+			},
+		},
+	}
+	// Registered middleware is known to configuration validation
+	_, err := cfg.Routes[0].Middleware[0].Settings()
+	require.NoError(t, err)
+
+	handlers := map[string]http.Handler{
+		"test": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	router, err := NewRouter(cfg, handlers, zap.NewNop(), metrics.NewMetrics())
+	require.NoError(t, err)
+	defer router.Close()
+
+	serve := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/test", strings.NewReader(body)))
+		return w
+	}
+
+	w := serve("small")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "stamped /test", w.Header().Get("X-Stamp"))
+
+	// Bodies over the limit are rejected before they count against the rate limit
+	assert.Equal(t, http.StatusRequestEntityTooLarge, serve("far too large").Code)
+
+	assert.Equal(t, http.StatusOK, serve("").Code)
+	assert.Equal(t, http.StatusTooManyRequests, serve("").Code)
+}
+
+func TestMiddlewareWithoutConstructor(t *testing.T) {
+	// Valid in configurations, but the router cannot build it
+	config.RegisterMiddleware("test_unbuilt", nil, nil)
+
+	cfg := &config.Config{
+		Routes: []config.RouteConfig{
+			{Path: "/test", Handler: "test", Version: "v1", Middleware: config.Middleware("logging", "test_unbuilt")},
+		},
+	}
+	_, err := cfg.Routes[0].Middleware[1].Settings()
+	require.NoError(t, err)
+
+	handlers := map[string]http.Handler{"test": http.NotFoundHandler()}
+	_, err = NewRouter(cfg, handlers, zap.NewNop(), metrics.NewMetrics())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "middleware test_unbuilt: no constructor registered")
+}
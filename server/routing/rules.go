@@ -0,0 +1,203 @@
+package routing
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/errors"
+	"github.com/teilomillet/hapax/server/metrics"
+	"github.com/teilomillet/hapax/server/middleware"
+	"github.com/teilomillet/hapax/server/provider"
+	"github.com/teilomillet/hapax/server/validation"
+	"go.uber.org/zap"
+)
+
+// defaultRule labels the routing decisions of requests matching no rule.
+const defaultRule = "default"
+
+// RequestAttributes are the properties of a request that routing rules
+// match on.
+type RequestAttributes struct {
+	PromptTokens int
+	HasSystem    bool
+	Type         string
+	Header       http.Header
+	Identity     middleware.Identity
+}
+
+// RuleEngine routes completion requests to a model of the registry
+// according to the routing rules of the configuration.
+type RuleEngine struct {
+	rules    []config.RoutingRule
+	fallback string
+	alias    string
+	metrics  *metrics.Metrics
+	logger   *zap.Logger
+}
+
+// NewRuleEngine creates a rule engine evaluating the given configuration.
+// Decisions are counted in the metrics when they are given.
+func NewRuleEngine(cfg config.RoutingConfig, m *metrics.Metrics, logger *zap.Logger) *RuleEngine {
+	return &RuleEngine{
+		rules:    cfg.Rules,
+		fallback: cfg.Default,
+		alias:    cfg.RoutingAlias(),
+		metrics:  m,
+		logger:   logger,
+	}
+}
+
+// Route returns the model of a request with the given attributes, and the
+// name of the rule that chose it: the first matching rule, or the default.
+func (e *RuleEngine) Route(attrs RequestAttributes) (model, rule string) {
+	for _, r := range e.rules {
+		if matches(&r, attrs) {
+			return r.Model, r.Name
+		}
+	}
+	return e.fallback, defaultRule
+}
+
+// matches reports whether the request meets every condition of the rule.
+func matches(rule *config.RoutingRule, attrs RequestAttributes) bool {
+	if rule.MinPromptTokens > 0 && attrs.PromptTokens < rule.MinPromptTokens {
+		return false
+	}
+	if rule.MaxPromptTokens > 0 && attrs.PromptTokens > rule.MaxPromptTokens {
+		return false
+	}
+	if rule.HasSystem != nil && *rule.HasSystem != attrs.HasSystem {
+		return false
+	}
+	if len(rule.Types) > 0 && !contains(rule.Types, attrs.Type) {
+		return false
+	}
+	if len(rule.KeyLabels) > 0 && !contains(rule.KeyLabels, attrs.Identity.Label) {
+		return false
+	}
+	if len(rule.Tenants) > 0 && !contains(rule.Tenants, attrs.Identity.Tenant) {
+		return false
+	}
+	for name, want := range rule.Headers {
+		got := attrs.Header.Get(name)
+		if got == "" || (want != "*" && got != want) {
+			return false
+		}
+	}
+	return true
+}
+
+// contains reports whether values holds value.
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// routedBody holds the fields of the native, OpenAI and Anthropic request
+// formats that routing rules look at.
+type routedBody struct {
+	Model    string          `json:"model"`
+	Input    string          `json:"input"`
+	System   json.RawMessage `json:"system"`
+	Messages []struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	} `json:"messages"`
+}
+
+// Handler routes requests that name no model, or name the routing alias,
+// to the model chosen by the rules. The body is read to find the prompt
+// and restored for the next handler; malformed bodies are left for the
+// handler to reject.
+func (e *RuleEngine) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			errors.ErrorWithType(w, "Failed to read request body", errors.BadRequestError, http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(data))
+
+		var body routedBody
+		if err := json.Unmarshal(data, &body); err != nil || (body.Model != "" && body.Model != e.alias) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		attrs := requestAttributes(r, &body)
+		model, rule := e.Route(attrs)
+		if e.metrics != nil {
+			e.metrics.RoutingDecisions.WithLabelValues(rule, model).Inc()
+		}
+		e.logger.Debug("routed request",
+			zap.String("rule", rule),
+			zap.String("model", model),
+			zap.Int("prompt_tokens", attrs.PromptTokens))
+
+		next.ServeHTTP(w, r.WithContext(provider.WithModel(r.Context(), model)))
+	})
+}
+
+// requestAttributes describes a request and its decoded body to the rules.
+func requestAttributes(r *http.Request, body *routedBody) RequestAttributes {
+	var prompt strings.Builder
+	prompt.WriteString(body.Input)
+
+	system := contentText(body.System)
+	prompt.WriteString(system)
+	hasSystem := system != ""
+	for _, msg := range body.Messages {
+		text := contentText(msg.Content)
+		prompt.WriteString(text)
+		if msg.Role == "system" || msg.Role == "developer" {
+			hasSystem = hasSystem || text != ""
+		}
+	}
+
+	requestType := r.URL.Query().Get("type")
+	if requestType == "" {
+		requestType = "default"
+	}
+	identity, _ := middleware.IdentityFromContext(r.Context())
+
+	return RequestAttributes{
+		PromptTokens: validation.CountTokens(prompt.String()),
+		HasSystem:    hasSystem,
+		Type:         requestType,
+		Header:       r.Header,
+		Identity:     identity,
+	}
+}
+
+// contentText returns the text of a message content, which is either a
+// string or an array of parts of which the text parts are kept.
+func contentText(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text
+	}
+
+	var parts []struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, p := range parts {
+		b.WriteString(p.Text)
+	}
+	return b.String()
+}
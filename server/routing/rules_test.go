@@ -0,0 +1,90 @@
+package routing
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/teilomillet/hapax/config"
+	"github.com/teilomillet/hapax/server/metrics"
+	"github.com/teilomillet/hapax/server/middleware"
+	"go.uber.org/zap"
+)
+
+func TestRuleEngineRoute(t *testing.T) {
+	withSystem := true
+	engine := NewRuleEngine(config.RoutingConfig{
+		Default: "fast",
+		Rules: []config.RoutingRule{
+			{Name: "batch", KeyLabels: []string{"batch jobs"}, Model: "cheap"},
+			{Name: "long-context", MinPromptTokens: 1000, Model: "big"},
+			{Name: "agents", HasSystem: &withSystem, Types: []string{"function"}, Model: "smart"},
+			{Name: "beta", Headers: map[string]string{"X-Beta": "*"}, Model: "smart"},
+		},
+	}, nil, zap.NewNop())
+
+	tests := []struct {
+		name  string
+		attrs RequestAttributes
+		model string
+		rule  string
+	}{
+		{"short prompt", RequestAttributes{PromptTokens: 10, Type: "default"}, "fast", "default"},
+		{"long prompt", RequestAttributes{PromptTokens: 5000, Type: "default"}, "big", "long-context"},
+		{"rules apply in order", RequestAttributes{PromptTokens: 5000, Identity: middleware.Identity{Label: "batch jobs"}}, "cheap", "batch"},
+		{"all conditions must hold", RequestAttributes{HasSystem: true, Type: "default"}, "fast", "default"},
+		{"function with system prompt", RequestAttributes{HasSystem: true, Type: "function"}, "smart", "agents"},
+		{"header present", RequestAttributes{Header: http.Header{"X-Beta": {"1"}}}, "smart", "beta"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			model, rule := engine.Route(tt.attrs)
+			assert.Equal(t, tt.model, model)
+			assert.Equal(t, tt.rule, rule)
+		})
+	}
+}
+
+func TestRuleEngineHandler(t *testing.T) {
+	m := metrics.NewMetrics()
+	withSystem := true
+	engine := NewRuleEngine(config.RoutingConfig{
+		Default: "fast",
+		Rules: []config.RoutingRule{
+			{Name: "system", HasSystem: &withSystem, Model: "smart"},
+		},
+	}, m, zap.NewNop())
+
+	var received string
+	handler := engine.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		received = string(body)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func(body string) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), middleware.IdentityKey, middleware.Identity{KeyID: "app"}))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, body, received, "the body is passed on")
+	}
+
+	send(`{"input": "hello"}`)
+	send(`{"model": "auto", "messages": [{"role": "system", "content": "Be brief"}, {"role": "user", "content": "hello"}]}`)
+	send(`{"system": [{"type": "text", "text": "Be brief"}], "messages": [{"role": "user", "content": "hello"}]}`)
+
+	// Requests naming a model are not routed
+	send(`{"model": "smart", "messages": [{"role": "user", "content": "hello"}]}`)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.RoutingDecisions.WithLabelValues("default", "fast")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.RoutingDecisions.WithLabelValues("system", "smart")))
+}
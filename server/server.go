@@ -13,9 +13,10 @@ import (
 	"log"
 	"net"
 	"net/http"
-	"os"
 	"os/exec"
+	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -28,47 +29,259 @@ import (
 	"github.com/teilomillet/hapax/server/metrics"
 	"github.com/teilomillet/hapax/server/middleware"
 	"github.com/teilomillet/hapax/server/processing"
+	"github.com/teilomillet/hapax/server/provider"
+	"github.com/teilomillet/hapax/server/routing"
 	"go.uber.org/zap"
 	"golang.org/x/sys/unix"
 )
 
 // Router handles HTTP routing and middleware configuration.
 // It sets up all endpoints and applies common middleware to requests.
+//
+// Update applies a new configuration without interrupting requests: new
+// requests get a handler built from it, while those in flight finish on
+// the previous one. The API keys, request queue, rate limiters, budgets and
+// provider manager outlive handlers, so their state survives reloads.
 type Router struct {
-	router     chi.Router       // Chi router for flexible routing
-	completion http.Handler     // Handler for completion requests
-	metrics    *metrics.Metrics // Server metrics
+	components
+	handler  atomic.Pointer[chi.Mux] // Handler of the current configuration
+	llm      gollm.LLM               // Primary provider of the failover chain
+	logger   *zap.Logger             // Server logger
+	metrics  *metrics.Metrics        // Server metrics
+	keys     *middleware.KeyStore    // API keys accepted by the server
+	limiters *routing.RouteLimiters  // Limiters of routes with limits of their own
+	manager  *provider.Manager       // Provider manager, nil when it failed to initialize
+	replay   *sync.Map               // Hashes of recent completion requests, for replay protection
+	watcher  config.Watcher          // Source of the configuration, nil when it is not reloaded
+	routes   *routing.Router         // Configured routes of the current handler
+	cfg      *config.Config          // Configuration of the current handler
+	mu       sync.Mutex              // Serializes updates
+}
+
+// components are the long-lived components that the configuration enables
+// and handlers are built with.
+type components struct {
+	queue   *middleware.QueueMiddleware // Request queue, nil when disabled
+	limiter *middleware.RateLimiter     // Limiter of the rate_limit section, nil when disabled
+	budgets *middleware.Budgets         // Token and spend budgets, nil when disabled
 }
 
 // NewRouter creates a new router with all endpoints configured.
 // It:
-// 1. Sets up common middleware (request ID, timing, panic recovery, CORS)
-// 2. Configures the completion endpoint for LLM requests
-// 3. Adds health check endpoint for container orchestration
-// 4. Adds metrics endpoint for Prometheus monitoring
-func NewRouter(llm gollm.LLM, cfg *config.Config, logger *zap.Logger) *Router {
-	r := chi.NewRouter()
+// 1. Sets up common middleware (request ID, queue, timing, panic recovery)
+// 2. Registers the handlers of routes: completion endpoints (native, OpenAI- and Anthropic-compatible), health and metrics
+// 3. Serves the configured routes with them, each with its version prefix, methods, headers, middleware and CORS policy
+// 4. Adds the admin endpoints, which require an admin API key
+//
+// It fails when a route names an unknown handler. Call Close when the
+// router is no longer used.
+func NewRouter(llm gollm.LLM, cfg *config.Config, logger *zap.Logger) (*Router, error) {
+	return newRouter(llm, cfg, logger, nil)
+}
 
+// newRouter creates a router like NewRouter. When the configuration comes
+// from a watcher, its reloads are reported by the metrics and admin
+// endpoints.
+func newRouter(llm gollm.LLM, cfg *config.Config, logger *zap.Logger, watcher config.Watcher) (*Router, error) {
 	// Initialize metrics
 	m := metrics.NewMetrics()
+	if watcher != nil {
+		m.RegisterReloadStatus(watcher.Status)
+	}
 
-	// Add middleware stack for all requests
-	r.Use(middleware.RequestID) // Adds unique ID to each request
+	router := &Router{
+		llm:      llm,
+		logger:   logger,
+		metrics:  m,
+		keys:     middleware.NewKeyStore(),
+		limiters: routing.NewRouteLimiters(),
+		replay:   &sync.Map{},
+		watcher:  watcher,
+	}
+
+	// Load API keys. On failure every key is rejected.
+	if err := router.keys.Update(cfg.Auth); err != nil {
+		logger.Error("Failed to load API keys", zap.Error(err))
+	}
+
+	// The request queue, rate limiter and budgets of the sections enabled.
+	// Budgets persist their consumption, so that it survives restarts.
+	router.components = router.stage(cfg)
+
+	// Route completions through the provider manager so that failover,
+	// retries and response caching apply. The given LLM serves as the
+	// primary entry of the failover chain.
+	manager, err := provider.NewManager(cfg, logger, m.Registry())
+	if err == nil {
+		err = manager.SetProvider(cfg.LLM.Provider, llm)
+	}
+	if err != nil {
+		logger.Error("Failed to create provider manager, using default LLM", zap.Error(err))
+		manager = nil
+	}
+	router.manager = manager
+
+	mux, routes, err := router.build(cfg, router.registry(llm, cfg), router.components)
+	if err != nil {
+		router.limiters.Discard()
+		router.Close()
+		return nil, err
+	}
+	router.serve(cfg, mux, routes)
+	return router, nil
+}
+
+// newQueue creates the request queue of the configuration.
+func newQueue(cfg *config.Config, m *metrics.Metrics) *middleware.QueueMiddleware {
+	return middleware.NewQueueMiddleware(middleware.QueueConfig{
+		InitialSize:  cfg.Queue.InitialSize,
+		Metrics:      m,
+		StatePath:    cfg.Queue.StatePath,
+		SaveInterval: cfg.Queue.SaveInterval,
+	})
+}
+
+// Update applies a new configuration to the router, with llm as the
+// primary provider of the failover chain. The handler of the configuration
+// is built and the providers updated before anything else changes, so that
+// a configuration rejected by either, such as one whose routes name
+// unknown handlers or whose providers cannot be created, leaves the router
+// as it was. Then the long-lived components take the changes and the new
+// handler serves the requests that arrive from now on.
+func (r *Router) Update(llm gollm.LLM, cfg *config.Config) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	registry := r.registry(llm, cfg)
+	if err := registry.Validate(cfg.Routes); err != nil {
+		return err
+	}
+	if _, err := cfg.Auth.LoadKeys(); err != nil {
+		return fmt.Errorf("load API keys: %w", err)
+	}
+
+	next := r.stage(cfg)
+	mux, routes, err := r.build(cfg, registry, next)
+	if err != nil {
+		r.limiters.Discard()
+		r.discard(next)
+		return err
+	}
+
+	// A provider manager that failed to initialize is not retried, as its
+	// metrics are already registered
+	if r.manager != nil {
+		if err := r.manager.UpdatePrimary(cfg, llm); err != nil {
+			routes.Close()
+			r.limiters.Discard()
+			r.discard(next)
+			return fmt.Errorf("update providers: %w", err)
+		}
+	}
+
+	// The keys were loaded above; should they fail now, every key is
+	// rejected
+	if err := r.keys.Update(cfg.Auth); err != nil {
+		r.logger.Error("Failed to load API keys", zap.Error(err))
+	}
+	r.commit(cfg, next)
+	r.llm = llm
+	r.serve(cfg, mux, routes)
+	return nil
+}
+
+// stage returns the components of cfg: the current ones, which take the
+// changes of cfg on commit, and new ones for the sections cfg enables.
+// Nothing changes until commit.
+func (r *Router) stage(cfg *config.Config) components {
+	next := r.components
+	switch {
+	case !cfg.Queue.Enabled:
+		next.queue = nil
+	case next.queue == nil:
+		next.queue = newQueue(cfg, r.metrics)
+	}
+	switch {
+	case !cfg.RateLimit.Enabled:
+		next.limiter = nil
+	case next.limiter == nil:
+		next.limiter = middleware.NewRateLimiter(cfg.RateLimit, r.metrics)
+	}
+	switch {
+	case !cfg.Budgets.Enabled:
+		next.budgets = nil
+	case next.budgets == nil:
+		next.budgets = middleware.NewBudgets(cfg.Budgets, r.metrics, r.logger)
+	}
+	return next
+}
+
+// discard releases the components that stage created for a configuration
+// that is not applied.
+func (r *Router) discard(next components) {
+	if next.queue != nil && next.queue != r.queue {
+		if err := next.queue.Shutdown(context.Background()); err != nil {
+			r.logger.Error("Failed to shut down request queue", zap.Error(err))
+		}
+	}
+	if next.budgets != nil && next.budgets != r.budgets {
+		if err := next.budgets.Close(); err != nil {
+			r.logger.Error("Failed to save budget consumption", zap.Error(err))
+		}
+	}
+}
+
+// commit replaces the current components with next, staged for cfg.
+// Components that stay take the changes of cfg, and those cfg disables are
+// released: queued requests of a disabled queue are drained in the
+// background. Callers hold r.mu.
+func (r *Router) commit(cfg *config.Config, next components) {
+	switch {
+	case r.queue != nil && next.queue == nil:
+		queue := r.queue
+		go func() {
+			if err := queue.Shutdown(context.Background()); err != nil {
+				r.logger.Error("Failed to shut down request queue", zap.Error(err))
+			}
+		}()
+	case r.queue != nil && cfg.Queue.InitialSize != r.cfg.Queue.InitialSize:
+		r.queue.SetMaxSize(cfg.Queue.InitialSize)
+	}
+
+	if r.limiter != nil && next.limiter == r.limiter {
+		r.limiter.Update(cfg.RateLimit)
+	}
 
-	// Configure queue middleware if enabled
-	if cfg.Queue.Enabled {
-		qm := middleware.NewQueueMiddleware(middleware.QueueConfig{
-			InitialSize:  cfg.Queue.InitialSize,
-			Metrics:      m,
-			StatePath:    cfg.Queue.StatePath,
-			SaveInterval: cfg.Queue.SaveInterval,
-		})
-		r.Use(qm.Handler)
+	// Budgets moving to another state file start over from its content
+	switch {
+	case r.budgets != nil && next.budgets == nil:
+		if err := r.budgets.Close(); err != nil {
+			r.logger.Error("Failed to save budget consumption", zap.Error(err))
+		}
+	case r.budgets != nil:
+		r.budgets.Update(cfg.Budgets)
 	}
 
-	r.Use(middleware.RequestTimer)  // Tracks request duration
-	r.Use(middleware.PanicRecovery) // Recovers from panics gracefully
-	r.Use(middleware.CORS)          // Enables cross-origin requests
+	r.components = next
+}
+
+// serve has mux, the handler of cfg, serve new requests, along with the
+// limiters of its routes. Requests in flight do not depend on the health
+// checks of the previous routes. Callers hold r.mu, except newRouter.
+func (r *Router) serve(cfg *config.Config, mux *chi.Mux, routes *routing.Router) {
+	r.handler.Store(mux)
+	r.limiters.Commit()
+	if r.routes != nil {
+		r.routes.Close()
+	}
+	r.routes = routes
+	r.cfg = cfg
+}
+
+// registry creates the handlers that routes of cfg may name, with llm as
+// the primary provider.
+func (r *Router) registry(llm gollm.LLM, cfg *config.Config) *routing.Registry {
+	logger := r.logger
 
 	// Create processor for the completion handler
 	processingCfg := &config.ProcessingConfig{
@@ -83,6 +296,9 @@ func NewRouter(llm gollm.LLM, cfg *config.Config, logger *zap.Logger) *Router {
 	if err != nil {
 		logger.Fatal("Failed to create processor", zap.Error(err))
 	}
+	if r.manager != nil {
+		processor.SetManager(r.manager)
+	}
 
 	// Create new completion handler using the handlers package
 	completionHandler := handlers.NewCompletionHandler(processor, logger)
@@ -91,47 +307,146 @@ func NewRouter(llm gollm.LLM, cfg *config.Config, logger *zap.Logger) *Router {
 	replayProtection := &replayProtectionHandler{
 		handler: completionHandler,
 		logger:  logger,
+		seen:    r.replay,
 		enabled: true,
 		allowed: false,
 		maxSize: 1000, // Maximum number of request hashes to store
 	}
 
-	router := &Router{
-		router:     r,
-		completion: replayProtection,
-		metrics:    m,
+	// Resolve the handlers of the configured routes. Completion endpoints
+	// spend provider budget: unless their routes list middleware, they
+	// require an API key when auth is enabled, then are rate limited, so
+	// that limits can apply per key and tenant, and charged to budgets last,
+	// so that rate limited requests do not count.
+	registry := routing.NewRegistry()
+	completions := []string{"ratelimit", "budget"}
+	if cfg.Auth.Enabled {
+		completions = append([]string{"auth"}, completions...)
+	}
+
+	// Requests leaving the choice of model to the server are routed by content
+	routed := func(h http.Handler) http.Handler { return h }
+	if len(cfg.Routing.Rules) > 0 || cfg.Routing.Default != "" {
+		routed = routing.NewRuleEngine(cfg.Routing, r.metrics, logger).Handler
 	}
 
-	// Mount routes
 	// Completion endpoint for LLM requests
-	r.Post("/v1/completions", replayProtection.ServeHTTP)
+	registry.Register("completion", routed(replayProtection), completions...)
+
+	// OpenAI-compatible chat completions. Replay protection is not applied:
+	// OpenAI clients legitimately send identical requests.
+	registry.Register("chat_completions", routed(handlers.NewChatCompletionsHandler(processor, logger)), completions...)
+
+	// Anthropic-compatible Messages API, for the same reason without replay protection
+	registry.Register("messages", routed(handlers.NewMessagesHandler(processor, logger)), completions...)
 
 	// Health check endpoint for container orchestration
-	// Returns 200 OK with {"status": "ok"} when the service is healthy
-	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
-		if err := json.NewEncoder(w).Encode(map[string]string{
+	// Returns 200 OK with {"status": "ok"} when the service is healthy,
+	// along with the health and ejection state of each provider
+	manager := r.manager
+	registry.Register("health", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := map[string]interface{}{
 			"status": "ok",
-		}); err != nil {
+		}
+		if manager != nil {
+			response["providers"] = manager.Health()
+		}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
 			// Use the existing error handling mechanism
 			errors.ErrorWithType(w, "Failed to encode response", errors.ProviderError, http.StatusInternalServerError)
 			return
 		}
-	})
+	}))
 
 	// Prometheus metrics endpoint
 	// Returns metrics in Prometheus text format:
 	// - Request counts by status code
 	// - Request duration histogram
 	// - LLM request counts by provider/model
-	r.Handle("/metrics", m.Handler())
+	registry.Register("metrics", r.metrics.Handler())
+
+	return registry
+}
+
+// build creates the handler serving cfg with the components c and the
+// handlers of registry, along with the router of its configured routes.
+func (r *Router) build(cfg *config.Config, registry *routing.Registry, c components) (*chi.Mux, *routing.Router, error) {
+	mux := chi.NewRouter()
+	logger := r.logger
 
-	return router
+	// Add middleware stack for all requests
+	mux.Use(middleware.RequestID) // Adds unique ID to each request
+	if c.queue != nil {
+		mux.Use(c.queue.Handler)
+	}
+	mux.Use(middleware.RequestTimer)  // Tracks request duration
+	mux.Use(middleware.PanicRecovery) // Recovers from panics gracefully
+
+	// Serve the configured routes, each with its version prefix, methods,
+	// required headers and middleware
+	routes, err := routing.NewRouterWithRegistry(cfg, registry, routing.Options{
+		Keys:        r.keys,
+		Budgets:     c.budgets,
+		RateLimiter: c.limiter,
+		Limiters:    r.limiters,
+	}, logger, r.metrics)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Admin endpoints always require an admin key, even when
+	// authentication of completions is disabled
+	mux.Route("/admin", func(admin chi.Router) {
+		admin.Use(routes.CORS)
+		admin.Use(middleware.Authentication(r.keys, r.metrics))
+		admin.Use(middleware.RequireAdmin)
+
+		// Token and spend consumption against budgets
+		admin.Get("/usage", handlers.NewUsageHandler(c.budgets, logger).ServeHTTP)
+
+		// Provider health, modes and circuit breakers
+		providers := handlers.NewProvidersHandler(r.manager, logger)
+		admin.Get("/providers", providers.List)
+		admin.Post("/providers/{name}/mode", providers.SetMode)
+		admin.Post("/providers/{name}/breaker", providers.SetBreaker)
+		admin.Put("/preference", providers.SetPreference)
+
+		// Configuration reloads
+		if r.watcher != nil {
+			reloads := handlers.NewConfigHandler(r.watcher, logger)
+			admin.Get("/config", reloads.Status)
+			admin.Post("/config/reload", reloads.Reload)
+		}
+	})
+
+	// Every other path is served by the configured routes
+	mux.Mount("/", routes)
+
+	return mux, routes, nil
+}
+
+// Close releases the resources of the router, stopping the health checks
+// of routes and providers and saving budget consumption.
+func (r *Router) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.routes != nil {
+		r.routes.Close()
+	}
+	if r.manager != nil {
+		r.manager.Close()
+	}
+	if r.budgets != nil {
+		return r.budgets.Close()
+	}
+	return nil
 }
 
 // ServeHTTP implements the http.Handler interface for the router.
 // This allows the router to be used directly with the standard library's HTTP server.
 func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	r.router.ServeHTTP(w, req)
+	r.handler.Load().ServeHTTP(w, req)
 }
 
 // Server represents the HTTP server instance.
@@ -141,6 +456,8 @@ func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 type Server struct {
 	httpServer  *http.Server
 	http3Server *http3.Server
+	router      *Router
+	applied     *config.Config // Configuration of the router, as loaded
 	config      config.Watcher
 	logger      *zap.Logger
 	llm         gollm.LLM
@@ -158,7 +475,7 @@ func NewServer(configPath string, logger *zap.Logger) (*Server, error) {
 
 	// Create initial LLM instance
 	initialConfig := configWatcher.GetCurrentConfig()
-	llm, err := gollm.NewLLM(gollm.SetProvider(initialConfig.LLM.Provider))
+	llm, err := newPrimaryLLM(initialConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize LLM: %w", err)
 	}
@@ -171,16 +488,27 @@ func NewServer(configPath string, logger *zap.Logger) (*Server, error) {
 
 	// Initialize server with current config
 	if err := s.updateServerConfig(initialConfig); err != nil {
-		return nil, err
+		configWatcher.Close()
+		return nil, fmt.Errorf("failed to apply config: %w", err)
 	}
 
-	// Subscribe to config changes
-	configChan := configWatcher.Subscribe()
-	go s.handleConfigUpdates(configChan)
+	// Reloads are applied before they are served
+	configWatcher.SetApplier(s.applyReload)
 
 	return s, nil
 }
 
+// newPrimaryLLM creates the LLM described by the llm block of the configuration,
+// which heads the failover chain.
+func newPrimaryLLM(cfg *config.Config) (gollm.LLM, error) {
+	return provider.NewLLM(config.ProviderConfig{
+		Type:     cfg.LLM.Provider,
+		Model:    cfg.LLM.Model,
+		APIKey:   cfg.LLM.APIKey,
+		Endpoint: cfg.LLM.Endpoint,
+	})
+}
+
 // NewServerWithConfig for testing now takes care of the LLM
 func NewServerWithConfig(cfg config.Watcher, llm gollm.LLM, logger *zap.Logger) (*Server, error) {
 	s := &Server{
@@ -191,211 +519,223 @@ func NewServerWithConfig(cfg config.Watcher, llm gollm.LLM, logger *zap.Logger)
 
 	// Initialize server with current config
 	if err := s.updateServerConfig(cfg.GetCurrentConfig()); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to apply config: %w", err)
 	}
 
-	// Subscribe to config changes
-	configChan := cfg.Subscribe()
-	go s.handleConfigUpdates(configChan)
+	// Reloads are applied before they are served
+	cfg.SetApplier(s.applyReload)
 
 	return s, nil
 }
 
-// updateServerConfig updates the server configuration and handles graceful shutdown.
-// When a new configuration is received, it first checks if the server is running.
-// If it is, it initiates a graceful shutdown to close existing connections before applying the new configuration.
-// This ensures that there are no disruptions during the transition to the new configuration.
+// updateServerConfig applies a configuration to the server. See applyConfig.
 func (s *Server) updateServerConfig(cfg *config.Config) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.applyConfig(cfg)
+}
 
-	// If there's an existing server, shut it down gracefully first
-	if s.httpServer != nil {
-		ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
-		defer cancel()
-
-		if err := s.httpServer.Shutdown(ctx); err != nil {
-			return fmt.Errorf("failed to shutdown existing server: %w", err)
+// applyConfig applies a configuration to the server without interrupting
+// it. The router takes the configuration, so that requests in flight
+// finish on the previous one, and listeners only restart when their port
+// or HTTP/3 settings change. A configuration the router rejects is not
+// applied. Callers hold s.mu.
+func (s *Server) applyConfig(cfg *config.Config) error {
+	if s.router == nil {
+		router, err := newRouter(s.llm, cfg, s.logger, s.config)
+		if err != nil {
+			return err
 		}
+		s.router = router
+	} else if err := s.router.Update(s.llm, cfg); err != nil {
+		return err
 	}
 
-	// If there's an existing HTTP/3 server, shut it down gracefully
-	if s.http3Server != nil {
-		if err := s.http3Server.Close(); err != nil {
-			return fmt.Errorf("failed to shutdown existing HTTP/3 server: %w", err)
-		}
+	// A copy is kept to compare reloads with, as the port it records is
+	// reset when the listener cannot move
+	previous := s.applied
+	applied := *cfg
+	s.applied = &applied
+
+	if s.httpServer == nil || previous == nil {
+		s.httpServer = newHTTPServer(cfg, s.router)
+		s.http3Server = newHTTP3Server(cfg, s.router)
+		return nil
 	}
 
-	// Create router
-	router := NewRouter(s.llm, cfg, s.logger)
+	if cfg.Server.Port != previous.Server.Port {
+		s.restartHTTP(cfg, previous.Server.Port)
+	} else if cfg.Server.ReadTimeout != previous.Server.ReadTimeout ||
+		cfg.Server.WriteTimeout != previous.Server.WriteTimeout ||
+		cfg.Server.MaxHeaderBytes != previous.Server.MaxHeaderBytes {
+		s.logger.Warn("Server timeouts and header limits apply when the listener restarts")
+	}
+	if !reflect.DeepEqual(cfg.Server.HTTP3, previous.Server.HTTP3) {
+		s.restartHTTP3(cfg)
+	}
+	return nil
+}
 
-	// Create new HTTP server instance
-	s.httpServer = &http.Server{
+// newHTTPServer creates the HTTP server of the configuration.
+func newHTTPServer(cfg *config.Config, handler http.Handler) *http.Server {
+	return &http.Server{
 		Addr:           fmt.Sprintf(":%d", cfg.Server.Port),
-		Handler:        router,
+		Handler:        handler,
 		ReadTimeout:    cfg.Server.ReadTimeout,
 		WriteTimeout:   cfg.Server.WriteTimeout,
 		MaxHeaderBytes: cfg.Server.MaxHeaderBytes,
 	}
+}
 
-	// Configure HTTP/3 if enabled
-	if cfg.Server.HTTP3 != nil && cfg.Server.HTTP3.Enabled {
-		s.http3Server = &http3.Server{
-			Addr:            fmt.Sprintf(":%d", cfg.Server.HTTP3.Port),
-			Handler:         router,
-			MaxHeaderBytes:  cfg.Server.MaxHeaderBytes,
-			EnableDatagrams: true,
-			QUICConfig: &quic.Config{
-				MaxIdleTimeout:             cfg.Server.HTTP3.IdleTimeout,
-				MaxStreamReceiveWindow:     cfg.Server.HTTP3.MaxStreamReceiveWindow,
-				MaxConnectionReceiveWindow: cfg.Server.HTTP3.MaxConnectionReceiveWindow,
-				Allow0RTT:                  cfg.Server.HTTP3.Enable0RTT,
-				MaxIncomingStreams:         int64(cfg.Server.HTTP3.MaxBiStreamsConcurrent),
-				MaxIncomingUniStreams:      int64(cfg.Server.HTTP3.MaxUniStreamsConcurrent),
-			},
-		}
+// newHTTP3Server creates the HTTP/3 server of the configuration, or
+// returns nil when HTTP/3 is disabled.
+func newHTTP3Server(cfg *config.Config, handler http.Handler) *http3.Server {
+	if cfg.Server.HTTP3 == nil || !cfg.Server.HTTP3.Enabled {
+		return nil
+	}
+	return &http3.Server{
+		Addr:            fmt.Sprintf(":%d", cfg.Server.HTTP3.Port),
+		Handler:         handler,
+		MaxHeaderBytes:  cfg.Server.MaxHeaderBytes,
+		EnableDatagrams: true,
+		QUICConfig: &quic.Config{
+			MaxIdleTimeout:             cfg.Server.HTTP3.IdleTimeout,
+			MaxStreamReceiveWindow:     cfg.Server.HTTP3.MaxStreamReceiveWindow,
+			MaxConnectionReceiveWindow: cfg.Server.HTTP3.MaxConnectionReceiveWindow,
+			Allow0RTT:                  cfg.Server.HTTP3.Enable0RTT,
+			MaxIncomingStreams:         int64(cfg.Server.HTTP3.MaxBiStreamsConcurrent),
+			MaxIncomingUniStreams:      int64(cfg.Server.HTTP3.MaxUniStreamsConcurrent),
+		},
 	}
-
-	return nil
 }
 
-// waitForServer checks if the server is ready on its new port.
-// It attempts to connect multiple times to ensure that the server is fully initialized before proceeding.
-// This is crucial for confirming that the service is operational in its new location (port).
-func (s *Server) waitForServer(port int) error {
-	// Helper function to check if port is in use
-	checkPort := func() error {
-		conn, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", port), 100*time.Millisecond)
-		if err != nil {
-			return err
-		}
-		conn.Close()
-		return nil
+// restartHTTP moves the HTTP server to the port of cfg. A running server
+// listens on the new port before the previous one shuts down gracefully,
+// so that no request is refused in between. When the new port cannot be
+// listened on, the server keeps its port, and a later reload retries.
+// Callers hold s.mu.
+func (s *Server) restartHTTP(cfg *config.Config, port int) {
+	server := newHTTPServer(cfg, s.router)
+	if !s.running {
+		s.httpServer = server
+		return
 	}
 
-	// Try to connect multiple times
-	for i := 0; i < 50; i++ { // Try for 5 seconds (50 * 100ms)
-		err := checkPort()
-		if err == nil {
-			// Port is available and server is listening
-			return nil
-		}
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		s.logger.Error("Failed to listen on new port, keeping the current one",
+			zap.Int("port", cfg.Server.Port),
+			zap.Error(err))
+		s.applied.Server.Port = port
+		return
+	}
 
-		// Check if the error indicates the port is in use by another process
-		if opErr, ok := err.(*net.OpError); ok {
-			if syscallErr, ok := opErr.Err.(*os.SyscallError); ok {
-				if syscallErr.Syscall == "connect" {
-					// Port is in use, but not by our server
-					s.logger.Warn("Port is in use by another process",
-						zap.Int("port", port),
-						zap.Error(err))
-				}
-			}
+	previous := s.httpServer
+	s.httpServer = server
+	go func() {
+		if err := server.Serve(ln); err != http.ErrServerClosed {
+			s.logger.Error("HTTP server error", zap.Error(err))
 		}
+	}()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+		defer cancel()
+		if err := previous.Shutdown(ctx); err != nil {
+			s.logger.Error("Failed to shutdown previous HTTP server", zap.Error(err))
+		}
+	}()
 
-		time.Sleep(100 * time.Millisecond)
-	}
-
-	return fmt.Errorf("server failed to start on port %d within timeout", port)
+	s.logger.Info("Server moved to new port",
+		zap.Int("previous_port", port),
+		zap.Int("port", cfg.Server.Port))
 }
 
-// handleConfigUpdates listens for configuration changes and processes them.
-// When a new configuration is received, it updates the server's settings and manages the lifecycle of the server accordingly.
-// This includes shutting down the existing server and starting a new one with the updated configuration.
-func (s *Server) handleConfigUpdates(configChan <-chan *config.Config) {
-	for newConfig := range configChan {
-		s.logger.Info("Received config update")
-
-		// Update LLM if provider changed
-		if newConfig.LLM.Provider != s.llm.GetProvider() {
-			newLLM, err := gollm.NewLLM(gollm.SetProvider(newConfig.LLM.Provider))
-			if err != nil {
-				s.logger.Error("Failed to update LLM provider", zap.Error(err))
-				continue
-			}
-			s.llm = newLLM
+// restartHTTP3 replaces the HTTP/3 server with the one of cfg, starting it
+// when the server is running. The previous server shuts down gracefully,
+// letting requests in flight finish within the shutdown timeout. As both
+// listen on UDP, a new server on the same port starts once the previous
+// one has released it. Callers hold s.mu.
+func (s *Server) restartHTTP3(cfg *config.Config) {
+	previous := s.http3Server
+	server := newHTTP3Server(cfg, s.router)
+	s.http3Server = server
+	start := server != nil && s.running
+
+	released := make(chan struct{})
+	go func() {
+		defer close(released)
+		if previous == nil {
+			return
 		}
-
-		// Handle the configuration update in a separate function to properly scope the defer
-		if err := s.applyConfigUpdate(newConfig); err != nil {
-			s.logger.Error("Failed to apply config update", zap.Error(err))
-			continue
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+		defer cancel()
+		if err := previous.Shutdown(ctx); err != nil {
+			s.logger.Error("Failed to shutdown previous HTTP/3 server", zap.Error(err))
 		}
+	}()
+	if !start {
+		return
 	}
-}
-
-// applyConfigUpdate handles the actual configuration update process.
-// It manages the shutdown of existing servers and startup of new ones with updated configuration.
-func (s *Server) applyConfigUpdate(newConfig *config.Config) error {
-	// Create a context for the update operation
-	ctx, cancel := context.WithTimeout(context.Background(), newConfig.Server.ShutdownTimeout)
-	defer cancel() // This defer is now properly scoped
 
-	// Stop the current server
-	s.mu.Lock()
-	if s.httpServer != nil {
-		if err := s.httpServer.Shutdown(ctx); err != nil {
-			s.logger.Error("Failed to shutdown HTTP server", zap.Error(err))
+	samePort := previous != nil && previous.Addr == server.Addr
+	go func() {
+		if samePort {
+			<-released
 		}
-	}
-	if s.http3Server != nil {
-		if err := s.http3Server.Close(); err != nil {
-			s.logger.Error("Failed to shutdown HTTP/3 server", zap.Error(err))
+		if err := server.ListenAndServeTLS(
+			cfg.Server.HTTP3.TLSCertFile,
+			cfg.Server.HTTP3.TLSKeyFile,
+		); err != http.ErrServerClosed {
+			s.logger.Error("HTTP/3 server error", zap.Error(err))
 		}
-	}
-	s.httpServer = nil
-	s.http3Server = nil
-	s.mu.Unlock()
-
-	// Wait for ports to be released
-	time.Sleep(100 * time.Millisecond)
+	}()
+	s.logger.Info("HTTP/3 server restarted with new settings", zap.Int("port", cfg.Server.HTTP3.Port))
+}
 
-	// Update server configuration
-	if err := s.updateServerConfig(newConfig); err != nil {
-		return fmt.Errorf("failed to update server config: %w", err)
+// closeRouter closes the current router, if any. Callers hold s.mu.
+func (s *Server) closeRouter() {
+	if s.router == nil {
+		return
 	}
-
-	// Verify server initialization
-	s.mu.RLock()
-	httpServer := s.httpServer
-	http3Server := s.http3Server
-	if httpServer == nil {
-		s.mu.RUnlock()
-		return fmt.Errorf("server initialization failed: httpServer is nil after config update")
+	if err := s.router.Close(); err != nil {
+		s.logger.Error("Failed to close router", zap.Error(err))
 	}
-	s.mu.RUnlock()
+	s.router = nil
+}
 
-	// Start HTTP server
-	go func() {
-		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
-			s.logger.Error("HTTP server error", zap.Error(err))
-		}
-	}()
+// applyReload applies a reloaded configuration to the running server. The
+// primary LLM is recreated when its provider, model or API key changes.
+// When it fails, the server keeps the current configuration, and the
+// watcher rejects the new one.
+func (s *Server) applyReload(newConfig *config.Config) error {
+	s.logger.Info("Received config update")
 
-	// Start HTTP/3 server if enabled
-	if http3Server != nil {
-		go func() {
-			if err := http3Server.ListenAndServeTLS(
-				newConfig.Server.HTTP3.TLSCertFile,
-				newConfig.Server.HTTP3.TLSKeyFile,
-			); err != http.ErrServerClosed {
-				s.logger.Error("HTTP/3 server error", zap.Error(err))
-			}
-		}()
-	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// Wait for server to be ready
-	if err := s.waitForServer(newConfig.Server.Port); err != nil {
-		s.logger.Error("Server failed to start on new port", zap.Error(err))
+	llm := s.llm
+	if s.applied == nil || newConfig.LLM.Provider != s.applied.LLM.Provider ||
+		newConfig.LLM.Model != s.applied.LLM.Model || newConfig.LLM.APIKey != s.applied.LLM.APIKey {
+		newLLM, err := newPrimaryLLM(newConfig)
+		if err != nil {
+			return fmt.Errorf("create LLM provider: %w", err)
+		}
+		s.llm = newLLM
+	}
+	if err := s.applyConfig(newConfig); err != nil {
+		s.llm = llm
 		return err
 	}
-
-	s.logger.Info("Server restarted with new configuration",
-		zap.Int("port", newConfig.Server.Port))
-
 	return nil
 }
 
+// Reload reloads the configuration file, as on SIGHUP. When the new
+// configuration is invalid, the server keeps the current one and the error
+// is returned.
+func (s *Server) Reload() error {
+	return s.config.Reload()
+}
+
 // Start begins serving HTTP requests and blocks until shutdown.
 // It handles graceful shutdown when the context is cancelled, ensuring that all connections are properly closed before exiting.
 func (s *Server) Start(ctx context.Context) error {
@@ -407,9 +747,9 @@ func (s *Server) Start(ctx context.Context) error {
 
 	// Initialize server configuration if not already done
 	if s.httpServer == nil {
-		if err := s.updateServerConfig(s.config.GetCurrentConfig()); err != nil {
+		if err := s.applyConfig(s.config.GetCurrentConfig()); err != nil {
 			s.mu.Unlock()
-			return fmt.Errorf("failed to initialize server configuration: %w", err)
+			return fmt.Errorf("server initialization failed: %w", err)
 		}
 	}
 
@@ -419,7 +759,11 @@ func (s *Server) Start(ctx context.Context) error {
 		return fmt.Errorf("server initialization failed: httpServer is nil")
 	}
 
+	// Servers replaced by reloads from now on are started by them
 	s.running = true
+	httpServer := s.httpServer
+	http3Server := s.http3Server
+	cfg := s.applied
 	s.mu.Unlock()
 
 	defer func() {
@@ -433,26 +777,12 @@ func (s *Server) Start(ctx context.Context) error {
 
 	// Start HTTP server
 	go func() {
-		s.mu.RLock()
-		httpServer := s.httpServer
-		s.mu.RUnlock()
-
-		if httpServer == nil {
-			errChan <- fmt.Errorf("HTTP server is nil")
-			return
-		}
-
 		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
 			errChan <- fmt.Errorf("HTTP server error: %w", err)
 		}
 	}()
 
 	// Configure HTTP/3 if enabled
-	s.mu.RLock()
-	cfg := s.config.GetCurrentConfig()
-	http3Server := s.http3Server
-	s.mu.RUnlock()
-
 	if cfg.Server.HTTP3 != nil && cfg.Server.HTTP3.Enabled && http3Server != nil {
 		// Try to configure UDP buffer size, but don't fail if we can't
 		if cfg.Server.HTTP3.UDPReceiveBufferSize > 0 {
@@ -535,6 +865,7 @@ func (s *Server) Start(ctx context.Context) error {
 		s.mu.Lock()
 		s.httpServer = nil
 		s.http3Server = nil
+		s.closeRouter()
 		s.mu.Unlock()
 
 		return nil
@@ -601,7 +932,7 @@ func getUDPBufferSize(conn *net.UDPConn) (int, error) {
 type replayProtectionHandler struct {
 	handler http.Handler
 	logger  *zap.Logger
-	seen    sync.Map
+	seen    *sync.Map
 	maxSize uint32
 	enabled bool
 	allowed bool
@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
@@ -25,8 +26,13 @@ import (
 	"github.com/teilomillet/hapax/server/middleware"
 	"github.com/teilomillet/hapax/server/mocks"
 	"github.com/teilomillet/hapax/server/processing"
+	"github.com/teilomillet/hapax/server/provider"
+	"github.com/teilomillet/hapax/server/routing"
+	"github.com/teilomillet/hapax/server/validation"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 // MockConfigWatcher provides a thread-safe implementation of the config.Watcher interface for testing.
@@ -46,7 +52,11 @@ type MockConfigWatcher struct {
 	// This channel is created once during initialization and closed on shutdown
 	ch chan *config.Config
 
-	// mu protects concurrent access to the config field
+	// apply takes configuration updates before they are stored, as the
+	// server's applier does for reloads
+	apply func(*config.Config) error
+
+	// mu protects concurrent access to the config and apply fields
 	// Using RWMutex allows multiple readers with exclusive writer access
 	mu sync.RWMutex
 }
@@ -87,21 +97,41 @@ func (w *MockConfigWatcher) Subscribe() <-chan *config.Config {
 	return w.ch
 }
 
+// SetApplier implements config.Watcher, registering the function that
+// applies configuration updates.
+func (w *MockConfigWatcher) SetApplier(apply func(*config.Config) error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.apply = apply
+}
+
 // UpdateConfig safely updates the current configuration and notifies all subscribers.
 // This method is thread-safe and ensures atomic updates of the configuration.
 //
 // Parameters:
 //   - cfg: The new configuration to apply
 //
+// Returns:
+//   - error: The error of the applier, in which case the configuration is unchanged
+//
 // Implementation Notes:
 //   - Acquires a write lock to prevent concurrent access during update
-//   - Updates the configuration atomically
-//   - Notifies all subscribers through the update channel
-func (w *MockConfigWatcher) UpdateConfig(cfg *config.Config) {
+//   - Has the applier take the configuration before storing it, as reloads do
+//   - Notifies subscribers through the update channel without waiting for them
+func (w *MockConfigWatcher) UpdateConfig(cfg *config.Config) error {
 	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.apply != nil {
+		if err := w.apply(cfg); err != nil {
+			return err
+		}
+	}
 	w.config = cfg
-	w.mu.Unlock()
-	w.ch <- cfg
+	select {
+	case w.ch <- cfg:
+	default:
+	}
+	return nil
 }
 
 // Close implements proper cleanup of the watcher resources.
@@ -114,6 +144,22 @@ func (w *MockConfigWatcher) Close() error {
 	return nil
 }
 
+// Reload implements config.Watcher. The mock has no file to reload, so
+// reloads always succeed without changing the configuration.
+func (w *MockConfigWatcher) Reload() error {
+	return nil
+}
+
+// Check implements config.Watcher, reporting the configuration as valid.
+func (w *MockConfigWatcher) Check() (string, error) {
+	return "mock", nil
+}
+
+// Status implements config.Watcher.
+func (w *MockConfigWatcher) Status() config.ReloadStatus {
+	return config.ReloadStatus{Version: "mock"}
+}
+
 // TestCompletionHandler tests the completion handler for various scenarios.
 // It includes tests for invalid methods, invalid JSON input, missing prompts, LLM errors, and successful completions.
 // Each test checks the response status and body to ensure the handler behaves as expected.
@@ -171,9 +217,11 @@ func TestCompletionHandler(t *testing.T) {
 			generateFunc: func(ctx context.Context, p *gollm.Prompt) (string, error) {
 				return "Hello, world!", nil
 			},
-			wantStatus:   http.StatusOK,
-			wantResponse: `{"content":"Hello, world!"}` + "\n",
-			expectJSON:   true,
+			wantStatus: http.StatusOK,
+			// Without a provider manager, no cost is estimated
+			wantResponse: fmt.Sprintf(`{"content":"Hello, world!","provider":"mock","usage":{"prompt_tokens":%d,"completion_tokens":%d,"estimated_cost":0}}`,
+				validation.CountTokens("Hello"), validation.CountTokens("Hello, world!")) + "\n",
+			expectJSON: true,
 		},
 	}
 
@@ -259,7 +307,8 @@ func TestRouter(t *testing.T) {
 	logger := zaptest.NewLogger(t)
 	mockLLM := mocks.NewMockLLM(nil)
 	cfg := config.DefaultConfig()
-	router := NewRouter(mockLLM, cfg, logger)
+	router, err := NewRouter(mockLLM, cfg, logger)
+	require.NoError(t, err)
 
 	tests := []struct {
 		name       string
@@ -305,7 +354,9 @@ func TestRouterWithMiddleware(t *testing.T) {
 		return "test response", nil
 	})
 	cfg := config.DefaultConfig()
-	router := NewRouter(mockLLM, cfg, logger)
+	cfg.Auth.Keys = []config.APIKeyConfig{{ID: "test", Hash: config.HashAPIKey("sk-test")}}
+	router, err := NewRouter(mockLLM, cfg, logger)
+	require.NoError(t, err)
 
 	tests := []struct {
 		name           string
@@ -349,6 +400,7 @@ func TestRouterWithMiddleware(t *testing.T) {
 			if tt.method == "POST" {
 				req.Header.Set("Content-Type", "application/json")
 			}
+			req.Header.Set("Authorization", "Bearer sk-test")
 			rec := httptest.NewRecorder()
 
 			router.ServeHTTP(rec, req)
@@ -365,6 +417,647 @@ func TestRouterWithMiddleware(t *testing.T) {
 	}
 }
 
+// TestRouterAuthentication verifies that enabling auth protects the
+// completion endpoints with the configured keys, but not the health check.
+func TestRouterAuthentication(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	mockLLM := mocks.NewMockLLM(func(ctx context.Context, prompt *gollm.Prompt) (string, error) {
+		return "test response", nil
+	})
+	cfg := config.DefaultConfig()
+	cfg.Auth = config.AuthConfig{
+		Enabled: true,
+		Keys:    []config.APIKeyConfig{{ID: "test", Hash: config.HashAPIKey("sk-test")}},
+	}
+	router, err := NewRouter(mockLLM, cfg, logger)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		apiKey     string
+		wantStatus int
+	}{
+		{"completion without key", http.MethodPost, "/v1/completions", "", http.StatusUnauthorized},
+		{"completion with wrong key", http.MethodPost, "/v1/completions", "sk-wrong", http.StatusUnauthorized},
+		{"completion with key", http.MethodPost, "/v1/completions", "sk-test", http.StatusOK},
+		{"chat completion without key", http.MethodPost, "/v1/chat/completions", "", http.StatusUnauthorized},
+		{"messages without key", http.MethodPost, "/v1/messages", "", http.StatusUnauthorized},
+		{"health check without key", http.MethodGet, "/health", "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{"input": "`+tt.name+`"}`))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.apiKey != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.apiKey)
+			}
+			rec := httptest.NewRecorder()
+
+			router.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+		})
+	}
+}
+
+// TestRouterAuthenticationDisabled verifies that routes listing the auth
+// middleware require a key even when auth is disabled, which only leaves
+// open the completion routes listing no middleware.
+func TestRouterAuthenticationDisabled(t *testing.T) {
+	mockLLM := mocks.NewMockLLM(func(ctx context.Context, prompt *gollm.Prompt) (string, error) {
+		return "test response", nil
+	})
+	cfg := config.DefaultConfig()
+	cfg.Auth.Keys = []config.APIKeyConfig{{ID: "test", Hash: config.HashAPIKey("sk-test")}}
+	cfg.Routes = append(cfg.Routes, config.RouteConfig{Path: "/open", Handler: "completion", Version: "v2", Methods: []string{"POST"}})
+	router, err := NewRouter(mockLLM, cfg, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	defer router.Close()
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		apiKey     string
+		wantStatus int
+	}{
+		{"completion without key", http.MethodPost, "/v1/completions", "", http.StatusUnauthorized},
+		{"completion with key", http.MethodPost, "/v1/completions", "sk-test", http.StatusOK},
+		{"metrics without key", http.MethodGet, "/metrics", "", http.StatusUnauthorized},
+		{"default middleware without key", http.MethodPost, "/v2/open", "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{"input": "`+tt.name+`"}`))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.apiKey != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.apiKey)
+			}
+			rec := httptest.NewRecorder()
+
+			router.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code, rec.Body.String())
+		})
+	}
+}
+
+// TestRouterRoutes verifies that the router serves the configured routes,
+// with their version prefix, methods, headers and middleware.
+func TestRouterRoutes(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	mockLLM := mocks.NewMockLLM(func(ctx context.Context, prompt *gollm.Prompt) (string, error) {
+		return "test response", nil
+	})
+	cfg := config.DefaultConfig()
+	cfg.Auth = config.AuthConfig{
+		Enabled: true,
+		Keys:    []config.APIKeyConfig{{ID: "test", Hash: config.HashAPIKey("sk-test")}},
+	}
+	cfg.Routes = []config.RouteConfig{
+		{Path: "/chat", Handler: "chat_completions", Version: "v2", Methods: []string{"POST"}},
+		{Path: "/open", Handler: "completion", Version: "v2", Methods: []string{"POST"}, Middleware: config.Middleware("logging")},
+		{Path: "/tagged", Handler: "completion", Version: "v2", Headers: map[string]string{"X-Tenant": "acme"}, Middleware: config.Middleware("logging")},
+		{Path: "/health", Handler: "health", Version: "v1", Methods: []string{"GET"}},
+	}
+	router, err := NewRouter(mockLLM, cfg, logger)
+	require.NoError(t, err)
+	defer router.Close()
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		header     http.Header
+		wantStatus int
+	}{
+		{"default middleware requires a key", http.MethodPost, "/v2/chat", nil, http.StatusUnauthorized},
+		{"default middleware accepts the key", http.MethodPost, "/v2/chat", http.Header{"Authorization": {"Bearer sk-test"}}, http.StatusOK},
+		{"route without auth", http.MethodPost, "/v2/open", nil, http.StatusOK},
+		{"method not allowed", http.MethodGet, "/v2/open", nil, http.StatusMethodNotAllowed},
+		{"missing required header", http.MethodPost, "/v2/tagged", nil, http.StatusBadRequest},
+		{"required header", http.MethodPost, "/v2/tagged", http.Header{"X-Tenant": {"acme"}}, http.StatusOK},
+		{"unconfigured route", http.MethodPost, "/v1/completions", nil, http.StatusNotFound},
+		{"health", http.MethodGet, "/health", nil, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"input": "` + tt.name + `"}`
+			if tt.path == "/v2/chat" {
+				body = `{"model": "test", "messages": [{"role": "user", "content": "` + tt.name + `"}]}`
+			}
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(body))
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+
+			router.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code, rec.Body.String())
+		})
+	}
+}
+
+// TestRouterUpdate verifies that a configuration update applies to new
+// requests while requests in flight finish on the previous configuration.
+func TestRouterUpdate(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	mockLLM := mocks.NewMockLLM(func(ctx context.Context, prompt *gollm.Prompt) (string, error) {
+		once.Do(func() {
+			close(started)
+			<-release
+		})
+		return "test response", nil
+	})
+	// The completion route lists no middleware, so that it requires a key
+	// only once authentication is enabled
+	cfg := config.DefaultConfig()
+	cfg.Routes[0].Middleware = nil
+	router, err := NewRouter(mockLLM, cfg, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	defer router.Close()
+
+	// A request is in flight when authentication gets enabled
+	inFlight := make(chan int)
+	go func() {
+		req := httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(`{"input": "in flight"}`))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		inFlight <- rec.Code
+	}()
+	<-started
+
+	updated := config.DefaultConfig()
+	updated.Routes[0].Middleware = nil
+	updated.Auth = config.AuthConfig{
+		Enabled: true,
+		Keys:    []config.APIKeyConfig{{ID: "test", Hash: config.HashAPIKey("sk-test")}},
+	}
+	require.NoError(t, router.Update(mockLLM, updated))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(`{"input": "after update"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// A configuration whose routes name unknown handlers is rejected, and
+	// the current one stays in place
+	invalid := config.DefaultConfig()
+	invalid.Routes = append(invalid.Routes, config.RouteConfig{Path: "/v1/other", Handler: "missing", Version: "v1"})
+	assert.ErrorContains(t, router.Update(mockLLM, invalid), "unknown handler: missing")
+
+	req = httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(`{"input": "after rejected update"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-inFlight)
+}
+
+// TestRouterUpdateRejected verifies that a configuration the router
+// fails to build leaves its keys, request queue, rate limiter, budgets and
+// providers as they were.
+func TestRouterUpdateRejected(t *testing.T) {
+	routing.RegisterMiddleware("test_failing", func(_ *struct{}, _ routing.MiddlewareEnv) (func(http.Handler) http.Handler, error) {
+		return nil, fmt.Errorf("cannot be built")
+	})
+	mockLLM := mocks.NewMockLLM(func(ctx context.Context, prompt *gollm.Prompt) (string, error) {
+		return "test response", nil
+	})
+	cfg := config.DefaultConfig()
+	cfg.Auth = config.AuthConfig{
+		Enabled: true,
+		Keys:    []config.APIKeyConfig{{ID: "old", Hash: config.HashAPIKey("sk-old")}},
+	}
+	cfg.Queue.Enabled = true
+	cfg.Queue.InitialSize = 10
+	cfg.RateLimit.Enabled = true
+	cfg.RateLimit.Policies = []config.RateLimitPolicy{{Scope: config.RateLimitScopeKey, Window: time.Minute, Requests: 100}}
+	cfg.Budgets = config.BudgetConfig{
+		Enabled: true,
+		Limits: []config.BudgetLimit{
+			{Name: "daily", Scope: config.RateLimitScopeKey, Period: config.BudgetPeriodDaily, Tokens: 1000000},
+		},
+	}
+	router, err := NewRouter(mockLLM, cfg, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	defer router.Close()
+	current := router.components
+	providers := func() []string {
+		var names []string
+		for _, state := range router.manager.Providers() {
+			names = append(names, state.Name)
+		}
+		return names
+	}
+	preference := providers()
+
+	updated := config.DefaultConfig()
+	updated.Auth = config.AuthConfig{
+		Enabled: true,
+		Keys:    []config.APIKeyConfig{{ID: "new", Hash: config.HashAPIKey("sk-new")}},
+	}
+	updated.LLM.Provider = "openai"
+	updated.Routes = append(updated.Routes, config.RouteConfig{
+		Path:       "/v1/other",
+		Handler:    "completion",
+		Version:    "v1",
+		Middleware: config.Middleware("test_failing"),
+	})
+	assert.ErrorContains(t, router.Update(mockLLM, updated), "cannot be built")
+
+	assert.Equal(t, current, router.components)
+	assert.Equal(t, int64(10), router.queue.GetMaxSize())
+	assert.Same(t, cfg, router.cfg)
+	assert.Equal(t, preference, providers())
+
+	send := func(apiKey string) int {
+		req := httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(`{"input": "hello"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusOK, send("sk-old"))
+	assert.Equal(t, http.StatusUnauthorized, send("sk-new"))
+}
+
+// TestRouterCORS verifies that responses follow the CORS policy of the
+// configuration, as overridden by the cors middleware of routes.
+func TestRouterCORS(t *testing.T) {
+	mockLLM := mocks.NewMockLLM(func(ctx context.Context, prompt *gollm.Prompt) (string, error) {
+		return "test response", nil
+	})
+	cfg := config.DefaultConfig()
+	cfg.Auth = config.AuthConfig{
+		Enabled: true,
+		Keys:    []config.APIKeyConfig{{ID: "test", Hash: config.HashAPIKey("sk-test")}},
+	}
+	cfg.CORS = config.CORSConfig{Origins: []string{"https://app.example.com"}}
+	credentials := true
+	cfg.Routes[1].Middleware = append(cfg.Routes[1].Middleware, config.MiddlewareConfig{
+		Name:   "cors",
+		Params: map[string]interface{}{"origins": []string{"https://*.partner.io"}, "allow_credentials": credentials},
+	})
+	require.NoError(t, cfg.Validate())
+	router, err := NewRouter(mockLLM, cfg, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	defer router.Close()
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		origin     string
+		wantStatus int
+		wantOrigin string
+	}{
+		{"allowed origin", http.MethodGet, "/health", "https://app.example.com", http.StatusOK, "https://app.example.com"},
+		{"other origin", http.MethodGet, "/health", "https://evil.com", http.StatusOK, ""},
+		{"admin endpoint", http.MethodGet, "/admin/providers", "https://app.example.com", http.StatusUnauthorized, "https://app.example.com"},
+		{"preflight before authentication", http.MethodOptions, "/v1/completions", "https://app.example.com", http.StatusNoContent, "https://app.example.com"},
+		{"route override", http.MethodOptions, "/v1/chat/completions", "https://api.partner.io", http.StatusNoContent, "https://api.partner.io"},
+		{"origin of the section on an overriding route", http.MethodOptions, "/v1/chat/completions", "https://app.example.com", http.StatusNoContent, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Origin", tt.origin)
+			if tt.method == http.MethodOptions {
+				req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			}
+			rec := httptest.NewRecorder()
+
+			router.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, tt.wantOrigin, rec.Header().Get("Access-Control-Allow-Origin"))
+			assert.Contains(t, rec.Header().Values("Vary"), "Origin")
+		})
+	}
+
+	// Only the overriding route allows credentials
+	req := httptest.NewRequest(http.MethodOptions, "/v1/chat/completions", nil)
+	req.Header.Set("Origin", "https://api.partner.io")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, "true", rec.Header().Get("Access-Control-Allow-Credentials"))
+}
+
+// TestRouterBudgets verifies that completions are charged against budgets
+// and that consumption is reported to admin keys only.
+func TestRouterBudgets(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	mockLLM := mocks.NewMockLLM(func(ctx context.Context, prompt *gollm.Prompt) (string, error) {
+		return "test response", nil
+	})
+	cfg := config.DefaultConfig()
+	cfg.Auth = config.AuthConfig{
+		Keys: []config.APIKeyConfig{
+			{ID: "app", Hash: config.HashAPIKey("sk-app")},
+			{ID: "ops", Hash: config.HashAPIKey("sk-ops"), Admin: true},
+		},
+	}
+	cfg.Budgets = config.BudgetConfig{
+		Enabled: true,
+		Limits: []config.BudgetLimit{
+			{Name: "daily", Scope: config.RateLimitScopeKey, Period: config.BudgetPeriodDaily, Tokens: 1000000},
+		},
+	}
+	router, err := NewRouter(mockLLM, cfg, logger)
+	require.NoError(t, err)
+	defer router.Close()
+
+	send := func(method, path, apiKey, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = "192.0.2.1:1234"
+		if apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	require.Equal(t, http.StatusOK, send(http.MethodPost, "/v1/completions", "sk-app", `{"input": "hello"}`).Code)
+
+	// The admin endpoints require an admin key
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodGet, "/admin/usage", "", "").Code)
+	assert.Equal(t, http.StatusForbidden, send(http.MethodGet, "/admin/usage", "sk-app", "").Code)
+
+	rec := send(http.MethodGet, "/admin/usage", "sk-ops", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp handlers.UsageResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	require.Len(t, resp.Usage, 1)
+	assert.Equal(t, "daily", resp.Usage[0].Budget)
+	assert.Equal(t, "app", resp.Usage[0].Subject)
+	assert.Positive(t, resp.Usage[0].TokensUsed)
+	assert.Equal(t, int64(1000000), resp.Usage[0].TokensLimit)
+}
+
+// TestRouterConfig verifies that administrators can inspect and trigger
+// configuration reloads, which are also reported by the metrics.
+func TestRouterConfig(t *testing.T) {
+	mockLLM := mocks.NewMockLLM(func(ctx context.Context, prompt *gollm.Prompt) (string, error) {
+		return "test response", nil
+	})
+	configFile := filepath.Join(t.TempDir(), "hapax.yaml")
+	valid := `
+auth:
+  keys:
+    - id: ops
+      hash: ` + config.HashAPIKey("sk-ops") + `
+      admin: true
+`
+	require.NoError(t, os.WriteFile(configFile, []byte(valid), 0600))
+	watcher, err := config.NewConfigWatcher(configFile, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	defer watcher.Close()
+
+	router, err := newRouter(mockLLM, watcher.GetCurrentConfig(), zaptest.NewLogger(t), watcher)
+	require.NoError(t, err)
+	defer router.Close()
+
+	send := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer sk-ops")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	status := func(rec *httptest.ResponseRecorder) config.ReloadStatus {
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var resp config.ReloadStatus
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		return resp
+	}
+
+	initial := status(send(http.MethodGet, "/admin/config"))
+	assert.Equal(t, watcher.Status().Version, initial.Version)
+
+	// An invalid configuration fails the dry run and the reload, and the
+	// current one stays in place
+	require.NoError(t, os.WriteFile(configFile, []byte("server:\n  port: 70000\n"), 0600))
+	assert.Equal(t, http.StatusUnprocessableEntity, send(http.MethodPost, "/admin/config/reload?dry_run=true").Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, send(http.MethodPost, "/admin/config/reload").Code)
+	failed := status(send(http.MethodGet, "/admin/config"))
+	assert.Equal(t, initial.Version, failed.Version)
+	assert.NotEmpty(t, failed.LastError)
+
+	metrics := send(http.MethodGet, "/metrics").Body.String()
+	assert.Contains(t, metrics, `hapax_config_info{version="`+initial.Version+`"} 1`)
+	assert.Contains(t, metrics, "hapax_config_last_reload_successful 0")
+
+	// A valid one is reported with its new version
+	require.NoError(t, os.WriteFile(configFile, []byte(valid+"\nserver:\n  port: 8081\n"), 0600))
+	rec := send(http.MethodPost, "/admin/config/reload?dry_run=true")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var check handlers.CheckResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&check))
+	assert.True(t, check.DryRun)
+	assert.NotEqual(t, initial.Version, check.Version)
+
+	reloaded := status(send(http.MethodPost, "/admin/config/reload"))
+	assert.Equal(t, check.Version, reloaded.Version)
+	assert.Empty(t, reloaded.LastError)
+	assert.Equal(t, 8081, watcher.GetCurrentConfig().Server.Port)
+}
+
+// TestServerReloadRejected verifies that a reload the server fails to
+// apply is answered and reported as failed, and that the server keeps
+// the current configuration.
+func TestServerReloadRejected(t *testing.T) {
+	mockLLM := mocks.NewMockLLM(func(ctx context.Context, prompt *gollm.Prompt) (string, error) {
+		return "test response", nil
+	})
+	configFile := filepath.Join(t.TempDir(), "hapax.yaml")
+	valid := `
+auth:
+  keys:
+    - id: ops
+      hash: ` + config.HashAPIKey("sk-ops") + `
+      admin: true
+`
+	require.NoError(t, os.WriteFile(configFile, []byte(valid), 0600))
+	watcher, err := config.NewConfigWatcher(configFile, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	defer watcher.Close()
+
+	server, err := NewServerWithConfig(watcher, mockLLM, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	defer server.router.Close()
+
+	send := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer sk-ops")
+		rec := httptest.NewRecorder()
+		server.router.ServeHTTP(rec, req)
+		return rec
+	}
+	initial := watcher.Status()
+
+	// The configuration loads, but the router rejects its unknown handler
+	require.NoError(t, os.WriteFile(configFile, []byte(valid+`
+server:
+  port: 8081
+routes:
+  - path: /v1/completions
+    handler: missing
+    version: v1
+`), 0600))
+	rec := send(http.MethodPost, "/admin/config/reload")
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Contains(t, rec.Body.String(), "unknown handler")
+
+	status := watcher.Status()
+	assert.Equal(t, initial.Version, status.Version)
+	assert.Contains(t, status.LastError, "unknown handler")
+	assert.Zero(t, status.Reloads)
+	assert.NotEqual(t, 8081, watcher.GetCurrentConfig().Server.Port)
+
+	metrics := send(http.MethodGet, "/metrics").Body.String()
+	assert.Contains(t, metrics, `hapax_config_info{version="`+initial.Version+`"} 1`)
+	assert.Contains(t, metrics, "hapax_config_last_reload_successful 0")
+
+	server.mu.RLock()
+	assert.NotEqual(t, 8081, server.applied.Server.Port)
+	server.mu.RUnlock()
+}
+
+// TestRouterProviders verifies that admin keys can inspect and control
+// providers, and that every change is audited.
+func TestRouterProviders(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	mockLLM := mocks.NewMockLLM(func(ctx context.Context, prompt *gollm.Prompt) (string, error) {
+		return "test response", nil
+	})
+	cfg := config.DefaultConfig()
+	cfg.Auth = config.AuthConfig{
+		Keys: []config.APIKeyConfig{
+			{ID: "app", Hash: config.HashAPIKey("sk-app")},
+			{ID: "ops", Hash: config.HashAPIKey("sk-ops"), Admin: true},
+		},
+	}
+	router, err := NewRouter(mockLLM, cfg, zap.New(core))
+	require.NoError(t, err)
+	defer router.Close()
+
+	send := func(method, path, apiKey, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	providers := func(rec *httptest.ResponseRecorder) map[string]provider.ProviderState {
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var resp handlers.ProvidersResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		states := make(map[string]provider.ProviderState)
+		for _, p := range resp.Providers {
+			states[p.Name] = p
+		}
+		return states
+	}
+	name := cfg.LLM.Provider
+
+	assert.Equal(t, http.StatusForbidden, send(http.MethodGet, "/admin/providers", "sk-app", "").Code)
+	state := providers(send(http.MethodGet, "/admin/providers", "sk-ops", ""))[name]
+	assert.Equal(t, provider.ModeActive, state.Mode)
+	assert.Equal(t, "closed", state.Breaker.State)
+	assert.True(t, state.Health.Healthy)
+
+	// A breaker forced open rejects completions until it is released
+	state = providers(send(http.MethodPost, "/admin/providers/"+name+"/breaker", "sk-ops", `{"state": "open"}`))[name]
+	assert.Equal(t, "open", state.Breaker.State)
+	assert.True(t, state.Breaker.Forced)
+	assert.NotEqual(t, http.StatusOK, send(http.MethodPost, "/v1/completions", "sk-app", `{"input": "hello"}`).Code)
+
+	state = providers(send(http.MethodPost, "/admin/providers/"+name+"/breaker", "sk-ops", `{"state": "auto"}`))[name]
+	assert.False(t, state.Breaker.Forced)
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "/v1/completions", "sk-app", `{"input": "hello again"}`).Code)
+
+	state = providers(send(http.MethodPost, "/admin/providers/"+name+"/mode", "sk-ops", `{"mode": "draining"}`))[name]
+	assert.Equal(t, provider.ModeDraining, state.Mode)
+
+	// Invalid changes are rejected, and audited as well
+	assert.Equal(t, http.StatusNotFound, send(http.MethodPost, "/admin/providers/unknown/mode", "sk-ops", `{"mode": "disabled"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, send(http.MethodPost, "/admin/providers/"+name+"/breaker", "sk-ops", `{"state": "half-open"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, send(http.MethodPut, "/admin/preference", "sk-ops", `{"preference": []}`).Code)
+
+	audit := logs.Filter(func(e observer.LoggedEntry) bool { return e.LoggerName == "audit" })
+	assert.Equal(t, 3, audit.FilterMessage("Admin action").FilterField(zap.String("key_id", "ops")).Len())
+	assert.Equal(t, 3, audit.FilterMessage("Admin action rejected").Len())
+	assert.Equal(t, 1, audit.FilterField(zap.String("action", "set_mode")).FilterField(zap.String("mode", "draining")).Len())
+}
+
+func TestRouterModels(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	mockLLM := mocks.NewMockLLM(func(ctx context.Context, prompt *gollm.Prompt) (string, error) {
+		return "test response", nil
+	})
+	cfg := config.DefaultConfig()
+	cfg.Models = config.ModelRegistry{
+		"fast": {{Provider: "mock"}},
+	}
+	cfg.Auth.Keys = []config.APIKeyConfig{{ID: "test", Hash: config.HashAPIKey("sk-test")}}
+	router, err := NewRouter(mockLLM, cfg, logger)
+	require.NoError(t, err)
+	defer router.Close()
+
+	send := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer sk-test")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Aliases and the models of the providers themselves can be requested
+	assert.Equal(t, http.StatusOK, send("/v1/completions", `{"input": "hello", "model": "fast"}`).Code)
+	assert.Equal(t, http.StatusOK, send("/v1/completions", `{"input": "hello", "model": "mock-model"}`).Code)
+
+	rec := send("/v1/completions", `{"input": "hello", "model": "gpt-5"}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	var hapaxErr errors.ErrorResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&hapaxErr))
+	assert.Equal(t, errors.ValidationError, hapaxErr.Type)
+	assert.Equal(t, "Unknown model: gpt-5", hapaxErr.Message)
+
+	rec = send("/v1/chat/completions", `{"model": "gpt-5", "messages": [{"role": "user", "content": "hello"}]}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	var openAIErr handlers.OpenAIErrorResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&openAIErr))
+	require.NotNil(t, openAIErr.Error.Code)
+	assert.Equal(t, "model_not_found", *openAIErr.Error.Code)
+
+	rec = send("/v1/messages", `{"model": "gpt-5", "max_tokens": 10, "messages": [{"role": "user", "content": "hello"}]}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "invalid_request_error")
+}
+
 // TestServer tests the server lifecycle, including starting and stopping the server.
 // It ensures that the server can handle configuration updates without service interruption.
 // This includes verifying that the server shuts down gracefully and starts correctly with new settings.
@@ -501,7 +1194,7 @@ func TestServer(t *testing.T) {
 		}
 
 		// Update configuration
-		watcher.UpdateConfig(newConfig)
+		require.NoError(t, watcher.UpdateConfig(newConfig))
 
 		// Wait for server to be ready on new port
 		require.Eventually(t, func() bool {
@@ -537,6 +1230,56 @@ func TestServer(t *testing.T) {
 	}
 }
 
+// TestServerReload tests that configuration updates apply to the running
+// router, and that the listener only changes with its port.
+func TestServerReload(t *testing.T) {
+	mockLLM := mocks.NewMockLLM(func(ctx context.Context, prompt *gollm.Prompt) (string, error) {
+		return "test response", nil
+	})
+	newConfig := func(threshold uint32) *config.Config {
+		cfg := config.DefaultConfig()
+		cfg.LLM.Provider = "mock"
+		cfg.CircuitBreaker.FailureThreshold = threshold
+		cfg.CircuitBreaker.TestMode = true
+		return cfg
+	}
+
+	watcher := NewMockConfigWatcher(newConfig(5))
+	server, err := NewServerWithConfig(watcher, mockLLM, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	server.mu.RLock()
+	router, httpServer := server.router, server.httpServer
+	server.mu.RUnlock()
+
+	require.NoError(t, watcher.UpdateConfig(newConfig(2)))
+	require.Eventually(t, func() bool {
+		server.mu.RLock()
+		defer server.mu.RUnlock()
+		return server.applied.CircuitBreaker.FailureThreshold == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	server.mu.RLock()
+	assert.Same(t, router, server.router, "the router is kept")
+	assert.Same(t, httpServer, server.httpServer, "the listener is kept")
+	server.mu.RUnlock()
+
+	// A new port gets a new listener, served by the same router
+	moved := newConfig(2)
+	moved.Server.Port++
+	require.NoError(t, watcher.UpdateConfig(moved))
+	require.Eventually(t, func() bool {
+		server.mu.RLock()
+		defer server.mu.RUnlock()
+		return server.applied.Server.Port == moved.Server.Port
+	}, 5*time.Second, 10*time.Millisecond)
+
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+	assert.Same(t, router, server.router)
+	assert.NotSame(t, httpServer, server.httpServer)
+	assert.Equal(t, fmt.Sprintf(":%d", moved.Server.Port), server.httpServer.Addr)
+}
+
 // DefaultConfig returns the default server configuration
 func DefaultConfig() config.ServerConfig {
 	return config.ServerConfig{
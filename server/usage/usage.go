@@ -0,0 +1,88 @@
+// Package usage accounts for the tokens consumed while serving a request,
+// and for their estimated cost. Middleware attaches a Tracker to the
+// request context, the processing layer records generated tokens into it,
+// and the middleware reads the totals once the request has been served.
+package usage
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+)
+
+type contextKey struct{}
+
+// Tracker accumulates the token usage of one request.
+// It is safe for concurrent use.
+type Tracker struct {
+	generations      atomic.Int64
+	promptTokens     atomic.Int64
+	completionTokens atomic.Int64
+	cost             atomic.Uint64 // float64 bits, in USD
+}
+
+// NewContext returns a context carrying a Tracker. If ctx already carries
+// one, it is reused so that every middleware observes the same totals.
+func NewContext(ctx context.Context) (context.Context, *Tracker) {
+	if t := FromContext(ctx); t != nil {
+		return ctx, t
+	}
+	t := &Tracker{}
+	return context.WithValue(ctx, contextKey{}, t), t
+}
+
+// FromContext returns the Tracker carried by ctx, or nil.
+func FromContext(ctx context.Context) *Tracker {
+	t, _ := ctx.Value(contextKey{}).(*Tracker)
+	return t
+}
+
+// Record adds the tokens of one generation to the Tracker carried by ctx.
+// It does nothing when ctx carries no Tracker.
+func Record(ctx context.Context, promptTokens, completionTokens int) {
+	if t := FromContext(ctx); t != nil {
+		t.generations.Add(1)
+		t.promptTokens.Add(int64(promptTokens))
+		t.completionTokens.Add(int64(completionTokens))
+	}
+}
+
+// RecordCost adds the estimated cost in USD of one generation to the
+// Tracker carried by ctx. It does nothing when ctx carries no Tracker.
+func RecordCost(ctx context.Context, cost float64) {
+	t := FromContext(ctx)
+	if t == nil || cost == 0 {
+		return
+	}
+	for {
+		old := t.cost.Load()
+		if t.cost.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+cost)) {
+			return
+		}
+	}
+}
+
+// Generations returns the number of generations recorded so far.
+func (t *Tracker) Generations() int64 {
+	return t.generations.Load()
+}
+
+// PromptTokens returns the number of prompt tokens recorded so far.
+func (t *Tracker) PromptTokens() int64 {
+	return t.promptTokens.Load()
+}
+
+// CompletionTokens returns the number of completion tokens recorded so far.
+func (t *Tracker) CompletionTokens() int64 {
+	return t.completionTokens.Load()
+}
+
+// TotalTokens returns the sum of prompt and completion tokens.
+func (t *Tracker) TotalTokens() int64 {
+	return t.PromptTokens() + t.CompletionTokens()
+}
+
+// Cost returns the estimated cost in USD recorded so far.
+func (t *Tracker) Cost() float64 {
+	return math.Float64frombits(t.cost.Load())
+}
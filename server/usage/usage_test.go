@@ -0,0 +1,32 @@
+package usage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTracker(t *testing.T) {
+	// Recording without a tracker is a no-op
+	Record(context.Background(), 10, 20)
+	RecordCost(context.Background(), 0.5)
+	assert.Nil(t, FromContext(context.Background()))
+
+	ctx, tracker := NewContext(context.Background())
+	Record(ctx, 10, 20)
+	Record(ctx, 5, 0)
+
+	// Nested middleware shares the tracker
+	nested, again := NewContext(ctx)
+	assert.Same(t, tracker, again)
+	Record(nested, 0, 1)
+
+	assert.Equal(t, int64(15), tracker.PromptTokens())
+	assert.Equal(t, int64(21), tracker.CompletionTokens())
+	assert.Equal(t, int64(36), tracker.TotalTokens())
+
+	RecordCost(ctx, 0.25)
+	RecordCost(nested, 0.5)
+	assert.InDelta(t, 0.75, tracker.Cost(), 1e-9)
+}
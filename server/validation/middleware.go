@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"reflect"
+	"sync"
 	"time"
 
 	"github.com/go-playground/validator/v10"
@@ -13,11 +14,22 @@ import (
 )
 
 var (
-	validate = validator.New()
-	counter  *TokenCounter
-	cfg      *config.Config
+	validate     = validator.New()
+	counter      *TokenCounter
+	counterErr   error     // Last failure to load the default encoding
+	counterRetry time.Time // When loading it may be tried again
+	counterMu    sync.Mutex
+	cfg          *config.Config
+
+	// newDefaultCounter loads the default encoding, replaced by tests
+	newDefaultCounter = func() (*TokenCounter, error) { return NewTokenCounter("gpt-4") }
 )
 
+// counterRetryInterval is how long a failure to load the default encoding
+// is reported before loading it is tried again, so that a transient
+// failure does not last until a restart without every request retrying.
+const counterRetryInterval = 30 * time.Second
+
 // CompletionRequest represents the expected schema for completion requests
 type CompletionRequest struct {
 	Messages []Message `json:"messages,omitempty" validate:"omitempty,dive"`
@@ -68,6 +80,22 @@ type RetryOptions struct {
 	RetryableErrors []string      `json:"retryable_errors" validate:"required,min=1,dive,oneof=rate_limit timeout server_error"`
 }
 
+// Validate checks that the retry options form a usable policy
+func (r *RetryOptions) Validate() error {
+	return validateRetryOptions(r)
+}
+
+// Config converts the options into the retry configuration used by the provider manager
+func (r *RetryOptions) Config() *config.RetryConfig {
+	return &config.RetryConfig{
+		MaxRetries:      r.MaxRetries,
+		InitialDelay:    r.InitialDelay,
+		MaxDelay:        r.MaxDelay,
+		Multiplier:      r.Multiplier,
+		RetryableErrors: r.RetryableErrors,
+	}
+}
+
 type ValidationErrorDetail struct {
 	Field   string `json:"field"`           // The field that failed validation
 	Message string `json:"message"`         // Human-readable error message
@@ -84,13 +112,39 @@ type APIError struct {
 	Suggestion string                  `json:"suggestion,omitempty"` // Helpful suggestion for fixing the error
 }
 
-func init() {
-	// Initialize with a default model, can be overridden
-	var err error
-	counter, err = NewTokenCounter("gpt-4")
+// tokenCounter returns the configured token counter, creating a default
+// one on first use. Loading an encoding may require a download, so it is
+// not done at import time, and a failure is retried after
+// counterRetryInterval.
+func tokenCounter() (*TokenCounter, error) {
+	counterMu.Lock()
+	defer counterMu.Unlock()
+
+	if counter == nil && !time.Now().Before(counterRetry) {
+		// Initialize with a default model, can be overridden
+		c, err := newDefaultCounter()
+		if err != nil {
+			counterErr = fmt.Errorf("failed to initialize token counter: %v", err)
+			counterRetry = time.Now().Add(counterRetryInterval)
+		} else {
+			counter, counterErr = c, nil
+		}
+	}
+	if counter == nil {
+		return nil, counterErr
+	}
+	return counter, nil
+}
+
+// CountTokens counts the tokens of text with the shared token counter.
+// When no encoding can be loaded it falls back to an estimate of one
+// token per four bytes, so that usage reporting keeps working offline.
+func CountTokens(text string) int {
+	tc, err := tokenCounter()
 	if err != nil {
-		panic(fmt.Sprintf("failed to initialize token counter: %v", err))
+		return (len(text) + 3) / 4
 	}
+	return tc.CountTokens(Message{Content: text})
 }
 
 // Initialize initializes the validation middleware with configuration
@@ -100,11 +154,14 @@ func Initialize(c *config.Config) error {
 		return fld.Tag.Get("json")
 	})
 
-	var err error
-	counter, err = NewTokenCounter(cfg.LLM.Model)
+	tc, err := NewTokenCounter(cfg.LLM.Model)
 	if err != nil {
 		return fmt.Errorf("failed to initialize token counter: %v", err)
 	}
+
+	counterMu.Lock()
+	counter, counterErr = tc, nil
+	counterMu.Unlock()
 	return nil
 }
 
@@ -232,7 +289,20 @@ func ValidateCompletion(next http.Handler) http.Handler {
 		}
 
 		// Token validation with clear error messaging
-		if err := counter.ValidateTokens(req, cfg.LLM.MaxContextTokens); err != nil {
+		tc, err := tokenCounter()
+		if err != nil {
+			sendError(
+				"Token counting unavailable",
+				[]ValidationErrorDetail{{
+					Field:   "messages",
+					Message: err.Error(),
+					Code:    "token_counter_unavailable",
+				}},
+				http.StatusInternalServerError,
+			)
+			return
+		}
+		if err := tc.ValidateTokens(req, cfg.LLM.MaxContextTokens); err != nil {
 			sendError(
 				"Token limit exceeded",
 				[]ValidationErrorDetail{{
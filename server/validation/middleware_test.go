@@ -3,9 +3,11 @@ package validation
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/teilomillet/hapax/config"
@@ -193,3 +195,39 @@ func TestValidateCompletion(t *testing.T) {
 		})
 	}
 }
+
+func TestTokenCounterRetry(t *testing.T) {
+	counterMu.Lock()
+	saved, savedNew := counter, newDefaultCounter
+	counter, counterErr, counterRetry = nil, nil, time.Time{}
+	counterMu.Unlock()
+	t.Cleanup(func() {
+		counterMu.Lock()
+		counter, counterErr, counterRetry, newDefaultCounter = saved, nil, time.Time{}, savedNew
+		counterMu.Unlock()
+	})
+
+	loads := 0
+	newDefaultCounter = func() (*TokenCounter, error) {
+		loads++
+		if loads == 1 {
+			return nil, errors.New("download failed")
+		}
+		return &TokenCounter{encoding: &mockTiktoken{countTokens: func(string) int { return 1 }}}, nil
+	}
+
+	// A failure is reported until the retry interval has passed
+	_, err := tokenCounter()
+	assert.ErrorContains(t, err, "download failed")
+	_, err = tokenCounter()
+	assert.ErrorContains(t, err, "download failed")
+	assert.Equal(t, 1, loads)
+
+	counterMu.Lock()
+	counterRetry = time.Now()
+	counterMu.Unlock()
+	tc, err := tokenCounter()
+	assert.NoError(t, err)
+	assert.NotNil(t, tc)
+	assert.Equal(t, 2, loads)
+}
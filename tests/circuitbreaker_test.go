@@ -153,6 +153,121 @@ func TestCircuitBreaker(t *testing.T) {
 		assert.True(t, counts.TotalFailures > 0)
 		assert.True(t, counts.Requests > counts.TotalFailures)
 	})
+
+	t.Run("Opens On Error Rate", func(t *testing.T) {
+		cb, err := circuitbreaker.NewCircuitBreaker(circuitbreaker.Config{
+			Name:             "error-rate",
+			MaxRequests:      1,
+			Interval:         time.Minute,
+			Timeout:          time.Minute,
+			FailureThreshold: 5,
+			ErrorRate:        0.5,
+			MinRequests:      4,
+			TestMode:         true,
+		}, logger, registry)
+		require.NoError(t, err)
+
+		// Alternating failures never reach the consecutive threshold, but
+		// trip the circuit once there are enough requests
+		for i := 0; i < 3; i++ {
+			_ = cb.Execute(func() error {
+				if i%2 == 0 {
+					return errors.New("failure")
+				}
+				return nil
+			})
+		}
+		assert.Equal(t, gobreaker.StateClosed, cb.State())
+
+		_ = cb.Execute(func() error { return errors.New("failure") })
+		assert.Equal(t, gobreaker.StateOpen, cb.State())
+	})
+
+	t.Run("Ignores Excluded Errors", func(t *testing.T) {
+		invalid := errors.New("invalid request")
+		cb, err := circuitbreaker.NewCircuitBreaker(circuitbreaker.Config{
+			Name:             "excluded",
+			MaxRequests:      1,
+			Interval:         time.Minute,
+			Timeout:          time.Minute,
+			FailureThreshold: 2,
+			IsExcluded:       func(err error) bool { return errors.Is(err, invalid) },
+			TestMode:         true,
+		}, logger, registry)
+		require.NoError(t, err)
+
+		// Excluded errors reach the caller without counting as failures
+		for i := 0; i < 3; i++ {
+			err := cb.Execute(func() error { return invalid })
+			assert.ErrorIs(t, err, invalid)
+		}
+		assert.Equal(t, gobreaker.StateClosed, cb.State())
+		assert.Zero(t, cb.Counts().TotalFailures)
+	})
+
+	t.Run("Reconfigures", func(t *testing.T) {
+		cb, err := newCB()
+		require.NoError(t, err)
+
+		// A new threshold applies in place, keeping the counts
+		_ = cb.Execute(func() error { return errors.New("failure") })
+		cb.Reconfigure(circuitbreaker.Config{
+			MaxRequests:      1,
+			Interval:         time.Second,
+			Timeout:          100 * time.Millisecond,
+			FailureThreshold: 3,
+			TestMode:         true,
+		})
+		_ = cb.Execute(func() error { return errors.New("failure") })
+		assert.Equal(t, gobreaker.StateClosed, cb.State())
+		_ = cb.Execute(func() error { return errors.New("failure") })
+		assert.Equal(t, gobreaker.StateOpen, cb.State())
+
+		// A new timeout resets the circuit
+		cb.Reconfigure(circuitbreaker.Config{
+			MaxRequests:      1,
+			Interval:         time.Second,
+			Timeout:          time.Minute,
+			FailureThreshold: 3,
+			TestMode:         true,
+		})
+		assert.Equal(t, gobreaker.StateClosed, cb.State())
+		assert.Zero(t, cb.Counts().Requests)
+	})
+
+	t.Run("Forced State", func(t *testing.T) {
+		cb, err := newCB()
+		require.NoError(t, err)
+
+		// Forced open, no request gets through
+		require.NoError(t, cb.Force(gobreaker.StateOpen))
+		called := false
+		err = cb.Execute(func() error {
+			called = true
+			return nil
+		})
+		assert.ErrorIs(t, err, gobreaker.ErrOpenState)
+		assert.False(t, called)
+		assert.Equal(t, gobreaker.StateOpen, cb.State())
+		assert.True(t, cb.Forced())
+
+		// Forced closed, failures do not trip the circuit
+		require.NoError(t, cb.Force(gobreaker.StateClosed))
+		for i := 0; i < 3; i++ {
+			assert.Error(t, cb.Execute(func() error { return errors.New("failure") }))
+		}
+		assert.Equal(t, gobreaker.StateClosed, cb.State())
+
+		// Released, the circuit trips on its own again
+		cb.Release()
+		assert.False(t, cb.Forced())
+		for i := 0; i < 2; i++ {
+			_ = cb.Execute(func() error { return errors.New("failure") })
+		}
+		assert.Equal(t, gobreaker.StateOpen, cb.State())
+
+		assert.Error(t, cb.Force(gobreaker.StateHalfOpen))
+	})
 }
 
 func TestProviderManagerWithCircuitBreaker(t *testing.T) {
@@ -173,7 +288,7 @@ func TestProviderManagerWithCircuitBreaker(t *testing.T) {
 			MaxRequests:      1,
 			Interval:         10 * time.Millisecond,
 			Timeout:          100 * time.Millisecond,
-			FailureThreshold: 1, // Change to 1 to make it trip after first failure
+			FailureThreshold: 2, // The first failure reaches the caller before the circuit trips
 			TestMode:         true,
 		},
 	}